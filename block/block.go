@@ -2,13 +2,11 @@ package block
 
 import (
 	"bytes"
-	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"math/big"
-	"time"
 
-	"github.com/GGP1/btcs/encoding/gob"
+	"github.com/GGP1/btcs/chaincfg"
 	"github.com/GGP1/btcs/tx"
 	"github.com/GGP1/btcs/tx/merkle"
 )
@@ -17,6 +15,9 @@ const (
 	// genesisCoinbaseData is the data the first Bitcoin block contains.
 	genesisCoinbaseData = "The Times 03/Jan/2009 Chancellor on brink of second bailout for banks"
 	genesisAddr         = "1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa"
+
+	// MaxBlockSize is the maximum size in bytes of the transactions in a block.
+	MaxBlockSize = 1_000_000
 )
 
 // Header represents a block header.
@@ -39,25 +40,24 @@ type Block struct {
 
 // NewBlock creates and returns a block without a header hash and nonce.
 // It should be mined before being saved in the databse.
+//
+// The block is not added to the index until it's added to the chain.
 func NewBlock(prevBlock *Block, txs []tx.Tx) (*Block, error) {
 	merkleRootHash, err := merkleRootHash(txs)
 	if err != nil {
 		return nil, err
 	}
 
-	now := time.Now().Unix()
-	newHeight := prevBlock.Height + 1
-	blockIndex.addNode(newHeight, now)
-
+	header := &Header{
+		PrevBlockHash:  prevBlock.Hash,
+		MerkleRootHash: merkleRootHash,
+		Version:        ComputeBlockVersion(prevBlock.Height),
+		Timestamp:      NextTimestamp(*prevBlock),
+		Bits:           CalculateNextDifficulty(*prevBlock),
+	}
 	return &Block{
-		Header: &Header{
-			PrevBlockHash:  prevBlock.Hash,
-			MerkleRootHash: merkleRootHash,
-			Version:        1,
-			Timestamp:      now,
-			Bits:           CalculateNextDifficulty(*prevBlock),
-		},
-		Height:       newHeight,
+		Header:       header,
+		Height:       prevBlock.Height + 1,
 		Transactions: txs,
 	}, nil
 }
@@ -65,27 +65,32 @@ func NewBlock(prevBlock *Block, txs []tx.Tx) (*Block, error) {
 // NewGenesis creates and returns the first block of the chain.
 //
 // It's called the "genesis", it's pre-mined and statically embedded in the client so
-// every node starts with one known block.
+// every node starts with one known block. Its coinbase has a fixed ID instead of a random
+// one so the merkle root matches it, the hash was mined with SHA-256.
 func NewGenesis() (*Block, error) {
-	coinbaseTx, err := tx.NewCoinbase(genesisAddr, genesisCoinbaseData, 0, 0)
-	if err != nil {
-		return nil, err
+	coinbaseID, _ := hex.DecodeString("11ff23506755fca9806417a25ac021d007275ffb2abd576995bb2e93ba213335")
+	coinbaseTx := tx.Tx{
+		ID: coinbaseID,
+		Inputs: []tx.Input{
+			{PubKey: []byte(genesisCoinbaseData), PrevOutput: tx.OutPoint{Index: -1}},
+		},
+		Outputs: []tx.Output{tx.NewOutput(tx.CalculateBlockSubsidy(0), genesisAddr)},
 	}
 
-	merkleRootHash, _ := hex.DecodeString("898325b2e3f11b70cc81b6f0fc97381e82294cecefc1e483e7826c09a1557714")
-	hash, _ := hex.DecodeString("000000f72eda1d4d8a8418c992ef803f7e060290c1208abac7c7b1a77d27b3fc")
+	merkleRootHash, _ := hex.DecodeString("bfd3af5312435120def310626643c1d1d1bfcb39a7099530dc56a590ddf2ccb8")
+	hash, _ := hex.DecodeString("000002c63d7f6337959d4713143c400cc798114bbb68718278a6ef42f196185d")
 	return &Block{
 		Header: &Header{
 			Version:        1,
 			PrevBlockHash:  []byte{},
 			MerkleRootHash: merkleRootHash,
 			Timestamp:      1670513773,
-			Nonce:          374174,
+			Nonce:          389488,
 			Bits:           baseDifficulty,
 		},
 		Hash:         hash,
 		Height:       0,
-		Transactions: []tx.Tx{*coinbaseTx},
+		Transactions: []tx.Tx{coinbaseTx},
 	}, nil
 }
 
@@ -101,21 +106,53 @@ func (b Block) IsValid() bool {
 		return false
 	}
 
-	data, err := b.PowData()
+	hash, err := b.PowHash()
 	if err != nil {
 		return false
 	}
+	hashInt := new(big.Int).SetBytes(hash)
+
+	return hashInt.Cmp(target) <= 0
+}
+
+// PowHash returns the hash of the block data and its nonce, the one that must be lower
+// than the target for the block to be valid. It's calculated with the active network's
+// proof-of-work function.
+func (b Block) PowHash() ([]byte, error) {
+	data, err := b.PowData()
+	if err != nil {
+		return nil, err
+	}
 
 	n, err := IntToBytes(int64(b.Nonce))
 	if err != nil {
-		return false
+		return nil, err
 	}
 
 	data = append(data, n...)
-	hash := sha256.Sum256(data)
-	hashInt := new(big.Int).SetBytes(hash[:])
+	return chaincfg.ActiveParams.PowHasher.Hash(data), nil
+}
 
-	return hashInt.Cmp(target) <= 0
+// HasValidMerkleRoot returns whether the block's merkle root hash matches its transactions.
+func (b Block) HasValidMerkleRoot() (bool, error) {
+	merkleRootHash, err := merkleRootHash(b.Transactions)
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(merkleRootHash, b.MerkleRootHash), nil
+}
+
+// UpdateMerkleRoot recalculates the block's merkle root hash, it must be called
+// after modifying its transactions.
+func (b *Block) UpdateMerkleRoot() error {
+	merkleRootHash, err := merkleRootHash(b.Transactions)
+	if err != nil {
+		return err
+	}
+
+	b.MerkleRootHash = merkleRootHash
+	return nil
 }
 
 // PowData joins a block's fields so we can generate its hash.
@@ -152,11 +189,7 @@ func merkleRootHash(txs []tx.Tx) ([]byte, error) {
 	encodedTxs := make([][]byte, 0, len(txs))
 
 	for _, tx := range txs {
-		encodedTx, err := gob.Encode(tx)
-		if err != nil {
-			return nil, err
-		}
-		encodedTxs = append(encodedTxs, encodedTx)
+		encodedTxs = append(encodedTxs, tx.Serialize())
 	}
 
 	// Transactions in a block are represented using a merkle tree, and the root node hash
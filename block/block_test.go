@@ -0,0 +1,46 @@
+package block
+
+import (
+	"testing"
+
+	"github.com/GGP1/btcs/chaincfg"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewBlockDoesNotIndex(t *testing.T) {
+	genesis, err := NewGenesis()
+	assert.NoError(t, err)
+	blockIndex.reset()
+	blockIndex.addNode(genesis.Height, genesis.Header)
+	blockIndex.setHash(genesis.Height, genesis.Hash)
+	defer blockIndex.reset()
+
+	b, err := NewBlock(genesis, genesis.Transactions)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), b.Height)
+
+	// Templates must not be taken into account until they are added to the chain
+	assert.Equal(t, indexNode{}, blockIndex.node(b.Height))
+	assert.Equal(t, int32(0), blockIndex.bestHeight())
+}
+
+func TestGenesis(t *testing.T) {
+	genesis, err := NewGenesis()
+	require.NoError(t, err)
+
+	ok, err := genesis.HasValidMerkleRoot()
+	require.NoError(t, err)
+	assert.True(t, ok, "The merkle root matches the coinbase")
+
+	hash, err := genesis.PowHash()
+	require.NoError(t, err)
+	assert.Equal(t, genesis.Hash, hash)
+	assert.True(t, genesis.IsValid())
+	assert.Equal(t, chaincfg.MainNetParams.Checkpoints[0].Hash, genesis.Hash)
+
+	other, err := NewGenesis()
+	require.NoError(t, err)
+	assert.Equal(t, genesis, other, "Every node builds the same genesis block")
+}
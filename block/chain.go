@@ -3,10 +3,12 @@ package block
 import (
 	"bytes"
 	"crypto/ecdsa"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/GGP1/btcs/encoding/gob"
 	"github.com/GGP1/btcs/tx"
@@ -17,14 +19,37 @@ import (
 const (
 	dbPath       = "blockchain.db"
 	blocksBucket = "blocks"
+	// metaBucket contains information about the blockchain database, like the format of
+	// its blocks.
+	metaBucket = "blocks_meta"
+	// chainVersion is the format of the blocks. In version 0 the merkle roots and the
+	// signatures were calculated over the gob encoding of the transactions, which differs
+	// between processes, and the genesis coinbase was random. Since version 1 they use
+	// tx.Serialize and the genesis block is fixed, the old blocks can't be validated.
+	chainVersion = 1
 )
 
 var (
 	// ErrBlockchainNotFound is thrown when the blockchain database file is not found.
 	ErrBlockchainNotFound = errors.New("blockchain not found")
-	errEmptyBlockchain    = errors.New("empty blockchain")
+	// ErrBlockNotFound is returned when looking up a block that is not in the chain.
+	ErrBlockNotFound = errors.New("block not found")
+	// ErrInvalidBlock is returned when a block breaks the consensus rules. Other errors,
+	// like database failures, don't mean the block is invalid.
+	ErrInvalidBlock = errors.New("invalid block")
+	// ErrInvalidTx is returned when a transaction breaks the consensus rules.
+	ErrInvalidTx = errors.New("invalid transaction")
+	// ErrTxExists is returned when verifying a transaction that is already in the chain.
+	ErrTxExists = errors.New("transaction already exists")
+	// ErrNotTipExtension is returned when adding a block whose parent is not the chain tip.
+	ErrNotTipExtension = errors.New("block does not extend the chain tip")
+	// ErrOutdatedChain is returned when loading a blockchain database written in an older
+	// format, it has to be replaced by a new one.
+	ErrOutdatedChain   = errors.New("blockchain database is in an outdated format")
+	errEmptyBlockchain = errors.New("empty blockchain")
 
 	lastHashKey = []byte("l")
+	versionKey  = []byte("version")
 )
 
 // Chain allows to read/write the blockchain file.
@@ -64,12 +89,25 @@ func NewChain() (*Chain, error) {
 		if err := b.Put(genesis.Hash, encodedBlock); err != nil {
 			return err
 		}
+		if err := b.Put(lastHashKey, genesis.Hash); err != nil {
+			return err
+		}
 
-		return b.Put(lastHashKey, genesis.Hash)
+		meta, err := tx.CreateBucket([]byte(metaBucket))
+		if err != nil {
+			return err
+		}
+
+		version := make([]byte, 4)
+		binary.BigEndian.PutUint32(version, chainVersion)
+		return meta.Put(versionKey, version)
 	})
 	if err != nil {
 		return nil, err
 	}
+	blockIndex.reset()
+	blockIndex.addNode(genesis.Height, genesis.Header)
+	blockIndex.setHash(genesis.Height, genesis.Hash)
 
 	return &Chain{
 		tip: genesis.Hash,
@@ -79,7 +117,8 @@ func NewChain() (*Chain, error) {
 
 // LoadChain reads the blockchain file and loads the tip of the chain.
 //
-// Call Close to release the Chain's associated resources when done.
+// It returns ErrOutdatedChain if the blocks were written in an older format, see
+// BackupChain. Call Close to release the Chain's associated resources when done.
 func LoadChain() (*Chain, error) {
 	if _, err := os.Stat(dbPath); err != nil {
 		if os.IsNotExist(err) {
@@ -93,20 +132,59 @@ func LoadChain() (*Chain, error) {
 		return nil, err
 	}
 
-	var tip []byte
+	var (
+		tip     []byte
+		version uint32
+	)
 	err = db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
 		tip = b.Get(lastHashKey)
+
+		if meta := tx.Bucket([]byte(metaBucket)); meta != nil {
+			if v := meta.Get(versionKey); v != nil {
+				version = binary.BigEndian.Uint32(v)
+			}
+		}
 		return nil
 	})
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
+	if version < chainVersion {
+		db.Close()
+		return nil, fmt.Errorf("%w: version %d, expected %d", ErrOutdatedChain, version, chainVersion)
+	}
 
-	return &Chain{
+	chain := &Chain{
 		tip: tip,
 		DB:  db,
-	}, nil
+	}
+	if err := chain.loadIndex(); err != nil {
+		return nil, err
+	}
+
+	return chain, nil
+}
+
+// BackupChain moves the blockchain file to a backup one so a new chain can be created,
+// it returns the backup path.
+func BackupChain() (string, error) {
+	backupPath := fmt.Sprintf("%s.%d.bak", dbPath, time.Now().Unix())
+	if err := os.Rename(dbPath, backupPath); err != nil {
+		return "", err
+	}
+	return backupPath, nil
+}
+
+// loadIndex adds the blocks in the chain to the index used by the difficulty calculations.
+func (c *Chain) loadIndex() error {
+	blockIndex.reset()
+	return c.NewIterator().ForEach(func(block Block) error {
+		blockIndex.addNode(block.Height, block.Header)
+		blockIndex.setHash(block.Height, block.Hash)
+		return nil
+	})
 }
 
 // NewIterator returns a BlockchainIterat
@@ -119,12 +197,37 @@ func (c *Chain) NewIterator() *ChainIterator {
 
 // AddBlock adds the block to the chain.
 func (c *Chain) AddBlock(block Block) error {
+	return c.addBlock(block, true)
+}
+
+// AddAssumedValidBlock is like AddBlock but the signatures of the block transactions are
+// not verified. The caller must check the block is an ancestor of the assumed valid block,
+// see HeaderChain.IsAssumedValid.
+func (c *Chain) AddAssumedValidBlock(block Block) error {
+	return c.addBlock(block, false)
+}
+
+func (c *Chain) addBlock(block Block, checkSignatures bool) error {
 	if !block.IsValid() {
-		return errors.New("invalid block")
+		return fmt.Errorf("%w: %x has an invalid proof of work", ErrInvalidBlock, block.Hash)
+	}
+
+	if c.tip != nil {
+		if !bytes.Equal(block.PrevBlockHash, c.tip) {
+			return fmt.Errorf("%w: %x follows %x", ErrNotTipExtension, block.Hash, block.PrevBlockHash)
+		}
+
+		tipHeight, err := c.BestHeight()
+		if err != nil {
+			return err
+		}
+		if err := CheckCheckpoints(block, tipHeight); err != nil {
+			return err
+		}
 	}
 
 	for _, tx := range block.Transactions {
-		if err := c.VerifyTx(tx); err != nil {
+		if err := c.verifyTx(tx, checkSignatures); err != nil {
 			return err
 		}
 	}
@@ -150,10 +253,45 @@ func (c *Chain) AddBlock(block Block) error {
 		}
 
 		c.tip = block.Hash
+		// Record the block so the difficulty calculations take its timestamp into account
+		blockIndex.addNode(block.Height, block.Header)
+		blockIndex.setHash(block.Height, block.Hash)
 		return nil
 	})
 }
 
+// DisconnectTip removes the last block from the chain and returns it, so the blocks of a
+// competing branch with more work can replace it. The UTXO set has to be rebuilt afterwards.
+//
+// The genesis block and the blocks at or below the latest checkpoint can't be removed.
+func (c *Chain) DisconnectTip() (Block, error) {
+	tip, err := c.LastBlock()
+	if err != nil {
+		return Block{}, err
+	}
+	if tip.IsGenesis() {
+		return Block{}, errors.New("can't disconnect the genesis block")
+	}
+	if checkpoint := LatestCheckpoint(tip.Height); checkpoint != nil && tip.Height <= checkpoint.Height {
+		return Block{}, fmt.Errorf("%w at height %d: block height %d", ErrForkBelowCheckpoint, checkpoint.Height, tip.Height)
+	}
+
+	err = c.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		if err := b.Delete(tip.Hash); err != nil {
+			return err
+		}
+		return b.Put(lastHashKey, tip.PrevBlockHash)
+	})
+	if err != nil {
+		return Block{}, err
+	}
+
+	c.tip = tip.PrevBlockHash
+	blockIndex.removeNode(tip.Height)
+	return tip, nil
+}
+
 // BestHeight returns the height of the latest block.
 func (c *Chain) BestHeight() (int32, error) {
 	block, err := c.LastBlock()
@@ -178,7 +316,7 @@ func (c *Chain) Block(hash []byte) (Block, error) {
 
 		blockData := b.Get(hash)
 		if blockData == nil {
-			return errors.New("block not found")
+			return fmt.Errorf("%w: %x", ErrBlockNotFound, hash)
 		}
 
 		decodedBlock, err := gob.Decode[Block](blockData)
@@ -196,24 +334,16 @@ func (c *Chain) Block(hash []byte) (Block, error) {
 	return block, nil
 }
 
-// BlocksHashes returns a list of hashes of all the blocks in the chain.
-func (c *Chain) BlocksHashes() ([][]byte, error) {
-	bci := c.NewIterator()
-	blocksCount, err := bci.BlocksCount()
-	if err != nil {
-		return nil, err
-	}
-	blocks := make([][]byte, 0, blocksCount)
-
-	err = bci.ForEach(func(block Block) error {
-		blocks = append(blocks, block.Hash)
-		return nil
-	})
-	if err != nil {
-		return nil, err
-	}
+// Tip returns the hash and height of the last block.
+func (c *Chain) Tip() ([]byte, int32) {
+	height := blockIndex.bestHeight()
+	return blockIndex.hash(height), height
+}
 
-	return blocks, nil
+// HasBlock returns whether the block with the hash provided is in the chain.
+func (c *Chain) HasBlock(hash []byte) bool {
+	_, ok := blockIndex.height(hash)
+	return ok
 }
 
 // FindTransaction looks for a transaction by its id.
@@ -250,17 +380,19 @@ func (c *Chain) FindTransaction(id []byte) (Block, tx.Tx, error) {
 }
 
 // FindUTXOs finds all unspent transaction outputs and returns transactions with spent outputs removed.
-func (c *Chain) FindUTXOs() (map[string][]tx.Output, error) {
-	utxo := make(map[string][]tx.Output)
+//
+// Outputs are keyed by their index in the transaction so spending one doesn't shift the others.
+func (c *Chain) FindUTXOs() (map[string]map[int]tx.Output, error) {
+	utxo := make(map[string]map[int]tx.Output)
 	spentTXOs := make(map[string][]int)
 	bci := c.NewIterator()
 
 	err := bci.ForEach(func(block Block) error {
-		for _, tx := range block.Transactions {
-			txID := hex.EncodeToString(tx.ID)
+		for _, transaction := range block.Transactions {
+			txID := hex.EncodeToString(transaction.ID)
 
 		Outputs:
-			for outIdx, out := range tx.Outputs {
+			for outIdx, out := range transaction.Outputs {
 				// Was the output spent?
 				if spentOutputs, ok := spentTXOs[txID]; ok {
 					for _, spentOutIdx := range spentOutputs {
@@ -271,13 +403,14 @@ func (c *Chain) FindUTXOs() (map[string][]tx.Output, error) {
 				}
 
 				// Add the output to the other outputs of this transaction
-				outputs := utxo[txID]
-				outputs = append(outputs, out)
-				utxo[txID] = outputs
+				if _, ok := utxo[txID]; !ok {
+					utxo[txID] = make(map[int]tx.Output)
+				}
+				utxo[txID][outIdx] = out
 			}
 
-			if !tx.IsCoinbase() {
-				for _, in := range tx.Inputs {
+			if !transaction.IsCoinbase() {
+				for _, in := range transaction.Inputs {
 					inTxID := hex.EncodeToString(in.PrevOutput.TxID)
 					spentTXOs[inTxID] = append(spentTXOs[inTxID], in.PrevOutput.Index)
 				}
@@ -316,37 +449,70 @@ func (c *Chain) SignTransaction(t *tx.Tx, privKey *ecdsa.PrivateKey) error {
 	return t.Sign(privKey, prevTxs)
 }
 
+// PrevTxs returns the transactions referenced by the inputs of the one passed, by id.
+func (c *Chain) PrevTxs(t tx.Tx) (map[string]tx.Tx, error) {
+	prevTxs := make(map[string]tx.Tx, len(t.Inputs))
+	for _, in := range t.Inputs {
+		_, prevTx, err := c.FindTransaction(in.PrevOutput.TxID)
+		if err != nil {
+			return nil, err
+		}
+		prevTxs[hex.EncodeToString(prevTx.ID)] = prevTx
+	}
+
+	return prevTxs, nil
+}
+
 // VerifyTx returns an error if a transaction is not valid.
 //
 // TODO:
 //   - utxo should not belong to the genesis block
 //   - the size of the serialized transaction should not exceed max block size
 //   - inputs referenced outputs should be unspent and in the chain/mempool
-//   - inputs referenced outputs and new outputs should have the same amount of coins
 func (c *Chain) VerifyTx(t tx.Tx) error {
+	return c.verifyTx(t, true)
+}
+
+// verifyTx is like VerifyTx but the verification of the signatures can be skipped.
+func (c *Chain) verifyTx(t tx.Tx, checkSignatures bool) error {
 	if t.IsCoinbase() {
 		return nil
 	}
 
 	if len(t.Inputs) == 0 {
-		return errors.New("transaction has no inputs")
+		return fmt.Errorf("%w %x: no inputs", ErrInvalidTx, t.ID)
 	}
 	if len(t.Outputs) == 0 {
-		return errors.New("transaction has no outputs")
+		return fmt.Errorf("%w %x: no outputs", ErrInvalidTx, t.ID)
+	}
+	for i, out := range t.Outputs {
+		if out.Value <= 0 {
+			return fmt.Errorf("%w %x: output %d has a non-positive value", ErrInvalidTx, t.ID, i)
+		}
 	}
 
 	// Reject transactions already in the blockchain
 	if _, _, err := c.FindTransaction(t.ID); err == nil {
-		return fmt.Errorf("transaction %x already exists", t.ID)
+		return fmt.Errorf("%w: %x", ErrTxExists, t.ID)
 	}
 
-	prevTxs := make(map[string]tx.Tx, len(t.Inputs))
-	for _, in := range t.Inputs {
-		_, prevTx, err := c.FindTransaction(in.PrevOutput.TxID)
-		if err != nil {
-			return err
-		}
-		prevTxs[hex.EncodeToString(prevTx.ID)] = prevTx
+	prevTxs, err := c.PrevTxs(t)
+	if err != nil {
+		return err
+	}
+
+	// Inputs referenced outputs and new outputs should have the same amount of coins,
+	// the surplus is the transaction fee
+	fee, err := t.Fee(prevTxs)
+	if err != nil {
+		return err
+	}
+	if fee < 0 {
+		return fmt.Errorf("%w %x: outputs value exceeds inputs value by %d SAT", ErrInvalidTx, t.ID, -fee)
+	}
+
+	if !checkSignatures {
+		return nil
 	}
 
 	ok, err := t.Verify(prevTxs)
@@ -354,7 +520,7 @@ func (c *Chain) VerifyTx(t tx.Tx) error {
 		return err
 	}
 	if !ok {
-		return errors.New("invalid transaction signature")
+		return fmt.Errorf("%w %x: invalid signature", ErrInvalidTx, t.ID)
 	}
 
 	return nil
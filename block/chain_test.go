@@ -0,0 +1,65 @@
+package block
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GGP1/btcs/encoding/gob"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestLoadChainOutdated(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(wd)
+	defer blockIndex.reset()
+
+	// A database written before the format was versioned
+	db, err := bolt.Open(dbPath, 0o600, nil)
+	require.NoError(t, err)
+	genesis, err := NewGenesis()
+	require.NoError(t, err)
+	encodedBlock, err := gob.Encode(genesis)
+	require.NoError(t, err)
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte(blocksBucket))
+		if err != nil {
+			return err
+		}
+		if err := b.Put(genesis.Hash, encodedBlock); err != nil {
+			return err
+		}
+		return b.Put(lastHashKey, genesis.Hash)
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	_, err = LoadChain()
+	assert.ErrorIs(t, err, ErrOutdatedChain)
+
+	backupPath, err := BackupChain()
+	require.NoError(t, err)
+	assert.FileExists(t, backupPath)
+	_, err = LoadChain()
+	assert.ErrorIs(t, err, ErrBlockchainNotFound)
+
+	chain, err := NewChain()
+	require.NoError(t, err)
+	require.NoError(t, chain.Close())
+
+	chain, err = LoadChain()
+	require.NoError(t, err)
+	defer chain.Close()
+	tip, height := chain.Tip()
+	assert.Equal(t, genesis.Hash, tip)
+	assert.Equal(t, int32(0), height)
+
+	backups, err := filepath.Glob(dbPath + ".*.bak")
+	require.NoError(t, err)
+	assert.Equal(t, []string{backupPath}, backups)
+}
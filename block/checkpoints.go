@@ -0,0 +1,46 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/GGP1/btcs/chaincfg"
+)
+
+var (
+	// ErrCheckpointMismatch is returned when a block at a checkpoint height has a different hash.
+	ErrCheckpointMismatch = errors.New("block does not match the checkpoint")
+	// ErrForkBelowCheckpoint is returned when a block would fork the chain below a checkpoint
+	// it already passed.
+	ErrForkBelowCheckpoint = errors.New("block forks the chain below a checkpoint")
+)
+
+// LatestCheckpoint returns the highest checkpoint at or below height, nil if there is none.
+func LatestCheckpoint(height int32) *chaincfg.Checkpoint {
+	checkpoints := chaincfg.ActiveParams.Checkpoints
+	for i := len(checkpoints) - 1; i >= 0; i-- {
+		if checkpoints[i].Height <= height {
+			return &checkpoints[i]
+		}
+	}
+	return nil
+}
+
+// CheckCheckpoints returns an error if the block doesn't match the checkpoint at its height
+// or if it would replace a block at or below the latest checkpoint the chain, whose best
+// height is tipHeight, has passed.
+func CheckCheckpoints(b Block, tipHeight int32) error {
+	for _, checkpoint := range chaincfg.ActiveParams.Checkpoints {
+		if checkpoint.Height == b.Height && !bytes.Equal(checkpoint.Hash, b.Hash) {
+			return fmt.Errorf("%w at height %d: expected %x, got %x", ErrCheckpointMismatch, b.Height, checkpoint.Hash, b.Hash)
+		}
+	}
+
+	checkpoint := LatestCheckpoint(tipHeight)
+	if checkpoint != nil && b.Height <= checkpoint.Height {
+		return fmt.Errorf("%w at height %d: block height %d", ErrForkBelowCheckpoint, checkpoint.Height, b.Height)
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package block
+
+import (
+	"testing"
+
+	"github.com/GGP1/btcs/chaincfg"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckCheckpoints(t *testing.T) {
+	params := chaincfg.MainNetParams
+	params.Checkpoints = []chaincfg.Checkpoint{
+		{Height: 0, Hash: []byte{0}},
+		{Height: 10, Hash: []byte{10}},
+		{Height: 20, Hash: []byte{20}},
+	}
+	chaincfg.ActiveParams = &params
+	defer func() { chaincfg.ActiveParams = &chaincfg.MainNetParams }()
+
+	cases := []struct {
+		desc      string
+		height    int32
+		hash      []byte
+		tipHeight int32
+		expected  error
+	}{
+		{desc: "Matching checkpoint", height: 10, hash: []byte{10}, tipHeight: 9},
+		{desc: "Between checkpoints", height: 15, hash: []byte{1}, tipHeight: 14},
+		{desc: "Mismatching checkpoint", height: 20, hash: []byte{1}, tipHeight: 19, expected: ErrCheckpointMismatch},
+		{desc: "Fork below checkpoint", height: 8, hash: []byte{1}, tipHeight: 12, expected: ErrForkBelowCheckpoint},
+		{desc: "Fork at checkpoint", height: 10, hash: []byte{10}, tipHeight: 12, expected: ErrForkBelowCheckpoint},
+		{desc: "Fork above checkpoint", height: 11, hash: []byte{1}, tipHeight: 12},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			b := Block{Header: &Header{}, Hash: tc.hash, Height: tc.height}
+			assert.ErrorIs(t, CheckCheckpoints(b, tc.tipHeight), tc.expected)
+		})
+	}
+}
+
+func TestLatestCheckpoint(t *testing.T) {
+	params := chaincfg.MainNetParams
+	params.Checkpoints = []chaincfg.Checkpoint{{Height: 5}, {Height: 10}}
+	chaincfg.ActiveParams = &params
+	defer func() { chaincfg.ActiveParams = &chaincfg.MainNetParams }()
+
+	assert.Nil(t, LatestCheckpoint(4))
+	assert.Equal(t, int32(5), LatestCheckpoint(9).Height)
+	assert.Equal(t, int32(10), LatestCheckpoint(100).Height)
+}
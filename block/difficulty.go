@@ -5,7 +5,7 @@ package block
 import (
 	"math/big"
 
-	"github.com/GGP1/btcs/logger"
+	"github.com/GGP1/btcs/chaincfg"
 )
 
 // MaxTarget is the highest proof of work value a block can have.
@@ -41,43 +41,45 @@ const (
 	maxRetargetTimespan      = targetTimespan * retargetAdjustmentFactor
 )
 
-// CalculateNextDifficulty adjusts the difficulty to find a block's hash
-// every blocksRetargetPeriod blocks.
+// CalculateNextDifficulty returns the compact target of the block following prevBlock
+// using the active network's difficulty adjustment algorithm.
+//
+// If the active network has retargeting disabled, it returns the minimum difficulty.
+// The block following the genesis uses the initial difficulty of the network's
+// proof-of-work function.
 func CalculateNextDifficulty(prevBlock Block) uint32 {
-	nextBlockHeight := prevBlock.Height + 1
-	// Return the previous block's difficulty if this block
-	// is not at a difficulty retarget period
-	if nextBlockHeight%blocksRetargetPeriod != 0 {
-		return prevBlock.Bits
-	}
+	return calculateNextDifficulty(prevBlock, &blockIndex)
+}
 
-	// Get the timestamp of the block at the previous retarget (targetTimespan time worth of blocks)
-	lastRetargetTs := blockIndex.nodeTimestamp(nextBlockHeight - blocksRetargetPeriod)
-	actualTimespan := prevBlock.Timestamp - lastRetargetTs
-	logger.Debugf("Difficulty adjustment. Target timespan %d seconds, actual timespan %d seconds",
-		targetTimespan,
-		actualTimespan)
-
-	if actualTimespan < minRetargetTimespan {
-		actualTimespan = minRetargetTimespan
-	} else if actualTimespan > maxRetargetTimespan {
-		actualTimespan = maxRetargetTimespan
+func calculateNextDifficulty(prevBlock Block, chain headers) uint32 {
+	if chaincfg.ActiveParams.NoRetargeting {
+		return chaincfg.ActiveParams.PowLimitBits
 	}
 
-	// nextDifficulty = currentDifficulty * actualTimespan / targetTimespan
-	oldTarget := CompactToBig(prevBlock.Bits)
-	newTarget := new(big.Int).Mul(oldTarget, big.NewInt(actualTimespan))
-	newTarget.Div(newTarget, big.NewInt(targetTimespan))
+	if prevBlock.IsGenesis() {
+		return chaincfg.ActiveParams.PowHasher.InitialBits()
+	}
 
-	if newTarget.Cmp(MaxTarget) > 0 {
-		newTarget.Set(MaxTarget)
+	retargeter, ok := retargeters[chaincfg.ActiveParams.RetargetAlgorithm]
+	if !ok {
+		retargeter = windowRetarget{}
 	}
 
-	newTargetBits := BigToCompact(newTarget)
-	logger.Debugf("Old target: %08x", prevBlock.Bits)
-	logger.Debugf("New target: %08x", newTargetBits)
+	prevNode := indexNode{timestamp: prevBlock.Timestamp, bits: prevBlock.Bits}
+	return retargeter.nextBits(prevNode, prevBlock.Height, chain)
+}
+
+// Difficulty returns how many times harder than the network's minimum difficulty it is
+// to find a hash lower than the target represented by bits.
+func Difficulty(bits uint32) float64 {
+	powLimit := new(big.Float).SetInt(CompactToBig(chaincfg.ActiveParams.PowLimitBits))
+	target := new(big.Float).SetInt(CompactToBig(bits))
+	if target.Sign() <= 0 {
+		return 0
+	}
 
-	return newTargetBits
+	difficulty, _ := new(big.Float).Quo(powLimit, target).Float64()
+	return difficulty
 }
 
 // CompactToBig converts a compact representation of a whole number N to an
@@ -175,3 +177,16 @@ func BigToCompact(n *big.Int) uint32 {
 	}
 	return compact
 }
+
+// CalcWork returns the expected number of hashes required to find a block with the
+// difficulty bits provided, 2^256 / (target+1), used to compare the work of competing
+// chains.
+func CalcWork(bits uint32) *big.Int {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+
+	denominator := new(big.Int).Add(target, big.NewInt(1))
+	return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), denominator)
+}
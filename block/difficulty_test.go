@@ -0,0 +1,66 @@
+package block
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/GGP1/btcs/chaincfg"
+	"github.com/GGP1/btcs/pow"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalculateNextDifficultyNoRetargeting(t *testing.T) {
+	chaincfg.ActiveParams = &chaincfg.RegressionNetParams
+	defer func() { chaincfg.ActiveParams = &chaincfg.MainNetParams }()
+
+	genesis, err := NewGenesis()
+	assert.NoError(t, err)
+
+	prevBlock := *genesis
+	prevBlock.Height = blocksRetargetPeriod - 1
+	bits := CalculateNextDifficulty(prevBlock)
+	assert.Equal(t, chaincfg.RegressionNetParams.PowLimitBits, bits)
+	assert.True(t, CompactToBig(bits).Cmp(MaxTarget) <= 0)
+}
+
+func TestCalculateNextDifficultyInitialBits(t *testing.T) {
+	genesis, err := NewGenesis()
+	assert.NoError(t, err)
+	assert.Equal(t, pow.SHA256.InitialBits(), CalculateNextDifficulty(*genesis))
+
+	params := chaincfg.MainNetParams
+	params.PowHasher = pow.Argon2
+	chaincfg.ActiveParams = &params
+	defer func() { chaincfg.ActiveParams = &chaincfg.MainNetParams }()
+
+	assert.Equal(t, pow.Argon2.InitialBits(), CalculateNextDifficulty(*genesis))
+}
+
+func TestInitialBits(t *testing.T) {
+	// The initial targets are the genesis one multiplied by the cost of each function
+	genesisTarget := CompactToBig(baseDifficulty)
+	cases := []struct {
+		hasher pow.Hasher
+		factor int64
+	}{
+		{hasher: pow.SHA256, factor: 1},
+		{hasher: pow.SHA256d, factor: 2},
+		{hasher: pow.Scrypt, factor: 1 << 12},
+		{hasher: pow.Argon2, factor: 1 << 13},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.hasher.Name(), func(t *testing.T) {
+			expected := new(big.Int).Mul(genesisTarget, big.NewInt(tc.factor))
+			assert.Equal(t, BigToCompact(expected), tc.hasher.InitialBits())
+			assert.True(t, CompactToBig(tc.hasher.InitialBits()).Cmp(MaxTarget) <= 0)
+		})
+	}
+}
+
+func TestDifficulty(t *testing.T) {
+	assert.Equal(t, 1.0, Difficulty(chaincfg.MainNetParams.PowLimitBits))
+	assert.InDelta(t, 2.0, Difficulty(0x203fffff), 0.0001)
+	assert.Zero(t, Difficulty(0))
+}
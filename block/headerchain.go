@@ -0,0 +1,317 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/GGP1/btcs/chaincfg"
+)
+
+var (
+	// ErrHeaderDoesNotConnect is returned when adding a header that doesn't follow the tip of
+	// the header chain.
+	ErrHeaderDoesNotConnect = errors.New("header does not connect to the header chain")
+	// ErrInvalidHeader is returned when adding a header that breaks the consensus rules or
+	// descends from an invalid block.
+	ErrInvalidHeader = errors.New("invalid header")
+)
+
+// HeaderChain contains the validated headers following the tip of the chain whose blocks
+// weren't connected yet. Headers are downloaded first so the blocks can be requested
+// from several peers at the same time and connected in order.
+//
+// A fork of the header chain may follow a block below the chain tip instead, the blocks
+// above it have to be disconnected before connecting the ones of the fork.
+//
+// It's not safe for concurrent use.
+type HeaderChain struct {
+	// headers and hashes are keyed by height, they only contain the heights above the
+	// block they follow as the lower ones are pruned once their blocks are connected
+	headers map[int32]Header
+	hashes  map[int32][]byte
+	heights map[string]int32
+	// low and height are the heights of the first and last headers, height is -1 if there
+	// are none
+	low    int32
+	height int32
+	// base is the height of the block the headers follow when it's below the chain tip,
+	// -1 if they follow the chain tip
+	base int32
+	// invalid contains the hashes of the blocks that failed validation, their headers
+	// are rejected. It's shared with the forks of the header chain
+	invalid map[string]struct{}
+}
+
+// NewHeaderChain returns an empty header chain following the chain tip.
+func NewHeaderChain() *HeaderChain {
+	h := &HeaderChain{invalid: make(map[string]struct{})}
+	h.reset()
+	return h
+}
+
+// Fork returns a copy of the header chain truncated at height, so the headers of a
+// competing branch can be added to it.
+//
+// If height is below the block the headers follow, the fork follows the chain block at
+// height. Blocks at or below the latest checkpoint can't be replaced.
+func (h *HeaderChain) Fork(height int32) (*HeaderChain, error) {
+	_, tipHeight := h.Tip()
+	if height < 0 || height > tipHeight {
+		return nil, fmt.Errorf("can't fork the header chain at height %d, its tip is at %d", height, tipHeight)
+	}
+	if checkpoint := LatestCheckpoint(blockIndex.bestHeight()); checkpoint != nil && height < checkpoint.Height {
+		return nil, fmt.Errorf("%w at height %d: fork height %d", ErrForkBelowCheckpoint, checkpoint.Height, height)
+	}
+
+	fork := &HeaderChain{invalid: h.invalid}
+	fork.reset()
+	if height < h.baseHeight() {
+		fork.base = height
+		return fork, nil
+	}
+
+	fork.base = h.base
+	for i := h.low; i <= height && h.height >= 0; i++ {
+		fork.headers[i] = h.headers[i]
+		fork.hashes[i] = h.hashes[i]
+		fork.heights[string(h.hashes[i])] = i
+		fork.height = i
+	}
+	fork.low = h.low
+	return fork, nil
+}
+
+// Work returns the sum of the work of the headers.
+func (h *HeaderChain) Work() *big.Int {
+	h.prune()
+	work := new(big.Int)
+	for height := h.low; height <= h.height; height++ {
+		work.Add(work, CalcWork(h.headers[height].Bits))
+	}
+	return work
+}
+
+// WorkSince returns the sum of the work of the blocks and headers above height.
+func (h *HeaderChain) WorkSince(height int32) *big.Int {
+	_, tipHeight := h.Tip()
+	work := new(big.Int)
+	for height++; height <= tipHeight; height++ {
+		work.Add(work, CalcWork(h.node(height).bits))
+	}
+	return work
+}
+
+// ForkHeight returns the height of the chain block the headers follow, it's below the
+// chain tip if the header chain is a competing branch forking below it.
+func (h *HeaderChain) ForkHeight() int32 {
+	return h.baseHeight()
+}
+
+// Invalidate discards the header with the hash provided and its descendants, they are
+// rejected if added again.
+func (h *HeaderChain) Invalidate(hash []byte) {
+	h.invalid[string(hash)] = struct{}{}
+
+	h.prune()
+	height, ok := h.heights[string(hash)]
+	if !ok {
+		return
+	}
+	for ; h.height >= height; h.height-- {
+		delete(h.heights, string(h.hashes[h.height]))
+		delete(h.headers, h.height)
+		delete(h.hashes, h.height)
+	}
+	if h.height < h.low {
+		h.reset()
+	}
+}
+
+// Add validates the header and appends it to the header chain, returning its hash.
+//
+// It checks the header follows the tip, its proof of work, difficulty, timestamp and
+// the checkpoints.
+func (h *HeaderChain) Add(header Header) ([]byte, error) {
+	h.prune()
+
+	b := Block{Header: &header}
+	hash, err := b.PowHash()
+	if err != nil {
+		return nil, err
+	}
+	b.Hash = hash
+
+	if _, ok := h.invalid[string(hash)]; ok {
+		return nil, fmt.Errorf("%w: %x is an invalid block", ErrInvalidHeader, hash)
+	}
+	if _, ok := h.invalid[string(header.PrevBlockHash)]; ok {
+		return nil, fmt.Errorf("%w: %x follows the invalid block %x", ErrInvalidHeader, hash, header.PrevBlockHash)
+	}
+
+	tipHash, tipHeight := h.Tip()
+	if !bytes.Equal(header.PrevBlockHash, tipHash) {
+		return nil, fmt.Errorf("%w: %x follows %x, the tip is %x", ErrHeaderDoesNotConnect, hash, header.PrevBlockHash, tipHash)
+	}
+	b.Height = tipHeight + 1
+
+	if !b.IsValid() {
+		return nil, fmt.Errorf("%w: %x has an invalid proof of work", ErrInvalidHeader, hash)
+	}
+	prevBlock := Block{Header: h.header(tipHeight), Hash: tipHash, Height: tipHeight}
+	if bits := calculateNextDifficulty(prevBlock, h); header.Bits != bits {
+		return nil, fmt.Errorf("%w: %x has difficulty bits %08x, expected %08x", ErrInvalidHeader, hash, header.Bits, bits)
+	}
+	if err := checkTimestamp(b, h); err != nil {
+		if errors.Is(err, ErrTimeTooNew) {
+			return nil, fmt.Errorf("header %x: %w", hash, err)
+		}
+		return nil, fmt.Errorf("%w: %x: %v", ErrInvalidHeader, hash, err)
+	}
+	if err := CheckCheckpoints(b, tipHeight); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidHeader, err)
+	}
+
+	if h.height < 0 {
+		h.low = b.Height
+	}
+	h.headers[b.Height] = header
+	h.hashes[b.Height] = hash
+	h.heights[string(hash)] = b.Height
+	h.height = b.Height
+	return hash, nil
+}
+
+// IsAssumedValid returns whether the block with the hash and height provided is the assumed
+// valid block or one of its ancestors, so its signatures don't have to be verified.
+//
+// That's the case if the assumed valid block is in the header chain at or above the height
+// and the header chain has the block at the height. Blocks that are not in the header chain
+// or follow the assumed valid block are not.
+func (h *HeaderChain) IsAssumedValid(hash []byte, height int32) bool {
+	assumeValid := chaincfg.ActiveParams.AssumeValid
+	if len(assumeValid) == 0 {
+		return false
+	}
+
+	assumeValidHeight, ok := h.Height(assumeValid)
+	if !ok || height > assumeValidHeight {
+		return false
+	}
+
+	return bytes.Equal(h.Hash(height), hash)
+}
+
+// Contains returns whether the header chain or the chain has the hash provided.
+func (h *HeaderChain) Contains(hash []byte) bool {
+	_, ok := h.Height(hash)
+	return ok
+}
+
+// Hash returns the hash of the header at height, nil if there is none.
+func (h *HeaderChain) Hash(height int32) []byte {
+	if height <= h.baseHeight() {
+		return blockIndex.hash(height)
+	}
+	return h.hashes[height]
+}
+
+// Height returns the height of the header with the hash provided and whether it's
+// in the header chain or the chain blocks it follows.
+func (h *HeaderChain) Height(hash []byte) (int32, bool) {
+	base := h.baseHeight()
+	if height, ok := blockIndex.height(hash); ok && height <= base {
+		return height, true
+	}
+	height, ok := h.heights[string(hash)]
+	if !ok || height <= base {
+		return 0, false
+	}
+	return height, true
+}
+
+// Locator returns a block locator from the tip of the header chain.
+func (h *HeaderChain) Locator() [][]byte {
+	_, tipHeight := h.Tip()
+	heights := locatorHeights(tipHeight)
+	locator := make([][]byte, 0, len(heights))
+	for _, height := range heights {
+		if hash := h.Hash(height); hash != nil {
+			locator = append(locator, hash)
+		}
+	}
+
+	return locator
+}
+
+// Tip returns the hash and height of the last header, which is the block the header
+// chain follows if there are no headers.
+func (h *HeaderChain) Tip() ([]byte, int32) {
+	h.prune()
+	if h.height >= 0 {
+		return h.hashes[h.height], h.height
+	}
+
+	base := h.baseHeight()
+	return blockIndex.hash(base), base
+}
+
+// header returns the header at height.
+func (h *HeaderChain) header(height int32) *Header {
+	if header, ok := h.headers[height]; ok && height > h.baseHeight() {
+		return &header
+	}
+
+	node := blockIndex.node(height)
+	return &Header{Timestamp: node.timestamp, Bits: node.bits, Version: node.version}
+}
+
+// node implements the headers interface used by the difficulty and timestamp checks.
+func (h *HeaderChain) node(height int32) indexNode {
+	if header, ok := h.headers[height]; ok && height > h.baseHeight() {
+		return indexNode{timestamp: header.Timestamp, bits: header.Bits, version: header.Version}
+	}
+	return blockIndex.node(height)
+}
+
+// baseHeight returns the height of the chain block the headers follow. Once the blocks
+// above a fork's base are disconnected, it follows the chain tip.
+func (h *HeaderChain) baseHeight() int32 {
+	bestHeight := blockIndex.bestHeight()
+	if h.base < 0 || h.base >= bestHeight {
+		h.base = -1
+		return bestHeight
+	}
+	return h.base
+}
+
+// prune removes the headers whose blocks were connected to the chain. If the block the
+// headers follow is not in the chain anymore, all the headers are discarded.
+func (h *HeaderChain) prune() {
+	if h.height < 0 {
+		return
+	}
+
+	base := h.baseHeight()
+	for ; h.low <= base && h.low <= h.height; h.low++ {
+		delete(h.heights, string(h.hashes[h.low]))
+		delete(h.headers, h.low)
+		delete(h.hashes, h.low)
+	}
+
+	next, ok := h.headers[base+1]
+	if !ok || !bytes.Equal(next.PrevBlockHash, blockIndex.hash(base)) {
+		// All the headers were connected or the chain moved to another branch
+		h.reset()
+	}
+}
+
+func (h *HeaderChain) reset() {
+	h.headers = make(map[int32]Header)
+	h.hashes = make(map[int32][]byte)
+	h.heights = make(map[string]int32)
+	h.low = 0
+	h.height = -1
+	h.base = -1
+}
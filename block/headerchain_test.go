@@ -0,0 +1,242 @@
+package block
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/GGP1/btcs/chaincfg"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mineHeader returns a header following prevHash with a valid proof of work.
+func mineHeader(t *testing.T, prevHash []byte, timestamp int64) Header {
+	header := Header{
+		PrevBlockHash:  prevHash,
+		MerkleRootHash: []byte{1},
+		Timestamp:      timestamp,
+		Bits:           chaincfg.ActiveParams.PowLimitBits,
+	}
+	for !(Block{Header: &header}).IsValid() {
+		header.Nonce++
+	}
+	return header
+}
+
+func TestHeaderChain(t *testing.T) {
+	chaincfg.ActiveParams = &chaincfg.RegressionNetParams
+	savedIndex := blockIndex
+	blockIndex = newIndex()
+	defer func() {
+		chaincfg.ActiveParams = &chaincfg.MainNetParams
+		blockIndex = savedIndex
+	}()
+
+	genesis, err := NewGenesis()
+	require.NoError(t, err)
+	blockIndex.addNode(0, genesis.Header)
+	blockIndex.setHash(0, genesis.Hash)
+
+	h := NewHeaderChain()
+	tipHash, tipHeight := h.Tip()
+	assert.Equal(t, genesis.Hash, tipHash)
+	assert.Equal(t, int32(0), tipHeight)
+
+	headers := make([]Header, 0, 5)
+	hashes := make([][]byte, 0, 5)
+	prevHash := genesis.Hash
+	for i := int64(1); i <= 5; i++ {
+		header := mineHeader(t, prevHash, genesis.Timestamp+i*60)
+		hash, err := h.Add(header)
+		require.NoError(t, err)
+		headers = append(headers, header)
+		hashes = append(hashes, hash)
+		prevHash = hash
+	}
+
+	tipHash, tipHeight = h.Tip()
+	assert.Equal(t, hashes[4], tipHash)
+	assert.Equal(t, int32(5), tipHeight)
+	assert.True(t, h.Contains(hashes[2]))
+	assert.Equal(t, hashes[2], h.Hash(3))
+	assert.Equal(t, [][]byte{hashes[4], hashes[3], hashes[2], hashes[1], hashes[0], genesis.Hash}, h.Locator())
+
+	t.Run("Does not connect", func(t *testing.T) {
+		_, err := h.Add(mineHeader(t, hashes[2], genesis.Timestamp+1000))
+		assert.ErrorIs(t, err, ErrHeaderDoesNotConnect)
+	})
+
+	t.Run("Invalid difficulty", func(t *testing.T) {
+		header := mineHeader(t, tipHash, genesis.Timestamp+1000)
+		header.Bits = 0x1d00ffff
+		_, err := h.Add(header)
+		assert.ErrorIs(t, err, ErrInvalidHeader)
+	})
+
+	t.Run("Invalid timestamp", func(t *testing.T) {
+		_, err := h.Add(mineHeader(t, tipHash, genesis.Timestamp))
+		assert.ErrorIs(t, err, ErrInvalidHeader)
+	})
+
+	// Connecting the blocks prunes their headers
+	for i := 0; i < 2; i++ {
+		blockIndex.addNode(int32(i+1), &headers[i])
+		blockIndex.setHash(int32(i+1), hashes[i])
+	}
+	tipHash, tipHeight = h.Tip()
+	assert.Equal(t, hashes[4], tipHash)
+	assert.Equal(t, int32(5), tipHeight)
+	assert.NotContains(t, h.headers, int32(1))
+	assert.Equal(t, hashes[0], h.Hash(1))
+	assert.True(t, h.Contains(hashes[0]))
+
+	for i := 2; i < 5; i++ {
+		blockIndex.addNode(int32(i+1), &headers[i])
+		blockIndex.setHash(int32(i+1), hashes[i])
+	}
+	_, tipHeight = h.Tip()
+	assert.Equal(t, int32(5), tipHeight)
+	assert.Empty(t, h.headers)
+}
+
+func TestHeaderChainIsAssumedValid(t *testing.T) {
+	chaincfg.ActiveParams = &chaincfg.RegressionNetParams
+	savedIndex := blockIndex
+	blockIndex = newIndex()
+	defer func() {
+		chaincfg.ActiveParams = &chaincfg.MainNetParams
+		chaincfg.RegressionNetParams.AssumeValid = nil
+		blockIndex = savedIndex
+	}()
+
+	genesis, err := NewGenesis()
+	require.NoError(t, err)
+	blockIndex.addNode(0, genesis.Header)
+	blockIndex.setHash(0, genesis.Hash)
+
+	h := NewHeaderChain()
+	hashes := make([][]byte, 0, 4)
+	prevHash := genesis.Hash
+	for i := int64(1); i <= 4; i++ {
+		hash, err := h.Add(mineHeader(t, prevHash, genesis.Timestamp+i*60))
+		require.NoError(t, err)
+		hashes = append(hashes, hash)
+		prevHash = hash
+	}
+	// A block at height 2 on a competing branch
+	forkHeader := mineHeader(t, hashes[0], genesis.Timestamp+1000)
+	forkHash, err := Block{Header: &forkHeader}.PowHash()
+	require.NoError(t, err)
+
+	assert.False(t, h.IsAssumedValid(hashes[0], 1), "no assumed valid block")
+
+	chaincfg.ActiveParams.AssumeValid = hashes[2]
+	assert.True(t, h.IsAssumedValid(hashes[0], 1), "ancestor")
+	assert.True(t, h.IsAssumedValid(hashes[2], 3), "assumed valid block")
+	assert.False(t, h.IsAssumedValid(hashes[3], 4), "descendant")
+	assert.False(t, h.IsAssumedValid(forkHash, 2), "non-ancestor")
+	assert.False(t, h.IsAssumedValid(hashes[1], 1), "wrong height")
+
+	chaincfg.ActiveParams.AssumeValid = []byte{1, 2, 3}
+	assert.False(t, h.IsAssumedValid(hashes[0], 1), "assumed valid block not in the header chain")
+}
+
+func TestHeaderChainFork(t *testing.T) {
+	chaincfg.ActiveParams = &chaincfg.RegressionNetParams
+	savedIndex := blockIndex
+	blockIndex = newIndex()
+	defer func() {
+		chaincfg.ActiveParams = &chaincfg.MainNetParams
+		blockIndex = savedIndex
+	}()
+
+	genesis, err := NewGenesis()
+	require.NoError(t, err)
+	blockIndex.addNode(0, genesis.Header)
+	blockIndex.setHash(0, genesis.Hash)
+
+	h := NewHeaderChain()
+	hashes := make([][]byte, 0, 3)
+	prevHash := genesis.Hash
+	for i := int64(1); i <= 3; i++ {
+		hash, err := h.Add(mineHeader(t, prevHash, genesis.Timestamp+i*60))
+		require.NoError(t, err)
+		hashes = append(hashes, hash)
+		prevHash = hash
+	}
+	headerWork := CalcWork(chaincfg.ActiveParams.PowLimitBits)
+	assert.Equal(t, new(big.Int).Mul(headerWork, big.NewInt(3)), h.Work())
+
+	_, err = h.Fork(4)
+	assert.Error(t, err, "Above the tip")
+
+	fork, err := h.Fork(1)
+	require.NoError(t, err)
+	forkTip, forkHeight := fork.Tip()
+	assert.Equal(t, hashes[0], forkTip)
+	assert.Equal(t, int32(1), forkHeight)
+	assert.Equal(t, headerWork, fork.Work())
+
+	_, err = fork.Add(mineHeader(t, hashes[0], genesis.Timestamp+1000))
+	require.NoError(t, err)
+	_, tipHeight := h.Tip()
+	assert.Equal(t, int32(3), tipHeight, "The original header chain is not modified")
+	assert.Equal(t, hashes[1], h.Hash(2))
+
+	t.Run("Below the chain tip", func(t *testing.T) {
+		header := mineHeader(t, genesis.Hash, genesis.Timestamp+60)
+		blockIndex.addNode(1, &header)
+		blockIndex.setHash(1, []byte{1})
+		defer func() {
+			blockIndex.reset()
+			blockIndex.addNode(0, genesis.Header)
+			blockIndex.setHash(0, genesis.Hash)
+		}()
+
+		fork, err := NewHeaderChain().Fork(0)
+		require.NoError(t, err)
+		assert.Equal(t, int32(0), fork.ForkHeight())
+		tipHash, tipHeight := fork.Tip()
+		assert.Equal(t, genesis.Hash, tipHash)
+		assert.Equal(t, int32(0), tipHeight)
+		assert.False(t, fork.Contains([]byte{1}), "The chain blocks above the fork are not part of it")
+
+		hash, err := fork.Add(mineHeader(t, genesis.Hash, genesis.Timestamp+120))
+		require.NoError(t, err)
+		_, err = fork.Add(mineHeader(t, hash, genesis.Timestamp+180))
+		require.NoError(t, err)
+		assert.Equal(t, hash, fork.Hash(1))
+		assert.Equal(t, new(big.Int).Mul(headerWork, big.NewInt(2)), fork.Work())
+		assert.Equal(t, headerWork, NewHeaderChain().WorkSince(0))
+
+		params := chaincfg.RegressionNetParams
+		params.Checkpoints = append(params.Checkpoints, chaincfg.Checkpoint{Height: 1, Hash: []byte{1}})
+		chaincfg.ActiveParams = &params
+		_, err = NewHeaderChain().Fork(0)
+		assert.ErrorIs(t, err, ErrForkBelowCheckpoint)
+		chaincfg.ActiveParams = &chaincfg.RegressionNetParams
+
+		// Once the block above the fork is disconnected, the fork follows the chain tip
+		blockIndex.removeNode(1)
+		_, tipHeight = fork.Tip()
+		assert.Equal(t, int32(2), tipHeight)
+		height, ok := fork.Height(hash)
+		assert.True(t, ok)
+		assert.Equal(t, int32(1), height)
+	})
+
+	t.Run("Invalidate", func(t *testing.T) {
+		h.Invalidate(hashes[1])
+		tipHash, tipHeight := h.Tip()
+		assert.Equal(t, hashes[0], tipHash)
+		assert.Equal(t, int32(1), tipHeight)
+		assert.False(t, h.Contains(hashes[2]))
+
+		_, err := h.Add(mineHeader(t, hashes[0], genesis.Timestamp+2*60))
+		assert.ErrorIs(t, err, ErrInvalidHeader, "Invalid block")
+
+		_, err = fork.Add(mineHeader(t, hashes[1], genesis.Timestamp+3*60))
+		assert.ErrorIs(t, err, ErrInvalidHeader, "The forks share the invalid blocks")
+	})
+}
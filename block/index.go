@@ -1,10 +1,34 @@
 package block
 
-var blockIndex = index{blocks: map[int32]int64{}}
+import "sync"
+
+var blockIndex = newIndex()
 
 type index struct {
-	// map[height]timestamp
-	blocks map[int32]int64
+	mu *sync.RWMutex
+	// map[height]node
+	blocks map[int32]indexNode
+	// hashes contains the hashes of the blocks in the chain, map[height]hash
+	hashes map[int32][]byte
+	// heights is the reverse of hashes, map[hash]height
+	heights map[string]int32
+}
+
+func newIndex() index {
+	return index{
+		mu:      &sync.RWMutex{},
+		blocks:  make(map[int32]indexNode),
+		hashes:  make(map[int32][]byte),
+		heights: make(map[string]int32),
+	}
+}
+
+// indexNode contains the header fields the difficulty adjustment algorithms and the
+// deployments look at.
+type indexNode struct {
+	timestamp int64
+	bits      uint32
+	version   int32
 }
 
 // TODO: in btcs the index contains the total work in the chain so it can figure out
@@ -16,12 +40,84 @@ type index struct {
 // 	height    int32
 // }
 
-// addNode adds a node to the index.
-func (i *index) addNode(height int32, timestamp int64) {
-	i.blocks[height] = timestamp
+// reset removes all the blocks from the index.
+func (i *index) reset() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.blocks = make(map[int32]indexNode)
+	i.hashes = make(map[int32][]byte)
+	i.heights = make(map[string]int32)
+}
+
+// addNode adds the header of the block at height to the index.
+func (i *index) addNode(height int32, header *Header) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.blocks[height] = indexNode{
+		timestamp: header.Timestamp,
+		bits:      header.Bits,
+		version:   header.Version,
+	}
+}
+
+// removeNode removes the block at height from the index.
+func (i *index) removeNode(height int32) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	delete(i.heights, string(i.hashes[height]))
+	delete(i.hashes, height)
+	delete(i.blocks, height)
+}
+
+// node returns the node of the block at a certain height.
+func (i *index) node(height int32) indexNode {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.blocks[height]
 }
 
 // nodeTimestamp returns the timestamp of a block at a certain height.
 func (i *index) nodeTimestamp(height int32) int64 {
-	return i.blocks[height]
+	return i.node(height).timestamp
+}
+
+// setHash records the hash of the block at height in the chain.
+func (i *index) setHash(height int32, hash []byte) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if old, ok := i.hashes[height]; ok {
+		delete(i.heights, string(old))
+	}
+	i.hashes[height] = hash
+	i.heights[string(hash)] = height
+}
+
+// hash returns the hash of the block at height in the chain, nil if there is none.
+func (i *index) hash(height int32) []byte {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.hashes[height]
+}
+
+// height returns the height of the block with the hash provided and whether it's in the chain.
+func (i *index) height(hash []byte) (int32, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	height, ok := i.heights[string(hash)]
+	return height, ok
+}
+
+// bestHeight returns the height of the last block in the chain, -1 if it's empty.
+func (i *index) bestHeight() int32 {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return int32(len(i.hashes)) - 1
 }
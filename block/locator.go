@@ -0,0 +1,96 @@
+package block
+
+import "bytes"
+
+const (
+	// MaxBlocksPerInv is the maximum number of hashes sent in answer to a getblocks message.
+	MaxBlocksPerInv = 500
+	// MaxHeadersPerMsg is the maximum number of headers sent in answer to a getheaders message.
+	MaxHeadersPerMsg = 2000
+)
+
+// BlockLocator returns hashes of the chain from the tip back to the genesis block, the
+// first ten are consecutive and then the step doubles each time. A peer finds the point
+// where our chains diverge from it, even if we are on a long fork, in a few hashes.
+//
+// https://en.bitcoin.it/wiki/Protocol_documentation#getblocks
+func (c *Chain) BlockLocator() [][]byte {
+	return blockIndex.locator(blockIndex.bestHeight())
+}
+
+// LocateBlocks returns the hashes of the blocks following the first locator hash found in the
+// chain, oldest first. It stops at hashStop (included) or after maxHashes.
+//
+// If no locator hash is known, the blocks following the genesis one are returned.
+func (c *Chain) LocateBlocks(locator [][]byte, hashStop []byte, maxHashes int) [][]byte {
+	return blockIndex.locateBlocks(locator, hashStop, maxHashes)
+}
+
+// LocateHeaders is like LocateBlocks but it returns the headers of the blocks.
+func (c *Chain) LocateHeaders(locator [][]byte, hashStop []byte, maxHeaders int) ([]Header, error) {
+	hashes := blockIndex.locateBlocks(locator, hashStop, maxHeaders)
+	headers := make([]Header, 0, len(hashes))
+	for _, hash := range hashes {
+		block, err := c.Block(hash)
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, *block.Header)
+	}
+
+	return headers, nil
+}
+
+// locator returns the locator of the chain with the tip at the height provided.
+func (i *index) locator(tipHeight int32) [][]byte {
+	if tipHeight < 0 {
+		return nil
+	}
+
+	heights := locatorHeights(tipHeight)
+	locator := make([][]byte, 0, len(heights))
+	for _, height := range heights {
+		if hash := i.hash(height); hash != nil {
+			locator = append(locator, hash)
+		}
+	}
+
+	return locator
+}
+
+func (i *index) locateBlocks(locator [][]byte, hashStop []byte, maxHashes int) [][]byte {
+	// Start after the fork point, the genesis block is common to all the chains
+	start := int32(1)
+	for _, hash := range locator {
+		if height, ok := i.height(hash); ok {
+			start = height + 1
+			break
+		}
+	}
+
+	bestHeight := i.bestHeight()
+	hashes := make([][]byte, 0)
+	for height := start; height <= bestHeight && len(hashes) < maxHashes; height++ {
+		hash := i.hash(height)
+		hashes = append(hashes, hash)
+		if bytes.Equal(hash, hashStop) {
+			break
+		}
+	}
+
+	return hashes
+}
+
+// locatorHeights returns the heights of the blocks included in a locator, in descending order.
+func locatorHeights(tipHeight int32) []int32 {
+	heights := make([]int32, 0, 32)
+	step := int32(1)
+	for height := tipHeight; height > 0; height -= step {
+		heights = append(heights, height)
+		if len(heights) >= 10 {
+			step *= 2
+		}
+	}
+
+	return append(heights, 0)
+}
@@ -0,0 +1,80 @@
+package block
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocatorHeights(t *testing.T) {
+	cases := []struct {
+		tipHeight int32
+		expected  []int32
+	}{
+		{tipHeight: 0, expected: []int32{0}},
+		{tipHeight: 5, expected: []int32{5, 4, 3, 2, 1, 0}},
+		{tipHeight: 30, expected: []int32{30, 29, 28, 27, 26, 25, 24, 23, 22, 21, 19, 15, 7, 0}},
+	}
+
+	for _, tc := range cases {
+		assert.Equal(t, tc.expected, locatorHeights(tc.tipHeight))
+	}
+}
+
+func TestLocateBlocks(t *testing.T) {
+	idx := newIndex()
+	for height := int32(0); height <= 20; height++ {
+		idx.setHash(height, []byte{byte(height)})
+	}
+
+	locator := idx.locator(idx.bestHeight())
+	assert.Equal(t, []byte{20}, locator[0])
+	assert.Equal(t, []byte{0}, locator[len(locator)-1])
+
+	cases := []struct {
+		desc      string
+		locator   [][]byte
+		hashStop  []byte
+		maxHashes int
+		expected  [][]byte
+	}{
+		{
+			desc:      "Fork point",
+			locator:   [][]byte{{99}, {98}, {17}, {10}},
+			maxHashes: MaxBlocksPerInv,
+			expected:  [][]byte{{18}, {19}, {20}},
+		},
+		{
+			desc:      "Stop hash",
+			locator:   [][]byte{{10}},
+			hashStop:  []byte{12},
+			maxHashes: MaxBlocksPerInv,
+			expected:  [][]byte{{11}, {12}},
+		},
+		{
+			desc:      "Max hashes",
+			locator:   [][]byte{{10}},
+			maxHashes: 2,
+			expected:  [][]byte{{11}, {12}},
+		},
+		{
+			desc:      "Unknown locator",
+			locator:   [][]byte{{99}},
+			maxHashes: 3,
+			expected:  [][]byte{{1}, {2}, {3}},
+		},
+		{
+			desc:      "Up to date",
+			locator:   [][]byte{{20}},
+			maxHashes: MaxBlocksPerInv,
+			expected:  [][]byte{},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			got := idx.locateBlocks(tc.locator, tc.hashStop, tc.maxHashes)
+			assert.Equal(t, tc.expected, got)
+		})
+	}
+}
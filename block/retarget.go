@@ -0,0 +1,186 @@
+package block
+
+import (
+	"math/big"
+
+	"github.com/GGP1/btcs/chaincfg"
+	"github.com/GGP1/btcs/logger"
+)
+
+const (
+	// lwmaWindow is the number of blocks the LWMA algorithm averages.
+	lwmaWindow = 45
+
+	// asertHalfLife is the time (in seconds) it takes the ASERT target to double (or halve)
+	// when blocks are one half-life ahead of (or behind) schedule.
+	//
+	// In Bitcoin Cash, it's two days.
+	asertHalfLife = 60 * 60
+
+	// asertAnchorHeight is the height of the block the ASERT schedule is calculated from.
+	// The genesis is not used because it was mined long before the rest of the chain.
+	asertAnchorHeight = 1
+)
+
+// headers provides the header fields of the blocks in the chain.
+type headers interface {
+	node(height int32) indexNode
+}
+
+// retargeter is a difficulty adjustment algorithm.
+type retargeter interface {
+	// nextBits returns the compact target of the block following prevBlock.
+	//
+	// It's never called for the block following the genesis, which uses the initial
+	// difficulty of the proof-of-work function.
+	nextBits(prevBlock indexNode, prevHeight int32, chain headers) uint32
+}
+
+var retargeters = map[string]retargeter{
+	chaincfg.RetargetWindow: windowRetarget{},
+	chaincfg.RetargetLWMA:   lwmaRetarget{},
+	chaincfg.RetargetASERT:  asertRetarget{},
+}
+
+// windowRetarget adjusts the difficulty every blocksRetargetPeriod blocks based on the
+// time it took to mine them, as Bitcoin does.
+type windowRetarget struct{}
+
+func (windowRetarget) nextBits(prevBlock indexNode, prevHeight int32, chain headers) uint32 {
+	nextBlockHeight := prevHeight + 1
+	// Return the previous block's difficulty if this block
+	// is not at a difficulty retarget period
+	if nextBlockHeight%blocksRetargetPeriod != 0 {
+		return prevBlock.bits
+	}
+
+	// Get the timestamp of the block at the previous retarget (targetTimespan time worth of blocks)
+	lastRetargetTs := chain.node(nextBlockHeight - blocksRetargetPeriod).timestamp
+	actualTimespan := prevBlock.timestamp - lastRetargetTs
+	logger.Debugf("Difficulty adjustment. Target timespan %d seconds, actual timespan %d seconds",
+		targetTimespan,
+		actualTimespan)
+
+	if actualTimespan < minRetargetTimespan {
+		actualTimespan = minRetargetTimespan
+	} else if actualTimespan > maxRetargetTimespan {
+		actualTimespan = maxRetargetTimespan
+	}
+
+	// nextDifficulty = currentDifficulty * actualTimespan / targetTimespan
+	oldTarget := CompactToBig(prevBlock.bits)
+	newTarget := new(big.Int).Mul(oldTarget, big.NewInt(actualTimespan))
+	newTarget.Div(newTarget, big.NewInt(targetTimespan))
+
+	newTargetBits := BigToCompact(clampTarget(newTarget))
+	logger.Debugf("Old target: %08x", prevBlock.bits)
+	logger.Debugf("New target: %08x", newTargetBits)
+
+	return newTargetBits
+}
+
+// lwmaRetarget adjusts the difficulty every block using a linearly weighted moving average
+// of the last lwmaWindow solve times, recent blocks weigh more so it reacts quickly to
+// hash rate changes.
+//
+// https://github.com/zawy12/difficulty-algorithms/issues/3
+type lwmaRetarget struct{}
+
+func (lwmaRetarget) nextBits(prevBlock indexNode, prevHeight int32, chain headers) uint32 {
+	nextBlockHeight := prevHeight + 1
+	// Not enough blocks to fill the window yet
+	if nextBlockHeight <= lwmaWindow {
+		return prevBlock.bits
+	}
+
+	var (
+		weightedSolveTimes int64
+		sumTargets         = new(big.Int)
+	)
+	prevTimestamp := chain.node(nextBlockHeight - lwmaWindow - 1).timestamp
+	for i := int32(1); i <= lwmaWindow; i++ {
+		node := chain.node(nextBlockHeight - lwmaWindow - 1 + i)
+		if i == lwmaWindow {
+			node = prevBlock
+		}
+
+		// Timestamps out of order count as one second solve times and long ones are limited
+		// so a single block can't move the difficulty too much
+		timestamp := node.timestamp
+		if timestamp <= prevTimestamp {
+			timestamp = prevTimestamp + 1
+		}
+		solveTime := timestamp - prevTimestamp
+		if solveTime > 6*targetTimePerBlock {
+			solveTime = 6 * targetTimePerBlock
+		}
+		prevTimestamp = timestamp
+
+		weightedSolveTimes += solveTime * int64(i)
+		sumTargets.Add(sumTargets, CompactToBig(node.bits))
+	}
+
+	// nextTarget = avgTarget * weightedSolveTimes / k, where k is the weighted sum of
+	// the solve times if all the blocks had been mined on time
+	const k = lwmaWindow * (lwmaWindow + 1) * targetTimePerBlock / 2
+	newTarget := sumTargets.Mul(sumTargets, big.NewInt(weightedSolveTimes))
+	newTarget.Div(newTarget, big.NewInt(k*lwmaWindow))
+
+	return BigToCompact(clampTarget(newTarget))
+}
+
+// asertRetarget adjusts the difficulty every block exponentially, based on how far the
+// chain is ahead of or behind the schedule set by an anchor block. The target doubles
+// every asertHalfLife seconds the chain is behind and halves when it's ahead.
+//
+// It implements the integer approximation used by Bitcoin Cash (aserti3-2d).
+//
+// https://github.com/bitcoincashorg/bitcoincash.org/blob/master/spec/2020-11-15-asert.md
+type asertRetarget struct{}
+
+func (asertRetarget) nextBits(prevBlock indexNode, prevHeight int32, chain headers) uint32 {
+	anchor := chain.node(asertAnchorHeight)
+	if prevHeight == asertAnchorHeight {
+		anchor = prevBlock
+	}
+
+	timeDelta := prevBlock.timestamp - anchor.timestamp
+	heightDelta := int64(prevHeight - asertAnchorHeight)
+
+	// exponent is a 16.16 fixed point number
+	exponent := ((timeDelta - targetTimePerBlock*heightDelta) * 65536) / asertHalfLife
+	shifts := exponent >> 16
+	frac := big.NewInt(exponent & 0xffff)
+
+	// Approximate 2^frac with a cubic polynomial, the result is scaled by 2^16
+	// factor = 65536 + ((195766423245049*frac + 971821376*frac^2 + 5127*frac^3 + 2^47) >> 48)
+	frac2 := new(big.Int).Mul(frac, frac)
+	frac3 := new(big.Int).Mul(frac2, frac)
+	factor := new(big.Int).Mul(big.NewInt(195766423245049), frac)
+	factor.Add(factor, new(big.Int).Mul(big.NewInt(971821376), frac2))
+	factor.Add(factor, new(big.Int).Mul(big.NewInt(5127), frac3))
+	factor.Add(factor, new(big.Int).Lsh(big.NewInt(1), 47))
+	factor.Rsh(factor, 48)
+	factor.Add(factor, big.NewInt(65536))
+
+	newTarget := new(big.Int).Mul(CompactToBig(anchor.bits), factor)
+	if shifts < 0 {
+		newTarget.Rsh(newTarget, uint(-shifts))
+	} else {
+		newTarget.Lsh(newTarget, uint(shifts))
+	}
+	newTarget.Rsh(newTarget, 16)
+
+	return BigToCompact(clampTarget(newTarget))
+}
+
+// clampTarget limits the target to the range [1, MaxTarget].
+func clampTarget(target *big.Int) *big.Int {
+	if target.Sign() <= 0 {
+		return target.SetInt64(1)
+	}
+	if target.Cmp(MaxTarget) > 0 {
+		return target.Set(MaxTarget)
+	}
+	return target
+}
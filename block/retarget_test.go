@@ -0,0 +1,157 @@
+package block
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/GGP1/btcs/chaincfg"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testHeaders is a chain of headers indexed by height.
+type testHeaders []indexNode
+
+func (h testHeaders) node(height int32) indexNode {
+	return h[height]
+}
+
+// simulate mines numBlocks blocks with the retargeter provided, the solve time of each
+// block is proportional to its difficulty and inversely proportional to the hash rate,
+// relative to the one the initial target was set for.
+func simulate(r retargeter, numBlocks int, hashRate func(height int32) float64) testHeaders {
+	initialTarget := new(big.Float).SetInt(CompactToBig(baseDifficulty))
+	chain := testHeaders{{timestamp: 1_000_000, bits: baseDifficulty}}
+
+	for height := int32(1); height <= int32(numBlocks); height++ {
+		prev := chain[height-1]
+		bits := baseDifficulty
+		if height > 1 {
+			bits = r.nextBits(prev, height-1, chain)
+		}
+
+		target := new(big.Float).SetInt(CompactToBig(bits))
+		difficulty, _ := new(big.Float).Quo(initialTarget, target).Float64()
+		solveTime := int64(targetTimePerBlock*difficulty/hashRate(height) + 0.5)
+		chain = append(chain, indexNode{timestamp: prev.timestamp + solveTime, bits: bits})
+	}
+
+	return chain
+}
+
+// avgSolveTime returns the average solve time of the last n blocks.
+func avgSolveTime(chain testHeaders, n int) float64 {
+	last := len(chain) - 1
+	return float64(chain[last].timestamp-chain[last-n].timestamp) / float64(n)
+}
+
+func TestRetargeters(t *testing.T) {
+	const numBlocks = 2000
+
+	cases := []struct {
+		desc     string
+		hashRate func(height int32) float64
+	}{
+		{
+			desc:     "Constant",
+			hashRate: func(height int32) float64 { return 1 },
+		},
+		{
+			desc:     "Increase",
+			hashRate: func(height int32) float64 { return 8 },
+		},
+		{
+			desc:     "Decrease",
+			hashRate: func(height int32) float64 { return 0.25 },
+		},
+		{
+			desc: "Oscillation",
+			hashRate: func(height int32) float64 {
+				if (height/100)%2 == 0 {
+					return 3
+				}
+				return 1
+			},
+		},
+	}
+
+	for name, r := range retargeters {
+		t.Run(name, func(t *testing.T) {
+			for _, tc := range cases {
+				t.Run(tc.desc, func(t *testing.T) {
+					chain := simulate(r, numBlocks, tc.hashRate)
+
+					for _, node := range chain {
+						target := CompactToBig(node.bits)
+						assert.Positive(t, target.Sign())
+						assert.True(t, target.Cmp(MaxTarget) <= 0)
+					}
+
+					// Over the long run, blocks are mined on schedule
+					assert.InDelta(t, targetTimePerBlock, avgSolveTime(chain, 400), 0.25*targetTimePerBlock)
+				})
+			}
+		})
+	}
+}
+
+func TestRetargetersResponse(t *testing.T) {
+	// After the hash rate doubles the difficulty goes up, and down after it halves
+	for name, r := range retargeters {
+		t.Run(name, func(t *testing.T) {
+			up := simulate(r, 200, func(height int32) float64 { return 2 })
+			assert.Equal(t, -1, CompactToBig(up[200].bits).Cmp(CompactToBig(baseDifficulty)))
+
+			down := simulate(r, 200, func(height int32) float64 { return 0.5 })
+			assert.Equal(t, 1, CompactToBig(down[200].bits).Cmp(CompactToBig(baseDifficulty)))
+		})
+	}
+}
+
+func TestRetargetersSelection(t *testing.T) {
+	for _, name := range chaincfg.RetargetAlgorithms {
+		_, ok := retargeters[name]
+		assert.True(t, ok, name)
+	}
+}
+
+func TestLWMAWindow(t *testing.T) {
+	// Blocks keep the previous difficulty until the window is full
+	chain := simulate(lwmaRetarget{}, lwmaWindow, func(height int32) float64 { return 4 })
+	for _, node := range chain {
+		assert.Equal(t, baseDifficulty, node.bits)
+	}
+}
+
+func TestASERTSchedule(t *testing.T) {
+	anchor := indexNode{timestamp: 1_000_000, bits: baseDifficulty}
+	chain := testHeaders{{}, anchor}
+	anchorTarget := CompactToBig(baseDifficulty)
+
+	cases := []struct {
+		desc string
+		// Time elapsed since the anchor
+		elapsed int64
+		height  int32
+		// Expected target relative to the anchor target
+		factor float64
+	}{
+		{desc: "On schedule", elapsed: 10 * targetTimePerBlock, height: 11, factor: 1},
+		{desc: "One half-life behind", elapsed: 10*targetTimePerBlock + asertHalfLife, height: 11, factor: 2},
+		{desc: "One half-life ahead", elapsed: 10*targetTimePerBlock - asertHalfLife, height: 11, factor: 0.5},
+		{desc: "Two half-lives behind", elapsed: targetTimePerBlock + 2*asertHalfLife, height: 2, factor: 4},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			prev := indexNode{timestamp: anchor.timestamp + tc.elapsed, bits: baseDifficulty}
+			bits := asertRetarget{}.nextBits(prev, tc.height, chain)
+
+			got, _ := new(big.Float).Quo(
+				new(big.Float).SetInt(CompactToBig(bits)),
+				new(big.Float).SetInt(anchorTarget),
+			).Float64()
+			assert.InDelta(t, tc.factor, got, 0.001*tc.factor)
+		})
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2013-2014 The btcsuite developers
+
+package block
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/GGP1/btcs/logger"
+)
+
+// ErrTimeTooNew is returned when a block timestamp is too far ahead of the network-adjusted
+// time. The block may be accepted later, it doesn't mean it's invalid.
+var ErrTimeTooNew = errors.New("block timestamp is too far in the future")
+
+const (
+	// maxAllowedOffset is the maximum number of seconds in either direction that local
+	// clock will be adjusted. When the median time of the network is outside of this range,
+	// no offset will be applied.
+	maxAllowedOffset = 70 * 60
+
+	// similarTimeSecs is the number of seconds in either direction from the local clock
+	// that is used to determine that it is likely wrong and hence to show a warning.
+	similarTimeSecs = 5 * 60
+
+	// maxMedianTimeEntries is the maximum number of entries allowed in the median time data.
+	maxMedianTimeEntries = 200
+
+	// minMedianTimeEntries is the minimum number of samples needed to adjust the local clock.
+	minMedianTimeEntries = 5
+
+	// medianTimeBlocks is the number of previous blocks which should be used to calculate
+	// the median time used to validate block timestamps.
+	medianTimeBlocks = 11
+
+	// maxTimeOffset is the maximum number of seconds a block time is allowed to be ahead
+	// of the network-adjusted time.
+	maxTimeOffset = 2 * 60 * 60
+)
+
+// TimeSource is the network-adjusted clock used to stamp and validate blocks.
+var TimeSource = NewMedianTimeSource()
+
+// MedianTimeSource provides a clock adjusted by the median of the time offsets reported by
+// the peers, it keeps the node in line with the network if its local clock is wrong.
+type MedianTimeSource struct {
+	mu *sync.Mutex
+	// knownSources prevents a peer from adding multiple samples
+	knownSources map[string]struct{}
+	// offsets are sorted by insertion time so the oldest can be evicted
+	offsets            []int64
+	offsetSecs         int64
+	invalidTimeChecked bool
+}
+
+// NewMedianTimeSource returns a time source without samples, its adjusted time matches
+// the local clock.
+func NewMedianTimeSource() *MedianTimeSource {
+	return &MedianTimeSource{
+		mu:           &sync.Mutex{},
+		knownSources: make(map[string]struct{}),
+		offsets:      make([]int64, 0, maxMedianTimeEntries),
+	}
+}
+
+// AdjustedTime returns the local time adjusted by the median offset.
+func (m *MedianTimeSource) AdjustedTime() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Limit the adjusted time to 1 second precision
+	now := time.Unix(time.Now().Unix(), 0)
+	return now.Add(time.Duration(m.offsetSecs) * time.Second)
+}
+
+// Offset returns the number of seconds the local clock is adjusted by.
+func (m *MedianTimeSource) Offset() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return time.Duration(m.offsetSecs) * time.Second
+}
+
+// AddTimeSample adds the time reported by a peer, identified by sourceID, to the samples
+// used to calculate the offset. Only the first sample of each source is considered.
+func (m *MedianTimeSource) AddTimeSample(sourceID string, timeVal time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.knownSources[sourceID]; exists {
+		return
+	}
+	m.knownSources[sourceID] = struct{}{}
+
+	// Truncate the local time to 1 second precision since the samples have it
+	now := time.Unix(time.Now().Unix(), 0)
+	offsetSecs := int64(timeVal.Sub(now).Seconds())
+	if len(m.offsets) == maxMedianTimeEntries {
+		m.offsets = m.offsets[1:]
+	}
+	m.offsets = append(m.offsets, offsetSecs)
+	logger.Debugf("Added time sample of %ds from %s", offsetSecs, sourceID)
+
+	// Bitcoin Core only updates the offset with an odd number of samples so the median
+	// is one of them
+	numOffsets := len(m.offsets)
+	if numOffsets < minMedianTimeEntries || numOffsets%2 == 0 {
+		return
+	}
+
+	sortedOffsets := make([]int64, numOffsets)
+	copy(sortedOffsets, m.offsets)
+	sort.Slice(sortedOffsets, func(i, j int) bool { return sortedOffsets[i] < sortedOffsets[j] })
+	median := sortedOffsets[numOffsets/2]
+
+	// The network is too far from the local clock to trust either of them, don't adjust it
+	if median < -maxAllowedOffset || median > maxAllowedOffset {
+		m.offsetSecs = 0
+		if !m.invalidTimeChecked {
+			m.invalidTimeChecked = true
+
+			// Warn if none of the peers has a time close to ours
+			for _, offset := range sortedOffsets {
+				if offset > -similarTimeSecs && offset < similarTimeSecs {
+					return
+				}
+			}
+			logger.Info("Please check your date and time are correct! btcs will not work properly with an invalid time")
+		}
+		return
+	}
+
+	m.offsetSecs = median
+	logger.Debugf("New time offset: %ds", median)
+}
+
+// MedianTimePast returns the median timestamp of the last medianTimeBlocks blocks, up to
+// and including the one at height.
+func MedianTimePast(height int32) int64 {
+	return medianTimePast(height, &blockIndex)
+}
+
+func medianTimePast(height int32, chain headers) int64 {
+	timestamps := make([]int64, 0, medianTimeBlocks)
+	for h := height; h >= 0 && h > height-medianTimeBlocks; h-- {
+		timestamps = append(timestamps, chain.node(h).timestamp)
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2]
+}
+
+// NextTimestamp returns the timestamp the block following prevBlock should have, the
+// network-adjusted time unless it isn't greater than the median time past.
+func NextTimestamp(prevBlock Block) int64 {
+	minTimestamp := MedianTimePast(prevBlock.Height) + 1
+	now := TimeSource.AdjustedTime().Unix()
+	if now < minTimestamp {
+		return minTimestamp
+	}
+	return now
+}
+
+// CheckTimestamp returns an error if the block timestamp is not greater than the median
+// time past of its ancestors or too far in the future according to the network-adjusted time.
+func CheckTimestamp(b Block) error {
+	return checkTimestamp(b, &blockIndex)
+}
+
+func checkTimestamp(b Block, chain headers) error {
+	if b.Header == nil {
+		return errors.New("block has no header")
+	}
+
+	if b.Height > 0 {
+		if mtp := medianTimePast(b.Height-1, chain); b.Timestamp <= mtp {
+			return fmt.Errorf("block timestamp %d is not after the median time past %d", b.Timestamp, mtp)
+		}
+	}
+
+	maxTimestamp := TimeSource.AdjustedTime().Unix() + maxTimeOffset
+	if b.Timestamp > maxTimestamp {
+		return fmt.Errorf("%w: %d, the maximum is %d", ErrTimeTooNew, b.Timestamp, maxTimestamp)
+	}
+
+	return nil
+}
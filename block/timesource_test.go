@@ -0,0 +1,75 @@
+package block
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMedianTimeSource(t *testing.T) {
+	cases := []struct {
+		desc     string
+		offsets  []int64
+		expected int64
+	}{
+		{desc: "Not enough samples", offsets: []int64{-10, 20, 30, 40}, expected: 0},
+		{desc: "Odd samples", offsets: []int64{-10, 20, 30, 40, 50}, expected: 30},
+		{desc: "Even samples", offsets: []int64{-10, 20, 30, 40, 50, 60}, expected: 30},
+		{desc: "Negative", offsets: []int64{-60, -50, -40, 10, 20}, expected: -40},
+		{desc: "Out of range", offsets: []int64{5000, 5000, 5000, 5000, 5000}, expected: 0},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			m := NewMedianTimeSource()
+			for i, offset := range tc.offsets {
+				m.AddTimeSample(strconv.Itoa(i), time.Now().Add(time.Duration(offset)*time.Second))
+			}
+
+			// Allow one second of difference in case the clock ticked while adding the samples
+			assert.InDelta(t, tc.expected, int64(m.Offset().Seconds()), 1)
+			expectedTime := time.Now().Unix() + tc.expected
+			assert.InDelta(t, expectedTime, m.AdjustedTime().Unix(), 1)
+		})
+	}
+}
+
+func TestMedianTimeSourceDuplicates(t *testing.T) {
+	m := NewMedianTimeSource()
+	for i := 0; i < 10; i++ {
+		m.AddTimeSample("peer", time.Now().Add(time.Hour))
+	}
+
+	assert.Zero(t, m.Offset())
+}
+
+func TestMedianTimePast(t *testing.T) {
+	const start = 1000
+	timestamps := []int64{10, 30, 20, 50, 40, 60, 90, 70, 80, 110, 100, 120}
+	for i, ts := range timestamps {
+		blockIndex.addNode(start+int32(i), &Header{Timestamp: ts, Bits: baseDifficulty})
+	}
+	defer func() {
+		for i := range timestamps {
+			delete(blockIndex.blocks, start+int32(i))
+		}
+	}()
+
+	// Only the last 11 blocks are considered
+	assert.Equal(t, int64(70), MedianTimePast(start+11))
+	assert.Equal(t, int64(60), MedianTimePast(start+10))
+
+	prevBlock := Block{Header: &Header{}, Height: start + 11}
+	assert.Greater(t, NextTimestamp(prevBlock), int64(70))
+
+	b := Block{Header: &Header{Timestamp: 70}, Height: start + 12}
+	assert.Error(t, CheckTimestamp(b), "Timestamp equal to the median time past")
+
+	b.Timestamp = 71
+	assert.NoError(t, CheckTimestamp(b))
+
+	b.Timestamp = time.Now().Add(2*time.Hour + time.Minute).Unix()
+	assert.ErrorIs(t, CheckTimestamp(b), ErrTimeTooNew, "Timestamp too far in the future")
+}
@@ -0,0 +1,202 @@
+package block
+
+import (
+	"fmt"
+
+	"github.com/GGP1/btcs/chaincfg"
+)
+
+const (
+	// VersionBitsTopBits are the bits set in the version of blocks signalling deployments.
+	VersionBitsTopBits = 0x20000000
+
+	// versionBitsTopMask is the bitmask used to determine if a block version uses version bits.
+	versionBitsTopMask = 0xe0000000
+
+	// baseVersion is the version of the blocks when there are no deployments to signal.
+	baseVersion = 1
+)
+
+// ThresholdState is the state of a deployment, all the blocks of a confirmation window
+// share the same state.
+type ThresholdState uint8
+
+// Deployment states, the transitions are:
+//
+//	DEFINED -> STARTED -> LOCKED_IN -> ACTIVE
+//	DEFINED -> FAILED
+//	STARTED -> FAILED
+const (
+	// ThresholdDefined is the first state, until the median time past reaches the start time.
+	ThresholdDefined ThresholdState = iota
+	// ThresholdStarted means miners signal support and the votes are counted.
+	ThresholdStarted
+	// ThresholdLockedIn means the threshold was reached, the rules will be enforced in
+	// the next window.
+	ThresholdLockedIn
+	// ThresholdActive means the rules are enforced, it's final.
+	ThresholdActive
+	// ThresholdFailed means the deployment expired before locking in, it's final.
+	ThresholdFailed
+)
+
+// String returns the name of the state.
+func (s ThresholdState) String() string {
+	switch s {
+	case ThresholdDefined:
+		return "DEFINED"
+	case ThresholdStarted:
+		return "STARTED"
+	case ThresholdLockedIn:
+		return "LOCKED_IN"
+	case ThresholdActive:
+		return "ACTIVE"
+	case ThresholdFailed:
+		return "FAILED"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", uint8(s))
+	}
+}
+
+// DeploymentStatus contains the state of a deployment at a block.
+type DeploymentStatus struct {
+	chaincfg.ConsensusDeployment
+	State ThresholdState
+	// Since is the height of the first block with the current state
+	Since int32
+	// Window is the number of blocks in a confirmation window
+	Window uint32
+	// Elapsed is the number of blocks of the current window, only set when STARTED
+	Elapsed uint32
+	// Signalling is the number of blocks of the current window signalling support,
+	// only set when STARTED
+	Signalling uint32
+}
+
+// DeploymentState returns the state of a deployment for the block following the one at
+// prevHeight.
+func DeploymentState(prevHeight int32, deployment chaincfg.ConsensusDeployment) ThresholdState {
+	return deploymentStatus(prevHeight, deployment, &blockIndex).State
+}
+
+// DeploymentStatuses returns the status of all the active network deployments for the
+// block following the one at prevHeight.
+func DeploymentStatuses(prevHeight int32) []DeploymentStatus {
+	deployments := chaincfg.ActiveParams.Deployments
+	statuses := make([]DeploymentStatus, 0, len(deployments))
+	for _, deployment := range deployments {
+		statuses = append(statuses, deploymentStatus(prevHeight, deployment, &blockIndex))
+	}
+	return statuses
+}
+
+// IsDeploymentActive returns whether the rules of the deployment with the name provided
+// must be enforced in the block following the one at prevHeight.
+func IsDeploymentActive(prevHeight int32, name string) bool {
+	for _, deployment := range chaincfg.ActiveParams.Deployments {
+		if deployment.Name == name {
+			return DeploymentState(prevHeight, deployment) == ThresholdActive
+		}
+	}
+	return false
+}
+
+// ComputeBlockVersion returns the version the block following the one at prevHeight should
+// have, signalling support for the deployments that are started or locked in.
+func ComputeBlockVersion(prevHeight int32) int32 {
+	version := int32(VersionBitsTopBits)
+	signalling := false
+	for _, deployment := range chaincfg.ActiveParams.Deployments {
+		switch DeploymentState(prevHeight, deployment) {
+		case ThresholdStarted, ThresholdLockedIn:
+			version |= 1 << deployment.BitNumber
+			signalling = true
+		}
+	}
+
+	if !signalling {
+		return baseVersion
+	}
+	return version
+}
+
+// deploymentStatus walks the chain window by window, from the first one, and returns the
+// status of the deployment for the block following the one at prevHeight.
+func deploymentStatus(prevHeight int32, deployment chaincfg.ConsensusDeployment, chain headers) DeploymentStatus {
+	window := int32(chaincfg.ActiveParams.MinerConfirmationWindow)
+	status := DeploymentStatus{
+		ConsensusDeployment: deployment,
+		State:               ThresholdDefined,
+		Window:              uint32(window),
+	}
+	if window <= 0 {
+		return status
+	}
+
+	// The state changes only at the start of each window, its value depends on the
+	// median time past and the signalling blocks of the previous window.
+	// The first window is always DEFINED
+	nextHeight := prevHeight + 1
+	for windowStart := window; windowStart <= nextHeight; windowStart += window {
+		windowEnd := windowStart - 1
+		state := nextState(status.State, windowEnd, deployment, chain)
+		if state != status.State {
+			status.State = state
+			status.Since = windowStart
+		}
+	}
+
+	if status.State == ThresholdStarted {
+		currentWindowStart := nextHeight - nextHeight%window
+		for h := currentWindowStart; h <= prevHeight; h++ {
+			status.Elapsed++
+			if isSignalling(chain.node(h).version, deployment) {
+				status.Signalling++
+			}
+		}
+	}
+
+	return status
+}
+
+// nextState returns the state of the window following the one ending at windowEnd.
+func nextState(state ThresholdState, windowEnd int32, deployment chaincfg.ConsensusDeployment, chain headers) ThresholdState {
+	switch state {
+	case ThresholdDefined:
+		mtp := medianTimePast(windowEnd, chain)
+		if mtp >= deployment.ExpireTime {
+			return ThresholdFailed
+		}
+		if mtp >= deployment.StartTime {
+			return ThresholdStarted
+		}
+
+	case ThresholdStarted:
+		if medianTimePast(windowEnd, chain) >= deployment.ExpireTime {
+			return ThresholdFailed
+		}
+
+		window := int32(chaincfg.ActiveParams.MinerConfirmationWindow)
+		count := uint32(0)
+		for h := windowEnd - window + 1; h <= windowEnd; h++ {
+			if isSignalling(chain.node(h).version, deployment) {
+				count++
+			}
+		}
+		if count >= deployment.Threshold {
+			return ThresholdLockedIn
+		}
+
+	case ThresholdLockedIn:
+		return ThresholdActive
+	}
+
+	// ACTIVE and FAILED are final
+	return state
+}
+
+// isSignalling returns whether a block version signals support for the deployment.
+func isSignalling(version int32, deployment chaincfg.ConsensusDeployment) bool {
+	return uint32(version)&versionBitsTopMask == VersionBitsTopBits &&
+		uint32(version)&(1<<deployment.BitNumber) != 0
+}
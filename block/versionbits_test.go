@@ -0,0 +1,136 @@
+package block
+
+import (
+	"testing"
+
+	"github.com/GGP1/btcs/chaincfg"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeploymentStatus(t *testing.T) {
+	params := chaincfg.MainNetParams
+	params.MinerConfirmationWindow = 16
+	chaincfg.ActiveParams = &params
+	defer func() { chaincfg.ActiveParams = &chaincfg.MainNetParams }()
+
+	const genesisTime = 1_000_000
+	deployment := chaincfg.ConsensusDeployment{
+		Name:      "test",
+		BitNumber: 5,
+		// The median time past reaches the start time at block 15
+		StartTime:  genesisTime + 10*targetTimePerBlock,
+		ExpireTime: genesisTime + 100*targetTimePerBlock,
+		Threshold:  12,
+	}
+	signal := int32(VersionBitsTopBits | 1<<deployment.BitNumber)
+
+	// newChain returns a chain of numBlocks blocks mined every targetTimePerBlock seconds
+	newChain := func(numBlocks int, version func(height int32) int32) testHeaders {
+		chain := make(testHeaders, numBlocks)
+		for i := range chain {
+			chain[i] = indexNode{
+				timestamp: genesisTime + int64(i)*targetTimePerBlock,
+				bits:      baseDifficulty,
+				version:   version(int32(i)),
+			}
+		}
+		return chain
+	}
+
+	type expected struct {
+		prevHeight int32
+		state      ThresholdState
+		since      int32
+	}
+	cases := []struct {
+		desc     string
+		version  func(height int32) int32
+		expected []expected
+	}{
+		{
+			desc:    "Activation",
+			version: func(height int32) int32 { return signal },
+			expected: []expected{
+				{prevHeight: 0, state: ThresholdDefined, since: 0},
+				{prevHeight: 14, state: ThresholdDefined, since: 0},
+				{prevHeight: 15, state: ThresholdStarted, since: 16},
+				{prevHeight: 31, state: ThresholdLockedIn, since: 32},
+				{prevHeight: 47, state: ThresholdActive, since: 48},
+				{prevHeight: 199, state: ThresholdActive, since: 48},
+			},
+		},
+		{
+			desc: "Threshold",
+			version: func(height int32) int32 {
+				// Only 11 blocks of the second window signal, 12 of the third one
+				if (height >= 16 && height < 27) || (height >= 32 && height < 44) {
+					return signal
+				}
+				return baseVersion
+			},
+			expected: []expected{
+				{prevHeight: 31, state: ThresholdStarted, since: 16},
+				{prevHeight: 47, state: ThresholdLockedIn, since: 48},
+				{prevHeight: 63, state: ThresholdActive, since: 64},
+			},
+		},
+		{
+			desc: "Other bits",
+			version: func(height int32) int32 {
+				return VersionBitsTopBits | 1<<(deployment.BitNumber+1)
+			},
+			expected: []expected{
+				{prevHeight: 31, state: ThresholdStarted, since: 16},
+			},
+		},
+		{
+			desc:    "Timeout",
+			version: func(height int32) int32 { return baseVersion },
+			expected: []expected{
+				{prevHeight: 95, state: ThresholdStarted, since: 16},
+				// The median time past of block 111 is past the expire time
+				{prevHeight: 111, state: ThresholdFailed, since: 112},
+				{prevHeight: 199, state: ThresholdFailed, since: 112},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			chain := newChain(200, tc.version)
+			for _, e := range tc.expected {
+				status := deploymentStatus(e.prevHeight, deployment, chain)
+				assert.Equal(t, e.state, status.State, "Height %d: expected %s, got %s", e.prevHeight+1, e.state, status.State)
+				assert.Equal(t, e.since, status.Since, "Height %d", e.prevHeight+1)
+			}
+		})
+	}
+}
+
+func TestDeploymentStatusSignalling(t *testing.T) {
+	deployment := chaincfg.ConsensusDeployment{BitNumber: 1, StartTime: 0, ExpireTime: 1 << 62, Threshold: 16}
+	chain := make(testHeaders, 40)
+	for i := 32; i < len(chain); i += 2 {
+		chain[i].version = VersionBitsTopBits | 1<<deployment.BitNumber
+	}
+
+	status := deploymentStatus(int32(len(chain)-1), deployment, chain)
+	assert.Equal(t, ThresholdStarted, status.State)
+	assert.Equal(t, uint32(8), status.Elapsed)
+	assert.Equal(t, uint32(4), status.Signalling)
+}
+
+func TestIsSignalling(t *testing.T) {
+	deployment := chaincfg.ConsensusDeployment{BitNumber: 28}
+
+	assert.True(t, isSignalling(VersionBitsTopBits|1<<28, deployment))
+	assert.False(t, isSignalling(VersionBitsTopBits, deployment))
+	assert.False(t, isSignalling(1<<28, deployment), "Missing top bits")
+	assert.False(t, isSignalling(baseVersion, deployment))
+}
+
+func TestThresholdStateString(t *testing.T) {
+	assert.Equal(t, "LOCKED_IN", ThresholdLockedIn.String())
+	assert.Equal(t, "UNKNOWN(9)", ThresholdState(9).String())
+}
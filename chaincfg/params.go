@@ -0,0 +1,145 @@
+// Package chaincfg defines the parameters of the networks a node can run on.
+package chaincfg
+
+import (
+	"encoding/hex"
+	"math"
+
+	"github.com/GGP1/btcs/pow"
+)
+
+// Difficulty adjustment algorithms, they are implemented in the block package.
+const (
+	// RetargetWindow adjusts the difficulty every retarget period based on the time it
+	// took to mine it, as Bitcoin does
+	RetargetWindow = "window"
+	// RetargetLWMA adjusts the difficulty every block using a linearly weighted moving
+	// average of the recent solve times
+	RetargetLWMA = "lwma"
+	// RetargetASERT adjusts the difficulty every block exponentially based on how far
+	// the chain is from the schedule, as Bitcoin Cash does
+	RetargetASERT = "asert"
+)
+
+// RetargetAlgorithms contains the names of the difficulty adjustment algorithms.
+var RetargetAlgorithms = []string{RetargetASERT, RetargetLWMA, RetargetWindow}
+
+// DeploymentTestDummy is a deployment without rules used to rehearse soft forks.
+const DeploymentTestDummy = "testdummy"
+
+// ConsensusDeployment defines a rule change deployed using version bits (BIP9).
+//
+// https://github.com/bitcoin/bips/blob/master/bip-0009.mediawiki
+type ConsensusDeployment struct {
+	// Name identifies the deployment
+	Name string
+	// BitNumber is the bit of the block version miners set to signal support
+	BitNumber uint8
+	// StartTime is the median time past (Unix) at which signalling starts
+	StartTime int64
+	// ExpireTime is the median time past (Unix) at which the deployment fails if it
+	// didn't lock in
+	ExpireTime int64
+	// Threshold is the number of blocks of a confirmation window that must signal
+	// for the deployment to lock in
+	Threshold uint32
+}
+
+// Checkpoint identifies a known good block, forks below it are rejected.
+type Checkpoint struct {
+	Height int32
+	Hash   []byte
+}
+
+// Params defines a network by its parameters.
+type Params struct {
+	// Name identifies the network
+	Name string
+	// Magic is the value that starts every peer-to-peer message of the network, it
+	// prevents nodes of different networks from talking to each other
+	Magic uint32
+	// PowLimitBits is the compact representation of the highest target a block can have
+	PowLimitBits uint32
+	// NoRetargeting disables the difficulty adjustments, all the blocks use PowLimitBits
+	NoRetargeting bool
+	// MineBlocksOnDemand allows generating blocks instantly with the generate RPCs
+	MineBlocksOnDemand bool
+	// PowHasher is the function used to calculate the proof-of-work hashes
+	PowHasher pow.Hasher
+	// RetargetAlgorithm is the name of the difficulty adjustment algorithm
+	RetargetAlgorithm string
+	// MinerConfirmationWindow is the number of blocks deployments are evaluated over
+	MinerConfirmationWindow uint32
+	// Deployments are the rule changes signalled with version bits
+	Deployments []ConsensusDeployment
+	// Checkpoints are sorted by height
+	Checkpoints []Checkpoint
+	// AssumeValid is the hash of a block whose ancestors (and itself) are assumed to
+	// have valid signatures, they are not verified. If it's empty, all signatures are
+	// verified
+	AssumeValid []byte
+}
+
+// genesisCheckpoint makes sure all the networks share the same genesis block.
+var genesisCheckpoint = Checkpoint{
+	Height: 0,
+	Hash:   hexToBytes("000002c63d7f6337959d4713143c400cc798114bbb68718278a6ef42f196185d"),
+}
+
+// MainNetParams are the parameters of the main network.
+var MainNetParams = Params{
+	Name:              "mainnet",
+	Magic:             0xd9b4bef9,
+	PowLimitBits:      0x207fffff,
+	NoRetargeting:     false,
+	PowHasher:         pow.SHA256,
+	RetargetAlgorithm: RetargetWindow,
+	// The same as the retarget period
+	MinerConfirmationWindow: 16,
+	Deployments: []ConsensusDeployment{
+		{
+			Name:       DeploymentTestDummy,
+			BitNumber:  28,
+			StartTime:  1672531200, // January 1, 2023
+			ExpireTime: 1704067200, // January 1, 2024
+			Threshold:  15,         // 95%
+		},
+	},
+	Checkpoints: []Checkpoint{genesisCheckpoint},
+}
+
+// RegressionNetParams are the parameters of the regression test network.
+//
+// Blocks are mined at the minimum difficulty so they can be generated on demand.
+var RegressionNetParams = Params{
+	Name:                    "regtest",
+	Magic:                   0xdab5bffa,
+	PowLimitBits:            0x207fffff,
+	NoRetargeting:           true,
+	MineBlocksOnDemand:      true,
+	PowHasher:               pow.SHA256,
+	RetargetAlgorithm:       RetargetWindow,
+	MinerConfirmationWindow: 16,
+	Deployments: []ConsensusDeployment{
+		{
+			Name:       DeploymentTestDummy,
+			BitNumber:  28,
+			StartTime:  0,
+			ExpireTime: math.MaxInt64,
+			Threshold:  12, // 75%
+		},
+	},
+	Checkpoints: []Checkpoint{genesisCheckpoint},
+}
+
+// ActiveParams are the parameters of the network the node is running on.
+var ActiveParams = &MainNetParams
+
+// hexToBytes decodes a hard-coded hexadecimal string, it panics if it's invalid.
+func hexToBytes(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
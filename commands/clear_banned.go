@@ -0,0 +1,34 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/GGP1/btcs/node/rpc"
+
+	"github.com/spf13/cobra"
+)
+
+func newClearBanned() *cobra.Command {
+	return &cobra.Command{
+		Use:   "clearbanned",
+		Short: "Remove all the banned IP addresses",
+		RunE:  runClearBanned(),
+	}
+}
+
+func runClearBanned() RunEFunc {
+	return func(cmd *cobra.Command, args []string) error {
+		client, err := rpc.NewClient()
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		if err := client.ClearBanned(); err != nil {
+			return err
+		}
+
+		fmt.Println("Ban list cleared")
+		return nil
+	}
+}
@@ -0,0 +1,57 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/GGP1/btcs/mempool"
+	"github.com/GGP1/btcs/node"
+	"github.com/GGP1/btcs/node/rpc"
+
+	"github.com/spf13/cobra"
+)
+
+var confidence float64
+
+func newEstimateSmartFee() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "estimatesmartfee <conf_target>",
+		Short: "Estimate the fee rate needed for a transaction to confirm within a number of blocks",
+		Long: `Estimate the fee rate needed for a transaction to confirm within a number of blocks.
+The estimation is based on the time it took to confirm the transactions the node has seen.`,
+		Example: "estimatesmartfee 6 --confidence 0.95",
+		Args:    cobra.ExactArgs(1),
+		RunE:    runEstimateSmartFee(),
+	}
+
+	cmd.Flags().Float64VarP(&confidence, "confidence", "c", mempool.DefaultConfidence, "probability of confirming within the target, between 0 and 1")
+
+	return cmd
+}
+
+func runEstimateSmartFee() RunEFunc {
+	return func(cmd *cobra.Command, args []string) error {
+		confTarget, err := strconv.Atoi(args[0])
+		if err != nil {
+			return errors.New("invalid confirmation target")
+		}
+
+		client, err := rpc.NewClient()
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		resp, err := client.EstimateSmartFee(node.EstimateFeeParams{
+			ConfTarget: confTarget,
+			Confidence: confidence,
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Fee rate: %.2f SAT/byte\nBlocks: %d\n", resp.FeeRate, resp.Blocks)
+		return nil
+	}
+}
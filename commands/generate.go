@@ -0,0 +1,74 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/GGP1/btcs/node/rpc"
+
+	"github.com/spf13/cobra"
+)
+
+func newGenerate() *cobra.Command {
+	return &cobra.Command{
+		Use:   "generate <n>",
+		Short: "Mine blocks immediately, paying the rewards to the node's account",
+		Long: `Mine blocks immediately, paying the rewards to the node's account.
+Only available on the regression test network (startnode --regtest), where blocks are mined at the
+minimum difficulty and it takes almost no time.`,
+		Example: "generate 101",
+		RunE:    runGenerate(),
+	}
+}
+
+func runGenerate() RunEFunc {
+	return func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("number of blocks not specified. Use 'generate <n>'")
+		}
+
+		return generateToAddress(args[0], "")
+	}
+}
+
+func newGenerateToAddress() *cobra.Command {
+	return &cobra.Command{
+		Use:   "generatetoaddress <n> <address>",
+		Short: "Mine blocks immediately, paying the rewards to an address",
+		Long: `Mine blocks immediately, paying the rewards to an address.
+Only available on the regression test network (startnode --regtest).`,
+		Example: "generatetoaddress 101 1MVBUT4h8q7c5xAuKiEwqCY6xexN6cWUTV",
+		RunE:    runGenerateToAddress(),
+	}
+}
+
+func runGenerateToAddress() RunEFunc {
+	return func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return errors.New("invalid arguments. Use 'generatetoaddress <n> <address>'")
+		}
+
+		return generateToAddress(args[0], args[1])
+	}
+}
+
+// generateToAddress mines the number of blocks provided and prints their hashes.
+func generateToAddress(numBlocks, address string) error {
+	n, err := strconv.Atoi(numBlocks)
+	if err != nil || n < 1 {
+		return errors.New("invalid number of blocks, must be higher than zero")
+	}
+
+	client, err := rpc.NewClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	hashes, err := client.GenerateToAddress(n, address)
+	for _, hash := range hashes {
+		fmt.Printf("%x\n", hash)
+	}
+	return err
+}
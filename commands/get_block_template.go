@@ -0,0 +1,61 @@
+package commands
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/GGP1/btcs/node/rpc"
+
+	"github.com/spf13/cobra"
+)
+
+func newGetBlockTemplate() *cobra.Command {
+	return &cobra.Command{
+		Use:   "getblocktemplate",
+		Short: "Get the data needed to build and solve the next block",
+		Long: `Get the data needed to build and solve the next block.
+The template does not include the coinbase transaction, miners should create one paying the coinbase value.`,
+		RunE: runGetBlockTemplate(),
+	}
+}
+
+func runGetBlockTemplate() RunEFunc {
+	return func(cmd *cobra.Command, args []string) error {
+		client, err := rpc.NewClient()
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		template, err := client.GetBlockTemplate()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf(`Version: %d
+Previous block: %x
+Height: %d
+Timestamp: %s
+Bits: %08x
+Target: %064x
+Coinbase value: %d SAT
+Fees: %d SAT
+Transactions: %d
+`,
+			template.Version,
+			template.PrevBlockHash,
+			template.Height,
+			time.Unix(template.Timestamp, 0).Format(time.RFC3339Nano),
+			template.Bits,
+			template.Target,
+			template.CoinbaseValue,
+			template.Fees,
+			len(template.Transactions),
+		)
+
+		for _, tx := range template.Transactions {
+			fmt.Println(tx)
+		}
+		return nil
+	}
+}
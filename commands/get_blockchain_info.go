@@ -2,6 +2,7 @@ package commands
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/GGP1/btcs/node/rpc"
 
@@ -12,7 +13,13 @@ func newGetBlockchainInfo() *cobra.Command {
 	return &cobra.Command{
 		Use:   "getblockchaininfo",
 		Short: "Get information about the blockchain state",
-		RunE:  runGetBlockchainInfo(),
+		Long: `Get information about the blockchain state.
+
+The node downloads and validates the headers of the peer with the most work
+first, then requests the blocks from several peers in parallel and connects
+them in order. A heavier branch forking below the chain tip (down to the latest
+checkpoint) reorganizes the chain.`,
+		RunE: runGetBlockchainInfo(),
 	}
 }
 
@@ -24,6 +31,41 @@ func runGetBlockchainInfo() RunEFunc {
 		}
 		defer client.Close()
 
+		info, err := client.GetBlockchainInfo()
+		if err != nil {
+			return err
+		}
+
+		syncPeer := info.SyncPeer
+		if syncPeer == "" {
+			syncPeer = "none"
+		}
+		fmt.Printf(`Chain: %s
+Blocks: %d
+Headers: %d
+Best block: %x
+Difficulty: %g
+Median time: %s
+Verification progress: %.2f%%
+Initial block download: %t
+Blocks in flight: %d
+Orphan blocks: %d
+Headers sync peer: %s
+
+`,
+			info.Chain,
+			info.Blocks,
+			info.Headers,
+			info.BestBlockHash,
+			info.Difficulty,
+			time.Unix(info.MedianTime, 0).Format(time.RFC3339),
+			info.VerificationProgress*100,
+			info.InitialBlockDownload,
+			info.BlocksInFlight,
+			info.Orphans,
+			syncPeer,
+		)
+
 		blocks, err := client.ListBlocks()
 		if err != nil {
 			return err
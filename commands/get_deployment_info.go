@@ -0,0 +1,74 @@
+package commands
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/GGP1/btcs/block"
+	"github.com/GGP1/btcs/node/rpc"
+
+	"github.com/spf13/cobra"
+)
+
+func newGetDeploymentInfo() *cobra.Command {
+	return &cobra.Command{
+		Use:   "getdeploymentinfo",
+		Short: "Get the state of the soft fork deployments signalled with version bits",
+		RunE:  runGetDeploymentInfo(),
+	}
+}
+
+func runGetDeploymentInfo() RunEFunc {
+	return func(cmd *cobra.Command, args []string) error {
+		client, err := rpc.NewClient()
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		info, err := client.GetDeploymentInfo()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Tip: %x (height %d)\n", info.Hash, info.Height)
+		for _, d := range info.Deployments {
+			fmt.Printf(`
+============ Deployment %s ============
+Bit: %d
+Start time: %s
+Expire time: %s
+Threshold: %d/%d
+State: %s
+Since height: %d
+`,
+				d.Name,
+				d.BitNumber,
+				formatDeploymentTime(d.StartTime),
+				formatDeploymentTime(d.ExpireTime),
+				d.Threshold, d.Window,
+				d.State,
+				d.Since,
+			)
+
+			if d.State == block.ThresholdStarted {
+				fmt.Printf("Signalling: %d of %d blocks in the current window\n", d.Signalling, d.Elapsed)
+			}
+		}
+
+		return nil
+	}
+}
+
+// formatDeploymentTime formats a deployment time, which may be zero (always started)
+// or the maximum value (never expires).
+func formatDeploymentTime(t int64) string {
+	if t == 0 {
+		return "always"
+	}
+	if t == math.MaxInt64 {
+		return "never"
+	}
+	return time.Unix(t, 0).Format(time.RFC3339)
+}
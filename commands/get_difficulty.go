@@ -2,6 +2,9 @@ package commands
 
 import (
 	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
 
 	"github.com/GGP1/btcs/block"
 	"github.com/GGP1/btcs/node/rpc"
@@ -9,12 +12,20 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var difficultyHistory bool
+
 func newGetDifficulty() *cobra.Command {
-	return &cobra.Command{
-		Use:   "getdifficulty",
-		Short: "Get the proof-of-work difficulty",
-		RunE:  runGetDifficulty(),
+	cmd := &cobra.Command{
+		Use:     "getdifficulty",
+		Short:   "Get the proof-of-work difficulty",
+		Example: "getdifficulty --history",
+		RunE:    runGetDifficulty(),
 	}
+
+	f := cmd.Flags()
+	f.BoolVar(&difficultyHistory, "history", false, "print the target of every block in the chain")
+
+	return cmd
 }
 
 func runGetDifficulty() RunEFunc {
@@ -25,12 +36,46 @@ func runGetDifficulty() RunEFunc {
 		}
 		defer client.Close()
 
-		b, err := client.GetLastBlock()
+		if difficultyHistory {
+			blocks, err := client.ListBlocks()
+			if err != nil {
+				return err
+			}
+			return printDifficultyHistory(blocks)
+		}
+
+		// The node knows the proof-of-work function in use and thus the next block's bits
+		info, err := client.GetMiningInfo()
 		if err != nil {
 			return err
 		}
 
-		fmt.Println("Difficulty:", block.BigToCompact(block.MaxTarget)/block.CalculateNextDifficulty(b))
+		fmt.Println("Difficulty:", block.Difficulty(info.Bits))
 		return nil
 	}
 }
+
+// printDifficultyHistory prints the target evolution of the blocks, which are sorted from
+// the tip to the genesis.
+func printDifficultyHistory(blocks []block.Block) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "Height\tTime\tSolve time\tBits\tDifficulty\t")
+
+	for i := len(blocks) - 1; i >= 0; i-- {
+		b := blocks[i]
+		solveTime := "-"
+		if i < len(blocks)-1 {
+			solveTime = (time.Duration(b.Timestamp-blocks[i+1].Timestamp) * time.Second).String()
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%s\t%08x\t%.4f\t\n",
+			b.Height,
+			time.Unix(b.Timestamp, 0).Format("2006-01-02 15:04:05"),
+			solveTime,
+			b.Bits,
+			block.Difficulty(b.Bits),
+		)
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,73 @@
+package commands
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/GGP1/btcs/node"
+	"github.com/GGP1/btcs/node/rpc"
+
+	"github.com/spf13/cobra"
+)
+
+func newGetMempoolEntry() *cobra.Command {
+	return &cobra.Command{
+		Use:   "getmempoolentry <txid>",
+		Short: "Get information about a transaction in the memory pool",
+		RunE:  runGetMempoolEntry(),
+	}
+}
+
+func runGetMempoolEntry() RunEFunc {
+	return func(cmd *cobra.Command, args []string) error {
+		txID := strings.Join(args, " ")
+		if txID == "" {
+			return errors.New("transaction id not specified. Use 'getmempoolentry <txid>'")
+		}
+
+		id, err := hex.DecodeString(txID)
+		if err != nil {
+			return err
+		}
+
+		client, err := rpc.NewClient()
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		entry, err := client.GetMempoolEntry(id)
+		if err != nil {
+			return err
+		}
+
+		printMempoolEntry(entry)
+		return nil
+	}
+}
+
+func printMempoolEntry(entry node.MempoolEntry) {
+	fmt.Printf(`--- %s ---
+Time: %s
+Height: %d
+Size: %d bytes
+Fee: %d SAT
+Fee rate: %.2f SAT/byte
+Ancestors: %d (%d bytes)
+Descendants: %d (%d bytes)
+`,
+		entry.TxID,
+		time.Unix(entry.Time, 0).Format(time.RFC3339),
+		entry.Height,
+		entry.Size,
+		entry.Fee,
+		entry.FeeRate,
+		entry.AncestorCount,
+		entry.AncestorSize,
+		entry.DescendantCount,
+		entry.DescendantSize,
+	)
+}
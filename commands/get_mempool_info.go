@@ -0,0 +1,48 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/GGP1/btcs/node/rpc"
+
+	"github.com/spf13/cobra"
+)
+
+func newGetMempoolInfo() *cobra.Command {
+	return &cobra.Command{
+		Use:   "getmempoolinfo",
+		Short: "Get information about the memory pool state",
+		RunE:  runGetMempoolInfo(),
+	}
+}
+
+func runGetMempoolInfo() RunEFunc {
+	return func(cmd *cobra.Command, args []string) error {
+		client, err := rpc.NewClient()
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		info, err := client.GetMempoolInfo()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf(`Transactions: %d
+Bytes: %d
+Usage: %d bytes
+Minimum fee rate: %.2f SAT/byte
+Minimum relay fee rate: %.2f SAT/byte
+Expiry: %v
+`,
+			info.Count,
+			info.Bytes,
+			info.Usage,
+			info.MinFeeRate,
+			info.MinRelayFeeRate,
+			info.Expiry,
+		)
+		return nil
+	}
+}
@@ -0,0 +1,56 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/GGP1/btcs/node/rpc"
+
+	"github.com/spf13/cobra"
+)
+
+func newGetMiningInfo() *cobra.Command {
+	return &cobra.Command{
+		Use:   "getmininginfo",
+		Short: "Get the state of the node's miner",
+		RunE:  runGetMiningInfo(),
+	}
+}
+
+func runGetMiningInfo() RunEFunc {
+	return func(cmd *cobra.Command, args []string) error {
+		client, err := rpc.NewClient()
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		info, err := client.GetMiningInfo()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf(`Generating: %t
+Threads: %d
+Hash rate: %.2f kH/s
+Blocks found: %d
+Coinbase address: %s
+Height: %d
+Bits: %08x
+Target: %064x
+Template transactions: %d
+Pooled transactions: %d
+`,
+			info.Generating,
+			info.Threads,
+			info.HashRate/1000,
+			info.BlocksFound,
+			info.CoinbaseAddr,
+			info.Height,
+			info.Bits,
+			info.Target,
+			info.TemplateTxs,
+			info.PooledTxs,
+		)
+		return nil
+	}
+}
@@ -0,0 +1,74 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/GGP1/btcs/node/rpc"
+
+	"github.com/spf13/cobra"
+)
+
+func newGetNetworkInfo() *cobra.Command {
+	return &cobra.Command{
+		Use:   "getnetworkinfo",
+		Short: "Get the state of the node's peer-to-peer networking",
+		Long: `Get the state of the node's peer-to-peer networking.
+
+New blocks are relayed as compact blocks: the header, the prefilled coinbase
+and short IDs of the rest of the transactions, which are rebuilt from the
+mempool and the missing ones requested to the peer. The hit rates are the
+share of blocks and transactions that didn't need to be requested.`,
+		RunE: runGetNetworkInfo(),
+	}
+}
+
+func runGetNetworkInfo() RunEFunc {
+	return func(cmd *cobra.Command, args []string) error {
+		client, err := rpc.NewClient()
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		info, err := client.GetNetworkInfo()
+		if err != nil {
+			return err
+		}
+
+		compact := info.CompactBlocks
+		fmt.Printf(`Protocol version: %d
+User agent: %s
+Services: %s
+Connections: %d (%d inbound, %d outbound)
+Minimum relay fee rate: %v SAT/byte
+
+Compact blocks received: %d
+Reconstructed from the mempool: %d
+Reconstructed after requesting transactions: %d
+Full block requested: %d
+Block hit rate: %.2f%%
+Transactions prefilled: %d
+Transactions found in the mempool: %d
+Transactions requested: %d
+Transaction hit rate: %.2f%%
+`,
+			info.ProtocolVersion,
+			info.UserAgent,
+			info.Services,
+			info.Inbound+info.Outbound,
+			info.Inbound,
+			info.Outbound,
+			info.MinRelayFeeRate,
+			compact.Received,
+			compact.Reconstructed,
+			compact.Requested,
+			compact.Failed,
+			compact.HitRate()*100,
+			compact.PrefilledTxs,
+			compact.MempoolTxs,
+			compact.MissingTxs,
+			compact.TxHitRate()*100,
+		)
+		return nil
+	}
+}
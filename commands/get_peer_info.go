@@ -2,6 +2,7 @@ package commands
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/GGP1/btcs/node/rpc"
 
@@ -12,7 +13,9 @@ func newGetPeerInfo() *cobra.Command {
 	return &cobra.Command{
 		Use:   "getpeerinfo",
 		Short: "Get information about each connected node",
-		RunE:  runGetPeerInfo(),
+		Long: `Get information about each connected node.
+The services and user agent are the ones the peer announced in its version message.`,
+		RunE: runGetPeerInfo(),
 	}
 }
 
@@ -24,14 +27,51 @@ func runGetPeerInfo() RunEFunc {
 		}
 		defer client.Close()
 
-		addresses, err := client.GetPeerInfo()
+		peersInfo, err := client.GetPeerInfo()
 		if err != nil {
 			return err
 		}
 
-		fmt.Println("Connected nodes\n---------------")
-		for _, addr := range addresses {
-			fmt.Println(addr)
+		fmt.Printf("Connected nodes: %d\n", len(peersInfo))
+		for _, info := range peersInfo {
+			direction := "outbound"
+			if info.Inbound {
+				direction = "inbound"
+			}
+			compactBlocks := "no"
+			if info.HighBandwidth {
+				compactBlocks = "high-bandwidth"
+			} else if info.CompactBlocks {
+				compactBlocks = "low-bandwidth"
+			}
+
+			fmt.Printf(`
+============ Peer %s ============
+Listen address: %s
+Direction: %s
+Connected since: %s
+Protocol version: %d
+Services: %s
+User agent: %s
+Start height: %d
+Best height: %d
+Ban score: %d
+Fee filter: %v SAT/byte
+Compact blocks: %s
+`,
+				info.Addr,
+				info.ListenAddr,
+				direction,
+				time.Unix(info.ConnTime, 0).Format(time.RFC3339),
+				info.ProtocolVersion,
+				info.Services,
+				info.UserAgent,
+				info.StartHeight,
+				info.BestHeight,
+				info.BanScore,
+				info.FeeFilter,
+				compactBlocks,
+			)
 		}
 		return nil
 	}
@@ -0,0 +1,58 @@
+package commands
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/GGP1/btcs/node/rpc"
+
+	"github.com/spf13/cobra"
+)
+
+func newGetPoolWorkers() *cobra.Command {
+	return &cobra.Command{
+		Use:   "getpoolworkers",
+		Short: "Get the shares submitted by each worker of the stratum server",
+		RunE:  runGetPoolWorkers(),
+	}
+}
+
+func runGetPoolWorkers() RunEFunc {
+	return func(cmd *cobra.Command, args []string) error {
+		client, err := rpc.NewClient()
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		workers, err := client.GetPoolWorkers()
+		if err != nil {
+			return err
+		}
+
+		for _, w := range workers {
+			lastShare := "never"
+			if w.LastShare != 0 {
+				lastShare = time.Unix(w.LastShare, 0).Format(time.RFC3339)
+			}
+
+			fmt.Printf(`--- %s ---
+Accepted shares: %d
+Rejected shares: %d
+Accepted work: %.2f
+Blocks found: %d
+Difficulty: %.2f
+Last share: %s
+`,
+				w.Name,
+				w.AcceptedShares,
+				w.RejectedShares,
+				w.AcceptedWork,
+				w.BlocksFound,
+				w.Difficulty,
+				lastShare,
+			)
+		}
+		return nil
+	}
+}
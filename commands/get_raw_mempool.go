@@ -8,12 +8,18 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var verbose bool
+
 func newGetRawMempool() *cobra.Command {
-	return &cobra.Command{
+	cmd := &cobra.Command{
 		Use:   "getrawmempool",
 		Short: "Get all transaction ids in the memory pool",
 		RunE:  runGetRawMempool(),
 	}
+
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "show the details of each transaction")
+
+	return cmd
 }
 
 func runGetRawMempool() RunEFunc {
@@ -24,6 +30,23 @@ func runGetRawMempool() RunEFunc {
 		}
 		defer client.Close()
 
+		if verbose {
+			entries, err := client.GetRawMempoolVerbose()
+			if err != nil {
+				return err
+			}
+
+			if len(entries) == 0 {
+				fmt.Println("There are no transactions in the mempool")
+				return nil
+			}
+
+			for _, entry := range entries {
+				printMempoolEntry(entry)
+			}
+			return nil
+		}
+
 		txIDs, err := client.GetRawMempool()
 		if err != nil {
 			return err
@@ -0,0 +1,45 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/GGP1/btcs/node/rpc"
+
+	"github.com/spf13/cobra"
+)
+
+func newImportMempool() *cobra.Command {
+	return &cobra.Command{
+		Use:   "importmempool <path>",
+		Short: "Import the transactions of a mempool dump",
+		Long: `Import the transactions of a mempool dump.
+The file must be inside the node's data directory, relative paths are resolved from it.
+Each transaction is validated against the current chain and UTXO set before being accepted.`,
+		RunE: runImportMempool(),
+	}
+}
+
+func runImportMempool() RunEFunc {
+	return func(cmd *cobra.Command, args []string) error {
+		path := strings.Join(args, " ")
+		if path == "" {
+			return errors.New("file path not specified. Use 'importmempool <path>'")
+		}
+
+		client, err := rpc.NewClient()
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		added, err := client.ImportMempool(path)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("Transactions imported:", added)
+		return nil
+	}
+}
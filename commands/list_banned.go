@@ -0,0 +1,52 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/GGP1/btcs/node/rpc"
+
+	"github.com/spf13/cobra"
+)
+
+func newListBanned() *cobra.Command {
+	return &cobra.Command{
+		Use:   "listbanned",
+		Short: "List the banned IP addresses",
+		RunE:  runListBanned(),
+	}
+}
+
+func runListBanned() RunEFunc {
+	return func(cmd *cobra.Command, args []string) error {
+		client, err := rpc.NewClient()
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		entries, err := client.ListBanned()
+		if err != nil {
+			return err
+		}
+
+		if len(entries) == 0 {
+			fmt.Println("There are no banned addresses")
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "Address\tBanned at\tUntil\tReason")
+		for _, entry := range entries {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+				entry.Address,
+				time.Unix(entry.Created, 0).Format(time.RFC3339),
+				time.Unix(entry.Until, 0).Format(time.RFC3339),
+				entry.Reason,
+			)
+		}
+		return w.Flush()
+	}
+}
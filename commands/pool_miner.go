@@ -0,0 +1,62 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/GGP1/btcs/logger"
+	"github.com/GGP1/btcs/mining/stratum"
+	"github.com/GGP1/btcs/pow"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	poolAddr, workerName, workerPassword string
+	poolMinerThreads                     int
+)
+
+func newPoolMiner() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "poolminer",
+		Short:   "Mine against a stratum pool server",
+		Example: "poolminer --pool localhost:3333 --user worker1",
+		RunE:    runPoolMiner(),
+	}
+
+	f := cmd.Flags()
+	f.StringVar(&poolAddr, "pool", "localhost:3333", "stratum server address")
+	f.StringVarP(&workerName, "user", "u", "worker", "worker name")
+	f.StringVarP(&workerPassword, "password", "p", "x", "worker password")
+	f.IntVar(&poolMinerThreads, "threads", -1, "number of goroutines used for mining, -1 to use all the CPUs")
+	f.StringVar(&powName, "pow", "", fmt.Sprintf("proof-of-work function %v, it must match the pool's network. Defaults to the mainnet one", pow.Names()))
+	f.BoolVar(&debug, "debug", false, "set the logger mode to debug")
+
+	return cmd
+}
+
+func runPoolMiner() RunEFunc {
+	return func(cmd *cobra.Command, args []string) error {
+		logger.SetDevelopment(debug)
+		if err := overrideParams(powName, ""); err != nil {
+			return err
+		}
+
+		client, err := stratum.Dial(poolAddr, workerName, workerPassword, poolMinerThreads)
+		if err != nil {
+			return err
+		}
+
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-interrupt
+			client.Close()
+		}()
+
+		logger.Infof("Mining at %s as %q", poolAddr, workerName)
+		return client.Run()
+	}
+}
@@ -22,19 +22,38 @@ func NewRoot() *cobra.Command {
 
 	cmd.AddCommand(
 		newAddNode(),
+		newClearBanned(),
 		newDisconnectNode(),
+		newEstimateSmartFee(),
+		newGenerate(),
+		newGenerateToAddress(),
 		newGetBalance(),
 		newGetBlockCount(),
 		newGetBlock(),
+		newGetBlockTemplate(),
 		newGetBlockchainInfo(),
+		newGetDeploymentInfo(),
 		newGetDifficulty(),
+		newGetMempoolEntry(),
+		newGetMempoolInfo(),
+		newGetMiningInfo(),
+		newGetNetworkInfo(),
 		newGetPeerInfo(),
+		newGetPoolWorkers(),
 		newGetRawMempool(),
 		newGetTransaction(),
+		newImportMempool(),
+		newListBanned(),
 		newPing(),
+		newPoolMiner(),
+		newSaveMempool(),
 		newSendTx(),
+		newSetBan(),
+		newSetCoinbaseAddress(),
+		newSetGenerate(),
 		newStartNode(),
 		newStopNode(),
+		newSubmitBlock(),
 		wallet.NewCmd(),
 	)
 
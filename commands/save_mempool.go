@@ -0,0 +1,35 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/GGP1/btcs/node/rpc"
+
+	"github.com/spf13/cobra"
+)
+
+func newSaveMempool() *cobra.Command {
+	return &cobra.Command{
+		Use:   "savemempool",
+		Short: "Dump the memory pool to disk",
+		RunE:  runSaveMempool(),
+	}
+}
+
+func runSaveMempool() RunEFunc {
+	return func(cmd *cobra.Command, args []string) error {
+		client, err := rpc.NewClient()
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		path, err := client.SaveMempool()
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("Mempool saved to", path)
+		return nil
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/GGP1/btcs/mempool"
 	"github.com/GGP1/btcs/node"
 	"github.com/GGP1/btcs/node/rpc"
 	"github.com/GGP1/btcs/wallet"
@@ -13,15 +14,19 @@ import (
 )
 
 var (
-	to, txUnit  string
-	amount, fee int
+	to, txUnit              string
+	amount, fee, confTarget int
+	feeRate                 float64
 )
 
 func newSendTx() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:     "sendtx <account>",
-		Short:   "Create, sign and broadcast a transaction",
-		Example: "sendtx satoshi --to 1MVBUT4h8q7c5xAuKiEwqCY6xexN6cWUTV --amount 1 --unit BTC --fee 20000",
+		Use:   "sendtx <account>",
+		Short: "Create, sign and broadcast a transaction",
+		Long: `Create, sign and broadcast a transaction.
+The fee is taken from --fee, calculated from --feerate and the transaction size or, if
+none of them is specified, estimated to confirm within --conf-target blocks.`,
+		Example: "sendtx satoshi --to 1MVBUT4h8q7c5xAuKiEwqCY6xexN6cWUTV --amount 1 --unit BTC --feerate 20",
 		RunE:    runSendTx(),
 	}
 
@@ -29,6 +34,8 @@ func newSendTx() *cobra.Command {
 	f.StringVarP(&to, "to", "t", "", "to address")
 	f.IntVarP(&amount, "amount", "a", 0, "transaction amount")
 	f.IntVarP(&fee, "fee", "f", 0, "transaction fee (denominated in SAT)")
+	f.Float64Var(&feeRate, "feerate", 0, "transaction fee rate (denominated in SAT/byte)")
+	f.IntVar(&confTarget, "conf-target", 6, "number of blocks the transaction should confirm within, used to estimate the fee if it's not specified")
 	f.StringVarP(&txUnit, "unit", "u", "BTC", "transaction amount unit")
 	cmd.MarkFlagRequired("to")
 	cmd.MarkFlagRequired("amount")
@@ -51,6 +58,10 @@ func runSendTx() RunEFunc {
 			return errors.New("invalid amount, must be higher than zero")
 		}
 
+		if fee < 0 || feeRate < 0 {
+			return errors.New("invalid fee, must not be negative")
+		}
+
 		client, err := rpc.NewClient()
 		if err != nil {
 			return err
@@ -62,9 +73,15 @@ func runSendTx() RunEFunc {
 			To:          to,
 			Amount:      amountToSats(txUnit, amount),
 			Fee:         fee,
+			FeeRate:     feeRate,
+			ConfTarget:  confTarget,
 		}
 		txID, err := client.SendTx(params)
 		if err != nil {
+			var ruleErr mempool.RuleError
+			if errors.As(err, &ruleErr) {
+				return fmt.Errorf("transaction %x rejected (code 0x%02x): %s", txID, uint8(ruleErr.Code), ruleErr)
+			}
 			return err
 		}
 
@@ -0,0 +1,70 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/GGP1/btcs/node"
+	"github.com/GGP1/btcs/node/rpc"
+
+	"github.com/spf13/cobra"
+)
+
+var banTime time.Duration
+
+func newSetBan() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "setban <ip> add|remove",
+		Short: "Add or remove an IP address from the ban list",
+		Long: `Add or remove an IP address from the ban list.
+Banned addresses can't connect to the node and their connections are closed.
+
+Peers violating the protocol accumulate a ban score and are banned for a day
+once it reaches 100, local peers are only disconnected. The ban list is
+persisted across restarts.`,
+		Example: "setban 172.18.0.3 add --bantime 1h",
+		RunE:    runSetBan(),
+	}
+
+	cmd.Flags().DurationVar(&banTime, "bantime", node.DefaultBanDuration, "time the address is banned for")
+
+	return cmd
+}
+
+func runSetBan() RunEFunc {
+	return func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return errors.New("invalid arguments. Use 'setban <ip> add|remove'")
+		}
+
+		params := node.SetBanParams{
+			Address:  args[0],
+			Duration: banTime,
+		}
+		switch args[1] {
+		case "add":
+		case "remove":
+			params.Remove = true
+		default:
+			return errors.New("invalid command, must be \"add\" or \"remove\"")
+		}
+
+		client, err := rpc.NewClient()
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		if err := client.SetBan(params); err != nil {
+			return err
+		}
+
+		if params.Remove {
+			fmt.Println("Unbanned", params.Address)
+		} else {
+			fmt.Printf("Banned %s for %s\n", params.Address, params.Duration)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,36 @@
+package commands
+
+import (
+	"errors"
+
+	"github.com/GGP1/btcs/node/rpc"
+
+	"github.com/spf13/cobra"
+)
+
+func newSetCoinbaseAddress() *cobra.Command {
+	return &cobra.Command{
+		Use:   "setcoinbaseaddress <address>",
+		Short: "Set the address where the node's mining rewards are sent",
+		Long: `Set the address where the node's mining rewards are sent.
+If the node is mining, it restarts working on a block paying to the new address.`,
+		Example: "setcoinbaseaddress 1MVBUT4h8q7c5xAuKiEwqCY6xexN6cWUTV",
+		RunE:    runSetCoinbaseAddress(),
+	}
+}
+
+func runSetCoinbaseAddress() RunEFunc {
+	return func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("address not specified. Use 'setcoinbaseaddress <address>'")
+		}
+
+		client, err := rpc.NewClient()
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		return client.SetCoinbaseAddress(args[0])
+	}
+}
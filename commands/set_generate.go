@@ -0,0 +1,55 @@
+package commands
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/GGP1/btcs/node/rpc"
+
+	"github.com/spf13/cobra"
+)
+
+func newSetGenerate() *cobra.Command {
+	return &cobra.Command{
+		Use:   "setgenerate on|off [threads]",
+		Short: "Start or stop the node's miner",
+		Long: `Start or stop the node's miner.
+If the number of threads is not specified, the number of logical CPUs is used.`,
+		Example: "setgenerate on 4",
+		RunE:    runSetGenerate(),
+	}
+}
+
+func runSetGenerate() RunEFunc {
+	return func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 || len(args) > 2 {
+			return errors.New("invalid arguments. Use 'setgenerate on|off [threads]'")
+		}
+
+		var generate bool
+		switch args[0] {
+		case "on":
+			generate = true
+		case "off":
+		default:
+			return errors.New("invalid state, must be \"on\" or \"off\"")
+		}
+
+		threads := 0
+		if len(args) == 2 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return errors.New("invalid number of threads, must be higher than zero")
+			}
+			threads = n
+		}
+
+		client, err := rpc.NewClient()
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		return client.SetGenerate(generate, threads)
+	}
+}
@@ -1,20 +1,38 @@
 package commands
 
 import (
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/GGP1/btcs/chaincfg"
 	"github.com/GGP1/btcs/logger"
+	"github.com/GGP1/btcs/mempool"
 	"github.com/GGP1/btcs/node"
+	"github.com/GGP1/btcs/pow"
 
 	"github.com/spf13/cobra"
 )
 
 var (
-	miner, debug bool
-	nodes        []string
-	address      string
+	miner, debug  bool
+	regtest       bool
+	nodes         []string
+	address       string
+	mempoolExpiry time.Duration
+	minRelayFee   float64
+	mempoolSync   bool
+	genProcLimit  int
+	stratumAddr   string
+	powName       string
+	retargetName  string
+	checkpoints   []string
+	assumeValid   string
 
 	seedNodes = []string{
 		"node1:3000",
@@ -33,9 +51,19 @@ func newStartNode() *cobra.Command {
 
 	f := cmd.Flags()
 	f.StringVarP(&address, "address", "a", "", "node server address")
-	f.StringSliceVarP(&nodes, "nodes", "n", seedNodes, "nodes addresses to connect to")
+	f.StringSliceVarP(&nodes, "nodes", "n", seedNodes, "nodes addresses added to the address book (peers.dat), outbound peers are picked from it")
 	f.BoolVarP(&miner, "miner", "m", false, "whether the node will perform mining operations")
+	f.BoolVar(&regtest, "regtest", false, "run on the regression test network, blocks are mined at the minimum difficulty and can be generated on demand")
+	f.StringVar(&retargetName, "retarget", "", fmt.Sprintf("difficulty adjustment algorithm %v, all the nodes of the network must use the same one. Defaults to the network's one", chaincfg.RetargetAlgorithms))
+	f.StringVar(&powName, "pow", "", fmt.Sprintf("proof-of-work function %v, all the nodes of the network must use the same one. Defaults to the network's one", pow.Names()))
+	f.StringSliceVar(&checkpoints, "checkpoint", nil, "additional checkpoints in the format height:hash, forks below them are rejected")
+	f.StringVar(&assumeValid, "assumevalid", "", "hash of a block whose ancestors' signatures are assumed valid and not verified")
+	f.IntVar(&genProcLimit, "genproclimit", -1, "number of goroutines used for mining, -1 to use all the CPUs")
+	f.StringVar(&stratumAddr, "stratum", "", "address where the stratum mining pool server will be listening, disabled if empty")
 	f.BoolVar(&debug, "debug", false, "set the logger mode to debug")
+	f.Float64Var(&minRelayFee, "minrelayfee", mempool.DefaultMinRelayFeeRate, "minimum fee rate (SAT/byte) for transactions to be accepted into the mempool and relayed, peers are asked not to announce transactions below it (feefilter)")
+	f.BoolVar(&mempoolSync, "requestmempool", false, "request the unconfirmed transactions of the outbound peers after connecting to them (mempool message)")
+	f.DurationVar(&mempoolExpiry, "mempoolexpiry", mempool.DefaultExpiry, "time after which unconfirmed transactions are removed from the mempool")
 
 	return cmd
 }
@@ -56,7 +84,30 @@ func runStartNode() RunEFunc {
 
 		logger.SetDevelopment(debug)
 
-		node, err := node.New(address, nodes, miner)
+		if regtest {
+			chaincfg.ActiveParams = &chaincfg.RegressionNetParams
+		}
+		if err := overrideParams(powName, retargetName); err != nil {
+			return err
+		}
+		if err := overrideCheckpoints(checkpoints, assumeValid); err != nil {
+			return err
+		}
+		logger.Infof("Running on %s using %s proof of work and %s difficulty adjustments",
+			chaincfg.ActiveParams.Name,
+			chaincfg.ActiveParams.PowHasher.Name(),
+			chaincfg.ActiveParams.RetargetAlgorithm)
+
+		node, err := node.New(node.Config{
+			HostAddress:     address,
+			SeedNodes:       nodes,
+			Miner:           miner,
+			MiningThreads:   genProcLimit,
+			MempoolExpiry:   mempoolExpiry,
+			MinRelayFeeRate: minRelayFee,
+			RequestMempool:  mempoolSync,
+			StratumAddress:  stratumAddr,
+		})
 		if err != nil {
 			return err
 		}
@@ -64,3 +115,69 @@ func runStartNode() RunEFunc {
 		return node.Run(accountName)
 	}
 }
+
+// overrideParams replaces the proof-of-work function and the difficulty adjustment algorithm
+// of the active network parameters, the empty ones are left untouched.
+func overrideParams(powName, retargetName string) error {
+	// Copy the parameters so the predefined networks aren't modified
+	params := *chaincfg.ActiveParams
+
+	if powName != "" {
+		hasher, err := pow.Get(powName)
+		if err != nil {
+			return err
+		}
+		params.PowHasher = hasher
+	}
+
+	if retargetName != "" {
+		valid := false
+		for _, name := range chaincfg.RetargetAlgorithms {
+			valid = valid || name == retargetName
+		}
+		if !valid {
+			return fmt.Errorf("unknown difficulty adjustment algorithm %q, available: %v", retargetName, chaincfg.RetargetAlgorithms)
+		}
+		params.RetargetAlgorithm = retargetName
+	}
+
+	chaincfg.ActiveParams = &params
+	return nil
+}
+
+// overrideCheckpoints adds the checkpoints, in the format height:hash, to the active network
+// parameters and sets the assumed valid block if it's not empty.
+func overrideCheckpoints(checkpoints []string, assumeValid string) error {
+	params := *chaincfg.ActiveParams
+	params.Checkpoints = append([]chaincfg.Checkpoint(nil), params.Checkpoints...)
+
+	for _, c := range checkpoints {
+		heightStr, hashStr, ok := strings.Cut(c, ":")
+		if !ok {
+			return fmt.Errorf("invalid checkpoint %q, expected height:hash", c)
+		}
+		height, err := strconv.ParseInt(heightStr, 10, 32)
+		if err != nil || height < 0 {
+			return fmt.Errorf("invalid checkpoint height %q", heightStr)
+		}
+		hash, err := hex.DecodeString(hashStr)
+		if err != nil {
+			return fmt.Errorf("invalid checkpoint hash %q: %v", hashStr, err)
+		}
+		params.Checkpoints = append(params.Checkpoints, chaincfg.Checkpoint{Height: int32(height), Hash: hash})
+	}
+	sort.Slice(params.Checkpoints, func(i, j int) bool {
+		return params.Checkpoints[i].Height < params.Checkpoints[j].Height
+	})
+
+	if assumeValid != "" {
+		hash, err := hex.DecodeString(assumeValid)
+		if err != nil {
+			return fmt.Errorf("invalid assumed valid block hash %q: %v", assumeValid, err)
+		}
+		params.AssumeValid = hash
+	}
+
+	chaincfg.ActiveParams = &params
+	return nil
+}
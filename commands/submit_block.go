@@ -0,0 +1,56 @@
+package commands
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/GGP1/btcs/block"
+	"github.com/GGP1/btcs/encoding/gob"
+	"github.com/GGP1/btcs/node/rpc"
+
+	"github.com/spf13/cobra"
+)
+
+func newSubmitBlock() *cobra.Command {
+	return &cobra.Command{
+		Use:   "submitblock <hexdata>",
+		Short: "Submit a solved block to the node",
+		Long: `Submit a solved block to the node.
+The block must be gob encoded and represented in hexadecimal, it's validated, added to the chain and relayed to the peers.`,
+		RunE: runSubmitBlock(),
+	}
+}
+
+func runSubmitBlock() RunEFunc {
+	return func(cmd *cobra.Command, args []string) error {
+		hexData := strings.Join(args, " ")
+		if hexData == "" {
+			return errors.New("block data not specified. Use 'submitblock <hexdata>'")
+		}
+
+		data, err := hex.DecodeString(hexData)
+		if err != nil {
+			return err
+		}
+
+		b, err := gob.Decode[block.Block](data)
+		if err != nil {
+			return fmt.Errorf("decoding block: %v", err)
+		}
+
+		client, err := rpc.NewClient()
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		if err := client.SubmitBlock(b); err != nil {
+			return err
+		}
+
+		fmt.Printf("Block accepted: %x\n", b.Hash)
+		return nil
+	}
+}
@@ -0,0 +1,65 @@
+package mempool
+
+import "fmt"
+
+// RejectCode represents the reason a transaction was rejected.
+//
+// https://github.com/bitcoin/bips/blob/master/bip-0061.mediawiki
+type RejectCode uint8
+
+// Reject codes as defined in BIP61.
+const (
+	RejectMalformed       RejectCode = 0x01
+	RejectInvalid         RejectCode = 0x10
+	RejectObsolete        RejectCode = 0x11
+	RejectDuplicate       RejectCode = 0x12
+	RejectNonstandard     RejectCode = 0x40
+	RejectDust            RejectCode = 0x41
+	RejectInsufficientFee RejectCode = 0x42
+	RejectCheckpoint      RejectCode = 0x43
+)
+
+// String returns the name of the reject code.
+func (c RejectCode) String() string {
+	switch c {
+	case RejectMalformed:
+		return "malformed"
+	case RejectInvalid:
+		return "invalid"
+	case RejectObsolete:
+		return "obsolete"
+	case RejectDuplicate:
+		return "duplicate"
+	case RejectNonstandard:
+		return "nonstandard"
+	case RejectDust:
+		return "dust"
+	case RejectInsufficientFee:
+		return "insufficientfee"
+	case RejectCheckpoint:
+		return "checkpoint"
+	default:
+		return fmt.Sprintf("unknown (0x%02x)", uint8(c))
+	}
+}
+
+// RuleError is returned when a transaction is rejected from the pool.
+type RuleError struct {
+	Code   RejectCode
+	Reason string
+}
+
+// Error returns the reject code and the reason.
+func (e RuleError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Reason)
+}
+
+// NewRuleError returns a RuleError with the code provided and the error message as the reason.
+//
+// Policy errors are assigned the reject code corresponding to the rule that failed.
+func NewRuleError(code RejectCode, err error) RuleError {
+	if policyErr, ok := err.(PolicyError); ok {
+		return RuleError{Code: policyErr.RejectCode(), Reason: policyErr.Error()}
+	}
+	return RuleError{Code: code, Reason: err.Error()}
+}
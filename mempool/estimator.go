@@ -0,0 +1,273 @@
+package mempool
+
+import (
+	"encoding/hex"
+	"errors"
+	"math"
+	"os"
+	"sync"
+
+	"github.com/GGP1/btcs/encoding/gob"
+)
+
+// Fee estimation is based on Bitcoin Core's (CBlockPolicyEstimator), simplified.
+//
+// Transactions are grouped in buckets by their fee rate when they enter the pool. Once
+// they are included in a block, we record how many blocks it took to confirm them. To
+// answer "what fee rate do I need to confirm within N blocks", buckets are scanned from
+// the highest fee rate to the lowest and the lowest one in which enough transactions
+// confirmed within N blocks is returned.
+//
+// https://github.com/bitcoin/bitcoin/blob/master/src/policy/fees.cpp
+
+const (
+	// EstimatesPath is the file where the fee estimator state is stored when the node stops.
+	EstimatesPath = "fee_estimates.dat"
+
+	// MaxConfirmTarget is the highest number of blocks we track confirmations for.
+	MaxConfirmTarget = 25
+
+	// DefaultConfidence is the default probability of a transaction confirming within the
+	// target number of blocks.
+	DefaultConfidence = 0.85
+
+	// minBucketFeeRate is the fee rate (sat/byte) of the lowest bucket.
+	minBucketFeeRate = 0.1
+	// maxBucketFeeRate is the fee rate (sat/byte) of the highest bucket.
+	maxBucketFeeRate = 1e5
+	// bucketSpacing is the factor between the fee rates of two consecutive buckets.
+	bucketSpacing = 1.2
+	// decay is applied to all the data points on each block so old data
+	// weights less than recent one.
+	decay = 0.998
+	// sufficientFeeTxs is the average number of transactions per block a group of buckets
+	// needs to produce an estimate, as in Bitcoin Core.
+	sufficientFeeTxs = 0.1
+	// sufficientTxs is the minimum number of (decayed) data points a group of buckets
+	// needs to produce an estimate. Data points decay on each block, so it's the number
+	// of points a steady sufficientFeeTxs per block converges to.
+	sufficientTxs = sufficientFeeTxs / (1 - decay)
+)
+
+// ErrInsufficientData is returned when the estimator didn't collect enough
+// data to produce an estimate.
+var ErrInsufficientData = errors.New("insufficient data to estimate fee")
+
+// trackedTx is a transaction in the pool whose confirmation we are waiting for.
+type trackedTx struct {
+	Height int32
+	Bucket int
+}
+
+// FeeEstimator estimates the fee rate required for a transaction to be
+// included in a block within a number of blocks.
+type FeeEstimator struct {
+	mu *sync.Mutex
+	// BucketFeeRates contains the lower fee rate (sat/byte) bound of each bucket
+	BucketFeeRates []float64
+	// Confirmed[t][b] is the (decayed) number of transactions in bucket b
+	// that confirmed in t+1 blocks or less
+	Confirmed [][]float64
+	// Total[b] is the (decayed) number of transactions in bucket b that
+	// either confirmed or didn't within MaxConfirmTarget blocks
+	Total []float64
+	// Tracked contains the transactions in the pool by id
+	Tracked map[string]trackedTx
+	// BestHeight is the height of the last block processed
+	BestHeight int32
+}
+
+// NewFeeEstimator returns a fee estimator with no data.
+func NewFeeEstimator() *FeeEstimator {
+	bucketFeeRates := make([]float64, 0)
+	for feeRate := minBucketFeeRate; feeRate <= maxBucketFeeRate; feeRate *= bucketSpacing {
+		bucketFeeRates = append(bucketFeeRates, feeRate)
+	}
+
+	confirmed := make([][]float64, MaxConfirmTarget)
+	for i := range confirmed {
+		confirmed[i] = make([]float64, len(bucketFeeRates))
+	}
+
+	return &FeeEstimator{
+		mu:             &sync.Mutex{},
+		BucketFeeRates: bucketFeeRates,
+		Confirmed:      confirmed,
+		Total:          make([]float64, len(bucketFeeRates)),
+		Tracked:        make(map[string]trackedTx),
+	}
+}
+
+// LoadFeeEstimator reads the estimator state from the file at path.
+func LoadFeeEstimator(path string) (*FeeEstimator, error) {
+	fileContent, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	estimator, err := gob.Decode[*FeeEstimator](fileContent)
+	if err != nil {
+		return nil, err
+	}
+	estimator.mu = &sync.Mutex{}
+	if estimator.Tracked == nil {
+		estimator.Tracked = make(map[string]trackedTx)
+	}
+
+	return estimator, nil
+}
+
+// Save writes the estimator state to the file at path.
+func (f *FeeEstimator) Save(path string) error {
+	f.mu.Lock()
+	b, err := gob.Encode(f)
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, b, 0o644)
+}
+
+// ObserveTx starts tracking a transaction that entered the pool.
+func (f *FeeEstimator) ObserveTx(entry Entry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Tracked[hex.EncodeToString(entry.Tx.ID)] = trackedTx{
+		Height: entry.Height,
+		Bucket: f.bucketIndex(entry.FeeRate),
+	}
+}
+
+// ProcessBlock records the confirmation of the tracked transactions included in the block
+// at the height provided.
+func (f *FeeEstimator) ProcessBlock(height int32, txIDs [][]byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// The tip went backwards because of a reorganization or a chain reset, forget the
+	// transactions that entered the pool at heights that are being replaced
+	if height <= f.BestHeight {
+		for id, tracked := range f.Tracked {
+			if tracked.Height >= height {
+				delete(f.Tracked, id)
+			}
+		}
+	}
+	f.BestHeight = height
+
+	for t := range f.Confirmed {
+		for b := range f.Confirmed[t] {
+			f.Confirmed[t][b] *= decay
+		}
+	}
+	for b := range f.Total {
+		f.Total[b] *= decay
+	}
+
+	for _, txID := range txIDs {
+		id := hex.EncodeToString(txID)
+		tracked, ok := f.Tracked[id]
+		if !ok {
+			continue
+		}
+		delete(f.Tracked, id)
+
+		blocksToConfirm := int(height - tracked.Height)
+		if blocksToConfirm < 1 {
+			blocksToConfirm = 1
+		}
+
+		f.Total[tracked.Bucket]++
+		for t := blocksToConfirm - 1; t < MaxConfirmTarget; t++ {
+			f.Confirmed[t][tracked.Bucket]++
+		}
+	}
+
+	// Transactions that didn't confirm within the maximum target count as failures
+	for id, tracked := range f.Tracked {
+		if height-tracked.Height > MaxConfirmTarget {
+			f.Total[tracked.Bucket]++
+			delete(f.Tracked, id)
+		}
+	}
+}
+
+// EstimateFeeRate returns the lowest fee rate (sat/byte) at which transactions confirmed
+// within confTarget blocks with a probability of at least confidence.
+func (f *FeeEstimator) EstimateFeeRate(confTarget int, confidence float64) (float64, error) {
+	if confTarget < 1 || confTarget > MaxConfirmTarget {
+		return 0, errors.New("confirmation target out of range")
+	}
+	if confidence <= 0 || confidence > 1 {
+		return 0, errors.New("confidence must be between 0 and 1")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	confirmed := f.Confirmed[confTarget-1]
+	feeRate := -1.0
+	groupConfirmed, groupTotal := 0.0, 0.0
+
+	// Group buckets from the highest fee rate to the lowest until they have enough
+	// data points and stop at the first group that doesn't meet the confidence
+	for b := len(f.BucketFeeRates) - 1; b >= 0; b-- {
+		groupConfirmed += confirmed[b]
+		groupTotal += f.Total[b]
+		if groupTotal < sufficientTxs {
+			continue
+		}
+
+		if groupConfirmed/groupTotal < confidence {
+			break
+		}
+
+		feeRate = f.BucketFeeRates[b]
+		groupConfirmed, groupTotal = 0, 0
+	}
+
+	if feeRate < 0 {
+		return 0, ErrInsufficientData
+	}
+
+	return feeRate, nil
+}
+
+// EstimateSmartFeeRate is like EstimateFeeRate but if there isn't enough data for
+// confTarget it tries with higher targets.
+//
+// It returns the fee rate and the target for which the estimate was found.
+func (f *FeeEstimator) EstimateSmartFeeRate(confTarget int, confidence float64) (float64, int, error) {
+	if confTarget < 1 || confTarget > MaxConfirmTarget {
+		return 0, 0, errors.New("confirmation target out of range")
+	}
+
+	for target := confTarget; target <= MaxConfirmTarget; target++ {
+		feeRate, err := f.EstimateFeeRate(target, confidence)
+		if err != nil {
+			if err == ErrInsufficientData {
+				continue
+			}
+			return 0, 0, err
+		}
+
+		return feeRate, target, nil
+	}
+
+	return 0, 0, ErrInsufficientData
+}
+
+// bucketIndex returns the index of the bucket a fee rate belongs to.
+func (f *FeeEstimator) bucketIndex(feeRate float64) int {
+	if feeRate <= minBucketFeeRate {
+		return 0
+	}
+
+	idx := int(math.Log(feeRate/minBucketFeeRate) / math.Log(bucketSpacing))
+	if idx >= len(f.BucketFeeRates) {
+		return len(f.BucketFeeRates) - 1
+	}
+	return idx
+}
@@ -0,0 +1,94 @@
+package mempool
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/GGP1/btcs/tx"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeeEstimator(t *testing.T) {
+	estimator := NewFeeEstimator()
+
+	_, err := estimator.EstimateFeeRate(1, DefaultConfidence)
+	assert.ErrorIs(t, err, ErrInsufficientData)
+
+	// High fee transactions confirm in the next block, low fee ones take 10 blocks
+	height := int32(0)
+	for i := 0; i < 20; i++ {
+		highIDs := make([][]byte, 0, 5)
+		lowIDs := make([][]byte, 0, 5)
+		for j := 0; j < 5; j++ {
+			high := Entry{Tx: tx.Tx{ID: []byte(fmt.Sprint("high", i, j))}, Height: height, FeeRate: 50}
+			low := Entry{Tx: tx.Tx{ID: []byte(fmt.Sprint("low", i, j))}, Height: height, FeeRate: 2}
+			estimator.ObserveTx(high)
+			estimator.ObserveTx(low)
+			highIDs = append(highIDs, high.Tx.ID)
+			lowIDs = append(lowIDs, low.Tx.ID)
+		}
+
+		height++
+		estimator.ProcessBlock(height, highIDs)
+
+		height += 9
+		estimator.ProcessBlock(height, lowIDs)
+	}
+
+	feeRate, err := estimator.EstimateFeeRate(1, DefaultConfidence)
+	assert.NoError(t, err)
+	assert.InDelta(t, 50, feeRate, 50*(bucketSpacing-1))
+
+	lowFeeRate, err := estimator.EstimateFeeRate(10, DefaultConfidence)
+	assert.NoError(t, err)
+	assert.InDelta(t, 2, lowFeeRate, 2*(bucketSpacing-1))
+
+	feeRate, blocks, err := estimator.EstimateSmartFeeRate(5, DefaultConfidence)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, blocks)
+	assert.InDelta(t, 50, feeRate, 50*(bucketSpacing-1))
+
+	path := filepath.Join(t.TempDir(), EstimatesPath)
+	assert.NoError(t, estimator.Save(path))
+
+	loaded, err := LoadFeeEstimator(path)
+	assert.NoError(t, err)
+	loadedFeeRate, err := loaded.EstimateFeeRate(10, DefaultConfidence)
+	assert.NoError(t, err)
+	assert.Equal(t, lowFeeRate, loadedFeeRate)
+}
+
+func TestFeeEstimatorInsufficientData(t *testing.T) {
+	estimator := NewFeeEstimator()
+
+	// A few confirmations are not enough to produce an estimate
+	for i := 0; i < 5; i++ {
+		entry := Entry{Tx: tx.Tx{ID: []byte(fmt.Sprint("tx", i))}, Height: int32(i), FeeRate: 50}
+		estimator.ObserveTx(entry)
+		estimator.ProcessBlock(int32(i+1), [][]byte{entry.Tx.ID})
+	}
+
+	_, err := estimator.EstimateFeeRate(1, DefaultConfidence)
+	assert.ErrorIs(t, err, ErrInsufficientData)
+}
+
+func TestFeeEstimatorTipGoesBackwards(t *testing.T) {
+	estimator := NewFeeEstimator()
+	estimator.ProcessBlock(100, nil)
+
+	// The chain was reset, the transaction tracked at the old height is forgotten
+	stale := Entry{Tx: tx.Tx{ID: []byte("stale")}, Height: 100, FeeRate: 50}
+	estimator.ObserveTx(stale)
+	estimator.ProcessBlock(1, nil)
+	assert.Empty(t, estimator.Tracked)
+	assert.Equal(t, int32(1), estimator.BestHeight)
+
+	// Blocks are processed again from the new tip
+	entry := Entry{Tx: tx.Tx{ID: []byte("tx")}, Height: 1, FeeRate: 50}
+	estimator.ObserveTx(entry)
+	estimator.ProcessBlock(2, [][]byte{entry.Tx.ID})
+	assert.Equal(t, int32(2), estimator.BestHeight)
+	assert.Greater(t, estimator.Total[estimator.bucketIndex(50)], 0.0)
+}
@@ -2,38 +2,132 @@ package mempool
 
 import (
 	"encoding/hex"
+	"math"
 	"sync"
+	"time"
 
 	"github.com/GGP1/btcs/encoding/gob"
 	"github.com/GGP1/btcs/tx"
 )
 
+// DefaultExpiry is the time after which a transaction that wasn't included in a block
+// is removed from the pool.
+//
+// In Bitcoin Core, it's 336 hours (two weeks).
+const DefaultExpiry = 336 * time.Hour
+
 // TODO:
 // - keep the mempool memory below <n> MB (use SizeBytes).
 // In case the limit is about to be reached, remove transactions with the lowest fees (minmempoolfee).
 // Overtime it should self-adjust to accept transactions with lower fees if there's enough space.
 // Perhaps just take up to <n> transactions to make things simple, prioritizing the ones with higher fees.
 
+// Entry is a transaction stored in the pool along with the data the node
+// collected when it was accepted.
+type Entry struct {
+	Tx tx.Tx
+	// Unix time at which the transaction entered the pool
+	Time int64
+	// Height of the chain when the transaction entered the pool
+	Height int32
+	// Size of the serialized transaction in bytes
+	Size int
+	// Represented in satoshis
+	Fee int
+	// Satoshis per byte
+	FeeRate float64
+}
+
+// NewEntry returns a pool entry for a transaction paying the fee provided, received at
+// the chain height provided.
+func NewEntry(t tx.Tx, fee int, height int32) Entry {
+	size := t.SerializeSize()
+	return Entry{
+		Tx:      t,
+		Time:    time.Now().Unix(),
+		Height:  height,
+		Size:    size,
+		Fee:     fee,
+		FeeRate: FeeRate(fee, size),
+	}
+}
+
+// Info contains statistics about the pool.
+type Info struct {
+	// Number of transactions
+	Count int
+	// Sum of the transactions sizes
+	Bytes int
+	// Memory used by the pool in bytes
+	Usage int
+	// Lowest fee rate (sat/byte) of the transactions in the pool
+	MinFeeRate float64
+}
+
 // TxPool contains valid transactions that may be included in the next block.
 type TxPool struct {
 	mu   *sync.RWMutex
-	pool map[string]tx.Tx
+	pool map[string]Entry
+	// children contains the in-pool transactions spending the outputs of each
+	// transaction, map[parentID]map[childID]
+	children map[string]map[string]struct{}
+	// spenders contains the id of the in-pool transaction spending each output
+	spenders map[outPointKey]string
+}
+
+// outPointKey identifies an output in the spenders index.
+type outPointKey struct {
+	txID  string
+	index int
+}
+
+func newOutPointKey(outPoint tx.OutPoint) outPointKey {
+	return outPointKey{txID: string(outPoint.TxID), index: outPoint.Index}
 }
 
 // NewTxPool returns a new transaction pool.
 func NewTxPool() *TxPool {
 	return &TxPool{
-		pool: make(map[string]tx.Tx),
-		mu:   &sync.RWMutex{},
+		pool:     make(map[string]Entry),
+		children: make(map[string]map[string]struct{}),
+		spenders: make(map[outPointKey]string),
+		mu:       &sync.RWMutex{},
 	}
 }
 
-// Add adds a transaction to the pool.
-func (t *TxPool) Add(tx tx.Tx) {
-	txID := hex.EncodeToString(tx.ID)
+// Add adds a transaction paying the fee provided, received at the chain height provided,
+// to the pool.
+func (t *TxPool) Add(tx tx.Tx, fee int, height int32) {
+	t.AddEntry(NewEntry(tx, fee, height))
+}
+
+// AddEntry adds an entry to the pool, preserving its metadata.
+func (t *TxPool) AddEntry(entry Entry) {
+	txID := hex.EncodeToString(entry.Tx.ID)
 	t.mu.Lock()
-	t.pool[txID] = tx
-	t.mu.Unlock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.pool[txID]; ok {
+		t.remove(txID)
+	}
+	t.pool[txID] = entry
+	for _, in := range entry.Tx.Inputs {
+		parentID := hex.EncodeToString(in.PrevOutput.TxID)
+		if t.children[parentID] == nil {
+			t.children[parentID] = make(map[string]struct{})
+		}
+		t.children[parentID][txID] = struct{}{}
+		t.spenders[newOutPointKey(in.PrevOutput)] = txID
+	}
+}
+
+// Ancestors returns the number and total size in bytes of the transactions in the pool
+// the one passed depends on (directly or not), including itself.
+func (t *TxPool) Ancestors(txID []byte) (count, size int) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.sumSizes(t.ancestors(hex.EncodeToString(txID)))
 }
 
 // Contains returns whether the txID is in the pool or not.
@@ -52,15 +146,73 @@ func (t *TxPool) Count() int {
 	return len(t.pool)
 }
 
+// Descendants returns the number and total size in bytes of the transactions in the pool
+// depending on the one passed (directly or not), including itself.
+func (t *TxPool) Descendants(txID []byte) (count, size int) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.sumSizes(t.descendants(hex.EncodeToString(txID)))
+}
+
+// Entries returns a copy of the pool entries.
+func (t *TxPool) Entries() []Entry {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	entries := make([]Entry, 0, len(t.pool))
+	for _, entry := range t.pool {
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// Entry returns the pool entry of a transaction.
+func (t *TxPool) Entry(txID []byte) (Entry, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	entry, ok := t.pool[hex.EncodeToString(txID)]
+	return entry, ok
+}
+
+// Expire removes the transactions that entered the pool before the time provided,
+// along with the ones depending on them.
+//
+// It returns the number of transactions removed.
+func (t *TxPool) Expire(before time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	expired := make([]string, 0)
+	for id, entry := range t.pool {
+		if entry.Time < before.Unix() {
+			expired = append(expired, id)
+		}
+	}
+
+	removed := 0
+	for _, id := range expired {
+		for descendantID := range t.descendants(id) {
+			t.remove(descendantID)
+			removed++
+		}
+	}
+
+	return removed
+}
+
 // ForEach iterates over the pool executing f on each transaction.
 func (t *TxPool) ForEach(f func(txID string, tx tx.Tx) error) error {
-	t.mu.Lock()
-	for id, tx := range t.pool {
-		if err := f(id, tx); err != nil {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for id, entry := range t.pool {
+		if err := f(id, entry.Tx); err != nil {
 			return err
 		}
 	}
-	t.mu.Unlock()
 
 	return nil
 }
@@ -70,24 +222,197 @@ func (t *TxPool) Get(txID []byte) tx.Tx {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 
-	return t.pool[hex.EncodeToString(txID)]
+	return t.pool[hex.EncodeToString(txID)].Tx
+}
+
+// Info returns statistics about the pool.
+func (t *TxPool) Info() (Info, error) {
+	usage, err := t.SizeBytes()
+	if err != nil {
+		return Info{}, err
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	info := Info{
+		Count: len(t.pool),
+		Usage: usage,
+	}
+	minFeeRate := math.MaxFloat64
+	for _, entry := range t.pool {
+		info.Bytes += entry.Size
+		if entry.FeeRate < minFeeRate {
+			minFeeRate = entry.FeeRate
+		}
+	}
+	if info.Count > 0 {
+		info.MinFeeRate = minFeeRate
+	}
+
+	return info, nil
 }
 
 // Remove deletes a transaction from the pool.
 func (t *TxPool) Remove(txID []byte) {
 	t.mu.Lock()
-	delete(t.pool, hex.EncodeToString(txID))
+	t.remove(hex.EncodeToString(txID))
 	t.mu.Unlock()
 }
 
+// RemoveConflicts deletes the transactions spending any of the outputs the one passed
+// spends, along with the ones depending on them. It's used when the transaction is
+// included in a block.
+//
+// It returns the number of transactions removed.
+func (t *TxPool) RemoveConflicts(transaction tx.Tx) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	txID := hex.EncodeToString(transaction.ID)
+	removed := 0
+	for _, in := range transaction.Inputs {
+		spenderID, ok := t.spenders[newOutPointKey(in.PrevOutput)]
+		if !ok || spenderID == txID {
+			continue
+		}
+
+		for descendantID := range t.descendants(spenderID) {
+			t.remove(descendantID)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// Spender returns the id of the transaction in the pool spending the output provided, if any.
+func (t *TxPool) Spender(outPoint tx.OutPoint) ([]byte, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	spenderID, ok := t.spenders[newOutPointKey(outPoint)]
+	if !ok {
+		return nil, false
+	}
+
+	return t.pool[spenderID].Tx.ID, true
+}
+
+// conflict returns the id of a transaction in the pool spending any of the outputs the one
+// passed spends, if any.
+func (t *TxPool) conflict(transaction tx.Tx) ([]byte, bool) {
+	for _, in := range transaction.Inputs {
+		if spenderID, ok := t.Spender(in.PrevOutput); ok {
+			return spenderID, true
+		}
+	}
+	return nil, false
+}
+
 // SizeBytes returns the size of the mempool in bytes.
 func (t *TxPool) SizeBytes() (int, error) {
 	t.mu.RLock()
+	defer t.mu.RUnlock()
+
 	b, err := gob.Encode(t.pool)
 	if err != nil {
 		return 0, err
 	}
-	t.mu.RUnlock()
 
 	return len(b), nil
 }
+
+// ancestors returns the identifiers of the transactions in the pool the one passed
+// depends on (directly or not), including itself.
+//
+// The caller must hold the lock.
+func (t *TxPool) ancestors(txID string) map[string]struct{} {
+	result := make(map[string]struct{})
+	if _, ok := t.pool[txID]; !ok {
+		return result
+	}
+
+	queue := []string{txID}
+	result[txID] = struct{}{}
+	for len(queue) > 0 {
+		childID := queue[0]
+		queue = queue[1:]
+
+		for _, in := range t.pool[childID].Tx.Inputs {
+			parentID := hex.EncodeToString(in.PrevOutput.TxID)
+			if _, ok := result[parentID]; ok {
+				continue
+			}
+			if _, ok := t.pool[parentID]; !ok {
+				continue
+			}
+			result[parentID] = struct{}{}
+			queue = append(queue, parentID)
+		}
+	}
+
+	return result
+}
+
+// descendants returns the set of in-pool transactions spending the outputs
+// of the one passed (directly or not), including itself.
+//
+// The caller must hold the lock.
+func (t *TxPool) descendants(txID string) map[string]struct{} {
+	result := make(map[string]struct{})
+	if _, ok := t.pool[txID]; !ok {
+		return result
+	}
+
+	queue := []string{txID}
+	result[txID] = struct{}{}
+	for len(queue) > 0 {
+		parentID := queue[0]
+		queue = queue[1:]
+
+		for childID := range t.children[parentID] {
+			if _, ok := result[childID]; ok {
+				continue
+			}
+			result[childID] = struct{}{}
+			queue = append(queue, childID)
+		}
+	}
+
+	return result
+}
+
+// sumSizes returns the number of transactions passed and the sum of their sizes.
+//
+// The caller must hold the lock.
+func (t *TxPool) sumSizes(txIDs map[string]struct{}) (count, size int) {
+	for txID := range txIDs {
+		size += t.pool[txID].Size
+	}
+	return len(txIDs), size
+}
+
+// remove deletes a transaction from the pool and the children index.
+//
+// The caller must hold the lock.
+func (t *TxPool) remove(txID string) {
+	entry, ok := t.pool[txID]
+	if !ok {
+		return
+	}
+	delete(t.pool, txID)
+
+	for _, in := range entry.Tx.Inputs {
+		parentID := hex.EncodeToString(in.PrevOutput.TxID)
+		delete(t.children[parentID], txID)
+		if len(t.children[parentID]) == 0 {
+			delete(t.children, parentID)
+		}
+
+		key := newOutPointKey(in.PrevOutput)
+		if t.spenders[key] == txID {
+			delete(t.spenders, key)
+		}
+	}
+}
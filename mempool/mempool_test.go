@@ -0,0 +1,158 @@
+package mempool
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GGP1/btcs/tx"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaveImport(t *testing.T) {
+	pool := NewTxPool()
+	tx1 := tx.Tx{ID: []byte("tx1")}
+	tx2 := tx.Tx{ID: []byte("tx2")}
+	pool.Add(tx1, 1000, 1)
+	pool.Add(tx2, 2000, 1)
+
+	path := filepath.Join(t.TempDir(), DefaultPath)
+	err := pool.Save(path)
+	assert.NoError(t, err)
+
+	restored := NewTxPool()
+	added, err := restored.Import(path, func(entry Entry) error {
+		if string(entry.Tx.ID) == "tx2" {
+			return errors.New("invalid")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, added)
+	assert.True(t, restored.Contains(tx1.ID))
+	assert.False(t, restored.Contains(tx2.ID))
+
+	entry := restored.Entries()[0]
+	assert.Equal(t, 1000, entry.Fee)
+	assert.NotZero(t, entry.Time)
+}
+
+func TestImportConflicting(t *testing.T) {
+	outPoint := tx.OutPoint{TxID: []byte("prev"), Index: 0}
+	pool := NewTxPool()
+	pool.Add(tx.Tx{ID: []byte("tx1"), Inputs: []tx.Input{{PrevOutput: outPoint}}}, 1000, 1)
+	pool.Add(tx.Tx{ID: []byte("tx2"), Inputs: []tx.Input{{PrevOutput: outPoint}}}, 2000, 1)
+
+	path := filepath.Join(t.TempDir(), DefaultPath)
+	err := pool.Save(path)
+	assert.NoError(t, err)
+
+	// Only one of the transactions spending the same output can be restored
+	restored := NewTxPool()
+	added, err := restored.Import(path, func(entry Entry) error { return nil })
+	assert.NoError(t, err)
+	assert.Equal(t, 1, added)
+	assert.Equal(t, 1, restored.Count())
+}
+
+func TestExpire(t *testing.T) {
+	pool := NewTxPool()
+	parent := tx.Tx{ID: []byte("parent")}
+	child := tx.Tx{
+		ID:     []byte("child"),
+		Inputs: []tx.Input{{PrevOutput: tx.OutPoint{TxID: parent.ID}}},
+	}
+	other := tx.Tx{ID: []byte("other")}
+
+	pool.AddEntry(Entry{Tx: parent, Time: time.Now().Add(-2 * time.Hour).Unix()})
+	pool.AddEntry(Entry{Tx: child, Time: time.Now().Unix()})
+	pool.AddEntry(Entry{Tx: other, Time: time.Now().Unix()})
+
+	// The child depends on the expired parent, so it's removed as well
+	removed := pool.Expire(time.Now().Add(-time.Hour))
+	assert.Equal(t, 2, removed)
+	assert.Equal(t, 1, pool.Count())
+	assert.True(t, pool.Contains(other.ID))
+}
+
+func TestRemoveChildrenIndex(t *testing.T) {
+	pool := NewTxPool()
+	parent := tx.Tx{ID: []byte("parent")}
+	child := tx.Tx{
+		ID:     []byte("child"),
+		Inputs: []tx.Input{{PrevOutput: tx.OutPoint{TxID: parent.ID}}},
+	}
+	pool.Add(parent, 1000, 1)
+	pool.Add(child, 1000, 1)
+
+	// The parent was included in a block, the child stays in the pool
+	pool.Remove(parent.ID)
+	assert.Equal(t, 1, pool.Count())
+
+	pool.Remove(child.ID)
+	assert.Empty(t, pool.children)
+}
+
+func TestSpenderRemoveConflicts(t *testing.T) {
+	pool := NewTxPool()
+	outPoint := tx.OutPoint{TxID: []byte("prev"), Index: 1}
+	spender := tx.Tx{ID: []byte("spender"), Inputs: []tx.Input{{PrevOutput: outPoint}}}
+	child := tx.Tx{
+		ID:     []byte("child"),
+		Inputs: []tx.Input{{PrevOutput: tx.OutPoint{TxID: spender.ID}}},
+	}
+	pool.Add(spender, 1000, 1)
+	pool.Add(child, 1000, 1)
+
+	spenderID, ok := pool.Spender(outPoint)
+	assert.True(t, ok)
+	assert.Equal(t, spender.ID, spenderID)
+	_, ok = pool.Spender(tx.OutPoint{TxID: outPoint.TxID, Index: 0})
+	assert.False(t, ok)
+
+	// A block includes another transaction spending the same output
+	blockTx := tx.Tx{ID: []byte("block tx"), Inputs: []tx.Input{{PrevOutput: outPoint}}}
+	assert.Equal(t, 2, pool.RemoveConflicts(blockTx))
+	assert.Zero(t, pool.Count())
+	_, ok = pool.Spender(outPoint)
+	assert.False(t, ok)
+}
+
+func TestAncestorsDescendants(t *testing.T) {
+	pool := NewTxPool()
+	parent := tx.Tx{ID: []byte("parent")}
+	child := tx.Tx{
+		ID:     []byte("child"),
+		Inputs: []tx.Input{{PrevOutput: tx.OutPoint{TxID: parent.ID}}},
+	}
+	grandchild := tx.Tx{
+		ID:     []byte("grandchild"),
+		Inputs: []tx.Input{{PrevOutput: tx.OutPoint{TxID: child.ID}}},
+	}
+	pool.Add(parent, 1000, 1)
+	pool.Add(child, 1000, 1)
+	pool.Add(grandchild, 1000, 1)
+
+	parentEntry, _ := pool.Entry(parent.ID)
+	childEntry, _ := pool.Entry(child.ID)
+	grandchildEntry, _ := pool.Entry(grandchild.ID)
+
+	count, size := pool.Ancestors(child.ID)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, parentEntry.Size+childEntry.Size, size)
+
+	count, size = pool.Descendants(child.ID)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, childEntry.Size+grandchildEntry.Size, size)
+
+	count, _ = pool.Ancestors(parent.ID)
+	assert.Equal(t, 1, count)
+	count, _ = pool.Descendants(parent.ID)
+	assert.Equal(t, 3, count)
+
+	count, size = pool.Ancestors([]byte("unknown"))
+	assert.Zero(t, count)
+	assert.Zero(t, size)
+}
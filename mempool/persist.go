@@ -0,0 +1,60 @@
+package mempool
+
+import (
+	"os"
+
+	"github.com/GGP1/btcs/encoding/gob"
+	"github.com/GGP1/btcs/logger"
+)
+
+// DefaultPath is the file where the pool is dumped when the node stops.
+const DefaultPath = "mempool.dat"
+
+// Save writes the pool entries to the file at path so they survive a restart.
+func (t *TxPool) Save(path string) error {
+	b, err := gob.Encode(t.Entries())
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, b, 0o644)
+}
+
+// Import reads the entries stored in the file at path and adds to the pool
+// the ones for which check returns nil. Entries already in the pool or spending
+// the same outputs as a transaction in it are skipped.
+//
+// It returns the number of entries that were added.
+func (t *TxPool) Import(path string, check func(entry Entry) error) (int, error) {
+	fileContent, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	entries, err := gob.Decode[[]Entry](fileContent)
+	if err != nil {
+		return 0, err
+	}
+
+	added := 0
+	for _, entry := range entries {
+		if t.Contains(entry.Tx.ID) {
+			continue
+		}
+
+		if spenderID, ok := t.conflict(entry.Tx); ok {
+			logger.Debugf("Discarding mempool entry %x: it spends the same outputs as %x", entry.Tx.ID, spenderID)
+			continue
+		}
+
+		if err := check(entry); err != nil {
+			logger.Debugf("Discarding mempool entry %x: %v", entry.Tx.ID, err)
+			continue
+		}
+
+		t.AddEntry(entry)
+		added++
+	}
+
+	return added, nil
+}
@@ -0,0 +1,100 @@
+package mempool
+
+import (
+	"fmt"
+
+	"github.com/GGP1/btcs/tx"
+)
+
+const (
+	// DefaultMinRelayFeeRate is the minimum fee rate (sat/byte) a transaction must pay
+	// to be accepted into the pool and relayed.
+	DefaultMinRelayFeeRate = 1.0
+
+	// MaxStandardTxSize is the maximum size in bytes a transaction can have to be relayed.
+	//
+	// In Bitcoin Core, it's 400,000 weight units (100,000 bytes).
+	MaxStandardTxSize = 100000
+
+	// pubKeyHashSize is the size of the public key hash standard outputs are locked with.
+	pubKeyHashSize = 20
+
+	// spendInputSize is the approximate size of an input spending an output,
+	// used to calculate the dust threshold.
+	spendInputSize = 148
+
+	policyDust        = "dust"
+	policyMinRelayFee = "min relay fee not met"
+)
+
+// PolicyError is returned when a transaction is valid but it doesn't comply with the
+// node's policy, so it's not accepted into the pool.
+type PolicyError struct {
+	// Policy is the name of the rule that failed
+	Policy string
+	Reason string
+}
+
+// Error returns the rule that failed and the reason.
+func (e PolicyError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Policy, e.Reason)
+}
+
+// RejectCode returns the code used to notify other peers about the rejection.
+func (e PolicyError) RejectCode() RejectCode {
+	switch e.Policy {
+	case policyDust:
+		return RejectDust
+	case policyMinRelayFee:
+		return RejectInsufficientFee
+	default:
+		return RejectNonstandard
+	}
+}
+
+// FeeRate returns the fee rate of a transaction in satoshis per byte.
+func FeeRate(fee, size int) float64 {
+	if size == 0 {
+		return 0
+	}
+	return float64(fee) / float64(size)
+}
+
+// DustThreshold returns the value below which an output is considered dust,
+// that is, when spending it would cost more than a third of its value.
+func DustThreshold(out tx.Output, minRelayFeeRate float64) int {
+	// Value (8 bytes), public key script length (1 byte) and script
+	outSize := 8 + 1 + len(out.PubKeyHash)
+	return int(3 * minRelayFeeRate * float64(outSize+spendInputSize))
+}
+
+// CheckTransactionStandard returns a PolicyError if the transaction, paying the fee
+// provided, is not standard.
+func CheckTransactionStandard(t tx.Tx, fee int, minRelayFeeRate float64) error {
+	if t.IsCoinbase() {
+		return PolicyError{"coinbase", "coinbase transactions are only valid in blocks"}
+	}
+
+	size := t.SerializeSize()
+	if size > MaxStandardTxSize {
+		return PolicyError{"tx-size", fmt.Sprintf("size of %d bytes exceeds the maximum of %d", size, MaxStandardTxSize)}
+	}
+
+	for i, out := range t.Outputs {
+		if len(out.PubKeyHash) != pubKeyHashSize {
+			return PolicyError{"scriptpubkey", fmt.Sprintf("output %d is not locked with a public key hash", i)}
+		}
+
+		if dustThreshold := DustThreshold(out, minRelayFeeRate); out.Value < dustThreshold {
+			return PolicyError{policyDust, fmt.Sprintf("output %d value of %d SAT is below the dust threshold of %d SAT",
+				i, out.Value, dustThreshold)}
+		}
+	}
+
+	if feeRate := FeeRate(fee, size); feeRate < minRelayFeeRate {
+		return PolicyError{policyMinRelayFee, fmt.Sprintf("fee rate of %.2f SAT/byte is below the minimum of %.2f SAT/byte",
+			feeRate, minRelayFeeRate)}
+	}
+
+	return nil
+}
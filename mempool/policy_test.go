@@ -0,0 +1,56 @@
+package mempool
+
+import (
+	"testing"
+
+	"github.com/GGP1/btcs/tx"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckTransactionStandard(t *testing.T) {
+	pubKeyHash := make([]byte, pubKeyHashSize)
+	input := tx.Input{
+		Signature:  make([]byte, 71),
+		PubKey:     make([]byte, 64),
+		PrevOutput: tx.OutPoint{TxID: make([]byte, 32)},
+	}
+	newTx := func(values ...int) tx.Tx {
+		outputs := make([]tx.Output, 0, len(values))
+		for _, value := range values {
+			outputs = append(outputs, tx.Output{PubKeyHash: pubKeyHash, Value: value})
+		}
+		return tx.Tx{Inputs: []tx.Input{input}, Outputs: outputs}
+	}
+
+	cases := []struct {
+		desc   string
+		tx     tx.Tx
+		fee    int
+		policy string
+	}{
+		{desc: "standard", tx: newTx(100000), fee: 1000},
+		{desc: "dust", tx: newTx(100000, 100), fee: 1000, policy: "dust"},
+		{desc: "min relay fee", tx: newTx(100000), fee: 10, policy: "min relay fee not met"},
+		{
+			desc:   "script",
+			tx:     tx.Tx{Inputs: []tx.Input{input}, Outputs: []tx.Output{{PubKeyHash: []byte{1}, Value: 100000}}},
+			fee:    1000,
+			policy: "scriptpubkey",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := CheckTransactionStandard(tc.tx, tc.fee, DefaultMinRelayFeeRate)
+			if tc.policy == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			var policyErr PolicyError
+			assert.ErrorAs(t, err, &policyErr)
+			assert.Equal(t, tc.policy, policyErr.Policy)
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package mining
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/GGP1/btcs/block"
+	"github.com/GGP1/btcs/logger"
+	"github.com/GGP1/btcs/mempool"
+)
+
+// ControllerConfig contains the facilities the controller needs to mine on top of the chain.
+type ControllerConfig struct {
+	TxPool *mempool.TxPool
+	// Tip returns the last block of the chain
+	Tip func() (block.Block, error)
+	// Submit adds a mined block to the chain
+	Submit func(b block.Block) error
+}
+
+// ControllerInfo contains the state of the controller.
+type ControllerInfo struct {
+	Generating bool
+	// Number of goroutines mining
+	Threads int
+	// Hashes per second
+	HashRate     float64
+	BlocksFound  uint64
+	CoinbaseAddr string
+}
+
+// Controller starts, stops and reconfigures a CPU miner at runtime.
+type Controller struct {
+	config ControllerConfig
+
+	// mu protects the configuration and the mining loop lifecycle
+	mu           *sync.Mutex
+	coinbaseAddr string
+	numWorkers   int
+	miner        *CPUMiner
+	// stop cancels the mining loop, it's nil if it's not running
+	stop func()
+	done chan struct{}
+
+	// blockMu protects cancelBlock
+	blockMu *sync.Mutex
+	// cancelBlock cancels the block being mined
+	cancelBlock context.CancelFunc
+
+	blocksFound atomic.Uint64
+}
+
+// NewController returns a mining controller, mining doesn't start until Start is called.
+func NewController(config ControllerConfig) *Controller {
+	return &Controller{
+		config:      config,
+		mu:          &sync.Mutex{},
+		blockMu:     &sync.Mutex{},
+		cancelBlock: func() {},
+	}
+}
+
+// CoinbaseAddress returns the address where the rewards are sent.
+func (c *Controller) CoinbaseAddress() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.coinbaseAddr
+}
+
+// Info returns the state of the controller.
+func (c *Controller) Info() ControllerInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info := ControllerInfo{
+		Generating:   c.running(),
+		BlocksFound:  c.blocksFound.Load(),
+		CoinbaseAddr: c.coinbaseAddr,
+	}
+	if info.Generating {
+		info.Threads = c.miner.numWorkers
+		info.HashRate = c.miner.HashRate()
+	}
+
+	return info
+}
+
+// NewTip cancels the block being mined so the miner starts working on top of the new tip.
+func (c *Controller) NewTip() {
+	c.blockMu.Lock()
+	defer c.blockMu.Unlock()
+
+	c.cancelBlock()
+}
+
+// SetCoinbaseAddress sets the address where the rewards are sent. If the miner is
+// running, it's restarted.
+func (c *Controller) SetCoinbaseAddress(address string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.coinbaseAddr = address
+	if c.stop != nil {
+		c.restart()
+	}
+}
+
+// Start starts mining with the number of goroutines provided, if it's lower than one,
+// the number of logical CPUs is used. If the miner is running, it's restarted.
+func (c *Controller) Start(numWorkers int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.coinbaseAddr == "" {
+		return errors.New("no coinbase address set")
+	}
+
+	c.numWorkers = numWorkers
+	c.restart()
+	return nil
+}
+
+// Stop stops mining and waits until the miner is done.
+func (c *Controller) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.halt()
+}
+
+// restart stops the mining loop, if it's running, and starts a new one.
+//
+// The caller must hold the lock.
+func (c *Controller) restart() {
+	c.halt()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.miner = NewCPUMiner(c.coinbaseAddr, c.config.TxPool, c.numWorkers)
+	c.stop = cancel
+	c.done = make(chan struct{})
+	go c.run(ctx, c.miner, c.done)
+
+	logger.Infof("Mining started with %d workers, rewards will be send to %s", c.miner.numWorkers, c.coinbaseAddr)
+}
+
+// halt stops the mining loop and waits until it's done.
+//
+// The caller must hold the lock.
+func (c *Controller) halt() {
+	if c.stop == nil {
+		return
+	}
+
+	c.stop()
+	<-c.done
+	c.stop = nil
+	logger.Info("Mining stopped")
+}
+
+// running returns whether the mining loop is running, it may have stopped because of an error.
+//
+// The caller must hold the lock.
+func (c *Controller) running() bool {
+	if c.stop == nil {
+		return false
+	}
+
+	select {
+	case <-c.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// run mines blocks on top of the chain tip until the context is cancelled.
+func (c *Controller) run(ctx context.Context, miner *CPUMiner, done chan<- struct{}) {
+	defer close(done)
+
+	for ctx.Err() == nil {
+		// The tip is read while holding the lock so a call to NewTip either happens
+		// before (and we get the new tip) or cancels this block
+		c.blockMu.Lock()
+		prevBlock, err := c.config.Tip()
+		blockCtx, cancel := context.WithCancel(ctx)
+		c.cancelBlock = cancel
+		c.blockMu.Unlock()
+		if err != nil {
+			cancel()
+			logger.Error("Mining: ", err)
+			return
+		}
+
+		b, err := miner.Mine(blockCtx, &prevBlock)
+		cancel()
+		if err != nil {
+			logger.Error("Mining: ", err)
+			return
+		}
+
+		// The block was cancelled, either by a new tip or a stop
+		if b.Hash == nil {
+			continue
+		}
+
+		if err := c.config.Submit(b); err != nil {
+			logger.Error("Mining: submitting block: ", err)
+			continue
+		}
+		c.blocksFound.Add(1)
+	}
+}
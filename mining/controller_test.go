@@ -0,0 +1,61 @@
+package mining
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GGP1/btcs/block"
+	"github.com/GGP1/btcs/chaincfg"
+	"github.com/GGP1/btcs/mempool"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestController(t *testing.T) {
+	// Regtest blocks are mined instantly
+	chaincfg.ActiveParams = &chaincfg.RegressionNetParams
+	defer func() { chaincfg.ActiveParams = &chaincfg.MainNetParams }()
+
+	genesis, err := block.NewGenesis()
+	assert.NoError(t, err)
+
+	mu := &sync.Mutex{}
+	tip := *genesis
+	controller := NewController(ControllerConfig{
+		TxPool: mempool.NewTxPool(),
+		Tip: func() (block.Block, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return tip, nil
+		},
+		Submit: func(b block.Block) error {
+			mu.Lock()
+			defer mu.Unlock()
+			tip = b
+			return nil
+		},
+	})
+
+	assert.Error(t, controller.Start(2), "Started without a coinbase address")
+
+	controller.SetCoinbaseAddress("1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa")
+	assert.NoError(t, controller.Start(2))
+
+	info := controller.Info()
+	assert.True(t, info.Generating)
+	assert.Equal(t, 2, info.Threads)
+
+	assert.Eventually(t, func() bool {
+		return controller.Info().BlocksFound >= 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	controller.Stop()
+	info = controller.Info()
+	assert.False(t, info.Generating)
+	assert.Zero(t, info.HashRate)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, int32(info.BlocksFound), tip.Height)
+}
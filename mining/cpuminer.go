@@ -1,146 +1,282 @@
 package mining
 
 import (
-	"crypto/sha256"
+	"context"
+	"encoding/binary"
 	"fmt"
 	"math"
 	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/GGP1/btcs/block"
+	"github.com/GGP1/btcs/chaincfg"
 	"github.com/GGP1/btcs/logger"
 	"github.com/GGP1/btcs/mempool"
+	"github.com/GGP1/btcs/pow"
 	"github.com/GGP1/btcs/tx"
-	"github.com/GGP1/btcs/wallet"
 )
 
-const maxNonce = math.MaxUint32
+const (
+	maxNonce = math.MaxUint32
+
+	// hashRateInterval is the time between hash rate reports.
+	hashRateInterval = 10 * time.Second
+)
 
 // CPUMiner mines blocks using the CPU.
 type CPUMiner struct {
-	txPool    *mempool.TxPool
-	newBlocks <-chan block.Block
+	txPool *mempool.TxPool
+	// hasher is the proof-of-work function of the active network
+	hasher pow.Hasher
 	// coinbaseAddr is the address where mining rewards will be send
 	coinbaseAddr string
+	// numWorkers is the number of goroutines the nonce space is split across
+	numWorkers int
+	// hashes is the number of hashes computed since the last hash rate report
+	hashes atomic.Uint64
+	// hashRate contains the float64 bits of the last hash rate calculated (hashes per second)
+	hashRate atomic.Uint64
 }
 
-// NewCPUMiner returns an object that mines blocks with the CPU.
-func NewCPUMiner(accountName string, txPool *mempool.TxPool, newBlocks <-chan block.Block) (Miner, error) {
-	wallet, err := wallet.Load()
-	if err != nil {
-		return nil, err
-	}
-
-	if !wallet.AccountExists(accountName) {
-		return nil, fmt.Errorf("account %q does not exist", accountName)
-	}
-
-	coinbaseAddr, err := wallet.Account(accountName).NewAddress(true)
-	if err != nil {
-		return nil, err
-	}
-
-	if err := wallet.Save(); err != nil {
-		return nil, err
+// NewCPUMiner returns an object that mines blocks with the CPU and sends the rewards
+// to coinbaseAddr.
+//
+// If numWorkers is lower than one, the number of logical CPUs is used.
+func NewCPUMiner(coinbaseAddr string, txPool *mempool.TxPool, numWorkers int) *CPUMiner {
+	if numWorkers < 1 {
+		numWorkers = runtime.NumCPU()
 	}
 
-	logger.Info("Mining rewards and fees will be send to: ", coinbaseAddr)
-
 	return &CPUMiner{
 		coinbaseAddr: coinbaseAddr,
 		txPool:       txPool,
-		newBlocks:    newBlocks,
-	}, nil
+		hasher:       chaincfg.ActiveParams.PowHasher,
+		numWorkers:   numWorkers,
+	}
 }
 
-// Mine solves a block's puzzle and returns the mined block if it suceeds.
-//
-// If lastBlock is nil, it will mine the genesis block.
+// HashRate returns the number of hashes per second computed by the miner.
+func (c *CPUMiner) HashRate() float64 {
+	return math.Float64frombits(c.hashRate.Load())
+}
+
+// Mine solves the puzzle of the block following prevBlock and returns the mined block
+// if it suceeds.
 //
-// It must be called inside a goroutine.
-func (c *CPUMiner) Mine(prevBlock *block.Block) (block.Block, error) {
-	b, err := c.buildBlock(prevBlock)
+// If the context is cancelled, it returns an empty block.
+func (c *CPUMiner) Mine(ctx context.Context, prevBlock *block.Block) (block.Block, error) {
+	b, fees, err := c.buildBlock(prevBlock)
 	if err != nil {
 		return block.Block{}, err
 	}
 
-	if err := c.mine(b); err != nil {
+	if err := c.mine(ctx, b, fees); err != nil {
 		return block.Block{}, err
 	}
 
-	// Remove the block's transactions from the mempool
-	// Ignore the first transaction (coinbase)
-	for _, tx := range b.Transactions[1:] {
-		c.txPool.Remove(tx.ID)
+	// Mining was cancelled
+	if b.Hash == nil {
+		return block.Block{}, nil
 	}
 
 	return *b, nil
 }
 
 // buildBlock creates the block and populates it with transactions from the pool.
-func (c *CPUMiner) buildBlock(prevBlock *block.Block) (*block.Block, error) {
-	// TODO:
-	// - Take transactions from the pool until block is full (reaches size limit).
-	// - Prioritize transactions with higher SAT/bytes fees.
-	transactions := make([]tx.Tx, 0, c.txPool.Count())
-	fees := 0
-	_ = c.txPool.ForEach(func(txID string, tx tx.Tx) error {
-		transactions = append(transactions, tx)
-		fees += tx.Fee
-		return nil
-	})
+// It returns the block and the sum of its transactions fees.
+func (c *CPUMiner) buildBlock(prevBlock *block.Block) (*block.Block, int, error) {
+	template := NewBlockTemplate(c.txPool, prevBlock)
 
 	// Create the transaction that sends us the subsidy and fees if we succeed
-	coinbaseTx, err := tx.NewCoinbase(c.coinbaseAddr, "", fees, prevBlock.Height+1)
+	coinbaseTx, err := c.newCoinbase(template.Fees, template.Height, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	b, err := template.NewBlock(*coinbaseTx)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	transactions = append([]tx.Tx{*coinbaseTx}, transactions...)
-	return block.NewBlock(prevBlock, transactions)
+	return b, template.Fees, nil
+}
+
+// newCoinbase returns the coinbase transaction of the block at the height provided.
+//
+// The extra nonce is included in the coinbase data so the block merkle root changes
+// when the nonce space is exhausted.
+func (c *CPUMiner) newCoinbase(fees int, height int32, extraNonce uint64) (*tx.Tx, error) {
+	data := fmt.Sprintf("%d", extraNonce)
+	return tx.NewCoinbase(c.coinbaseAddr, data, fees, height)
 }
 
 // mine hashes the block data and different nonces until it finds a hash lower than the target.
-func (c *CPUMiner) mine(b *block.Block) error {
+//
+// When the nonce space is exhausted, the coinbase extra nonce is incremented and the
+// search starts over. If mining is cancelled, the block hash is left empty.
+func (c *CPUMiner) mine(ctx context.Context, b *block.Block, fees int) error {
+	stopReport := c.reportHashRate()
+	defer stopReport()
+
+	for extraNonce := uint64(0); ; extraNonce++ {
+		if extraNonce > 0 {
+			logger.Debugf("Nonce space exhausted, rolling extra nonce to %d", extraNonce)
+			coinbaseTx, err := c.newCoinbase(fees, b.Height, extraNonce)
+			if err != nil {
+				return err
+			}
+			b.Transactions[0] = *coinbaseTx
+			if err := b.UpdateMerkleRoot(); err != nil {
+				return err
+			}
+		}
+
+		found, cancelled, err := c.solve(ctx, b)
+		if err != nil {
+			return err
+		}
+
+		if cancelled {
+			logger.Debug("Mining cancelled")
+			return nil
+		}
+
+		if found {
+			logger.Infof("New block mined: %x", b.Hash)
+			return nil
+		}
+	}
+}
+
+// solve splits the nonce space across the miner workers and searches for a nonce
+// that makes the block hash lower than the target.
+//
+// It returns whether a solution was found and whether the search was cancelled.
+func (c *CPUMiner) solve(ctx context.Context, b *block.Block) (bool, bool, error) {
 	data, err := b.PowData()
 	if err != nil {
-		return err
+		return false, false, err
 	}
 
 	target := block.CompactToBig(b.Bits)
+	quit := make(chan struct{})
+	solutions := make(chan uint32, c.numWorkers)
+	wg := &sync.WaitGroup{}
 
-	var (
-		hashInt big.Int
-		hash    [sha256.Size]byte
-	)
+	chunkSize := (uint64(maxNonce) + 1) / uint64(c.numWorkers)
+	for i := 0; i < c.numWorkers; i++ {
+		start := uint64(i) * chunkSize
+		end := start + chunkSize - 1
+		if i == c.numWorkers-1 {
+			end = maxNonce
+		}
 
-Loop:
-	for b.Nonce < maxNonce {
-		select {
-		case <-c.newBlocks:
-			// Stop mining if another node has already completed the task
-			logger.Info("New block received")
-			return nil
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.work(data, target, start, end, quit, solutions)
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
 
+	select {
+	case nonce := <-solutions:
+		close(quit)
+		<-done
+		b.Nonce = nonce
+		b.Hash = c.powHash(data, nonce)
+		return true, false, nil
+
+	case <-ctx.Done():
+		close(quit)
+		<-done
+		return false, true, nil
+
+	case <-done:
+		// All workers finished, check if one found a solution right before
+		select {
+		case nonce := <-solutions:
+			b.Nonce = nonce
+			b.Hash = c.powHash(data, nonce)
+			return true, false, nil
 		default:
-			n, err := block.IntToBytes(int64(b.Nonce))
-			if err != nil {
-				return err
-			}
+			return false, false, nil
+		}
+	}
+}
+
+// work hashes the block data with the nonces in the range [start, end] and sends the
+// first one that produces a hash lower than the target.
+func (c *CPUMiner) work(data []byte, target *big.Int, start, end uint64, quit <-chan struct{}, solutions chan<- uint32) {
+	var hashInt big.Int
+	// Check for cancellations every hashesPerCheck hashes
+	const hashesPerCheck = 1 << 12
 
-			fullData := append(data, n...)
-			hash = sha256.Sum256(fullData)
+	// Reuse the buffer, only the nonce at the end changes
+	fullData := make([]byte, len(data)+8)
+	copy(fullData, data)
 
-			// The hash has to be lower than the target to be accepted
-			hashInt.SetBytes(hash[:])
-			if hashInt.Cmp(target) <= 0 {
-				b.Hash = hash[:]
-				break Loop
+	for nonce := start; nonce <= end; nonce++ {
+		if nonce%hashesPerCheck == 0 {
+			select {
+			case <-quit:
+				return
+			default:
+				c.hashes.Add(hashesPerCheck)
 			}
+		}
+
+		binary.BigEndian.PutUint64(fullData[len(data):], nonce)
+		hash := c.hasher.Hash(fullData)
 
-			b.Nonce++
+		// The hash has to be lower than the target to be accepted
+		hashInt.SetBytes(hash)
+		if hashInt.Cmp(target) <= 0 {
+			solutions <- uint32(nonce)
+			return
 		}
 	}
+}
+
+// reportHashRate periodically calculates and logs the miner hash rate.
+// The function returned stops the reports.
+func (c *CPUMiner) reportHashRate() func() {
+	ticker := time.NewTicker(hashRateInterval)
+	stop := make(chan struct{})
+	c.hashes.Store(0)
+
+	go func() {
+		last := time.Now()
+		for {
+			select {
+			case <-stop:
+				ticker.Stop()
+				return
+
+			case now := <-ticker.C:
+				hashRate := float64(c.hashes.Swap(0)) / now.Sub(last).Seconds()
+				c.hashRate.Store(math.Float64bits(hashRate))
+				last = now
+				logger.Infof("Hash rate: %.2f kH/s", hashRate/1000)
+			}
+		}
+	}()
+
+	return func() { close(stop) }
+}
 
-	logger.Infof("New block mined: %x", b.Hash)
-	return nil
+// powHash returns the hash of the block data with the nonce appended, as in block.IsValid.
+func (c *CPUMiner) powHash(data []byte, nonce uint32) []byte {
+	fullData := make([]byte, len(data)+8)
+	copy(fullData, data)
+	binary.BigEndian.PutUint64(fullData[len(data):], uint64(nonce))
+	return c.hasher.Hash(fullData)
 }
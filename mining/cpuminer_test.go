@@ -0,0 +1,47 @@
+package mining
+
+import (
+	"context"
+	"testing"
+
+	"github.com/GGP1/btcs/block"
+	"github.com/GGP1/btcs/mempool"
+	"github.com/GGP1/btcs/tx"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMine(t *testing.T) {
+	genesis, err := block.NewGenesis()
+	assert.NoError(t, err)
+
+	miner := NewCPUMiner("1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa", mempool.NewTxPool(), 4)
+
+	b, fees, err := miner.buildBlock(genesis)
+	assert.NoError(t, err)
+	assert.Zero(t, fees)
+
+	// Use an easy target so the test is fast
+	b.Bits = 0x1f7fffff
+	assert.NoError(t, miner.mine(context.Background(), b, fees))
+	assert.NotNil(t, b.Hash)
+	assert.True(t, b.IsValid())
+	assert.Equal(t, []tx.Tx{b.Transactions[0]}, b.Transactions)
+}
+
+func TestMineCancelled(t *testing.T) {
+	genesis, err := block.NewGenesis()
+	assert.NoError(t, err)
+
+	miner := NewCPUMiner("1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa", mempool.NewTxPool(), 2)
+
+	b, fees, err := miner.buildBlock(genesis)
+	assert.NoError(t, err)
+
+	// Impossible target, only a cancellation can stop the miner
+	b.Bits = 0x01000001
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NoError(t, miner.mine(ctx, b, fees))
+	assert.Nil(t, b.Hash)
+}
@@ -1,10 +1,40 @@
 package mining
 
 import (
+	"context"
+	"fmt"
+
 	"github.com/GGP1/btcs/block"
+	"github.com/GGP1/btcs/wallet"
 )
 
 // Miner provides facilities for solving blocks.
 type Miner interface {
-	Mine(lastBlock *block.Block) (block.Block, error)
+	// Mine solves the block following prevBlock, it returns an empty block if the context
+	// is cancelled before
+	Mine(ctx context.Context, prevBlock *block.Block) (block.Block, error)
+}
+
+// CoinbaseAddress returns a new address of the wallet account provided where mining
+// rewards can be sent.
+func CoinbaseAddress(accountName string) (string, error) {
+	wallet, err := wallet.Load()
+	if err != nil {
+		return "", err
+	}
+
+	if !wallet.AccountExists(accountName) {
+		return "", fmt.Errorf("account %q does not exist", accountName)
+	}
+
+	coinbaseAddr, err := wallet.Account(accountName).NewAddress(true)
+	if err != nil {
+		return "", err
+	}
+
+	if err := wallet.Save(); err != nil {
+		return "", err
+	}
+
+	return coinbaseAddr, nil
 }
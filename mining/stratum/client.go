@@ -0,0 +1,468 @@
+package stratum
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GGP1/btcs/block"
+	"github.com/GGP1/btcs/chaincfg"
+	"github.com/GGP1/btcs/encoding/gob"
+	"github.com/GGP1/btcs/logger"
+	"github.com/GGP1/btcs/pow"
+	"github.com/GGP1/btcs/tx"
+	"github.com/GGP1/btcs/tx/merkle"
+)
+
+// userAgent is sent to the server when subscribing.
+const userAgent = "btcs-poolminer/1.0"
+
+// clientJob is a job received from the server.
+type clientJob struct {
+	id           string
+	prevHash     []byte
+	coinbaseAddr string
+	fees         int
+	height       int32
+	branch       [][]byte
+	version      int32
+	bits         uint32
+	timestamp    int64
+}
+
+// Client is a pool miner that solves the jobs handed out by a stratum server.
+type Client struct {
+	conn       net.Conn
+	scanner    *bufio.Scanner
+	writeMu    *sync.Mutex
+	workerName string
+	numWorkers int
+	nextID     atomic.Uint64
+	// hasher is the proof-of-work function of the network the pool mines on
+	hasher pow.Hasher
+
+	extraNonce1     string
+	extraNonce2Size int
+
+	mu         *sync.Mutex
+	job        *clientJob
+	difficulty float64
+	authorized bool
+	// stopMining cancels the workers solving the current job
+	stopMining func()
+
+	hashes   atomic.Uint64
+	accepted atomic.Uint64
+	rejected atomic.Uint64
+}
+
+// Dial connects to the stratum server at address, subscribes and authorizes the worker.
+//
+// If numWorkers is lower than one, the number of logical CPUs is used.
+func Dial(address, workerName, password string, numWorkers int) (*Client, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	if numWorkers < 1 {
+		numWorkers = runtime.NumCPU()
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), maxMessageSize)
+	c := &Client{
+		conn:       conn,
+		scanner:    scanner,
+		writeMu:    &sync.Mutex{},
+		workerName: workerName,
+		numWorkers: numWorkers,
+		hasher:     chaincfg.ActiveParams.PowHasher,
+		mu:         &sync.Mutex{},
+		difficulty: DefaultDifficulty,
+		stopMining: func() {},
+	}
+
+	if err := c.subscribe(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("subscribing: %w", err)
+	}
+	if err := c.authorize(password); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("authorizing: %w", err)
+	}
+
+	return c, nil
+}
+
+// Accepted returns the number of shares accepted by the server.
+func (c *Client) Accepted() uint64 {
+	return c.accepted.Load()
+}
+
+// Close stops mining and closes the connection with the server.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.stopMining()
+	c.stopMining = func() {}
+	// Don't start mining again on new notifications
+	c.authorized = false
+	c.mu.Unlock()
+
+	return c.conn.Close()
+}
+
+// Run processes the server messages until the connection is closed.
+func (c *Client) Run() error {
+	stopReport := c.reportStats()
+	defer stopReport()
+
+	for {
+		msg, err := c.read()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		if msg.Method != "" {
+			if err := c.handleNotification(msg); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Responses to "mining.submit"
+		var accepted bool
+		if msg.Error != nil || json.Unmarshal(msg.Result, &accepted) != nil || !accepted {
+			c.rejected.Add(1)
+			logger.Infof("Share rejected: %v", msg.Error)
+			continue
+		}
+		c.accepted.Add(1)
+		logger.Debug("Share accepted")
+	}
+}
+
+// subscribe asks the server for jobs and stores the extra nonce assigned.
+func (c *Client) subscribe() error {
+	result, err := c.call(methodSubscribe, userAgent)
+	if err != nil {
+		return err
+	}
+
+	var fields []json.RawMessage
+	if err := json.Unmarshal(result, &fields); err != nil {
+		return err
+	}
+
+	var subscriptions any
+	if err := parseParams(fields, &subscriptions, &c.extraNonce1, &c.extraNonce2Size); err != nil {
+		return err
+	}
+
+	logger.Debugf("Subscribed with extra nonce %s", c.extraNonce1)
+	return nil
+}
+
+// authorize registers the worker in the server and starts mining.
+func (c *Client) authorize(password string) error {
+	result, err := c.call(methodAuthorize, c.workerName, password)
+	if err != nil {
+		return err
+	}
+
+	var ok bool
+	if err := json.Unmarshal(result, &ok); err != nil {
+		return err
+	}
+	if !ok {
+		return errUnauthorized
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.authorized = true
+	c.restartMining()
+
+	logger.Infof("Worker %q authorized", c.workerName)
+	return nil
+}
+
+// call sends a request and waits for its response, handling the notifications
+// received in the meantime.
+func (c *Client) call(method string, params ...any) (json.RawMessage, error) {
+	id := c.nextID.Add(1)
+	if err := c.write(request{ID: json.RawMessage(strconv.FormatUint(id, 10)), Method: method, Params: params}); err != nil {
+		return nil, err
+	}
+
+	for {
+		msg, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+
+		if msg.Method != "" {
+			if err := c.handleNotification(msg); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if string(msg.ID) != strconv.FormatUint(id, 10) {
+			continue
+		}
+		if msg.Error != nil {
+			return nil, msg.Error
+		}
+		return msg.Result, nil
+	}
+}
+
+// handleNotification updates the difficulty or the job being mined.
+func (c *Client) handleNotification(msg incoming) error {
+	switch msg.Method {
+	case methodSetDifficulty:
+		var difficulty float64
+		if err := parseParams(msg.Params, &difficulty); err != nil {
+			return fmt.Errorf("%s: %w", msg.Method, err)
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.difficulty = difficulty
+		logger.Debugf("Share difficulty set to %.2f", difficulty)
+
+	case methodNotify:
+		j, err := parseJob(msg.Params)
+		if err != nil {
+			return fmt.Errorf("%s: %w", msg.Method, err)
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.job = j
+		logger.Debugf("New job %s at height %d", j.id, j.height)
+
+	default:
+		logger.Debugf("Unknown notification %q", msg.Method)
+		return nil
+	}
+
+	c.restartMining()
+	return nil
+}
+
+// parseJob decodes the parameters of a "mining.notify" message.
+func parseJob(params []json.RawMessage) (*clientJob, error) {
+	var (
+		j                     clientJob
+		prevHash, bits, nTime string
+		branch                []string
+		cleanJobs             bool
+	)
+	err := parseParams(params,
+		&j.id, &prevHash, &j.coinbaseAddr, &j.fees, &j.height,
+		&branch, &j.version, &bits, &nTime, &cleanJobs,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if j.prevHash, err = hex.DecodeString(prevHash); err != nil {
+		return nil, err
+	}
+	for _, h := range branch {
+		hash, err := hex.DecodeString(h)
+		if err != nil {
+			return nil, err
+		}
+		j.branch = append(j.branch, hash)
+	}
+
+	b, err := strconv.ParseUint(bits, 16, 32)
+	if err != nil {
+		return nil, err
+	}
+	j.bits = uint32(b)
+
+	if j.timestamp, err = strconv.ParseInt(nTime, 16, 64); err != nil {
+		return nil, err
+	}
+
+	return &j, nil
+}
+
+// restartMining cancels the current workers and starts new ones with the current job
+// and difficulty.
+//
+// The caller must hold the lock.
+func (c *Client) restartMining() {
+	c.stopMining()
+	c.stopMining = func() {}
+	if !c.authorized || c.job == nil {
+		return
+	}
+
+	j := c.job
+	// Shares harder than the network difficulty would skip blocks, the server caps them too
+	target := DifficultyToTarget(c.difficulty)
+	if networkTarget := block.CompactToBig(j.bits); target.Cmp(networkTarget) < 0 {
+		target = networkTarget
+	}
+	quit := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	for i := 0; i < c.numWorkers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := c.work(j, target, uint32(i), quit); err != nil {
+				logger.Error("Mining: ", err)
+			}
+		}(i)
+	}
+
+	c.stopMining = func() {
+		close(quit)
+		wg.Wait()
+	}
+}
+
+// work searches for shares rolling the extra nonce from start, in steps of the number of workers
+// so each one has a disjoint range.
+func (c *Client) work(j *clientJob, target *big.Int, start uint32, quit <-chan struct{}) error {
+	var hashInt big.Int
+	// Check for cancellations every hashesPerCheck hashes
+	const hashesPerCheck = 1 << 12
+
+	for extraNonce2 := start; ; extraNonce2 += uint32(c.numWorkers) {
+		extraNonce2Hex := fmt.Sprintf("%0*x", c.extraNonce2Size*2, extraNonce2)
+		coinbaseTx, err := tx.NewCoinbase(j.coinbaseAddr, c.extraNonce1+extraNonce2Hex, j.fees, j.height)
+		if err != nil {
+			return err
+		}
+		encodedCoinbase, err := gob.Encode(*coinbaseTx)
+		if err != nil {
+			return err
+		}
+
+		header := block.Block{
+			Header: &block.Header{
+				PrevBlockHash:  j.prevHash,
+				MerkleRootHash: merkle.RootFromBranch(coinbaseTx.Serialize(), j.branch),
+				Timestamp:      j.timestamp,
+				Version:        j.version,
+				Bits:           j.bits,
+			},
+		}
+		data, err := header.PowData()
+		if err != nil {
+			return err
+		}
+
+		// Only the nonce at the end changes
+		fullData := make([]byte, len(data)+8)
+		copy(fullData, data)
+
+		for nonce := uint64(0); nonce <= math.MaxUint32; nonce++ {
+			if nonce%hashesPerCheck == 0 {
+				select {
+				case <-quit:
+					return nil
+				default:
+					c.hashes.Add(hashesPerCheck)
+				}
+			}
+
+			binary.BigEndian.PutUint64(fullData[len(data):], nonce)
+			hashInt.SetBytes(c.hasher.Hash(fullData))
+			if hashInt.Cmp(target) > 0 {
+				continue
+			}
+
+			err := c.write(request{
+				ID:     json.RawMessage(strconv.FormatUint(c.nextID.Add(1), 10)),
+				Method: methodSubmit,
+				Params: []any{
+					c.workerName,
+					j.id,
+					extraNonce2Hex,
+					strconv.FormatInt(j.timestamp, 16),
+					fmt.Sprintf("%08x", nonce),
+					hex.EncodeToString(encodedCoinbase),
+				},
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// reportStats periodically logs the hash rate and the shares submitted.
+// The function returned stops the reports.
+func (c *Client) reportStats() func() {
+	ticker := time.NewTicker(10 * time.Second)
+	stop := make(chan struct{})
+
+	go func() {
+		last := time.Now()
+		for {
+			select {
+			case <-stop:
+				ticker.Stop()
+				return
+
+			case now := <-ticker.C:
+				hashRate := float64(c.hashes.Swap(0)) / now.Sub(last).Seconds()
+				last = now
+				logger.Infof("Hash rate: %.2f kH/s, accepted shares: %d, rejected shares: %d",
+					hashRate/1000,
+					c.accepted.Load(),
+					c.rejected.Load())
+			}
+		}
+	}()
+
+	return func() { close(stop) }
+}
+
+func (c *Client) read() (incoming, error) {
+	if !c.scanner.Scan() {
+		if err := c.scanner.Err(); err != nil {
+			return incoming{}, err
+		}
+		return incoming{}, net.ErrClosed
+	}
+
+	var msg incoming
+	if err := json.Unmarshal(c.scanner.Bytes(), &msg); err != nil {
+		return incoming{}, err
+	}
+	return msg, nil
+}
+
+func (c *Client) write(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err = c.conn.Write(append(data, '\n'))
+	return err
+}
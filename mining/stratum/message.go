@@ -0,0 +1,118 @@
+package stratum
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/GGP1/btcs/block"
+)
+
+// Stratum v1 uses JSON-RPC 1.0 messages delimited by new lines.
+//
+// The methods follow the original specification, the only difference is that, as
+// the transaction ids contain a random nonce, workers can't rebuild the coinbase
+// transaction from the coinb1 and coinb2 fields. Instead, "mining.notify" contains
+// the data needed to create it and "mining.submit" includes the encoded coinbase.
+//
+// https://en.bitcoin.it/wiki/Stratum_mining_protocol
+const (
+	methodAuthorize     = "mining.authorize"
+	methodNotify        = "mining.notify"
+	methodSetDifficulty = "mining.set_difficulty"
+	methodSubmit        = "mining.submit"
+	methodSubscribe     = "mining.subscribe"
+
+	// maxMessageSize is the maximum length of a message in bytes.
+	maxMessageSize = 1 << 20
+)
+
+// Error codes defined by the protocol.
+var (
+	errUnknown       = &Error{Code: 20, Message: "Other/Unknown"}
+	errJobNotFound   = &Error{Code: 21, Message: "Job not found"}
+	errDuplicate     = &Error{Code: 22, Message: "Duplicate share"}
+	errLowDifficulty = &Error{Code: 23, Message: "Low difficulty share"}
+	errUnauthorized  = &Error{Code: 24, Message: "Unauthorized worker"}
+	errNotSubscribed = &Error{Code: 25, Message: "Not subscribed"}
+)
+
+// Error is a stratum error, it's encoded as [code, message, traceback].
+type Error struct {
+	Code    int
+	Message string
+}
+
+// Error returns the error message.
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.Code)
+}
+
+// MarshalJSON encodes the error as an array.
+func (e *Error) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{e.Code, e.Message, nil})
+}
+
+// UnmarshalJSON decodes an error from an array.
+func (e *Error) UnmarshalJSON(data []byte) error {
+	var fields []json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if len(fields) < 2 {
+		return errors.New("invalid error format")
+	}
+
+	if err := json.Unmarshal(fields[0], &e.Code); err != nil {
+		return err
+	}
+	return json.Unmarshal(fields[1], &e.Message)
+}
+
+// request is a method call, notifications are requests without an id.
+type request struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params []any           `json:"params"`
+}
+
+// response is the result of a method call.
+type response struct {
+	ID     json.RawMessage `json:"id"`
+	Result any             `json:"result"`
+	Error  *Error          `json:"error"`
+}
+
+// incoming is any message received, either a request, a notification or a response.
+type incoming struct {
+	ID     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+	Result json.RawMessage   `json:"result"`
+	Error  *Error            `json:"error"`
+}
+
+// parseParams decodes the parameters of a message into the values provided.
+func parseParams(params []json.RawMessage, values ...any) error {
+	if len(params) < len(values) {
+		return fmt.Errorf("expected %d parameters, got %d", len(values), len(params))
+	}
+
+	for i, v := range values {
+		if err := json.Unmarshal(params[i], v); err != nil {
+			return fmt.Errorf("parameter %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// DifficultyToTarget returns the target a hash must not exceed to meet the difficulty
+// provided. Difficulty one corresponds to the maximum target.
+func DifficultyToTarget(difficulty float64) *big.Int {
+	target := new(big.Float).SetInt(block.MaxTarget)
+	target.Quo(target, big.NewFloat(difficulty))
+	result, _ := target.Int(nil)
+	return result
+}
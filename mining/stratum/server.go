@@ -0,0 +1,642 @@
+package stratum
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/GGP1/btcs/block"
+	"github.com/GGP1/btcs/encoding/gob"
+	"github.com/GGP1/btcs/logger"
+	"github.com/GGP1/btcs/mining"
+	"github.com/GGP1/btcs/tx"
+	"github.com/GGP1/btcs/tx/merkle"
+)
+
+const (
+	// DefaultDifficulty is the share difficulty assigned to new workers.
+	DefaultDifficulty = 1 << 16
+
+	// extraNonce2Size is the number of bytes of the extra nonce workers can roll.
+	extraNonce2Size = 4
+	// minDifficulty is the lowest share difficulty a worker can have.
+	minDifficulty = 1
+	// targetShareTime is the desired time between the shares of a worker.
+	targetShareTime = 10 * time.Second
+	// retargetTime is the time after which a worker share difficulty is re-calculated.
+	retargetTime = time.Minute
+	// maxRetargetShares is the number of shares after which a worker share difficulty is
+	// re-calculated even if retargetTime hasn't elapsed.
+	maxRetargetShares = 4 * int(retargetTime/targetShareTime)
+	// maxRetargetFactor limits the adjustment of the share difficulty on each retarget.
+	maxRetargetFactor = 4
+	// pollInterval is the time between checks for a new chain tip.
+	pollInterval = time.Second
+	// jobRefreshInterval is the time after which a new job is created, including the
+	// transactions that entered the mempool since the last one.
+	jobRefreshInterval = 30 * time.Second
+	// maxFutureTime is how far in the future the timestamp of a share can be.
+	maxFutureTime = 2 * time.Hour
+	// difficultyGracePeriod is the time during which shares meeting the previous difficulty
+	// are accepted after a change, as workers may have submitted them before receiving it.
+	difficultyGracePeriod = targetShareTime
+)
+
+// Config contains the stratum server configuration.
+type Config struct {
+	// CoinbaseAddr is the address where the pool rewards are sent
+	CoinbaseAddr string
+	// Template returns the template of the next block
+	Template func() (*mining.BlockTemplate, error)
+	// Submit adds a solved block to the chain
+	Submit func(b block.Block) error
+	// Difficulty is the share difficulty assigned to new workers, DefaultDifficulty if zero
+	Difficulty float64
+}
+
+// WorkerStats contains the shares submitted by a worker.
+type WorkerStats struct {
+	Name           string
+	AcceptedShares int
+	RejectedShares int
+	// Sum of the difficulties of the accepted shares
+	AcceptedWork float64
+	BlocksFound  int
+	// Difficulty of the last share accepted
+	Difficulty float64
+	// Unix time of the last share accepted
+	LastShare int64
+}
+
+// job is a unit of work handed out to the workers.
+type job struct {
+	id       string
+	template *mining.BlockTemplate
+	branch   [][]byte
+	// shares contains the hashes of the shares submitted, to detect duplicates
+	shares map[string]struct{}
+	// created is the time the job was handed out
+	created time.Time
+}
+
+// notifyParams returns the parameters of the "mining.notify" message.
+//
+// [job_id, prevhash, coinbase_address, fees, height, merkle_branch, version, nbits, ntime, clean_jobs]
+func (j *job) notifyParams(coinbaseAddr string, cleanJobs bool) []any {
+	branch := make([]string, 0, len(j.branch))
+	for _, hash := range j.branch {
+		branch = append(branch, hex.EncodeToString(hash))
+	}
+
+	return []any{
+		j.id,
+		hex.EncodeToString(j.template.PrevBlockHash),
+		coinbaseAddr,
+		j.template.Fees,
+		j.template.Height,
+		branch,
+		j.template.Version,
+		fmt.Sprintf("%08x", j.template.Bits),
+		strconv.FormatInt(j.template.Timestamp, 16),
+		cleanJobs,
+	}
+}
+
+// Server is a Stratum v1 mining pool server.
+type Server struct {
+	config         Config
+	coinbaseOutput tx.Output
+
+	mu   *sync.Mutex
+	jobs map[string]*job
+	// currentJob is the last job handed out
+	currentJob *job
+	jobsCount  uint64
+	// sessions contains the subscribed connections
+	sessions        map[*session]struct{}
+	nextExtraNonce1 uint32
+	workers         map[string]*WorkerStats
+	quit            chan struct{}
+}
+
+// NewServer returns a stratum server.
+func NewServer(config Config) *Server {
+	if config.Difficulty <= 0 {
+		config.Difficulty = DefaultDifficulty
+	}
+
+	return &Server{
+		config:         config,
+		coinbaseOutput: tx.NewOutput(0, config.CoinbaseAddr),
+		mu:             &sync.Mutex{},
+		jobs:           make(map[string]*job),
+		sessions:       make(map[*session]struct{}),
+		workers:        make(map[string]*WorkerStats),
+		quit:           make(chan struct{}),
+	}
+}
+
+// Serve accepts workers connections on the listener until it's closed.
+func (s *Server) Serve(ln net.Listener) error {
+	template, err := s.config.Template()
+	if err != nil {
+		return err
+	}
+	s.newJob(template, true)
+
+	go s.pollTemplates()
+	defer s.close()
+
+	logger.Info("Starting stratum server at ", ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			logger.Error("Stratum: ", err)
+			continue
+		}
+
+		go s.handleConn(conn)
+	}
+}
+
+// Workers returns the shares submitted by each worker, sorted by name.
+func (s *Server) Workers() []WorkerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	workers := make([]WorkerStats, 0, len(s.workers))
+	for _, stats := range s.workers {
+		workers = append(workers, *stats)
+	}
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].Name < workers[j].Name
+	})
+
+	return workers
+}
+
+// close stops creating jobs and disconnects all the workers.
+func (s *Server) close() {
+	close(s.quit)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sess := range s.sessions {
+		sess.conn.Close()
+	}
+}
+
+// pollTemplates creates a new job when the chain tip changes or the current one
+// is too old.
+func (s *Server) pollTemplates() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.quit:
+			return
+
+		case <-ticker.C:
+			template, err := s.config.Template()
+			if err != nil {
+				logger.Error("Stratum: ", err)
+				continue
+			}
+
+			s.mu.Lock()
+			current := s.currentJob
+			s.mu.Unlock()
+
+			newTip := !bytes.Equal(template.PrevBlockHash, current.template.PrevBlockHash)
+			if newTip || time.Since(current.created) >= jobRefreshInterval {
+				s.newJob(template, newTip)
+			}
+		}
+	}
+}
+
+// newJob creates a job from the template and sends it to the workers.
+//
+// If cleanJobs is true, the previous jobs are discarded.
+func (s *Server) newJob(template *mining.BlockTemplate, cleanJobs bool) {
+	encodedTxs := make([][]byte, 0, len(template.Transactions))
+	for _, t := range template.Transactions {
+		encodedTxs = append(encodedTxs, t.Serialize())
+	}
+
+	s.mu.Lock()
+	s.jobsCount++
+	j := &job{
+		id:       strconv.FormatUint(s.jobsCount, 16),
+		template: template,
+		branch:   merkle.Branch(encodedTxs),
+		shares:   make(map[string]struct{}),
+		created:  time.Now(),
+	}
+
+	if cleanJobs {
+		s.jobs = make(map[string]*job)
+	}
+	s.jobs[j.id] = j
+	s.currentJob = j
+	logger.Debugf("Stratum: new job %s at height %d", j.id, template.Height)
+
+	sessions := make([]*session, 0, len(s.sessions))
+	for sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.mu.Unlock()
+
+	params := j.notifyParams(s.config.CoinbaseAddr, cleanJobs)
+	for _, sess := range sessions {
+		if err := sess.notify(methodNotify, params...); err != nil {
+			logger.Debugf("Stratum: notifying %s: %v", sess.conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// handleConn reads the worker requests until the connection is closed.
+func (s *Server) handleConn(conn net.Conn) {
+	s.mu.Lock()
+	s.nextExtraNonce1++
+	sess := newSession(conn, s.nextExtraNonce1, s.config.Difficulty)
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.sessions, sess)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), maxMessageSize)
+	for scanner.Scan() {
+		var req incoming
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			logger.Debugf("Stratum: invalid message from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+
+		var (
+			result any
+			rpcErr *Error
+		)
+		switch req.Method {
+		case methodSubscribe:
+			result = s.handleSubscribe(sess)
+		case methodAuthorize:
+			result, rpcErr = s.handleAuthorize(sess, req.Params)
+		case methodSubmit:
+			result, rpcErr = s.handleSubmit(sess, req.Params)
+		default:
+			rpcErr = errUnknown
+		}
+
+		if err := sess.respond(req.ID, result, rpcErr); err != nil {
+			logger.Debugf("Stratum: responding %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+
+		if req.Method == methodSubscribe {
+			s.sendWork(sess)
+		}
+	}
+}
+
+// handleSubscribe registers the session so it receives jobs.
+//
+// The result is [[["mining.set_difficulty", id], ["mining.notify", id]], extranonce1, extranonce2_size].
+func (s *Server) handleSubscribe(sess *session) any {
+	s.mu.Lock()
+	s.sessions[sess] = struct{}{}
+	s.mu.Unlock()
+
+	subscriptions := [][]string{
+		{methodSetDifficulty, sess.extraNonce1},
+		{methodNotify, sess.extraNonce1},
+	}
+	return []any{subscriptions, sess.extraNonce1, extraNonce2Size}
+}
+
+// sendWork sends the session difficulty and the current job.
+func (s *Server) sendWork(sess *session) {
+	if err := sess.notify(methodSetDifficulty, sess.difficulty); err != nil {
+		logger.Debugf("Stratum: notifying %s: %v", sess.conn.RemoteAddr(), err)
+		return
+	}
+
+	s.mu.Lock()
+	params := s.currentJob.notifyParams(s.config.CoinbaseAddr, true)
+	s.mu.Unlock()
+
+	if err := sess.notify(methodNotify, params...); err != nil {
+		logger.Debugf("Stratum: notifying %s: %v", sess.conn.RemoteAddr(), err)
+	}
+}
+
+// handleAuthorize allows a worker to submit shares through the session.
+//
+// Params: [username, password]. Passwords are not checked.
+func (s *Server) handleAuthorize(sess *session, params []json.RawMessage) (any, *Error) {
+	var name string
+	if err := parseParams(params, &name); err != nil || name == "" {
+		return false, errUnauthorized
+	}
+
+	s.mu.Lock()
+	if _, ok := s.workers[name]; !ok {
+		s.workers[name] = &WorkerStats{Name: name}
+	}
+	s.mu.Unlock()
+
+	sess.workers[name] = struct{}{}
+	logger.Infof("Stratum: worker %q authorized from %s", name, sess.conn.RemoteAddr())
+	return true, nil
+}
+
+// handleSubmit validates a share and records it. If the share meets the network target,
+// the block is submitted.
+//
+// Params: [worker_name, job_id, extranonce2, ntime, nonce, coinbase].
+func (s *Server) handleSubmit(sess *session, params []json.RawMessage) (any, *Error) {
+	var workerName, jobID, extraNonce2, nTime, nonce, coinbase string
+	err := parseParams(params, &workerName, &jobID, &extraNonce2, &nTime, &nonce, &coinbase)
+	if err != nil {
+		return false, errUnknown
+	}
+
+	if _, ok := sess.workers[workerName]; !ok {
+		return false, errUnauthorized
+	}
+
+	b, hash, difficulty, rpcErr := s.checkShare(sess, jobID, extraNonce2, nTime, nonce, coinbase)
+	if rpcErr != nil {
+		s.recordShare(workerName, 0, false, false)
+		logger.Debugf("Stratum: share from %q rejected: %v", workerName, rpcErr)
+		return false, rpcErr
+	}
+
+	hashInt := new(big.Int).SetBytes(hash)
+	blockFound := hashInt.Cmp(block.CompactToBig(b.Bits)) <= 0
+	if blockFound {
+		b.Hash = hash
+		if err := s.config.Submit(*b); err != nil {
+			logger.Errorf("Stratum: block from %q rejected: %v", workerName, err)
+			blockFound = false
+		} else {
+			logger.Infof("Stratum: worker %q found block %x", workerName, b.Hash)
+		}
+	}
+
+	s.recordShare(workerName, difficulty, true, blockFound)
+	if sess.retarget(time.Now()) {
+		logger.Debugf("Stratum: %s share difficulty set to %.2f", sess.conn.RemoteAddr(), sess.difficulty)
+		if err := sess.notify(methodSetDifficulty, sess.difficulty); err != nil {
+			logger.Debugf("Stratum: notifying %s: %v", sess.conn.RemoteAddr(), err)
+		}
+	}
+
+	return true, nil
+}
+
+// checkShare builds the block corresponding to a share and returns it along with its hash
+// and the difficulty it met if the share is valid.
+func (s *Server) checkShare(sess *session, jobID, extraNonce2, nTime, nonce, coinbase string) (*block.Block, []byte, float64, *Error) {
+	s.mu.Lock()
+	j, ok := s.jobs[jobID]
+	s.mu.Unlock()
+	if !ok {
+		return nil, nil, 0, errJobNotFound
+	}
+
+	if len(extraNonce2) != extraNonce2Size*2 {
+		return nil, nil, 0, errUnknown
+	}
+	if _, err := hex.DecodeString(extraNonce2); err != nil {
+		return nil, nil, 0, errUnknown
+	}
+
+	timestamp, err := strconv.ParseInt(nTime, 16, 64)
+	if err != nil {
+		return nil, nil, 0, errUnknown
+	}
+	maxTimestamp := time.Now().Add(maxFutureTime).Unix()
+	if timestamp < j.template.Timestamp || timestamp > maxTimestamp {
+		return nil, nil, 0, &Error{Code: errUnknown.Code, Message: "Timestamp out of range"}
+	}
+
+	n, err := strconv.ParseUint(nonce, 16, 32)
+	if err != nil {
+		return nil, nil, 0, errUnknown
+	}
+
+	coinbaseTx, err := s.decodeCoinbase(coinbase, sess.extraNonce1+extraNonce2, j.template.CoinbaseValue)
+	if err != nil {
+		return nil, nil, 0, &Error{Code: errUnknown.Code, Message: err.Error()}
+	}
+
+	b, err := j.template.NewBlock(coinbaseTx)
+	if err != nil {
+		return nil, nil, 0, errUnknown
+	}
+	b.Timestamp = timestamp
+	b.Nonce = uint32(n)
+
+	hash, err := b.PowHash()
+	if err != nil {
+		return nil, nil, 0, errUnknown
+	}
+
+	difficulty := sess.shareDifficulty(new(big.Int).SetBytes(hash), b.Bits)
+	if difficulty == 0 {
+		return nil, nil, 0, errLowDifficulty
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := hex.EncodeToString(hash)
+	if _, ok := j.shares[key]; ok {
+		return nil, nil, 0, errDuplicate
+	}
+	j.shares[key] = struct{}{}
+
+	return b, hash, difficulty, nil
+}
+
+// decodeCoinbase decodes a coinbase transaction created by a worker and checks it contains
+// the worker extra nonce and pays the pool the value expected.
+func (s *Server) decodeCoinbase(coinbase, extraNonce string, value int) (tx.Tx, error) {
+	data, err := hex.DecodeString(coinbase)
+	if err != nil {
+		return tx.Tx{}, err
+	}
+
+	coinbaseTx, err := gob.Decode[tx.Tx](data)
+	if err != nil {
+		return tx.Tx{}, err
+	}
+
+	if !coinbaseTx.IsCoinbase() {
+		return tx.Tx{}, errors.New("coinbase transaction expected")
+	}
+	if string(coinbaseTx.Inputs[0].PubKey) != extraNonce {
+		return tx.Tx{}, errors.New("coinbase does not contain the worker extra nonce")
+	}
+	if len(coinbaseTx.Outputs) != 1 ||
+		coinbaseTx.Outputs[0].Value != value ||
+		!coinbaseTx.Outputs[0].IsLockedWithKey(s.coinbaseOutput.PubKeyHash) {
+		return tx.Tx{}, errors.New("coinbase does not pay the pool")
+	}
+
+	return coinbaseTx, nil
+}
+
+// recordShare updates the statistics of a worker.
+func (s *Server) recordShare(workerName string, difficulty float64, accepted, blockFound bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats, ok := s.workers[workerName]
+	if !ok {
+		return
+	}
+
+	if !accepted {
+		stats.RejectedShares++
+		return
+	}
+
+	stats.AcceptedShares++
+	stats.AcceptedWork += difficulty
+	stats.Difficulty = difficulty
+	stats.LastShare = time.Now().Unix()
+	if blockFound {
+		stats.BlocksFound++
+	}
+}
+
+// session is the connection with a worker.
+//
+// Its fields, except conn, are only accessed by the goroutine reading the worker requests.
+type session struct {
+	conn    net.Conn
+	writeMu *sync.Mutex
+	// extraNonce1 is the hex encoded prefix of the coinbase extra nonce assigned to
+	// the worker, it makes the workers ranges disjoint
+	extraNonce1 string
+	workers     map[string]struct{}
+	difficulty  float64
+	// prevDifficulty is accepted too during difficultyGracePeriod after a change, it's the
+	// lowest difficulty set during the period
+	prevDifficulty    float64
+	difficultyChanged time.Time
+	retargetTime      time.Time
+	retargetShares    int
+}
+
+func newSession(conn net.Conn, extraNonce1 uint32, difficulty float64) *session {
+	return &session{
+		conn:           conn,
+		writeMu:        &sync.Mutex{},
+		extraNonce1:    fmt.Sprintf("%08x", extraNonce1),
+		workers:        make(map[string]struct{}),
+		difficulty:     difficulty,
+		prevDifficulty: difficulty,
+		retargetTime:   time.Now(),
+	}
+}
+
+// notify sends a notification to the worker.
+func (c *session) notify(method string, params ...any) error {
+	return c.write(request{Method: method, Params: params})
+}
+
+// respond sends the result of a request to the worker.
+func (c *session) respond(id json.RawMessage, result any, rpcErr *Error) error {
+	return c.write(response{ID: id, Result: result, Error: rpcErr})
+}
+
+func (c *session) write(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err = c.conn.Write(append(data, '\n'))
+	return err
+}
+
+// shareDifficulty returns the difficulty met by a share hash, zero if it doesn't meet the
+// worker's. It's never higher than the network difficulty.
+func (c *session) shareDifficulty(hash *big.Int, bits uint32) float64 {
+	difficulties := []float64{c.difficulty}
+	if time.Since(c.difficultyChanged) < difficultyGracePeriod {
+		difficulties = append(difficulties, c.prevDifficulty)
+	}
+
+	networkTarget := block.CompactToBig(bits)
+	for _, difficulty := range difficulties {
+		target := DifficultyToTarget(difficulty)
+		if target.Cmp(networkTarget) < 0 {
+			target = networkTarget
+		}
+		if hash.Cmp(target) <= 0 {
+			return difficulty
+		}
+	}
+
+	return 0
+}
+
+// retarget adjusts the share difficulty so the worker submits a share every
+// targetShareTime. It returns whether the difficulty changed.
+func (c *session) retarget(now time.Time) bool {
+	c.retargetShares++
+	elapsed := now.Sub(c.retargetTime)
+	if elapsed < retargetTime && c.retargetShares < maxRetargetShares {
+		return false
+	}
+
+	// factor = actual shares / expected shares
+	expectedShares := elapsed.Seconds() / targetShareTime.Seconds()
+	factor := float64(c.retargetShares) / expectedShares
+	if factor > maxRetargetFactor {
+		factor = maxRetargetFactor
+	} else if factor < 1.0/maxRetargetFactor {
+		factor = 1.0 / maxRetargetFactor
+	}
+
+	c.retargetTime = now
+	c.retargetShares = 0
+
+	newDifficulty := c.difficulty * factor
+	if newDifficulty < minDifficulty {
+		newDifficulty = minDifficulty
+	}
+	if newDifficulty == c.difficulty {
+		return false
+	}
+
+	if now.Sub(c.difficultyChanged) >= difficultyGracePeriod || c.difficulty < c.prevDifficulty {
+		c.prevDifficulty = c.difficulty
+	}
+	c.difficulty = newDifficulty
+	c.difficultyChanged = now
+	return true
+}
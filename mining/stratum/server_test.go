@@ -0,0 +1,98 @@
+package stratum
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/GGP1/btcs/block"
+	"github.com/GGP1/btcs/mempool"
+	"github.com/GGP1/btcs/mining"
+	"github.com/GGP1/btcs/tx"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const poolAddr = "1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa"
+
+func TestPoolMining(t *testing.T) {
+	genesis, err := block.NewGenesis()
+	assert.NoError(t, err)
+
+	txPool := mempool.NewTxPool()
+	poolTx, err := tx.New(
+		[]tx.Input{{PrevOutput: tx.OutPoint{TxID: []byte{1}, Index: 0}}},
+		[]tx.Output{tx.NewOutput(100, poolAddr)},
+	)
+	assert.NoError(t, err)
+	txPool.Add(*poolTx, 10, 0)
+
+	template := mining.NewBlockTemplate(txPool, genesis)
+	// Use an easy target so the test is fast
+	template.Bits = 0x1f00ffff
+	template.Target = block.CompactToBig(template.Bits)
+
+	blocks := make(chan block.Block, 1)
+	server := NewServer(Config{
+		CoinbaseAddr: poolAddr,
+		Template: func() (*mining.BlockTemplate, error) {
+			return template, nil
+		},
+		Submit: func(b block.Block) error {
+			select {
+			case blocks <- b:
+			default:
+			}
+			return nil
+		},
+		Difficulty: 1 << 8,
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go server.Serve(ln)
+	defer ln.Close()
+
+	client, err := Dial(ln.Addr().String(), "worker1", "x", 2)
+	assert.NoError(t, err)
+	go client.Run()
+	defer client.Close()
+
+	select {
+	case b := <-blocks:
+		assert.True(t, b.IsValid())
+		ok, err := b.HasValidMerkleRoot()
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, genesis.Hash, b.PrevBlockHash)
+		assert.Equal(t, []tx.Tx{*poolTx}, b.Transactions[1:])
+		assert.Equal(t, template.CoinbaseValue, b.Transactions[0].OutputsValue())
+
+	case <-time.After(30 * time.Second):
+		t.Fatal("no block was found")
+	}
+
+	workers := server.Workers()
+	assert.Len(t, workers, 1)
+	assert.Equal(t, "worker1", workers[0].Name)
+	assert.NotZero(t, workers[0].AcceptedShares)
+	assert.NotZero(t, workers[0].BlocksFound)
+	assert.Zero(t, workers[0].RejectedShares)
+}
+
+func TestRetarget(t *testing.T) {
+	now := time.Now()
+	sess := &session{difficulty: 100, prevDifficulty: 100, retargetTime: now}
+
+	// Too many shares, the difficulty is increased by the maximum factor
+	for i := 0; i < maxRetargetShares-1; i++ {
+		assert.False(t, sess.retarget(now.Add(time.Second)))
+	}
+	assert.True(t, sess.retarget(now.Add(time.Second)))
+	assert.Equal(t, 400.0, sess.difficulty)
+	assert.Equal(t, 100.0, sess.prevDifficulty)
+
+	// One share in two minutes, the difficulty is decreased
+	assert.True(t, sess.retarget(now.Add(3*time.Minute)))
+	assert.Equal(t, 400.0/maxRetargetFactor, sess.difficulty)
+}
@@ -0,0 +1,106 @@
+package mining
+
+import (
+	"math/big"
+	"sort"
+
+	"github.com/GGP1/btcs/block"
+	"github.com/GGP1/btcs/mempool"
+	"github.com/GGP1/btcs/tx"
+)
+
+// BlockTemplate contains everything a miner needs to build and solve the next block
+// of the chain.
+//
+// It does not include the coinbase transaction, miners create their own one paying
+// CoinbaseValue to the address they want.
+//
+// https://en.bitcoin.it/wiki/BIP_0022
+type BlockTemplate struct {
+	Version       int32
+	PrevBlockHash []byte
+	Height        int32
+	// Unix time the block should have
+	Timestamp int64
+	// Compact representation of the target
+	Bits uint32
+	// Target is the value the block hash must not exceed
+	Target *big.Int
+	// CoinbaseValue is the block subsidy plus the transactions fees, in satoshis
+	CoinbaseValue int
+	// Fees is the sum of the transactions fees, in satoshis
+	Fees int
+	// Transactions selected from the mempool, excluding the coinbase
+	Transactions []tx.Tx
+}
+
+// coinbaseReservedSize is the space left in the block for the coinbase transaction.
+const coinbaseReservedSize = 1000
+
+// NewBlockTemplate returns a template for the block following prevBlock, including the
+// transactions in the pool with the highest fee rates that fit in the block.
+func NewBlockTemplate(txPool *mempool.TxPool, prevBlock *block.Block) *BlockTemplate {
+	transactions, fees := selectTransactions(txPool.Entries(), block.MaxBlockSize-coinbaseReservedSize)
+
+	height := prevBlock.Height + 1
+	bits := block.CalculateNextDifficulty(*prevBlock)
+	return &BlockTemplate{
+		Version:       block.ComputeBlockVersion(prevBlock.Height),
+		PrevBlockHash: prevBlock.Hash,
+		Height:        height,
+		Timestamp:     block.NextTimestamp(*prevBlock),
+		Bits:          bits,
+		Target:        block.CompactToBig(bits),
+		CoinbaseValue: tx.CalculateBlockSubsidy(height) + fees,
+		Fees:          fees,
+		Transactions:  transactions,
+	}
+}
+
+// selectTransactions returns the transactions of the entries with the highest fee rates
+// whose sizes sum up to maxSize at most, along with the sum of their fees.
+func selectTransactions(entries []mempool.Entry, maxSize int) ([]tx.Tx, int) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].FeeRate != entries[j].FeeRate {
+			return entries[i].FeeRate > entries[j].FeeRate
+		}
+		return entries[i].Time < entries[j].Time
+	})
+
+	transactions := make([]tx.Tx, 0, len(entries))
+	size, fees := 0, 0
+	for _, entry := range entries {
+		if size+entry.Size > maxSize {
+			break
+		}
+		transactions = append(transactions, entry.Tx)
+		size += entry.Size
+		fees += entry.Fee
+	}
+
+	return transactions, fees
+}
+
+// NewBlock returns an unsolved block built from the template with the coinbase
+// transaction provided.
+func (t *BlockTemplate) NewBlock(coinbaseTx tx.Tx) (*block.Block, error) {
+	transactions := make([]tx.Tx, 0, len(t.Transactions)+1)
+	transactions = append(transactions, coinbaseTx)
+	transactions = append(transactions, t.Transactions...)
+
+	b := &block.Block{
+		Header: &block.Header{
+			PrevBlockHash: t.PrevBlockHash,
+			Version:       t.Version,
+			Timestamp:     t.Timestamp,
+			Bits:          t.Bits,
+		},
+		Height:       t.Height,
+		Transactions: transactions,
+	}
+	if err := b.UpdateMerkleRoot(); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
@@ -0,0 +1,63 @@
+package mining
+
+import (
+	"testing"
+
+	"github.com/GGP1/btcs/block"
+	"github.com/GGP1/btcs/mempool"
+	"github.com/GGP1/btcs/tx"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockTemplate(t *testing.T) {
+	genesis, err := block.NewGenesis()
+	assert.NoError(t, err)
+
+	txPool := mempool.NewTxPool()
+	poolTx, err := tx.New(
+		[]tx.Input{{PrevOutput: tx.OutPoint{TxID: []byte{1}, Index: 0}}},
+		[]tx.Output{tx.NewOutput(100, "1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa")},
+	)
+	assert.NoError(t, err)
+	txPool.Add(*poolTx, 10, 0)
+
+	template := NewBlockTemplate(txPool, genesis)
+	assert.Equal(t, genesis.Hash, template.PrevBlockHash)
+	assert.Equal(t, int32(1), template.Height)
+	assert.Equal(t, block.CompactToBig(template.Bits), template.Target)
+	assert.Equal(t, 10, template.Fees)
+	assert.Equal(t, tx.CalculateBlockSubsidy(1)+10, template.CoinbaseValue)
+	assert.Equal(t, []tx.Tx{*poolTx}, template.Transactions)
+
+	coinbaseTx, err := tx.NewCoinbase("1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa", "", template.Fees, template.Height)
+	assert.NoError(t, err)
+	assert.Equal(t, template.CoinbaseValue, coinbaseTx.OutputsValue())
+
+	b, err := template.NewBlock(*coinbaseTx)
+	assert.NoError(t, err)
+	assert.Equal(t, []tx.Tx{*coinbaseTx, *poolTx}, b.Transactions)
+	assert.Equal(t, template.Bits, b.Bits)
+
+	ok, err := b.HasValidMerkleRoot()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestSelectTransactions(t *testing.T) {
+	newEntry := func(id string, size, fee int) mempool.Entry {
+		return mempool.Entry{Tx: tx.Tx{ID: []byte(id)}, Size: size, Fee: fee, FeeRate: mempool.FeeRate(fee, size)}
+	}
+	low := newEntry("low", 100, 100)
+	high := newEntry("high", 100, 1000)
+	medium := newEntry("medium", 200, 1000)
+	large := newEntry("large", 500, 10000)
+
+	transactions, fees := selectTransactions([]mempool.Entry{low, large, medium, high}, 2000)
+	assert.Equal(t, []tx.Tx{large.Tx, high.Tx, medium.Tx, low.Tx}, transactions, "Highest fee rate first")
+	assert.Equal(t, 12100, fees)
+
+	transactions, fees = selectTransactions([]mempool.Entry{low, large, medium, high}, 700)
+	assert.Equal(t, []tx.Tx{large.Tx, high.Tx}, transactions, "The block is full")
+	assert.Equal(t, 11000, fees)
+}
@@ -0,0 +1,459 @@
+package node
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	mrand "math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/GGP1/btcs/encoding/gob"
+)
+
+const (
+	// PeersPath is the file where the known addresses are stored when the node stops.
+	PeersPath = "peers.dat"
+
+	// newBucketCount and triedBucketCount are the number of buckets of each table, an
+	// address is assigned to a single bucket depending on its group (and the group of the
+	// peer that announced it for the new table), so a single entity can't fill the tables.
+	newBucketCount   = 64
+	triedBucketCount = 16
+	// bucketSize is the maximum number of addresses in a bucket.
+	bucketSize = 64
+
+	// getAddrPercent is the percentage of the known addresses sent in answer to a getaddr.
+	getAddrPercent = 23
+	// getAddrMin is the minimum number of addresses sent in answer to a getaddr, if known.
+	getAddrMin = 50
+	// maxAddrPerMessage is the maximum number of addresses an addr message can contain.
+	maxAddrPerMessage = 1000
+	// maxAddrRelay is the maximum number of addresses of an addr message for it to be
+	// considered an announcement and relayed.
+	maxAddrRelay = 10
+	// maxAddrRelayPeers is the number of peers announcements are relayed to.
+	maxAddrRelayPeers = 2
+	// addrRelayHorizon is the maximum age of the addresses relayed.
+	addrRelayHorizon = 10 * time.Minute
+
+	// horizon is the time after which addresses that weren't seen are forgotten.
+	horizon = 30 * 24 * time.Hour
+	// maxFailures is the number of failed attempts after which an address that never
+	// connected is forgotten.
+	maxFailures = 3
+	// maxFailuresSinceSuccess is the number of consecutive failed attempts after which an
+	// address that didn't connect in minFailDuration is forgotten.
+	maxFailuresSinceSuccess = 10
+	minFailDuration         = 7 * 24 * time.Hour
+	// maxFutureTimestamp is how far in the future the timestamp of an address can be.
+	maxFutureTimestamp = 10 * time.Minute
+	// recentAttempt is the time after an attempt during which selecting an address is unlikely.
+	recentAttempt = 10 * time.Minute
+)
+
+// knownAddress is an address the node knows about, with its connection history.
+type knownAddress struct {
+	Addr     string
+	Services ServiceFlag
+	// Source is the group of the peer that announced the address
+	Source string
+	// Unix times at which the address was last seen on the network, attempted and
+	// successfully connected
+	LastSeen    int64
+	LastAttempt int64
+	LastSuccess int64
+	// Successes is the number of successful connections
+	Successes int
+	// Failures is the number of failed attempts since the last success
+	Failures int
+	// Tried is true if the node connected to the address at least once, it's then in
+	// the tried table
+	Tried bool
+}
+
+// isTerrible returns whether the address is not worth keeping.
+func (ka *knownAddress) isTerrible(now time.Time) bool {
+	// Don't remove addresses just attempted
+	if ka.LastAttempt >= now.Add(-time.Minute).Unix() {
+		return false
+	}
+
+	switch {
+	case ka.LastSeen > now.Add(maxFutureTimestamp).Unix():
+		return true
+	case ka.LastSeen < now.Add(-horizon).Unix():
+		return true
+	case ka.LastSuccess == 0 && ka.Failures >= maxFailures:
+		return true
+	case ka.LastSuccess < now.Add(-minFailDuration).Unix() && ka.Failures >= maxFailuresSinceSuccess:
+		return true
+	}
+	return false
+}
+
+// chance returns the relative probability of selecting the address, recently attempted
+// and failing addresses are less likely to be picked.
+func (ka *knownAddress) chance(now time.Time) float64 {
+	c := 1.0
+	if ka.LastAttempt >= now.Add(-recentAttempt).Unix() {
+		c *= 0.01
+	}
+	for i := 0; i < ka.Failures && i < 8; i++ {
+		c *= 0.66
+	}
+	return c
+}
+
+// addrManager keeps track of the addresses of the network, split in two tables: the
+// new one, with addresses that were announced but never connected to, and the tried
+// one, with the addresses the node has connected to. It's safe for concurrent use.
+type addrManager struct {
+	mu   *sync.Mutex
+	rand *mrand.Rand
+	// key randomizes the buckets the addresses are assigned to, so they can't be
+	// predicted by other nodes
+	key          [32]byte
+	addrs        map[string]*knownAddress
+	newBuckets   [newBucketCount]map[string]*knownAddress
+	triedBuckets [triedBucketCount]map[string]*knownAddress
+}
+
+func newAddrManager() *addrManager {
+	a := &addrManager{
+		mu:    &sync.Mutex{},
+		rand:  mrand.New(mrand.NewSource(time.Now().UnixNano())),
+		addrs: make(map[string]*knownAddress),
+	}
+	if _, err := rand.Read(a.key[:]); err != nil {
+		// The key only makes the buckets less predictable
+		binary.LittleEndian.PutUint64(a.key[:], uint64(time.Now().UnixNano()))
+	}
+	for i := range a.newBuckets {
+		a.newBuckets[i] = make(map[string]*knownAddress)
+	}
+	for i := range a.triedBuckets {
+		a.triedBuckets[i] = make(map[string]*knownAddress)
+	}
+
+	return a
+}
+
+// serializedAddrManager is the content of the peers file.
+type serializedAddrManager struct {
+	Key       [32]byte
+	Addresses []knownAddress
+}
+
+// loadAddrManager reads the addresses stored in the file at path.
+func loadAddrManager(path string) (*addrManager, error) {
+	fileContent, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	serialized, err := gob.Decode[serializedAddrManager](fileContent)
+	if err != nil {
+		return nil, err
+	}
+
+	a := newAddrManager()
+	a.key = serialized.Key
+	for i := range serialized.Addresses {
+		ka := serialized.Addresses[i]
+		if ka.Tried {
+			bucket := a.triedBuckets[a.triedBucket(ka.Addr)]
+			if len(bucket) >= bucketSize {
+				ka.Tried = false
+			} else {
+				bucket[ka.Addr] = &ka
+				a.addrs[ka.Addr] = &ka
+				continue
+			}
+		}
+
+		bucket := a.newBuckets[a.newBucket(ka.Addr, ka.Source)]
+		if len(bucket) < bucketSize {
+			bucket[ka.Addr] = &ka
+			a.addrs[ka.Addr] = &ka
+		}
+	}
+
+	return a, nil
+}
+
+// Save writes the known addresses to the file at path.
+func (a *addrManager) Save(path string) error {
+	a.mu.Lock()
+	serialized := serializedAddrManager{
+		Key:       a.key,
+		Addresses: make([]knownAddress, 0, len(a.addrs)),
+	}
+	for _, ka := range a.addrs {
+		serialized.Addresses = append(serialized.Addresses, *ka)
+	}
+	a.mu.Unlock()
+
+	encoded, err := gob.Encode(serialized)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, encoded, 0o644)
+}
+
+// Add includes the addresses announced by the peer at source in the new table, or updates
+// their last seen time if they are known.
+//
+// It returns the addresses that weren't known.
+func (a *addrManager) Add(addresses []netAddress, source string) []netAddress {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	sourceGroup := addrGroup(source)
+	added := make([]netAddress, 0, len(addresses))
+	for _, na := range addresses {
+		if na.Addr == "" {
+			continue
+		}
+		timestamp := na.Timestamp
+		if timestamp <= 0 || timestamp > now.Add(maxFutureTimestamp).Unix() {
+			timestamp = now.Add(-5 * 24 * time.Hour).Unix()
+		}
+
+		if ka, ok := a.addrs[na.Addr]; ok {
+			if timestamp > ka.LastSeen {
+				ka.LastSeen = timestamp
+			}
+			ka.Services |= na.Services
+			continue
+		}
+
+		ka := &knownAddress{
+			Addr:     na.Addr,
+			Services: na.Services,
+			Source:   sourceGroup,
+			LastSeen: timestamp,
+		}
+		bucket := a.newBuckets[a.newBucket(ka.Addr, ka.Source)]
+		if len(bucket) >= bucketSize {
+			a.evictNew(bucket, now)
+		}
+		bucket[ka.Addr] = ka
+		a.addrs[ka.Addr] = ka
+		added = append(added, na)
+	}
+
+	return added
+}
+
+// AddressCache returns a random subset of the known addresses that are worth sharing.
+func (a *addrManager) AddressCache() []netAddress {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	addresses := make([]netAddress, 0, len(a.addrs))
+	for _, ka := range a.addrs {
+		if !ka.isTerrible(now) {
+			addresses = append(addresses, netAddress{Addr: ka.Addr, Services: ka.Services, Timestamp: ka.LastSeen})
+		}
+	}
+
+	count := len(addresses) * getAddrPercent / 100
+	if count < getAddrMin {
+		count = getAddrMin
+	}
+	if count > maxAddrPerMessage {
+		count = maxAddrPerMessage
+	}
+	if count > len(addresses) {
+		count = len(addresses)
+	}
+
+	a.rand.Shuffle(len(addresses), func(i, j int) {
+		addresses[i], addresses[j] = addresses[j], addresses[i]
+	})
+	return addresses[:count]
+}
+
+// Attempt records a connection attempt to the address.
+func (a *addrManager) Attempt(addr string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if ka, ok := a.addrs[addr]; ok {
+		ka.LastAttempt = time.Now().Unix()
+	}
+}
+
+// Connected updates the last seen time of an address the node is connected to.
+func (a *addrManager) Connected(addr string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if ka, ok := a.addrs[addr]; ok {
+		ka.LastSeen = time.Now().Unix()
+	}
+}
+
+// Failed records a failed connection attempt to the address.
+func (a *addrManager) Failed(addr string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if ka, ok := a.addrs[addr]; ok {
+		ka.Failures++
+	}
+}
+
+// Good records a successful connection to the address and moves it to the tried table.
+func (a *addrManager) Good(addr string, services ServiceFlag) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ka, ok := a.addrs[addr]
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	ka.LastSeen = now.Unix()
+	ka.LastAttempt = now.Unix()
+	ka.LastSuccess = now.Unix()
+	ka.Successes++
+	ka.Failures = 0
+	ka.Services = services
+	if ka.Tried {
+		return
+	}
+
+	delete(a.newBuckets[a.newBucket(ka.Addr, ka.Source)], ka.Addr)
+	ka.Tried = true
+
+	bucket := a.triedBuckets[a.triedBucket(ka.Addr)]
+	if len(bucket) >= bucketSize {
+		// Move the address that connected the longest time ago back to the new table
+		var oldest *knownAddress
+		for _, tried := range bucket {
+			if oldest == nil || tried.LastSuccess < oldest.LastSuccess {
+				oldest = tried
+			}
+		}
+		delete(bucket, oldest.Addr)
+		oldest.Tried = false
+
+		newBucket := a.newBuckets[a.newBucket(oldest.Addr, oldest.Source)]
+		if len(newBucket) >= bucketSize {
+			a.evictNew(newBucket, now)
+		}
+		newBucket[oldest.Addr] = oldest
+	}
+	bucket[ka.Addr] = ka
+}
+
+// Select returns a random address to connect to, skipping the ones for which exclude
+// returns true. Tried and new addresses are equally likely to be picked.
+func (a *addrManager) Select(exclude func(addr string) bool) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	var tried, fresh []*knownAddress
+	for _, ka := range a.addrs {
+		if exclude(ka.Addr) || ka.isTerrible(now) {
+			continue
+		}
+		if ka.Tried {
+			tried = append(tried, ka)
+		} else {
+			fresh = append(fresh, ka)
+		}
+	}
+	if len(tried) == 0 && len(fresh) == 0 {
+		return "", false
+	}
+
+	candidates := fresh
+	if len(fresh) == 0 || (len(tried) > 0 && a.rand.Intn(2) == 0) {
+		candidates = tried
+	}
+
+	// Pick addresses at random until one is accepted, raising the chances after each
+	// rejection so it eventually finishes
+	factor := 1.0
+	for {
+		ka := candidates[a.rand.Intn(len(candidates))]
+		if a.rand.Float64() < factor*ka.chance(now) {
+			return ka.Addr, true
+		}
+		factor *= 1.2
+	}
+}
+
+// Size returns the number of known addresses.
+func (a *addrManager) Size() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.addrs)
+}
+
+// evictNew removes a terrible address from the bucket or, if there is none, the one seen
+// the longest time ago.
+func (a *addrManager) evictNew(bucket map[string]*knownAddress, now time.Time) {
+	var oldest *knownAddress
+	for _, ka := range bucket {
+		if ka.isTerrible(now) {
+			oldest = ka
+			break
+		}
+		if oldest == nil || ka.LastSeen < oldest.LastSeen {
+			oldest = ka
+		}
+	}
+
+	delete(bucket, oldest.Addr)
+	delete(a.addrs, oldest.Addr)
+}
+
+// newBucket returns the index of the new table bucket of an address.
+func (a *addrManager) newBucket(addr, sourceGroup string) int {
+	return int(a.hash(sourceGroup, addrGroup(addr)) % newBucketCount)
+}
+
+// triedBucket returns the index of the tried table bucket of an address.
+func (a *addrManager) triedBucket(addr string) int {
+	return int(a.hash(addrGroup(addr), addr) % triedBucketCount)
+}
+
+func (a *addrManager) hash(values ...string) uint64 {
+	h := sha256.New()
+	h.Write(a.key[:])
+	for _, v := range values {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	return binary.LittleEndian.Uint64(h.Sum(nil))
+}
+
+// addrGroup returns the network group of an address, addresses of the same group are
+// likely controlled by the same entity. It's the /16 prefix of IPv4 addresses, the /32
+// one of IPv6 addresses and the host name otherwise.
+func addrGroup(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(16, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(32, 128)).String()
+}
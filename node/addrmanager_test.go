@@ -0,0 +1,146 @@
+package node
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddrManagerAdd(t *testing.T) {
+	a := newAddrManager()
+	now := time.Now().Unix()
+
+	added := a.Add([]netAddress{
+		{Addr: "10.0.0.1:3000", Timestamp: now},
+		{Addr: "10.0.0.2:3000", Timestamp: now},
+		{Addr: ""},
+	}, "10.1.0.1")
+	assert.Len(t, added, 2)
+	assert.Equal(t, 2, a.Size())
+
+	// Known addresses only update the last seen time
+	added = a.Add([]netAddress{{Addr: "10.0.0.1:3000", Timestamp: now + 60}}, "10.1.0.1")
+	assert.Empty(t, added)
+	assert.Equal(t, now+60, a.addrs["10.0.0.1:3000"].LastSeen)
+
+	// Timestamps too far in the future are not trusted
+	a.Add([]netAddress{{Addr: "10.0.0.3:3000", Timestamp: now + 3600}}, "10.1.0.1")
+	assert.Less(t, a.addrs["10.0.0.3:3000"].LastSeen, now)
+}
+
+func TestAddrManagerBucketLimit(t *testing.T) {
+	a := newAddrManager()
+	now := time.Now().Unix()
+
+	// Addresses from the same group announced by the same source share a bucket
+	addresses := make([]netAddress, 0, bucketSize+10)
+	for i := 0; i < bucketSize+10; i++ {
+		addresses = append(addresses, netAddress{Addr: fmt.Sprintf("10.0.0.1:%d", 3000+i), Timestamp: now + int64(i)})
+	}
+	a.Add(addresses, "10.1.0.1")
+	assert.Equal(t, bucketSize, a.Size())
+
+	// The oldest addresses are evicted
+	_, ok := a.addrs[addresses[0].Addr]
+	assert.False(t, ok)
+	_, ok = a.addrs[addresses[len(addresses)-1].Addr]
+	assert.True(t, ok)
+}
+
+func TestAddrManagerGood(t *testing.T) {
+	a := newAddrManager()
+	addr := "10.0.0.1:3000"
+	a.Add([]netAddress{{Addr: addr, Timestamp: time.Now().Unix()}}, "10.1.0.1")
+
+	a.Attempt(addr)
+	a.Failed(addr)
+	ka := a.addrs[addr]
+	assert.Equal(t, 1, ka.Failures)
+	assert.False(t, ka.Tried)
+
+	a.Good(addr, SFNodeNetwork)
+	assert.True(t, ka.Tried)
+	assert.Equal(t, 1, ka.Successes)
+	assert.Zero(t, ka.Failures)
+	assert.Equal(t, SFNodeNetwork, ka.Services)
+	assert.Contains(t, a.triedBuckets[a.triedBucket(addr)], addr)
+	assert.NotContains(t, a.newBuckets[a.newBucket(addr, ka.Source)], addr)
+}
+
+func TestAddrManagerSelect(t *testing.T) {
+	a := newAddrManager()
+	_, ok := a.Select(func(string) bool { return false })
+	assert.False(t, ok)
+
+	now := time.Now().Unix()
+	a.Add([]netAddress{
+		{Addr: "10.0.0.1:3000", Timestamp: now},
+		{Addr: "10.0.0.2:3000", Timestamp: now},
+		{Addr: "10.0.0.3:3000", Timestamp: now - int64(horizon.Seconds()) - 1},
+	}, "10.1.0.1")
+	a.Good("10.0.0.2:3000", SFNodeNetwork)
+
+	exclude := func(addr string) bool { return addr == "10.0.0.1:3000" }
+	for i := 0; i < 20; i++ {
+		addr, ok := a.Select(exclude)
+		require.True(t, ok)
+		assert.Equal(t, "10.0.0.2:3000", addr, "Excluded and terrible addresses can't be selected")
+	}
+}
+
+func TestAddrManagerAddressCache(t *testing.T) {
+	a := newAddrManager()
+	now := time.Now().Unix()
+
+	addresses := make([]netAddress, 0, 300)
+	for i := 0; i < 300; i++ {
+		addresses = append(addresses, netAddress{Addr: fmt.Sprintf("10.%d.0.1:%d", i%30, 3000+i), Timestamp: now})
+	}
+	a.Add(addresses, "10.1.0.1")
+
+	cache := a.AddressCache()
+	assert.Len(t, cache, a.Size()*getAddrPercent/100)
+
+	small := newAddrManager()
+	small.Add(addresses[:3], "10.1.0.1")
+	assert.Len(t, small.AddressCache(), 3)
+}
+
+func TestAddrManagerSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), PeersPath)
+	now := time.Now().Unix()
+
+	a := newAddrManager()
+	a.Add([]netAddress{
+		{Addr: "10.0.0.1:3000", Timestamp: now},
+		{Addr: "10.0.0.2:3000", Timestamp: now},
+	}, "10.1.0.1")
+	a.Good("10.0.0.1:3000", SFNodeNetwork)
+	require.NoError(t, a.Save(path))
+
+	loaded, err := loadAddrManager(path)
+	require.NoError(t, err)
+	assert.Equal(t, a.key, loaded.key)
+	assert.Equal(t, a.addrs, loaded.addrs)
+	assert.Contains(t, loaded.triedBuckets[loaded.triedBucket("10.0.0.1:3000")], "10.0.0.1:3000")
+}
+
+func TestAddrGroup(t *testing.T) {
+	cases := []struct {
+		address  string
+		expected string
+	}{
+		{address: "10.0.5.1:3000", expected: "10.0.0.0"},
+		{address: "10.0.6.1", expected: "10.0.0.0"},
+		{address: "[2001:db8::1]:3000", expected: "2001:db8::"},
+		{address: "node1:3000", expected: "node1"},
+	}
+
+	for _, tc := range cases {
+		assert.Equal(t, tc.expected, addrGroup(tc.address), tc.address)
+	}
+}
@@ -0,0 +1,200 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/GGP1/btcs/encoding/gob"
+)
+
+const (
+	// BanListPath is the file where the banned addresses are stored when the node stops.
+	BanListPath = "banlist.dat"
+	// DefaultBanDuration is the time misbehaving peers are banned for.
+	DefaultBanDuration = 24 * time.Hour
+	// banThreshold is the misbehavior score at which a peer is banned.
+	banThreshold = 100
+)
+
+// Misbehavior scores, they accumulate during a connection.
+const (
+	scorePrematureMessage = 1
+	scoreDuplicateMessage = 1
+	scoreUnknownCommand   = 10
+	scoreMalformedPayload = 20
+	scoreMalformedMessage = 50
+	scoreInvalidBlock     = 100
+)
+
+// errBanned is returned when connecting to a banned address.
+var errBanned = errors.New("address is banned")
+
+// BanEntry is a banned address.
+type BanEntry struct {
+	// Address is the banned IP address
+	Address string
+	// Unix times at which the ban was created and at which it expires
+	Created int64
+	Until   int64
+	Reason  string
+}
+
+// banList contains the addresses the node refuses to connect with, it's safe for
+// concurrent use.
+type banList struct {
+	mu      *sync.Mutex
+	entries map[string]BanEntry
+}
+
+func newBanList() *banList {
+	return &banList{
+		mu:      &sync.Mutex{},
+		entries: make(map[string]BanEntry),
+	}
+}
+
+// loadBanList reads the ban list stored in the file at path, expired entries are discarded.
+func loadBanList(path string) (*banList, error) {
+	fileContent, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := gob.Decode[[]BanEntry](fileContent)
+	if err != nil {
+		return nil, err
+	}
+
+	bl := newBanList()
+	now := time.Now().Unix()
+	for _, entry := range entries {
+		if entry.Until > now {
+			bl.entries[entry.Address] = entry
+		}
+	}
+
+	return bl, nil
+}
+
+// Save writes the ban list to the file at path.
+func (b *banList) Save(path string) error {
+	encoded, err := gob.Encode(b.List())
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, encoded, 0o644)
+}
+
+// Ban adds the address to the list for the duration provided. If it was already banned,
+// the ban is replaced.
+func (b *banList) Ban(address string, duration time.Duration, reason string) BanEntry {
+	now := time.Now()
+	entry := BanEntry{
+		Address: address,
+		Created: now.Unix(),
+		Until:   now.Add(duration).Unix(),
+		Reason:  reason,
+	}
+
+	b.mu.Lock()
+	b.entries[address] = entry
+	b.mu.Unlock()
+
+	return entry
+}
+
+// Clear removes all the bans.
+func (b *banList) Clear() {
+	b.mu.Lock()
+	b.entries = make(map[string]BanEntry)
+	b.mu.Unlock()
+}
+
+// IsBanned returns whether the address is banned.
+func (b *banList) IsBanned(address string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, ok := b.entries[address]
+	if !ok {
+		return false
+	}
+	if entry.Until <= time.Now().Unix() {
+		delete(b.entries, address)
+		return false
+	}
+	return true
+}
+
+// List returns the bans that haven't expired, sorted by address.
+func (b *banList) List() []BanEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now().Unix()
+	entries := make([]BanEntry, 0, len(b.entries))
+	for address, entry := range b.entries {
+		if entry.Until <= now {
+			delete(b.entries, address)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Address < entries[j].Address
+	})
+
+	return entries
+}
+
+// Unban removes the address from the list, it returns false if it wasn't banned.
+func (b *banList) Unban(address string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.entries[address]; !ok {
+		return false
+	}
+	delete(b.entries, address)
+	return true
+}
+
+// misbehaviorError is returned by the message handlers when a peer violates the protocol.
+type misbehaviorError struct {
+	score int
+	err   error
+}
+
+// misbehavior returns an error that increases the peer's ban score.
+func misbehavior(score int, err error) error {
+	return misbehaviorError{score: score, err: err}
+}
+
+func (e misbehaviorError) Error() string {
+	return e.err.Error()
+}
+
+func (e misbehaviorError) Unwrap() error {
+	return e.err
+}
+
+// banAddress returns the IP address of a host:port address, the ones banned. The port is
+// optional.
+func banAddress(address string) (string, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", fmt.Errorf("invalid IP address %q", host)
+	}
+	return ip.String(), nil
+}
@@ -0,0 +1,72 @@
+package node
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBanList(t *testing.T) {
+	bl := newBanList()
+	bl.Ban("10.0.0.1", time.Hour, "test")
+	bl.Ban("10.0.0.2", -time.Second, "expired")
+
+	assert.True(t, bl.IsBanned("10.0.0.1"))
+	assert.False(t, bl.IsBanned("10.0.0.2"), "Expired ban")
+	assert.False(t, bl.IsBanned("10.0.0.3"))
+
+	entries := bl.List()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "10.0.0.1", entries[0].Address)
+	assert.Equal(t, "test", entries[0].Reason)
+
+	assert.True(t, bl.Unban("10.0.0.1"))
+	assert.False(t, bl.Unban("10.0.0.1"))
+	assert.False(t, bl.IsBanned("10.0.0.1"))
+
+	bl.Ban("10.0.0.4", time.Hour, "")
+	bl.Clear()
+	assert.Empty(t, bl.List())
+}
+
+func TestBanListSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), BanListPath)
+
+	bl := newBanList()
+	bl.Ban("10.0.0.1", time.Hour, "test")
+	bl.entries["10.0.0.2"] = BanEntry{Address: "10.0.0.2", Until: time.Now().Add(-time.Hour).Unix()}
+	require.NoError(t, bl.Save(path))
+
+	loaded, err := loadBanList(path)
+	require.NoError(t, err)
+	assert.Equal(t, bl.List(), loaded.List())
+	assert.True(t, loaded.IsBanned("10.0.0.1"))
+}
+
+func TestBanAddress(t *testing.T) {
+	cases := []struct {
+		address  string
+		expected string
+		fail     bool
+	}{
+		{address: "10.0.0.1", expected: "10.0.0.1"},
+		{address: "10.0.0.1:3000", expected: "10.0.0.1"},
+		{address: "[::1]:3000", expected: "::1"},
+		{address: "node1:3000", fail: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.address, func(t *testing.T) {
+			got, err := banAddress(tc.address)
+			if tc.fail {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, got)
+		})
+	}
+}
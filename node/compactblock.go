@@ -0,0 +1,444 @@
+package node
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/GGP1/btcs/block"
+	"github.com/GGP1/btcs/encoding/gob"
+	"github.com/GGP1/btcs/logger"
+	"github.com/GGP1/btcs/mempool"
+	"github.com/GGP1/btcs/tx"
+)
+
+const (
+	// compactBlocksProtocol is the version of the compact blocks protocol announced in
+	// sendcmpct messages.
+	compactBlocksProtocol = 1
+	// maxHighBandwidthPeers is the number of peers asked to announce new blocks with
+	// compact blocks, without waiting for them to be requested.
+	maxHighBandwidthPeers = 3
+	// maxCompactBlockDepth is how far below the tip blocks are still sent as compact
+	// blocks, older ones are unlikely to be in the requester's pool so the full block
+	// is sent.
+	maxCompactBlockDepth = 5
+	// maxPartialBlocks is the number of blocks waiting for their missing transactions.
+	maxPartialBlocks = 16
+	// shortIDMask keeps the 6 bytes of the short transaction IDs.
+	shortIDMask = 1<<48 - 1
+)
+
+var errShortIDCollision = errors.New("short transaction ID collision")
+
+// CompactBlockStats contains the reconstruction results of the compact blocks received.
+type CompactBlockStats struct {
+	// Received is the number of compact blocks received
+	Received int
+	// Reconstructed is the number of blocks rebuilt with the transactions of the pool only
+	Reconstructed int
+	// Requested is the number of blocks rebuilt after requesting the missing transactions
+	Requested int
+	// Failed is the number of blocks whose full version had to be requested
+	Failed int
+	// PrefilledTxs, MempoolTxs and MissingTxs are the number of transactions included
+	// in the compact blocks, found in the pool and requested to the peers
+	PrefilledTxs int
+	MempoolTxs   int
+	MissingTxs   int
+}
+
+// HitRate returns the fraction of the compact blocks rebuilt without a round trip.
+func (s CompactBlockStats) HitRate() float64 {
+	if s.Received == 0 {
+		return 0
+	}
+	return float64(s.Reconstructed) / float64(s.Received)
+}
+
+// TxHitRate returns the fraction of the transactions identified by a short ID that were
+// found in the pool.
+func (s CompactBlockStats) TxHitRate() float64 {
+	if s.MempoolTxs+s.MissingTxs == 0 {
+		return 0
+	}
+	return float64(s.MempoolTxs) / float64(s.MempoolTxs+s.MissingTxs)
+}
+
+// partialBlock is a compact block waiting for the transactions that weren't in the pool.
+type partialBlock struct {
+	block block.Block
+	// missing contains the indexes of the transactions missing, in ascending order
+	missing  []int
+	peer     *peer
+	received time.Time
+}
+
+// newPartialBlock fills the transactions of the compact block with the prefilled ones
+// and the ones in the pool, it returns the number of transactions taken from the pool.
+//
+// Pool transactions whose short IDs collide are ignored and requested to the peer.
+func newPartialBlock(msg cmpctBlock, hash []byte, pool *mempool.TxPool) (*partialBlock, int, error) {
+	total := len(msg.ShortIDs) + len(msg.PrefilledTxs)
+	txs := make([]tx.Tx, total)
+	filled := make([]bool, total)
+	last := -1
+	for _, prefilled := range msg.PrefilledTxs {
+		if prefilled.Index <= last || prefilled.Index >= total {
+			return nil, 0, fmt.Errorf("invalid prefilled transaction index %d", prefilled.Index)
+		}
+		txs[prefilled.Index] = prefilled.Tx
+		filled[prefilled.Index] = true
+		last = prefilled.Index
+	}
+
+	// slots maps the short IDs to the index of their transaction
+	k0, k1 := shortIDKey(hash, msg.Nonce)
+	slots := make(map[uint64]int, len(msg.ShortIDs))
+	next := 0
+	for _, shortID := range msg.ShortIDs {
+		for filled[next] {
+			next++
+		}
+		if _, ok := slots[shortID]; ok {
+			return nil, 0, errShortIDCollision
+		}
+		slots[shortID] = next
+		next++
+	}
+
+	found := 0
+	ambiguous := make(map[int]bool)
+	for _, entry := range pool.Entries() {
+		i, ok := slots[shortTxID(k0, k1, entry.Tx.ID)]
+		if !ok {
+			continue
+		}
+		if filled[i] {
+			// Two pool transactions have the same short ID
+			ambiguous[i] = true
+			continue
+		}
+		txs[i] = entry.Tx
+		filled[i] = true
+		found++
+	}
+	for i := range ambiguous {
+		txs[i] = tx.Tx{}
+		filled[i] = false
+		found--
+	}
+
+	missing := make([]int, 0)
+	for i, ok := range filled {
+		if !ok {
+			missing = append(missing, i)
+		}
+	}
+
+	header := msg.Header
+	pb := &partialBlock{
+		block:    block.Block{Header: &header, Hash: hash, Height: msg.Height, Transactions: txs},
+		missing:  missing,
+		received: time.Now(),
+	}
+	return pb, found, nil
+}
+
+// fill sets the missing transactions, which must be in the order they were requested.
+func (pb *partialBlock) fill(txs []tx.Tx) error {
+	if len(txs) != len(pb.missing) {
+		return fmt.Errorf("received %d transactions, expected %d", len(txs), len(pb.missing))
+	}
+	for i, index := range pb.missing {
+		pb.block.Transactions[index] = txs[i]
+	}
+	pb.missing = nil
+	return nil
+}
+
+// newCmpctBlock returns the compact version of the block, with the coinbase prefilled
+// and the rest of the transactions identified by short IDs.
+func newCmpctBlock(b block.Block) (cmpctBlock, error) {
+	var nonceBytes [8]byte
+	if _, err := rand.Read(nonceBytes[:]); err != nil {
+		return cmpctBlock{}, err
+	}
+	nonce := binary.LittleEndian.Uint64(nonceBytes[:])
+
+	msg := cmpctBlock{
+		Header: *b.Header,
+		Height: b.Height,
+		Nonce:  nonce,
+	}
+	if len(b.Transactions) == 0 {
+		return msg, nil
+	}
+	msg.PrefilledTxs = []prefilledTx{{Index: 0, Tx: b.Transactions[0]}}
+
+	k0, k1 := shortIDKey(b.Hash, nonce)
+	seen := make(map[uint64]struct{}, len(b.Transactions)-1)
+	msg.ShortIDs = make([]uint64, 0, len(b.Transactions)-1)
+	for _, t := range b.Transactions[1:] {
+		shortID := shortTxID(k0, k1, t.ID)
+		if _, ok := seen[shortID]; ok {
+			return cmpctBlock{}, errShortIDCollision
+		}
+		seen[shortID] = struct{}{}
+		msg.ShortIDs = append(msg.ShortIDs, shortID)
+	}
+
+	return msg, nil
+}
+
+// shortIDKey returns the SipHash key used to calculate the short transaction IDs of a
+// compact block, the first 16 bytes of SHA256(block hash || nonce).
+func shortIDKey(blockHash []byte, nonce uint64) (uint64, uint64) {
+	data := make([]byte, len(blockHash)+8)
+	copy(data, blockHash)
+	binary.LittleEndian.PutUint64(data[len(blockHash):], nonce)
+	hash := sha256.Sum256(data)
+	return binary.LittleEndian.Uint64(hash[:8]), binary.LittleEndian.Uint64(hash[8:16])
+}
+
+// shortTxID returns the 6 bytes short ID of a transaction (BIP152).
+func shortTxID(k0, k1 uint64, txID []byte) uint64 {
+	return sipHash24(k0, k1, txID) & shortIDMask
+}
+
+// sipHash24 returns the SipHash-2-4 of the data with the key (k0, k1).
+func sipHash24(k0, k1 uint64, data []byte) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13)
+		v1 ^= v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17)
+		v1 ^= v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	length := len(data)
+	for ; len(data) >= 8; data = data[8:] {
+		m := binary.LittleEndian.Uint64(data)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+
+	// The last block contains the remaining bytes and the length in the most significant one
+	var last [8]byte
+	copy(last[:], data)
+	last[7] = byte(length)
+	m := binary.LittleEndian.Uint64(last[:])
+	v3 ^= m
+	round()
+	round()
+	v0 ^= m
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
+
+// compactManager keeps the compact blocks being reconstructed and the peers relaying
+// new blocks to the node in high-bandwidth mode.
+type compactManager struct {
+	mu *sync.Mutex
+	// partial contains the blocks waiting for their missing transactions, keyed by hash
+	partial map[string]*partialBlock
+	// highBandwidth contains the peers asked to announce new blocks with compact blocks,
+	// from the least to the most recent one that delivered a new block first
+	highBandwidth []*peer
+	stats         CompactBlockStats
+}
+
+func newCompactManager() *compactManager {
+	return &compactManager{
+		mu:      &sync.Mutex{},
+		partial: make(map[string]*partialBlock),
+	}
+}
+
+// compactBlockStats returns the reconstruction results of the compact blocks received.
+func (n *Node) compactBlockStats() CompactBlockStats {
+	n.compactManager.mu.Lock()
+	defer n.compactManager.mu.Unlock()
+	return n.compactManager.stats
+}
+
+// processCmpctBlock reconstructs the block with the transactions of the pool, it requests
+// the missing ones to the peer or, if reconstruction fails, the full block.
+func (n *Node) processCmpctBlock(p *peer, msg cmpctBlock, hash []byte) error {
+	c := n.compactManager
+	c.mu.Lock()
+	if _, ok := c.partial[string(hash)]; ok {
+		c.mu.Unlock()
+		return nil
+	}
+	c.stats.Received++
+	c.stats.PrefilledTxs += len(msg.PrefilledTxs)
+
+	pb, found, err := newPartialBlock(msg, hash, n.txPool)
+	if err != nil {
+		c.stats.Failed++
+		c.mu.Unlock()
+		if !errors.Is(err, errShortIDCollision) {
+			return misbehavior(scoreMalformedPayload, err)
+		}
+		logger.Debugf("Compact block %x from %s: %v, requesting the full block", hash, p.addr, err)
+		return n.sendGetData(p, typeBlock, hash)
+	}
+	c.stats.MempoolTxs += found
+	c.stats.MissingTxs += len(pb.missing)
+
+	if len(pb.missing) > 0 {
+		c.prune()
+		pb.peer = p
+		c.partial[string(hash)] = pb
+		c.mu.Unlock()
+		logger.Debugf("Compact block %x from %s: %d transactions found in the pool, requesting %d",
+			hash, p.addr, found, len(pb.missing))
+		return n.sendGetBlockTxn(p, hash, pb.missing)
+	}
+	c.mu.Unlock()
+
+	return n.completeCmpctBlock(p, pb.block, false)
+}
+
+// processBlockTxn completes a partial block with the transactions received from the peer.
+func (n *Node) processBlockTxn(p *peer, msg blockTxn) error {
+	c := n.compactManager
+	c.mu.Lock()
+	pb, ok := c.partial[string(msg.BlockHash)]
+	if !ok || pb.peer != p {
+		c.mu.Unlock()
+		logger.Debugf("Unexpected transactions of block %x from %s", msg.BlockHash, p.addr)
+		return nil
+	}
+	delete(c.partial, string(msg.BlockHash))
+	c.mu.Unlock()
+
+	if err := pb.fill(msg.Transactions); err != nil {
+		n.compactBlockFailed()
+		return misbehavior(scoreMalformedPayload, err)
+	}
+	return n.completeCmpctBlock(p, pb.block, true)
+}
+
+// completeCmpctBlock checks the reconstructed block matches its header and processes it.
+// If it doesn't, a pool transaction had the short ID of another one and the full block
+// is requested.
+func (n *Node) completeCmpctBlock(p *peer, b block.Block, requested bool) error {
+	validMerkleRoot, err := b.HasValidMerkleRoot()
+	if err != nil {
+		return err
+	}
+	if !validMerkleRoot {
+		n.compactBlockFailed()
+		logger.Debugf("Reconstructed block %x does not match its merkle root, requesting the full block", b.Hash)
+		return n.sendGetData(p, typeBlock, b.Hash)
+	}
+
+	c := n.compactManager
+	c.mu.Lock()
+	if requested {
+		c.stats.Requested++
+	} else {
+		c.stats.Reconstructed++
+	}
+	c.mu.Unlock()
+
+	encodedBlock, err := gob.Encode(b)
+	if err != nil {
+		return err
+	}
+	return n.processBlock(p, b, len(encodedBlock))
+}
+
+func (n *Node) compactBlockFailed() {
+	n.compactManager.mu.Lock()
+	n.compactManager.stats.Failed++
+	n.compactManager.mu.Unlock()
+}
+
+// prune discards the partial blocks that weren't completed in time and, if there are
+// too many, the oldest one.
+//
+// It must be called with the lock held.
+func (c *compactManager) prune() {
+	var oldest *partialBlock
+	for hash, pb := range c.partial {
+		if time.Since(pb.received) > blockRequestTimeout {
+			delete(c.partial, hash)
+			continue
+		}
+		if oldest == nil || pb.received.Before(oldest.received) {
+			oldest = pb
+		}
+	}
+	if len(c.partial) >= maxPartialBlocks && oldest != nil {
+		delete(c.partial, string(oldest.block.Hash))
+	}
+}
+
+// selectHighBandwidthPeer asks the peer, which delivered a new block first, to announce
+// the following ones with compact blocks. If there are maxHighBandwidthPeers already, the
+// one that delivered a block first least recently goes back to low-bandwidth mode.
+func (n *Node) selectHighBandwidthPeer(p *peer) {
+	if !p.supportsCompactBlocks() {
+		return
+	}
+
+	c := n.compactManager
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	isNew := true
+	selected := c.highBandwidth[:0]
+	for _, hbPeer := range c.highBandwidth {
+		if hbPeer == p {
+			isNew = false
+			continue
+		}
+		if hbPeer.connected() {
+			selected = append(selected, hbPeer)
+		}
+	}
+	c.highBandwidth = append(selected, p)
+
+	if len(c.highBandwidth) > maxHighBandwidthPeers {
+		evicted := c.highBandwidth[0]
+		c.highBandwidth = c.highBandwidth[1:]
+		if err := n.sendSendCmpct(evicted, false); err != nil {
+			logger.Debugf("Peer %s: %v", evicted.addr, err)
+		}
+	}
+	if isNew {
+		logger.Debugf("Requesting high-bandwidth compact blocks from %s", p.addr)
+		if err := n.sendSendCmpct(p, true); err != nil {
+			logger.Debugf("Peer %s: %v", p.addr, err)
+		}
+	}
+}
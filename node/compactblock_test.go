@@ -0,0 +1,76 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/GGP1/btcs/block"
+	"github.com/GGP1/btcs/mempool"
+	"github.com/GGP1/btcs/tx"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSipHash24(t *testing.T) {
+	// Reference vectors with the key 00 01 .. 0f and the messages 00 01 .. (length - 1)
+	k0, k1 := uint64(0x0706050403020100), uint64(0x0f0e0d0c0b0a0908)
+	cases := map[int]uint64{
+		0:  0x726fdb47dd0e0e31,
+		1:  0x74f839c593dc67fd,
+		8:  0x93f5f5799a932462,
+		15: 0xa129ca6149be45e5,
+	}
+	for length, expected := range cases {
+		data := make([]byte, length)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		assert.Equal(t, expected, sipHash24(k0, k1, data), "Length %d", length)
+	}
+}
+
+func TestCompactBlockReconstruction(t *testing.T) {
+	txs := make([]tx.Tx, 5)
+	for i := range txs {
+		txs[i] = tx.Tx{ID: []byte{byte(i), 1, 2, 3}, Outputs: []tx.Output{{Value: i + 1}}}
+	}
+	b := block.Block{
+		Header:       &block.Header{PrevBlockHash: []byte{1}, MerkleRootHash: []byte{2}},
+		Hash:         []byte{3},
+		Height:       10,
+		Transactions: txs,
+	}
+
+	msg, err := newCmpctBlock(b)
+	require.NoError(t, err)
+	assert.Len(t, msg.ShortIDs, 4)
+	assert.Equal(t, []prefilledTx{{Index: 0, Tx: txs[0]}}, msg.PrefilledTxs, "The coinbase is prefilled")
+
+	// The pool is missing the third and fifth transactions
+	pool := mempool.NewTxPool()
+	pool.Add(txs[1], 0, 9)
+	pool.Add(txs[3], 0, 9)
+	pool.Add(tx.Tx{ID: []byte{9}}, 0, 9)
+
+	pb, found, err := newPartialBlock(msg, b.Hash, pool)
+	require.NoError(t, err)
+	assert.Equal(t, 2, found)
+	assert.Equal(t, []int{2, 4}, pb.missing)
+
+	assert.Error(t, pb.fill(txs[2:3]))
+	require.NoError(t, pb.fill([]tx.Tx{txs[2], txs[4]}))
+	assert.Equal(t, b, pb.block)
+}
+
+func TestCompactBlockInvalidPrefilled(t *testing.T) {
+	msg := cmpctBlock{
+		ShortIDs:     []uint64{1},
+		PrefilledTxs: []prefilledTx{{Index: 2}},
+	}
+	_, _, err := newPartialBlock(msg, []byte{1}, mempool.NewTxPool())
+	assert.Error(t, err)
+
+	msg = cmpctBlock{ShortIDs: []uint64{1, 1}}
+	_, _, err = newPartialBlock(msg, []byte{1}, mempool.NewTxPool())
+	assert.ErrorIs(t, err, errShortIDCollision)
+}
@@ -4,18 +4,20 @@ ACCOUNT_NAME="satoshi"
 MNEMONIC=$(btcs wallet create | grep "Mnemonic" | tail -c +11)
 MINER="false"
 DEBUG="false"
+REGTEST="false"
 
 # Export the account name for use in other scripts
 export $ACCOUNT_NAME
 
 echo -n $MNEMONIC > mnemonic.txt
 
-while getopts ':dm' flag; do
+while getopts ':dmr' flag; do
   case "${flag}" in
 	d) DEBUG="true" ;;
     m) MINER="true" ;;
+    r) REGTEST="true" ;;
   esac
 done
 
 btcs wallet createaccount $ACCOUNT_NAME
-btcs startnode $ACCOUNT_NAME -m=$MINER --debug=$DEBUG
\ No newline at end of file
+btcs startnode $ACCOUNT_NAME -m=$MINER --debug=$DEBUG --regtest=$REGTEST
\ No newline at end of file
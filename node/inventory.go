@@ -0,0 +1,134 @@
+package node
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/GGP1/btcs/block"
+	"github.com/GGP1/btcs/logger"
+	"github.com/GGP1/btcs/mempool"
+)
+
+const (
+	// maxKnownInventory is the number of inventory hashes remembered per peer, the least
+	// recently used ones are forgotten first.
+	maxKnownInventory = 5000
+	// maxInvPerMessage is the maximum number of items of an inv message.
+	maxInvPerMessage = 50000
+	// txInvInterval is how often the pending transaction announcements are sent.
+	txInvInterval = 2 * time.Second
+	// maxFeeFilter is the highest fee rate (sat/byte) accepted in feefilter messages, the
+	// supply of satoshis.
+	maxFeeFilter = 21e6 * 1e8
+)
+
+// knownInventory is a bounded set of the inventory hashes a peer is known to have, either
+// because it announced or sent them or because we did.
+//
+// It's not safe for concurrent use, the peer lock guards it.
+type knownInventory struct {
+	capacity int
+	items    map[string]*list.Element
+	// order contains the hashes from the most to the least recently used
+	order *list.List
+}
+
+func newKnownInventory(capacity int) *knownInventory {
+	return &knownInventory{
+		capacity: capacity,
+		items:    make(map[string]*list.Element, capacity),
+		order:    list.New(),
+	}
+}
+
+// Add records the hash, evicting the least recently used one if the set is full.
+func (k *knownInventory) Add(hash []byte) {
+	if elem, ok := k.items[string(hash)]; ok {
+		k.order.MoveToFront(elem)
+		return
+	}
+
+	if k.order.Len() >= k.capacity {
+		oldest := k.order.Back()
+		k.order.Remove(oldest)
+		delete(k.items, oldest.Value.(string))
+	}
+	k.items[string(hash)] = k.order.PushFront(string(hash))
+}
+
+// Contains returns whether the hash is in the set.
+func (k *knownInventory) Contains(hash []byte) bool {
+	_, ok := k.items[string(hash)]
+	return ok
+}
+
+// Len returns the number of hashes in the set.
+func (k *knownInventory) Len() int {
+	return k.order.Len()
+}
+
+// invLoop periodically sends the transactions queued for each peer in a single inv
+// message. It should be called inside a goroutine.
+func (n *Node) invLoop() {
+	ticker := time.NewTicker(txInvInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.quit:
+			return
+		case <-ticker.C:
+		}
+
+		err := n.peers.ForEach(func(p *peer) error {
+			txIDs := p.takePendingTxInv()
+			for len(txIDs) > 0 {
+				batch := txIDs
+				if len(batch) > maxInvPerMessage {
+					batch = batch[:maxInvPerMessage]
+				}
+				txIDs = txIDs[len(batch):]
+
+				if err := n.sendInv(p, typeTx, batch); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			logger.Error("Announcing transactions: ", err)
+		}
+	}
+}
+
+// relayTx queues the announcement of a pool transaction to the peers that don't know it
+// already and whose fee filter it passes, it's sent by the inv loop.
+func (n *Node) relayTx(entry mempool.Entry) error {
+	return n.peers.ForEach(func(p *peer) error {
+		if p.handshakeComplete() {
+			p.queueTxInv(entry.Tx.ID, entry.FeeRate)
+		}
+		return nil
+	})
+}
+
+// announceBlock notifies the peers that don't know the block about it. The ones in
+// high-bandwidth mode receive the compact block, the ones that asked for headers
+// announcements its header and the rest an inv message.
+func (n *Node) announceBlock(b block.Block) error {
+	return n.peers.ForEach(func(p *peer) error {
+		if !p.handshakeComplete() || p.knowsInventory(b.Hash) {
+			return nil
+		}
+
+		switch {
+		case p.wantsCompactBlocks():
+			return n.sendCmpctBlock(p, b)
+		case p.prefersHeaders():
+			p.addKnownInventory(b.Hash)
+			return n.sendHeaders(p, []block.Header{*b.Header})
+		default:
+			return n.sendInv(p, typeBlock, [][]byte{b.Hash})
+		}
+	})
+}
@@ -0,0 +1,44 @@
+package node
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKnownInventory(t *testing.T) {
+	k := newKnownInventory(3)
+	k.Add([]byte{1})
+	k.Add([]byte{2})
+	k.Add([]byte{3})
+	assert.Equal(t, 3, k.Len())
+
+	// 1 becomes the most recently used, 2 is evicted
+	k.Add([]byte{1})
+	k.Add([]byte{4})
+	assert.Equal(t, 3, k.Len())
+	assert.True(t, k.Contains([]byte{1}))
+	assert.False(t, k.Contains([]byte{2}))
+	assert.True(t, k.Contains([]byte{3}))
+	assert.True(t, k.Contains([]byte{4}))
+}
+
+func TestPeerQueueTxInv(t *testing.T) {
+	conn, _ := net.Pipe()
+	p := newPeer(conn, "127.0.0.1:40000", true)
+	defer p.disconnect()
+
+	p.addKnownInventory([]byte{1})
+	p.setFeeFilter(2)
+	p.queueTxInv([]byte{1}, 5)
+	p.queueTxInv([]byte{2}, 5)
+	p.queueTxInv([]byte{2}, 5)
+	p.queueTxInv([]byte{3}, 2)
+	p.queueTxInv([]byte{4}, 1.5)
+
+	assert.Equal(t, [][]byte{{2}, {3}}, p.takePendingTxInv(), "Known, duplicate and filtered transactions are skipped")
+	assert.False(t, p.knowsInventory([]byte{4}))
+	assert.Empty(t, p.takePendingTxInv())
+	assert.True(t, p.knowsInventory([]byte{3}))
+}
@@ -0,0 +1,184 @@
+package node
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/GGP1/btcs/block"
+	"github.com/GGP1/btcs/logger"
+	"github.com/GGP1/btcs/mempool"
+	"github.com/GGP1/btcs/tx"
+	"github.com/GGP1/btcs/tx/utxo"
+)
+
+// loadMempool restores the transactions that were in the pool when the node stopped.
+func (n *Node) loadMempool() error {
+	added, err := n.importMempool(mempool.DefaultPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	logger.Infof("Loaded %d transactions from %s", added, mempool.DefaultPath)
+	return nil
+}
+
+// dataDirPath resolves path, relative to the node's data directory unless it's absolute,
+// and returns an error if it points outside of it.
+func dataDirPath(dataDir, path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dataDir, path)
+	}
+
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	dataDir, err = filepath.EvalSymlinks(dataDir)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(dataDir, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of the node's data directory", path)
+	}
+
+	return resolved, nil
+}
+
+// AcceptToMemoryPool validates a transaction and adds it to the pool if it complies with
+// the node's policy.
+//
+// Rejected transactions return a mempool.RuleError containing the reason.
+func (n *Node) AcceptToMemoryPool(t tx.Tx) (mempool.Entry, error) {
+	// Transactions spending the same outputs must not pass the checks at the same time
+	n.mempoolMu.Lock()
+	defer n.mempoolMu.Unlock()
+
+	fee, err := n.checkTx(t)
+	if err != nil {
+		return mempool.Entry{}, err
+	}
+
+	bestHeight, err := n.blockchain.BestHeight()
+	if err != nil {
+		return mempool.Entry{}, err
+	}
+	entry := mempool.NewEntry(t, fee, bestHeight)
+
+	n.expireMempool()
+	n.txPool.AddEntry(entry)
+	n.feeEstimator.ObserveTx(entry)
+
+	logger.Debugf("Accepted transaction %x into the mempool", t.ID)
+	return entry, nil
+}
+
+// importMempool adds the valid transactions of the mempool dump at path to the pool and
+// returns the number of transactions added.
+func (n *Node) importMempool(path string) (int, error) {
+	n.mempoolMu.Lock()
+	defer n.mempoolMu.Unlock()
+
+	return n.txPool.Import(path, n.checkPoolEntry)
+}
+
+// checkPoolEntry revalidates a previously accepted entry against the current chain
+// and UTXO set, as blocks may have been added since it entered the pool.
+func (n *Node) checkPoolEntry(entry mempool.Entry) error {
+	if time.Unix(entry.Time, 0).Before(time.Now().Add(-n.mempoolExpiry)) {
+		return errors.New("entry expired")
+	}
+
+	_, err := n.checkTx(entry.Tx)
+	return err
+}
+
+// checkTx validates a transaction and checks that it complies with the node's policy.
+// It returns the fee the transaction pays.
+//
+// The caller must hold the mempool lock.
+func (n *Node) checkTx(t tx.Tx) (int, error) {
+	if n.txPool.Contains(t.ID) {
+		return 0, mempool.RuleError{Code: mempool.RejectDuplicate, Reason: "transaction already in the mempool"}
+	}
+
+	if err := n.blockchain.VerifyTx(t); err != nil {
+		if errors.Is(err, block.ErrTxExists) {
+			return 0, mempool.NewRuleError(mempool.RejectDuplicate, err)
+		}
+		return 0, mempool.NewRuleError(mempool.RejectInvalid, err)
+	}
+
+	utxoSet := &utxo.Set{Blockchain: n.blockchain}
+	for _, in := range t.Inputs {
+		if spenderID, ok := n.txPool.Spender(in.PrevOutput); ok {
+			return 0, mempool.RuleError{
+				Code: mempool.RejectDuplicate,
+				Reason: fmt.Sprintf("output %x:%d is already spent by %x in the mempool",
+					in.PrevOutput.TxID, in.PrevOutput.Index, spenderID),
+			}
+		}
+
+		_, ok, err := utxoSet.Output(in.PrevOutput)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return 0, mempool.RuleError{
+				Code:   mempool.RejectDuplicate,
+				Reason: fmt.Sprintf("output %x:%d is already spent", in.PrevOutput.TxID, in.PrevOutput.Index),
+			}
+		}
+	}
+
+	prevTxs, err := n.blockchain.PrevTxs(t)
+	if err != nil {
+		return 0, mempool.NewRuleError(mempool.RejectInvalid, err)
+	}
+
+	fee, err := t.Fee(prevTxs)
+	if err != nil {
+		return 0, mempool.NewRuleError(mempool.RejectInvalid, err)
+	}
+
+	if err := mempool.CheckTransactionStandard(t, fee, n.minRelayFeeRate); err != nil {
+		return 0, mempool.NewRuleError(mempool.RejectNonstandard, err)
+	}
+
+	return fee, nil
+}
+
+// mempoolEntry returns the details of a pool entry.
+func (n *Node) mempoolEntry(entry mempool.Entry) MempoolEntry {
+	ancestorCount, ancestorSize := n.txPool.Ancestors(entry.Tx.ID)
+	descendantCount, descendantSize := n.txPool.Descendants(entry.Tx.ID)
+	return MempoolEntry{
+		TxID:            hex.EncodeToString(entry.Tx.ID),
+		Time:            entry.Time,
+		Height:          entry.Height,
+		Size:            entry.Size,
+		Fee:             entry.Fee,
+		FeeRate:         entry.FeeRate,
+		AncestorCount:   ancestorCount,
+		AncestorSize:    ancestorSize,
+		DescendantCount: descendantCount,
+		DescendantSize:  descendantSize,
+	}
+}
+
+// expireMempool removes the transactions that have been in the pool for longer than
+// the expiry configured.
+func (n *Node) expireMempool() {
+	if removed := n.txPool.Expire(time.Now().Add(-n.mempoolExpiry)); removed > 0 {
+		logger.Infof("Expired %d transactions from the mempool", removed)
+	}
+}
@@ -0,0 +1,73 @@
+package node
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/GGP1/btcs/tx"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDataDirPath(t *testing.T) {
+	dataDir := t.TempDir()
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "mempool.dat"), nil, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "secret"), nil, 0o644))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "secret"), filepath.Join(dataDir, "link")))
+
+	path, err := dataDirPath(dataDir, "mempool.dat")
+	assert.NoError(t, err)
+	assert.Equal(t, "mempool.dat", filepath.Base(path))
+
+	_, err = dataDirPath(dataDir, filepath.Join(dataDir, "mempool.dat"))
+	assert.NoError(t, err)
+
+	_, err = dataDirPath(dataDir, filepath.Join("..", filepath.Base(outside), "secret"))
+	assert.Error(t, err)
+
+	_, err = dataDirPath(dataDir, filepath.Join(outside, "secret"))
+	assert.Error(t, err)
+
+	_, err = dataDirPath(dataDir, "link")
+	assert.Error(t, err, "Symbolic link pointing outside")
+
+	_, err = dataDirPath(dataDir, "missing")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestAcceptToMemoryPoolConflicting(t *testing.T) {
+	n := newTestNode(t)
+	account, addr := newTestAccount(t)
+	coinbase := fundTestAccount(t, n, addr)
+	outPoint := tx.OutPoint{TxID: coinbase.ID, Index: 0}
+
+	// All the transactions spend the same output, only one can enter the pool
+	txs := make([]tx.Tx, 32)
+	for i := range txs {
+		txs[i] = newTestTx(t, n, account, []tx.OutPoint{outPoint}, coinbase.OutputsValue()-1000*(i+1), addr)
+	}
+
+	var accepted atomic.Int32
+	start := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	for _, t := range txs {
+		wg.Add(1)
+		go func(t tx.Tx) {
+			defer wg.Done()
+			<-start
+			if _, err := n.AcceptToMemoryPool(t); err == nil {
+				accepted.Add(1)
+			}
+		}(t)
+	}
+	close(start)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), accepted.Load())
+	assert.Equal(t, 1, n.txPool.Count())
+}
@@ -1,89 +1,274 @@
 package node
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/GGP1/btcs/block"
+	"github.com/GGP1/btcs/chaincfg"
 	"github.com/GGP1/btcs/encoding/gob"
+	"github.com/GGP1/btcs/mempool"
+	"github.com/GGP1/btcs/tx"
 )
 
 const (
 	messageLength = 12
 
+	// headerSize is the size of the messages header: magic (4 bytes), command (12 bytes),
+	// payload length (4 bytes) and checksum (4 bytes).
+	headerSize = 4 + messageLength + 4 + checksumSize
+	// checksumSize is the number of bytes of the payload double SHA-256 hash included in the header.
+	checksumSize = 4
+	// maxPayloadSize is the maximum number of bytes a message payload can have, only the
+	// messages carrying blocks can reach it.
+	maxPayloadSize = 32 * 1024 * 1024
+	// maxSmallPayloadSize is the maximum number of bytes of the payload of the messages
+	// that don't carry blocks, it fits an inventory with maxInvPerMessage items.
+	maxSmallPayloadSize = 2 * 1024 * 1024
+
 	// https://developer.bitcoin.org/reference/p2p_networking.html
-	msgAddr      message = "addr"
-	msgBlock     message = "block"
-	msgGetAddr   message = "getaddr"
-	msgGetBlocks message = "getblocks"
-	msgGetData   message = "getdata"
-	msgInv       message = "inv"
-	msgPing      message = "ping"
-	msgPong      message = "pong"
-	msgTx        message = "tx"
-	msgVersion   message = "version"
+	msgAddr        message = "addr"
+	msgBlock       message = "block"
+	msgBlockTxn    message = "blocktxn"
+	msgCmpctBlock  message = "cmpctblock"
+	msgFeeFilter   message = "feefilter"
+	msgGetAddr     message = "getaddr"
+	msgGetBlocks   message = "getblocks"
+	msgGetBlockTxn message = "getblocktxn"
+	msgGetData     message = "getdata"
+	msgGetHeaders  message = "getheaders"
+	msgHeaders     message = "headers"
+	msgInv         message = "inv"
+	msgMempool     message = "mempool"
+	msgNotFound    message = "notfound"
+	msgPing        message = "ping"
+	msgPong        message = "pong"
+	msgReject      message = "reject"
+	msgSendCmpct   message = "sendcmpct"
+	msgSendHeaders message = "sendheaders"
+	msgTx          message = "tx"
+	msgVerack      message = "verack"
+	msgVersion     message = "version"
+)
+
+var (
+	errInvalidMagic    = errors.New("invalid network magic")
+	errInvalidChecksum = errors.New("invalid payload checksum")
+	errPayloadTooLarge = errors.New("payload too large")
 )
 
+// The sender of the messages is identified by the connection they are received from.
 type (
 	message string
 
 	addr struct {
-		Addresses []string
+		Addresses []netAddress
+	}
+
+	// netAddress is the address of a node with the time it was last seen on the network.
+	netAddress struct {
+		Addr      string
+		Services  ServiceFlag
+		Timestamp int64
 	}
 
 	blockData struct {
-		AddrFrom string
-		Block    []byte
+		Block []byte
 	}
 
-	getaddr struct {
-		AddrFrom string
+	// blockTxn contains the transactions of a block requested with getblocktxn, in the
+	// same order.
+	blockTxn struct {
+		BlockHash    []byte
+		Transactions []tx.Tx
+	}
+
+	// cmpctBlock is a block whose transactions are identified by short IDs, so the
+	// receiver can rebuild it with the ones in its pool (BIP152).
+	cmpctBlock struct {
+		Header block.Header
+		Height int32
+		// Nonce is used along with the block hash to calculate the short IDs
+		Nonce uint64
+		// ShortIDs identify the transactions that are not prefilled, in order
+		ShortIDs     []uint64
+		PrefilledTxs []prefilledTx
 	}
 
+	// prefilledTx is a transaction included in a compact block, the coinbase always is.
+	prefilledTx struct {
+		// Index of the transaction in the block
+		Index int
+		Tx    tx.Tx
+	}
+
+	// getblocks requests the hashes of the blocks following the locator, up to the stop
+	// hash, getheaders requests their headers.
 	getblocks struct {
-		AddrFrom string
+		// Locator contains hashes of the sender's chain, from the tip back to the genesis
+		Locator  [][]byte
+		HashStop []byte
+	}
+
+	getheaders getblocks
+
+	// getBlockTxn requests the transactions of a block missing to rebuild it.
+	getBlockTxn struct {
+		BlockHash []byte
+		// Indexes of the transactions in the block, in ascending order
+		Indexes []int
+	}
+
+	headers struct {
+		Headers []block.Header
+	}
+
+	// feeFilter asks the receiver not to announce transactions paying a lower fee rate.
+	feeFilter struct {
+		// FeeRate is represented in satoshis per byte
+		FeeRate float64
 	}
 
 	getdata struct {
-		AddrFrom string
-		Type     string
-		ID       []byte
+		Type string
+		ID   []byte
 	}
 
 	inv struct {
-		AddrFrom string
-		Type     string
-		Items    [][]byte
+		Type  string
+		Items [][]byte
 	}
 
-	ping struct {
-		AddrFrom string
+	// notFound answers a getdata message requesting an object the sender doesn't have.
+	notFound getdata
+
+	reject struct {
+		// Message is the type of message rejected
+		Message message
+		Code    mempool.RejectCode
+		Reason  string
+		// Hash of the object rejected
+		Hash []byte
 	}
 
-	pong struct {
-		AddrFrom string
+	// sendCmpct announces the support of compact blocks. If Announce is true, the sender
+	// wants new blocks to be announced with compact blocks directly (high-bandwidth mode),
+	// otherwise with headers or inv messages (low-bandwidth mode).
+	sendCmpct struct {
+		Announce bool
+		Version  uint64
 	}
 
 	transaction struct {
-		AddrFrom    string
 		Transaction []byte
 	}
 
 	version struct {
-		AddrFrom   string
-		Version    int
-		BestHeight int32
+		ProtocolVersion int32
+		Services        ServiceFlag
+		// Timestamp is the sender's Unix time, used to calculate the network-adjusted time
+		Timestamp int64
+		// AddrFrom is the address where the sender accepts connections
+		AddrFrom string
+		// Nonce is a random number generated on startup, used to detect connections to self
+		Nonce     uint64
+		UserAgent string
+		// StartHeight is the height of the sender's best chain
+		StartHeight int32
 	}
 )
 
+// newMessage returns the serialized message, composed of a header and the encoded payload.
+//
+// If the payload is nil the message has no payload.
 func newMessage(cmd message, payload any) ([]byte, error) {
-	encPayload, err := gob.Encode(payload)
-	if err != nil {
-		return nil, err
+	if len(cmd) > messageLength {
+		return nil, fmt.Errorf("command %q is longer than %d bytes", cmd, messageLength)
 	}
 
-	var bytes [messageLength]byte
-	for i, c := range cmd {
-		bytes[i] = byte(c)
+	var encPayload []byte
+	if payload != nil {
+		var err error
+		encPayload, err = gob.Encode(payload)
+		if err != nil {
+			return nil, err
+		}
 	}
+	if len(encPayload) > int(maxMessagePayloadSize(cmd)) {
+		return nil, fmt.Errorf("%w: %d bytes", errPayloadTooLarge, len(encPayload))
+	}
+
+	msg := make([]byte, headerSize, headerSize+len(encPayload))
+	binary.LittleEndian.PutUint32(msg[:4], chaincfg.ActiveParams.Magic)
+	copy(msg[4:4+messageLength], cmd)
+	binary.LittleEndian.PutUint32(msg[4+messageLength:], uint32(len(encPayload)))
+	checksum := payloadChecksum(encPayload)
+	copy(msg[headerSize-checksumSize:], checksum[:])
 
-	return append(bytes[:], encPayload...), nil
+	return append(msg, encPayload...), nil
+}
+
+// readMessage reads a message from r and returns its command and payload.
+//
+// Messages from other networks, with payloads exceeding the command's maximum size or
+// whose checksum doesn't match are rejected. The payload is read as it arrives instead of
+// allocating the length announced in the header upfront.
+func readMessage(r io.Reader) (message, []byte, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return "", nil, err
+	}
+
+	if magic := binary.LittleEndian.Uint32(header[:4]); magic != chaincfg.ActiveParams.Magic {
+		return "", nil, fmt.Errorf("%w: %08x", errInvalidMagic, magic)
+	}
+
+	cmd := bytesToMessage(header[4 : 4+messageLength])
+	length := binary.LittleEndian.Uint32(header[4+messageLength:])
+	if length > maxMessagePayloadSize(cmd) {
+		return "", nil, fmt.Errorf("%w: %s message of %d bytes", errPayloadTooLarge, cmd, length)
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(length)); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", nil, err
+	}
+	payload := buf.Bytes()
+
+	checksum := payloadChecksum(payload)
+	if !bytes.Equal(checksum[:], header[headerSize-checksumSize:]) {
+		return "", nil, fmt.Errorf("%w: %s message", errInvalidChecksum, cmd)
+	}
+
+	return cmd, payload, nil
+}
+
+// maxMessagePayloadSize returns the maximum number of bytes the payload of the command's
+// messages can have.
+func maxMessagePayloadSize(cmd message) uint32 {
+	switch cmd {
+	case msgBlock, msgBlockTxn, msgCmpctBlock:
+		return maxPayloadSize
+	default:
+		return maxSmallPayloadSize
+	}
+}
+
+// payloadChecksum returns the first bytes of the payload double SHA-256 hash.
+func payloadChecksum(payload []byte) [checksumSize]byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+
+	var checksum [checksumSize]byte
+	copy(checksum[:], second[:checksumSize])
+	return checksum
 }
 
 func bytesToMessage(bytes []byte) message {
@@ -98,6 +283,12 @@ func bytesToMessage(bytes []byte) message {
 	return message(cmd)
 }
 
-func getPayload[T any](request []byte) (T, error) {
-	return gob.Decode[T](request[messageLength:])
+// getPayload decodes the payload of a message, decoding errors are considered
+// misbehavior of the sender.
+func getPayload[T any](payload []byte) (T, error) {
+	value, err := gob.Decode[T](payload)
+	if err != nil {
+		return value, misbehavior(scoreMalformedPayload, err)
+	}
+	return value, nil
 }
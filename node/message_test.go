@@ -0,0 +1,121 @@
+package node
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/GGP1/btcs/chaincfg"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageFraming(t *testing.T) {
+	payload := inv{Type: typeBlock, Items: [][]byte{{1, 2, 3}}}
+	msg, err := newMessage(msgInv, payload)
+	require.NoError(t, err)
+
+	cmd, gotPayload, err := readMessage(bytes.NewReader(msg))
+	require.NoError(t, err)
+	assert.Equal(t, msgInv, cmd)
+
+	got, err := getPayload[inv](gotPayload)
+	require.NoError(t, err)
+	assert.Equal(t, payload, got)
+}
+
+func TestMessageFramingEmptyPayload(t *testing.T) {
+	msg, err := newMessage(msgGetAddr, nil)
+	require.NoError(t, err)
+	assert.Len(t, msg, headerSize)
+
+	cmd, payload, err := readMessage(bytes.NewReader(msg))
+	require.NoError(t, err)
+	assert.Equal(t, msgGetAddr, cmd)
+	assert.Empty(t, payload)
+}
+
+func TestReadMessageErrors(t *testing.T) {
+	newMsg := func() []byte {
+		msg, err := newMessage(msgTx, transaction{Transaction: []byte("tx")})
+		require.NoError(t, err)
+		return msg
+	}
+
+	cases := []struct {
+		desc     string
+		modify   func(msg []byte) []byte
+		expected error
+	}{
+		{
+			desc: "Other network",
+			modify: func(msg []byte) []byte {
+				binary.LittleEndian.PutUint32(msg, chaincfg.RegressionNetParams.Magic)
+				return msg
+			},
+			expected: errInvalidMagic,
+		},
+		{
+			desc: "Payload too large",
+			modify: func(msg []byte) []byte {
+				binary.LittleEndian.PutUint32(msg[4+messageLength:], maxPayloadSize+1)
+				return msg
+			},
+			expected: errPayloadTooLarge,
+		},
+		{
+			desc: "Payload too large for the command",
+			modify: func(msg []byte) []byte {
+				binary.LittleEndian.PutUint32(msg[4+messageLength:], maxSmallPayloadSize+1)
+				return msg
+			},
+			expected: errPayloadTooLarge,
+		},
+		{
+			desc: "Truncated payload",
+			modify: func(msg []byte) []byte {
+				binary.LittleEndian.PutUint32(msg[4+messageLength:], maxSmallPayloadSize)
+				return msg
+			},
+			expected: io.ErrUnexpectedEOF,
+		},
+		{
+			desc: "Corrupted payload",
+			modify: func(msg []byte) []byte {
+				msg[len(msg)-1] ^= 0xff
+				return msg
+			},
+			expected: errInvalidChecksum,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			msg := tc.modify(newMsg())
+			_, _, err := readMessage(bytes.NewReader(msg))
+			assert.ErrorIs(t, err, tc.expected)
+		})
+	}
+}
+
+func TestNewMessageLongCommand(t *testing.T) {
+	_, err := newMessage("averylongcommand", nil)
+	assert.Error(t, err)
+}
+
+func TestMaxMessagePayloadSize(t *testing.T) {
+	assert.Equal(t, uint32(maxPayloadSize), maxMessagePayloadSize(msgBlock))
+	assert.Equal(t, uint32(maxPayloadSize), maxMessagePayloadSize(msgCmpctBlock))
+	assert.Equal(t, uint32(maxSmallPayloadSize), maxMessagePayloadSize(msgTx))
+	assert.Equal(t, uint32(maxSmallPayloadSize), maxMessagePayloadSize(msgInv))
+
+	// An inventory with the maximum number of items fits
+	items := make([][]byte, maxInvPerMessage)
+	for i := range items {
+		items[i] = bytes.Repeat([]byte{0xff}, 32)
+	}
+	_, err := newMessage(msgInv, inv{Type: typeTx, Items: items})
+	assert.NoError(t, err)
+}
@@ -2,218 +2,549 @@ package node
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"time"
 
 	"github.com/GGP1/btcs/block"
 	"github.com/GGP1/btcs/encoding/gob"
 	"github.com/GGP1/btcs/logger"
+	"github.com/GGP1/btcs/mempool"
 	"github.com/GGP1/btcs/tx"
-	"github.com/GGP1/btcs/tx/utxo"
 )
 
 const (
 	typeBlock = "block"
 	typeTx    = "tx"
+	// typeCompactBlock is used in getdata messages to request a block as a compact block
+	typeCompactBlock = "cmpctblock"
 )
 
-type handlerFunc func(request []byte) error
+type handlerFunc func(p *peer, payload []byte) error
 
 func (n *Node) messageHandlers() map[message]handlerFunc {
 	return map[message]handlerFunc{
-		msgAddr:      n.handleAddr,
-		msgBlock:     n.handleBlock,
-		msgInv:       n.handleInv,
-		msgGetAddr:   n.handleGetAddr,
-		msgGetBlocks: n.handleGetBlocks,
-		msgGetData:   n.handleGetData,
-		msgTx:        n.handleTx,
-		msgVersion:   n.handleVersion,
-		msgPing:      n.handlePing,
-		msgPong:      n.handlePong,
+		msgAddr:        n.handleAddr,
+		msgBlock:       n.handleBlock,
+		msgBlockTxn:    n.handleBlockTxn,
+		msgCmpctBlock:  n.handleCmpctBlock,
+		msgFeeFilter:   n.handleFeeFilter,
+		msgInv:         n.handleInv,
+		msgMempool:     n.handleMempool,
+		msgNotFound:    n.handleNotFound,
+		msgGetAddr:     n.handleGetAddr,
+		msgGetBlocks:   n.handleGetBlocks,
+		msgGetBlockTxn: n.handleGetBlockTxn,
+		msgGetData:     n.handleGetData,
+		msgGetHeaders:  n.handleGetHeaders,
+		msgHeaders:     n.handleHeaders,
+		msgTx:          n.handleTx,
+		msgVerack:      n.handleVerack,
+		msgVersion:     n.handleVersion,
+		msgPing:        n.handlePing,
+		msgPong:        n.handlePong,
+		msgReject:      n.handleReject,
+		msgSendCmpct:   n.handleSendCmpct,
+		msgSendHeaders: n.handleSendHeaders,
 	}
 }
 
-func (n *Node) request(address string, data []byte) error {
-	conn, err := net.Dial("tcp", address)
+// connect establishes a connection with the node at address and starts the handshake.
+//
+// It does nothing if the address is the node's one or if it's already connected.
+func (n *Node) connect(address string) error {
+	if address == n.hostAddress || n.peers.Contains(address) {
+		return nil
+	}
+
+	conn, err := net.DialTimeout("tcp", address, dialTimeout)
 	if err != nil {
-		logger.Errorf("Peer %q is not available", address)
-		n.peers.Remove(address)
+		return fmt.Errorf("peer %q is not available: %w", address, err)
+	}
+
+	p := newPeer(conn, address, false)
+	if n.banList.IsBanned(p.host) {
+		p.disconnect()
+		return fmt.Errorf("connecting to %s: %w", address, errBanned)
+	}
+	if !n.peers.Add(p) {
+		p.disconnect()
 		return nil
 	}
-	defer conn.Close()
+	logger.Debugf("Connected to peer %s", address)
+	go n.handlePeer(p)
 
-	if _, err := io.Copy(conn, bytes.NewReader(data)); err != nil {
-		return err
+	return n.sendVersion(p)
+}
+
+// maintainOutbound keeps up to maxOutboundPeers outbound connections, picking the
+// addresses from the address book. It should be called inside a goroutine.
+func (n *Node) maintainOutbound() {
+	ticker := time.NewTicker(outboundInterval)
+	defer ticker.Stop()
+
+	for {
+		n.connectOutbound()
+
+		select {
+		case <-n.quit:
+			return
+		case <-ticker.C:
+		}
 	}
+}
 
-	return nil
+// connectOutbound dials addresses from the address book until the number of outbound
+// connections is reached or there are no more candidates.
+func (n *Node) connectOutbound() {
+	exclude := func(addr string) bool {
+		if addr == n.hostAddress || n.peers.Contains(addr) {
+			return true
+		}
+		host, err := banAddress(addr)
+		return err == nil && n.banList.IsBanned(host)
+	}
+
+	for attempts := 0; attempts < maxOutboundPeers && n.peers.OutboundCount() < maxOutboundPeers; attempts++ {
+		address, ok := n.addrManager.Select(exclude)
+		if !ok {
+			return
+		}
+
+		n.addrManager.Attempt(address)
+		if err := n.connect(address); err != nil {
+			n.addrManager.Failed(address)
+			logger.Debug(err)
+		}
+	}
 }
 
-// handleAddr adds the requester address to the peer list and requests all peers for their blocks.
-func (n *Node) handleAddr(request []byte) error {
-	payload, err := getPayload[addr](request)
-	if err != nil {
-		return err
+// acceptPeer registers an inbound connection and starts reading its messages.
+func (n *Node) acceptPeer(conn net.Conn) {
+	p := newPeer(conn, conn.RemoteAddr().String(), true)
+	if !n.peers.Add(p) {
+		p.disconnect()
+		return
 	}
+	logger.Debugf("Accepted connection from %s", p.addr)
 
-	peersCount := n.peers.Add(payload.Addresses...)
-	logger.Infof("There are %d known peers", peersCount)
+	n.handlePeer(p)
+}
 
-	return n.peers.ForEach(func(addr string) error {
-		return n.sendGetBlocks(addr)
+// handlePeer reads and handles the peer's messages until the connection is closed,
+// then it removes the peer.
+func (n *Node) handlePeer(p *peer) {
+	defer func() {
+		p.disconnect()
+		if p.handshakeComplete() {
+			n.addrManager.Connected(p.listenAddress())
+		}
+		peersCount := n.peers.Remove(p)
+		n.syncPeerDisconnected(p)
+		logger.Debugf("Disconnected from peer %s, %d peers remaining", p.addr, peersCount)
+	}()
+
+	// Drop the peers that don't complete the handshake in time
+	handshakeTimer := time.AfterFunc(handshakeTimeout, func() {
+		if !p.handshakeComplete() {
+			logger.Debugf("Peer %s did not complete the handshake in time", p.addr)
+			p.disconnect()
+		}
 	})
+	defer handshakeTimer.Stop()
+
+	handlers := n.messageHandlers()
+	for {
+		cmd, payload, err := readMessage(p.conn)
+		if err != nil {
+			switch {
+			case errors.Is(err, errInvalidMagic), errors.Is(err, errInvalidChecksum), errors.Is(err, errPayloadTooLarge):
+				n.misbehaving(p, scoreMalformedMessage, err.Error())
+			case !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed):
+				logger.Errorf("Peer %s: %v", p.addr, err)
+			}
+			return
+		}
+
+		handle, ok := handlers[cmd]
+		if !ok {
+			n.misbehaving(p, scoreUnknownCommand, fmt.Sprintf("unknown command: %s", cmd))
+			continue
+		}
+
+		if cmd != msgVersion && cmd != msgVerack && !p.handshakeComplete() {
+			n.misbehaving(p, scorePrematureMessage, fmt.Sprintf("%s message received before the handshake", cmd))
+			continue
+		}
+
+		if err := handle(p, payload); err != nil {
+			var misbehaviorErr misbehaviorError
+			if errors.As(err, &misbehaviorErr) {
+				n.misbehaving(p, misbehaviorErr.score, fmt.Sprintf("%s: %v", cmd, err))
+				continue
+			}
+			logger.Errorf("Peer %s: %s handler: %v", p.addr, cmd, err)
+		}
+	}
 }
 
-// sendAddr relays connection information for peers on the network.
-func (n *Node) sendAddr(address string) error {
-	nodes := addr{Addresses: append(n.peers.List(), n.hostAddress)}
-	msg, err := newMessage(msgAddr, nodes)
-	if err != nil {
-		return err
+// misbehaving increases the ban score of the peer, it's banned and disconnected when the
+// score reaches the threshold.
+//
+// Bans apply to the whole host, so local peers are only disconnected to keep the others
+// running on the same machine.
+func (n *Node) misbehaving(p *peer, score int, reason string) {
+	banScore := p.addBanScore(score)
+	logger.Debugf("Peer %s misbehaved (%s), ban score %d", p.addr, reason, banScore)
+	if banScore < banThreshold {
+		return
+	}
+
+	if ip := net.ParseIP(p.host); ip != nil && ip.IsLoopback() {
+		logger.Infof("Disconnected local peer %s: %s", p.addr, reason)
+		p.disconnect()
+		return
 	}
 
-	return n.request(address, msg)
+	n.banList.Ban(p.host, DefaultBanDuration, reason)
+	logger.Infof("Banned %s for %s: %s", p.host, DefaultBanDuration, reason)
+	p.disconnect()
+
+	if err := n.banList.Save(BanListPath); err != nil {
+		logger.Error("Saving ban list: ", err)
+	}
 }
 
-// handleBlock receives a block and adds it to the blockchain.
-func (n *Node) handleBlock(request []byte) error {
-	payload, err := getPayload[blockData](request)
+// handleAddr adds the announced addresses to the address book. The ones that were unknown
+// and seen recently are relayed to a couple of random peers, as nodes announce themselves.
+func (n *Node) handleAddr(p *peer, payload []byte) error {
+	msg, err := getPayload[addr](payload)
 	if err != nil {
 		return err
 	}
+	if len(msg.Addresses) > maxAddrPerMessage {
+		return misbehavior(scoreMalformedPayload, fmt.Errorf("addr message with %d addresses", len(msg.Addresses)))
+	}
 
-	block, err := gob.Decode[block.Block](payload.Block)
-	if err != nil {
-		return err
+	addresses := make([]netAddress, 0, len(msg.Addresses))
+	for _, na := range msg.Addresses {
+		if na.Addr != n.hostAddress {
+			addresses = append(addresses, na)
+		}
 	}
 
-	// Ignore invalid blocks
-	if !block.IsValid() {
+	added := n.addrManager.Add(addresses, p.host)
+	if len(msg.Addresses) > maxAddrRelay {
+		// Answer to a getaddr, not an announcement
 		return nil
 	}
 
-	if n.miner {
-		// Notify the mining goroutine that we already got a new block so it restarts
-		// the process
-		n.newBlocks <- block
+	recent := make([]netAddress, 0, len(added))
+	since := time.Now().Add(-addrRelayHorizon).Unix()
+	for _, na := range added {
+		if na.Timestamp > since {
+			recent = append(recent, na)
+		}
+	}
+	if len(recent) > 0 {
+		n.relayAddr(recent, p)
+	}
+	return nil
+}
+
+// relayAddr sends the addresses to maxAddrRelayPeers random peers other than the one
+// they were received from.
+func (n *Node) relayAddr(addresses []netAddress, from *peer) {
+	var targets []*peer
+	n.peers.ForEach(func(p *peer) error {
+		if p != from && p.handshakeComplete() {
+			targets = append(targets, p)
+		}
+		return nil
+	})
+
+	// The iteration order of the peers is random already
+	if len(targets) > maxAddrRelayPeers {
+		targets = targets[:maxAddrRelayPeers]
+	}
+	for _, p := range targets {
+		if err := n.sendAddr(p, addresses); err != nil {
+			logger.Debugf("Relaying addresses to %s: %v", p.addr, err)
+		}
 	}
+}
 
-	// Remove new block's transactions from the mempool
-	for _, tx := range block.Transactions {
-		n.txPool.Remove(tx.ID)
+// sendAddr relays connection information for peers on the network.
+func (n *Node) sendAddr(p *peer, addresses []netAddress) error {
+	return p.send(msgAddr, addr{Addresses: addresses})
+}
+
+// handleBlock receives a block and adds it to the blockchain.
+func (n *Node) handleBlock(p *peer, payload []byte) error {
+	data, err := getPayload[blockData](payload)
+	if err != nil {
+		return err
 	}
 
-	if err := n.blockchain.AddBlock(block); err != nil {
-		return fmt.Errorf("adding block: %v", err)
+	b, err := gob.Decode[block.Block](data.Block)
+	if err != nil {
+		return misbehavior(scoreMalformedPayload, err)
 	}
 
-	utxoSet := &utxo.Set{Blockchain: n.blockchain}
-	if err := utxoSet.Update(block); err != nil {
-		return fmt.Errorf("updating utxo set: %v", err)
+	if b.Header == nil || !b.IsValid() {
+		return misbehavior(scoreInvalidBlock, fmt.Errorf("block %x has an invalid proof of work", b.Hash))
+	}
+	hash, err := b.PowHash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, b.Hash) {
+		return misbehavior(scoreInvalidBlock, fmt.Errorf("block hash %x does not match its header %x", b.Hash, hash))
+	}
+	validMerkleRoot, err := b.HasValidMerkleRoot()
+	if err != nil {
+		return err
+	}
+	if !validMerkleRoot {
+		return misbehavior(scoreInvalidBlock, fmt.Errorf("block %x has an invalid merkle root", b.Hash))
 	}
+	p.addKnownInventory(b.Hash)
 
-	logger.Infof("Added block at height %d (%x)", block.Height, block.Hash)
-	return nil
+	return n.processBlock(p, b, len(data.Block))
 }
 
 // sendBlock transmits a single serialized block.
 //
 // https://developer.bitcoin.org/reference/block_chain.html#serialized-blocks
-func (n *Node) sendBlock(addr string, b block.Block) error {
+func (n *Node) sendBlock(p *peer, b block.Block) error {
 	encodedBlock, err := gob.Encode(b)
 	if err != nil {
 		return err
 	}
 
-	blockData := blockData{
-		AddrFrom: n.hostAddress,
-		Block:    encodedBlock,
+	p.addKnownInventory(b.Hash)
+	return p.send(msgBlock, blockData{Block: encodedBlock})
+}
+
+// handleBlockTxn completes a compact block with the missing transactions received.
+func (n *Node) handleBlockTxn(p *peer, payload []byte) error {
+	msg, err := getPayload[blockTxn](payload)
+	if err != nil {
+		return err
 	}
-	msg, err := newMessage(msgBlock, blockData)
+
+	return n.processBlockTxn(p, msg)
+}
+
+// sendBlockTxn transmits the transactions of a block requested by the peer.
+func (n *Node) sendBlockTxn(p *peer, blockHash []byte, txs []tx.Tx) error {
+	return p.send(msgBlockTxn, blockTxn{BlockHash: blockHash, Transactions: txs})
+}
+
+// handleCmpctBlock validates the header of a compact block and rebuilds the block.
+func (n *Node) handleCmpctBlock(p *peer, payload []byte) error {
+	msg, err := getPayload[cmpctBlock](payload)
+	if err != nil {
+		return err
+	}
+
+	b := block.Block{Header: &msg.Header}
+	hash, err := b.PowHash()
 	if err != nil {
 		return err
 	}
+	b.Hash = hash
+	if !b.IsValid() {
+		return misbehavior(scoreInvalidBlock, fmt.Errorf("compact block %x has an invalid proof of work", hash))
+	}
+	p.addKnownInventory(hash)
 
-	return n.request(addr, msg)
+	if n.blockchain.HasBlock(hash) {
+		return nil
+	}
+	return n.processCmpctBlock(p, msg, hash)
 }
 
-// handleGetAddr sends the list of connected peers to the node requesting that information.
-func (n *Node) handleGetAddr(request []byte) error {
-	payload, err := getPayload[getblocks](request)
+// sendCmpctBlock transmits the block as a compact block, or the full block if two of its
+// transactions have the same short ID.
+func (n *Node) sendCmpctBlock(p *peer, b block.Block) error {
+	msg, err := newCmpctBlock(b)
 	if err != nil {
+		if errors.Is(err, errShortIDCollision) {
+			return n.sendBlock(p, b)
+		}
 		return err
 	}
 
-	return n.sendAddr(payload.AddrFrom)
+	p.addKnownInventory(b.Hash)
+	return p.send(msgCmpctBlock, msg)
 }
 
-// sendGetAddr requests an "addr" message from the receiving node.
-func (n *Node) sendGetAddr(address string) error {
-	getAddr := getaddr{
-		AddrFrom: n.hostAddress,
+// handleFeeFilter records the minimum fee rate of the transactions the peer wants to be
+// announced (BIP133).
+func (n *Node) handleFeeFilter(p *peer, payload []byte) error {
+	filter, err := getPayload[feeFilter](payload)
+	if err != nil {
+		return err
+	}
+	if !(filter.FeeRate >= 0 && filter.FeeRate <= maxFeeFilter) {
+		return misbehavior(scoreMalformedPayload, fmt.Errorf("invalid fee rate %v", filter.FeeRate))
 	}
 
-	msg, err := newMessage(msgGetAddr, getAddr)
+	p.setFeeFilter(filter.FeeRate)
+	logger.Debugf("Peer %s set its fee filter to %v sat/byte", p.addr, filter.FeeRate)
+	return nil
+}
+
+// sendFeeFilter asks the peer not to announce transactions paying less than feeRate (sat/byte).
+func (n *Node) sendFeeFilter(p *peer, feeRate float64) error {
+	return p.send(msgFeeFilter, feeFilter{FeeRate: feeRate})
+}
+
+// handleGetAddr sends a random subset of the known addresses to the node requesting
+// that information.
+func (n *Node) handleGetAddr(p *peer, _ []byte) error {
+	return n.sendAddr(p, n.addrManager.AddressCache())
+}
+
+// sendGetAddr requests an "addr" message from the receiving node.
+func (n *Node) sendGetAddr(p *peer) error {
+	return p.send(msgGetAddr, nil)
+}
+
+// handleGetBlocks answers with an inventory of the blocks following the last common block
+// between the locator received and our chain.
+func (n *Node) handleGetBlocks(p *peer, payload []byte) error {
+	msg, err := getPayload[getblocks](payload)
 	if err != nil {
 		return err
 	}
 
-	return n.request(address, msg)
+	hashes := n.blockchain.LocateBlocks(msg.Locator, msg.HashStop, block.MaxBlocksPerInv)
+	if len(hashes) == 0 {
+		return nil
+	}
+	return n.sendInv(p, typeBlock, hashes)
 }
 
-// handleGetBlocks answers by sending all the block hashes the node has.
-func (n *Node) handleGetBlocks(request []byte) error {
-	payload, err := getPayload[getblocks](request)
+// sendGetBlocks requests the hashes of the blocks following the locator, up to hashStop. If
+// it's nil, up to the maximum number of hashes per inventory.
+func (n *Node) sendGetBlocks(p *peer, locator [][]byte, hashStop []byte) error {
+	return p.send(msgGetBlocks, getblocks{Locator: locator, HashStop: hashStop})
+}
+
+// handleGetBlockTxn answers with the transactions of the block the peer is missing.
+func (n *Node) handleGetBlockTxn(p *peer, payload []byte) error {
+	req, err := getPayload[getBlockTxn](payload)
 	if err != nil {
 		return err
 	}
 
-	hashes, err := n.blockchain.BlocksHashes()
+	b, err := n.blockchain.Block(req.BlockHash)
 	if err != nil {
 		return err
 	}
 
-	return n.sendInv(payload.AddrFrom, typeBlock, hashes)
+	txs := make([]tx.Tx, 0, len(req.Indexes))
+	for _, i := range req.Indexes {
+		if i < 0 || i >= len(b.Transactions) {
+			return misbehavior(scoreMalformedPayload, fmt.Errorf("block %x has no transaction at index %d", req.BlockHash, i))
+		}
+		txs = append(txs, b.Transactions[i])
+	}
+	return n.sendBlockTxn(p, req.BlockHash, txs)
 }
 
-// sendGetBlocks requests block header hashes starting from
-// a particular point in the blockchain.
-func (n *Node) sendGetBlocks(address string) error {
-	getBlocks := getblocks{
-		AddrFrom: n.hostAddress,
+// sendGetBlockTxn requests the transactions of a compact block that weren't in the pool.
+func (n *Node) sendGetBlockTxn(p *peer, blockHash []byte, indexes []int) error {
+	return p.send(msgGetBlockTxn, getBlockTxn{BlockHash: blockHash, Indexes: indexes})
+}
+
+// handleGetHeaders answers with the headers of the blocks following the last common block
+// between the locator received and our chain.
+func (n *Node) handleGetHeaders(p *peer, payload []byte) error {
+	msg, err := getPayload[getheaders](payload)
+	if err != nil {
+		return err
 	}
-	msg, err := newMessage(msgGetBlocks, getBlocks)
+
+	blockHeaders, err := n.blockchain.LocateHeaders(msg.Locator, msg.HashStop, block.MaxHeadersPerMsg)
 	if err != nil {
 		return err
 	}
+	return n.sendHeaders(p, blockHeaders)
+}
+
+// sendGetHeaders requests the headers of the blocks following the locator, up to hashStop.
+func (n *Node) sendGetHeaders(p *peer, locator [][]byte, hashStop []byte) error {
+	return p.send(msgGetHeaders, getheaders{Locator: locator, HashStop: hashStop})
+}
+
+// handleHeaders adds the headers received to the header chain and requests their blocks.
+func (n *Node) handleHeaders(p *peer, payload []byte) error {
+	msg, err := getPayload[headers](payload)
+	if err != nil {
+		return err
+	}
+	if len(msg.Headers) > block.MaxHeadersPerMsg {
+		return misbehavior(scoreMalformedPayload, fmt.Errorf("headers message with %d headers", len(msg.Headers)))
+	}
+
+	return n.processHeaders(p, msg.Headers)
+}
 
-	return n.request(address, msg)
+// sendHeaders transmits block headers.
+func (n *Node) sendHeaders(p *peer, blockHeaders []block.Header) error {
+	return p.send(msgHeaders, headers{Headers: blockHeaders})
 }
 
 // handleGetData answers with the details of a block or transaction.
-func (n *Node) handleGetData(request []byte) error {
-	payload, err := getPayload[getdata](request)
+func (n *Node) handleGetData(p *peer, payload []byte) error {
+	data, err := getPayload[getdata](payload)
 	if err != nil {
 		return err
 	}
 
-	switch payload.Type {
+	switch data.Type {
 	case typeBlock:
-		block, err := n.blockchain.Block([]byte(payload.ID))
+		b, err := n.blockchain.Block(data.ID)
 		if err != nil {
+			if errors.Is(err, block.ErrBlockNotFound) {
+				return n.sendNotFound(p, data.Type, data.ID)
+			}
+			return err
+		}
+
+		if err := n.sendBlock(p, b); err != nil {
 			return err
 		}
 
-		if err := n.sendBlock(payload.AddrFrom, block); err != nil {
+	case typeCompactBlock:
+		b, err := n.blockchain.Block(data.ID)
+		if err != nil {
+			if errors.Is(err, block.ErrBlockNotFound) {
+				return n.sendNotFound(p, data.Type, data.ID)
+			}
+			return err
+		}
+
+		_, bestHeight := n.blockchain.Tip()
+		if bestHeight-b.Height > maxCompactBlockDepth {
+			return n.sendBlock(p, b)
+		}
+		if err := n.sendCmpctBlock(p, b); err != nil {
 			return err
 		}
 
 	case typeTx:
-		tx := n.txPool.Get(payload.ID)
+		entry, ok := n.txPool.Entry(data.ID)
+		if !ok {
+			return n.sendNotFound(p, data.Type, data.ID)
+		}
 
-		if err := n.sendTx(payload.AddrFrom, &tx); err != nil {
+		if err := n.sendTx(p, &entry.Tx); err != nil {
 			return err
 		}
 
@@ -223,44 +554,38 @@ func (n *Node) handleGetData(request []byte) error {
 }
 
 // sendGetData requests one or more data objects from another node.
-func (n *Node) sendGetData(address, kind string, id []byte) error {
+func (n *Node) sendGetData(p *peer, kind string, id []byte) error {
 	getData := getdata{
-		AddrFrom: n.hostAddress,
-		Type:     kind,
-		ID:       id,
+		Type: kind,
+		ID:   id,
 	}
-	msg, err := newMessage(msgGetData, getData)
-	if err != nil {
-		return err
-	}
-
-	return n.request(address, msg)
+	return p.send(msgGetData, getData)
 }
 
 // handleInv answers with the hashes of blocks or transactions the node has.
-func (n *Node) handleInv(request []byte) error {
-	payload, err := getPayload[inv](request)
+func (n *Node) handleInv(p *peer, payload []byte) error {
+	inventory, err := getPayload[inv](payload)
 	if err != nil {
 		return err
 	}
 
 	logger.Infof("Received inventory with %d %s/s from %s",
-		len(payload.Items),
-		payload.Type,
-		payload.AddrFrom)
+		len(inventory.Items),
+		inventory.Type,
+		p.addr)
+	p.addKnownInventory(inventory.Items...)
 
-	switch payload.Type {
+	switch inventory.Type {
 	case typeBlock:
-		for _, blockHash := range payload.Items {
-			if err := n.sendGetData(payload.AddrFrom, typeBlock, blockHash); err != nil {
-				return err
-			}
+		// Blocks are downloaded after their headers, request the ones we don't know
+		if unknown := n.unknownBlocks(inventory.Items); len(unknown) > 0 {
+			return n.sendGetHeaders(p, n.headersLocator(), unknown[len(unknown)-1])
 		}
 
 	case typeTx:
-		for _, txID := range payload.Items {
+		for _, txID := range inventory.Items {
 			if !n.txPool.Contains(txID) {
-				if err := n.sendGetData(payload.AddrFrom, typeTx, txID); err != nil {
+				if err := n.sendGetData(p, typeTx, txID); err != nil {
 					return err
 				}
 			}
@@ -276,169 +601,281 @@ func (n *Node) handleInv(request []byte) error {
 // The receiving peer can compare the inventories from an “inv” message against
 // the inventories it has already seen, and then use a follow-up message
 // to request unseen objects.
-func (n *Node) sendInv(address, kind string, items [][]byte) error {
+func (n *Node) sendInv(p *peer, kind string, items [][]byte) error {
 	inventory := inv{
-		AddrFrom: n.hostAddress,
-		Type:     kind,
-		Items:    items,
+		Type:  kind,
+		Items: items,
 	}
-	msg, err := newMessage(msgInv, inventory)
-	if err != nil {
-		return err
+	p.addKnownInventory(items...)
+	return p.send(msgInv, inventory)
+}
+
+// handleMempool announces the transactions in the pool that pass the peer's fee filter
+// (BIP35), they are sent by the inv loop along with the other pending announcements.
+func (n *Node) handleMempool(p *peer, _ []byte) error {
+	for _, entry := range n.txPool.Entries() {
+		p.queueTxInv(entry.Tx.ID, entry.FeeRate)
 	}
+	return nil
+}
 
-	return n.request(address, msg)
+// sendMempool requests the transactions in the peer's pool.
+func (n *Node) sendMempool(p *peer) error {
+	return p.send(msgMempool, nil)
 }
 
-// handlePing answers with a "pong" message.
-func (n *Node) handlePing(request []byte) error {
-	payload, err := getPayload[ping](request)
+// handleNotFound logs the objects a peer didn't have when we requested them.
+func (n *Node) handleNotFound(p *peer, payload []byte) error {
+	msg, err := getPayload[notFound](payload)
 	if err != nil {
 		return err
 	}
 
-	return n.sendPong(payload.AddrFrom)
+	logger.Debugf("Peer %s does not have %s %x", p.addr, msg.Type, msg.ID)
+	return nil
+}
+
+// sendNotFound informs a peer that the object it requested with getdata is unknown.
+func (n *Node) sendNotFound(p *peer, kind string, id []byte) error {
+	return p.send(msgNotFound, notFound{Type: kind, ID: id})
+}
+
+// handlePing answers with a "pong" message.
+func (n *Node) handlePing(p *peer, _ []byte) error {
+	return n.sendPong(p)
 }
 
 // sendPing helps confirm that the receiving peer is still connected.
 //
 // Bitcoin Core will, by default, disconnect from any clients which have not responded
 // to a “ping” message within 20 minutes.
-func (n *Node) sendPing(addr string) error {
-	ping := ping{AddrFrom: n.hostAddress}
-	msg, err := newMessage(msgPing, ping)
-	if err != nil {
-		return err
-	}
-
-	return n.request(addr, msg)
+func (n *Node) sendPing(p *peer) error {
+	return p.send(msgPing, nil)
 }
 
 // handlePong logs when another peer sent a pong message.
-func (n *Node) handlePong(request []byte) error {
-	payload, err := getPayload[pong](request)
-	if err != nil {
-		return err
-	}
-
-	logger.Info(payload.AddrFrom, " says PONG")
+func (n *Node) handlePong(p *peer, _ []byte) error {
+	logger.Info(p.addr, " says PONG")
 	return nil
 }
 
 // sendPong replies to a “ping” message, proving to the pinging node
 // that the ponging node is still alive.
-func (n *Node) sendPong(addr string) error {
-	pong := pong{AddrFrom: n.hostAddress}
-	msg, err := newMessage(msgPong, pong)
+func (n *Node) sendPong(p *peer) error {
+	return p.send(msgPong, nil)
+}
+
+// handleReject logs the reason why a peer rejected one of our messages.
+func (n *Node) handleReject(p *peer, payload []byte) error {
+	rej, err := getPayload[reject](payload)
 	if err != nil {
 		return err
 	}
 
-	return n.request(addr, msg)
+	logger.Infof("%s rejected %s %x: %s (%s)",
+		p.addr,
+		rej.Message,
+		rej.Hash,
+		rej.Reason,
+		rej.Code)
+	return nil
 }
 
-// handleTx receives a transaction, adds it to the mempool and includes it in the next block.
-func (n *Node) handleTx(request []byte) error {
-	payload, err := getPayload[transaction](request)
-	if err != nil {
-		return err
+// sendReject informs a peer that one of its messages was rejected.
+func (n *Node) sendReject(p *peer, msgType message, ruleErr mempool.RuleError, hash []byte) error {
+	reject := reject{
+		Message: msgType,
+		Code:    ruleErr.Code,
+		Reason:  ruleErr.Reason,
+		Hash:    hash,
 	}
+	return p.send(msgReject, reject)
+}
 
-	txx, err := gob.Decode[tx.Tx](payload.Transaction)
+// handleSendCmpct records whether the peer supports compact blocks and how it wants new
+// blocks to be announced.
+func (n *Node) handleSendCmpct(p *peer, payload []byte) error {
+	msg, err := getPayload[sendCmpct](payload)
 	if err != nil {
 		return err
 	}
 
-	if err := n.blockchain.VerifyTx(txx); err != nil {
+	p.setSendCmpct(msg)
+	logger.Debugf("Peer %s set compact blocks version %d, high-bandwidth %t", p.addr, msg.Version, msg.Announce)
+	return nil
+}
+
+// sendSendCmpct announces the support of compact blocks to the peer and asks it to send
+// new blocks as compact blocks directly if announce is true.
+func (n *Node) sendSendCmpct(p *peer, announce bool) error {
+	return p.send(msgSendCmpct, sendCmpct{Announce: announce, Version: compactBlocksProtocol})
+}
+
+// handleSendHeaders records that the peer wants new blocks to be announced with headers
+// messages.
+func (n *Node) handleSendHeaders(p *peer, _ []byte) error {
+	p.setPreferHeaders()
+	return nil
+}
+
+// sendSendHeaders asks the peer to announce new blocks with headers messages (BIP130).
+func (n *Node) sendSendHeaders(p *peer) error {
+	return p.send(msgSendHeaders, nil)
+}
+
+// handleTx receives a transaction, adds it to the mempool and includes it in the next block.
+//
+// Accepted transactions are announced to the other peers, rejected ones are notified
+// to the sender.
+func (n *Node) handleTx(p *peer, payload []byte) error {
+	data, err := getPayload[transaction](payload)
+	if err != nil {
 		return err
 	}
-	n.txPool.Add(txx)
 
-	logger.Debugf("Received a new transaction (%x) from %s", txx.ID, payload.AddrFrom)
+	txx, err := gob.Decode[tx.Tx](data.Transaction)
+	if err != nil {
+		ruleErr := mempool.NewRuleError(mempool.RejectMalformed, err)
+		if err := n.sendReject(p, msgTx, ruleErr, nil); err != nil {
+			return err
+		}
+		return misbehavior(scoreMalformedPayload, err)
+	}
+	p.addKnownInventory(txx.ID)
 
-	// Broadcast the transactions to other peers
-	err = n.peers.ForEach(func(addr string) error {
-		return n.sendInv(addr, typeTx, [][]byte{txx.ID})
-	})
+	entry, err := n.AcceptToMemoryPool(txx)
 	if err != nil {
+		var ruleErr mempool.RuleError
+		if errors.As(err, &ruleErr) {
+			logger.Debugf("Rejected transaction %x from %s: %v", txx.ID, p.addr, ruleErr)
+			return n.sendReject(p, msgTx, ruleErr, txx.ID)
+		}
 		return err
 	}
 
-	return nil
+	logger.Debugf("Received a new transaction (%x) from %s", txx.ID, p.addr)
+	return n.relayTx(entry)
 }
 
 // sendTx transmits a single encoded transaction.
-func (n *Node) sendTx(address string, tx *tx.Tx) error {
+func (n *Node) sendTx(p *peer, tx *tx.Tx) error {
 	encodedTx, err := gob.Encode(tx)
 	if err != nil {
 		return err
 	}
 
-	transaction := transaction{
-		AddrFrom:    n.hostAddress,
-		Transaction: encodedTx,
-	}
-	msg, err := newMessage(msgTx, transaction)
-	if err != nil {
-		return err
+	p.addKnownInventory(tx.ID)
+	return p.send(msgTx, transaction{Transaction: encodedTx})
+}
+
+// handleVerack completes the handshake and requests the peer's blocks if its chain
+// is longer.
+func (n *Node) handleVerack(p *peer, _ []byte) error {
+	if err := p.setVerackReceived(); err != nil {
+		return misbehavior(scorePrematureMessage, err)
 	}
 
-	// Send the transaction to ourselves so we can include it in the next block
-	if err := n.request(n.hostAddress, msg); err != nil {
+	info := p.info()
+	logger.Debugf("Handshake with %s completed: version %d, services %s, user agent %q",
+		p.addr, info.ProtocolVersion, info.Services, info.UserAgent)
+
+	// Announce the node's address and, on outbound connections, ask for more
+	self := netAddress{Addr: n.hostAddress, Services: services, Timestamp: time.Now().Unix()}
+	if err := n.sendAddr(p, []netAddress{self}); err != nil {
 		return err
 	}
+	if !p.inbound {
+		n.addrManager.Good(p.addr, info.Services)
+		if err := n.sendGetAddr(p); err != nil {
+			return err
+		}
+	}
 
-	if address == "" {
-		return n.peers.ForEach(func(addr string) error {
-			return n.request(addr, msg)
-		})
+	if info.ProtocolVersion >= sendHeadersVersion {
+		if err := n.sendSendHeaders(p); err != nil {
+			return err
+		}
+	}
+	if info.ProtocolVersion >= feeFilterVersion {
+		if err := n.sendFeeFilter(p, n.minRelayFeeRate); err != nil {
+			return err
+		}
+	}
+	if info.ProtocolVersion >= compactBlocksVersion {
+		// Start in low-bandwidth mode, the peers that deliver new blocks first are
+		// switched to high-bandwidth
+		if err := n.sendSendCmpct(p, false); err != nil {
+			return err
+		}
+	}
+	// Learn about the unconfirmed transactions we missed while offline
+	if n.requestMempool && !p.inbound {
+		if err := n.sendMempool(p); err != nil {
+			return err
+		}
 	}
 
-	return n.request(address, msg)
+	// Download the peer's chain if it's longer
+	n.syncPeerConnected()
+	return nil
 }
 
-// handleVersion exchanges information with other peer to find the longer blockchain.
-func (n *Node) handleVersion(request []byte) error {
-	payload, err := getPayload[version](request)
-	if err != nil {
-		return err
-	}
+// sendVerack acknowledges the version message received from a peer.
+func (n *Node) sendVerack(p *peer) error {
+	return p.send(msgVerack, nil)
+}
 
-	bestHeight, err := n.blockchain.BestHeight()
+// handleVersion records the peer information and acknowledges it.
+//
+// Connections to self and peers with an old protocol version are dropped. Inbound peers
+// start the exchange, they are answered with the node's version first.
+func (n *Node) handleVersion(p *peer, payload []byte) error {
+	peerVersion, err := getPayload[version](payload)
 	if err != nil {
 		return err
 	}
-	n.peers.Add(payload.AddrFrom)
 
-	peerBestHeight := payload.BestHeight
-	if bestHeight == peerBestHeight {
-		return nil
+	if peerVersion.Nonce == n.nonce {
+		p.disconnect()
+		return errors.New("connected to self")
+	}
+	if peerVersion.ProtocolVersion < minProtocolVersion {
+		p.disconnect()
+		return fmt.Errorf("protocol version %d is lower than the minimum %d", peerVersion.ProtocolVersion, minProtocolVersion)
 	}
 
-	if bestHeight < peerBestHeight {
-		return n.sendGetBlocks(payload.AddrFrom)
+	if err := p.setVersion(peerVersion); err != nil {
+		return misbehavior(scoreDuplicateMessage, err)
+	}
+	if peerVersion.Timestamp != 0 {
+		// Take a single sample per host, no matter how many connections it opens
+		block.TimeSource.AddTimeSample(p.host, time.Unix(peerVersion.Timestamp, 0))
 	}
 
-	return n.sendVersion(payload.AddrFrom)
+	if p.inbound {
+		if err := n.sendVersion(p); err != nil {
+			return err
+		}
+	}
+	return n.sendVerack(p)
 }
 
 // sendVersion provides information about the transmitting node
 // to the receiving node at the beginning of a connection.
-func (n *Node) sendVersion(addr string) error {
+func (n *Node) sendVersion(p *peer) error {
 	bestHeight, err := n.blockchain.BestHeight()
 	if err != nil {
 		return err
 	}
 
 	version := version{
-		AddrFrom:   n.hostAddress,
-		Version:    n.version,
-		BestHeight: bestHeight,
-	}
-	msg, err := newMessage(msgVersion, version)
-	if err != nil {
-		return err
-	}
-
-	return n.request(addr, msg)
+		ProtocolVersion: protocolVersion,
+		Services:        services,
+		Timestamp:       time.Now().Unix(),
+		AddrFrom:        n.hostAddress,
+		Nonce:           n.nonce,
+		UserAgent:       userAgent,
+		StartHeight:     bestHeight,
+	}
+	return p.send(msgVersion, version)
 }
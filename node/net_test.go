@@ -0,0 +1,55 @@
+package node
+
+import (
+	"net"
+	"testing"
+
+	"github.com/GGP1/btcs/encoding/gob"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleGetDataNotFound(t *testing.T) {
+	n := newTestNode(t)
+
+	for _, kind := range []string{typeBlock, typeCompactBlock, typeTx} {
+		t.Run(kind, func(t *testing.T) {
+			conn, remote := net.Pipe()
+			p := newPeer(conn, "127.0.0.1:40000", true)
+			defer p.disconnect()
+
+			payload, err := gob.Encode(getdata{Type: kind, ID: []byte{1, 2, 3}})
+			require.NoError(t, err)
+			require.NoError(t, n.handleGetData(p, payload))
+
+			cmd, reply, err := readMessage(remote)
+			require.NoError(t, err)
+			assert.Equal(t, msgNotFound, cmd)
+
+			msg, err := getPayload[notFound](reply)
+			require.NoError(t, err)
+			assert.Equal(t, notFound{Type: kind, ID: []byte{1, 2, 3}}, msg)
+		})
+	}
+}
+
+func TestMisbehavingLocalPeer(t *testing.T) {
+	n := newTestNode(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	p := newPeer(conn, ln.Addr().String(), false)
+	defer p.disconnect()
+
+	n.misbehaving(p, banThreshold, "invalid block")
+	assert.False(t, n.banList.IsBanned(p.host), "Other local peers can still connect")
+	select {
+	case <-p.quit:
+	default:
+		t.Error("The peer wasn't disconnected")
+	}
+}
@@ -1,35 +1,104 @@
 package node
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"io"
 	"net"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/GGP1/btcs/block"
 	"github.com/GGP1/btcs/logger"
 	"github.com/GGP1/btcs/mempool"
 	"github.com/GGP1/btcs/mining"
+	"github.com/GGP1/btcs/mining/stratum"
+	"github.com/GGP1/btcs/tx"
 	"github.com/GGP1/btcs/tx/utxo"
 )
 
+// Config contains the node's configuration.
+type Config struct {
+	// HostAddress is the address where the node server will be listening
+	HostAddress string
+	// SeedNodes are added to the address book on startup, the nodes to connect to
+	// are picked from it
+	SeedNodes []string
+	// Miner determines whether the node will perform mining operations
+	Miner bool
+	// MiningThreads is the number of goroutines used for mining, if it's lower than
+	// one the number of logical CPUs is used
+	MiningThreads int
+	// MempoolExpiry is the time after which unconfirmed transactions are removed
+	// from the pool
+	MempoolExpiry time.Duration
+	// MinRelayFeeRate is the minimum fee rate (sat/byte) for transactions to be
+	// accepted into the pool and relayed
+	MinRelayFeeRate float64
+	// RequestMempool determines whether the node asks its outbound peers for the
+	// transactions in their pool after the handshake
+	RequestMempool bool
+	// StratumAddress is the address where the stratum mining pool server will be listening,
+	// if it's empty the server is not started
+	StratumAddress string
+}
+
 // Node represents a Bitcoin Node.
 type Node struct {
-	blockchain  *block.Chain
-	txPool      *mempool.TxPool
-	peers       *peers
-	newBlocks   chan block.Block
-	interrupt   chan os.Signal
+	blockchain   *block.Chain
+	txPool       *mempool.TxPool
+	feeEstimator *mempool.FeeEstimator
+	peers        *peers
+	banList      *banList
+	addrManager  *addrManager
+	syncManager  *syncManager
+	// compactManager reconstructs the compact blocks received
+	compactManager *compactManager
+	seedNodes      []string
+	interrupt      chan os.Signal
+	// quit is closed when the node stops
+	quit        chan struct{}
 	hostAddress string
-	version     int
-	miner       bool
+	// nonce is sent in the version messages to detect connections to self
+	nonce            uint64
+	miner            bool
+	miningThreads    int
+	mempoolExpiry    time.Duration
+	minRelayFeeRate  float64
+	requestMempool   bool
+	stratumAddress   string
+	stratum          *stratum.Server
+	miningController *mining.Controller
+	// accountName is the wallet account the node is running with
+	accountName string
+	// generateMu serializes the generation of blocks on demand
+	generateMu *sync.Mutex
+	// chainMu serializes the validation and connection of blocks
+	chainMu *sync.Mutex
+	// mempoolMu serializes the acceptance of transactions into the pool and its updates
+	// when blocks are connected
+	mempoolMu *sync.Mutex
 }
 
 // New creates a new node.
-func New(hostAddr string, seedNodes []string, miner bool) (*Node, error) {
+func New(config Config) (*Node, error) {
 	blockchain, err := block.LoadChain()
+	if errors.Is(err, block.ErrOutdatedChain) {
+		// The blocks can't be validated with the current rules, start a new chain and
+		// download it again from the peers
+		backupPath, backupErr := block.BackupChain()
+		if backupErr != nil {
+			return nil, backupErr
+		}
+		logger.Infof("%v, moved it to %s and started a new one", err, backupPath)
+		err = block.ErrBlockchainNotFound
+	}
 	if err != nil {
 		if err != block.ErrBlockchainNotFound {
 			return nil, err
@@ -45,22 +114,88 @@ func New(hostAddr string, seedNodes []string, miner bool) (*Node, error) {
 		if err := utxoSet.Reindex(); err != nil {
 			return nil, err
 		}
+	} else {
+		utxoSet := utxo.Set{Blockchain: blockchain}
+		upgraded, err := utxoSet.Upgrade()
+		if err != nil {
+			return nil, err
+		}
+		if upgraded {
+			logger.Info("Rebuilt the UTXO set in the current format")
+		}
+	}
+
+	feeEstimator, err := mempool.LoadFeeEstimator(mempool.EstimatesPath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		feeEstimator = mempool.NewFeeEstimator()
+	}
+
+	banList, err := loadBanList(BanListPath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		banList = newBanList()
 	}
 
-	return &Node{
-		blockchain:  blockchain,
-		txPool:      mempool.NewTxPool(),
-		peers:       newPeers(hostAddr, seedNodes),
-		interrupt:   make(chan os.Signal, 1),
-		newBlocks:   make(chan block.Block, 1),
-		hostAddress: hostAddr,
-		miner:       miner,
-		version:     1,
-	}, nil
+	addrManager, err := loadAddrManager(PeersPath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		addrManager = newAddrManager()
+	}
+
+	var nonceBytes [8]byte
+	if _, err := rand.Read(nonceBytes[:]); err != nil {
+		return nil, err
+	}
+	nonce := binary.LittleEndian.Uint64(nonceBytes[:])
+
+	node := &Node{
+		blockchain:      blockchain,
+		txPool:          mempool.NewTxPool(),
+		feeEstimator:    feeEstimator,
+		peers:           newPeers(),
+		banList:         banList,
+		addrManager:     addrManager,
+		syncManager:     newSyncManager(),
+		compactManager:  newCompactManager(),
+		seedNodes:       config.SeedNodes,
+		interrupt:       make(chan os.Signal, 1),
+		quit:            make(chan struct{}),
+		hostAddress:     config.HostAddress,
+		miner:           config.Miner,
+		miningThreads:   config.MiningThreads,
+		mempoolExpiry:   config.MempoolExpiry,
+		minRelayFeeRate: config.MinRelayFeeRate,
+		requestMempool:  config.RequestMempool,
+		stratumAddress:  config.StratumAddress,
+		nonce:           nonce,
+		generateMu:      &sync.Mutex{},
+		chainMu:         &sync.Mutex{},
+		mempoolMu:       &sync.Mutex{},
+	}
+
+	node.miningController = mining.NewController(mining.ControllerConfig{
+		TxPool: node.txPool,
+		Tip:    blockchain.LastBlock,
+		Submit: node.submitBlock,
+	})
+
+	if err := node.loadMempool(); err != nil {
+		return nil, err
+	}
+
+	return node, nil
 }
 
 // Run starts the execution of the node.
 func (n *Node) Run(accountName string) error {
+	n.accountName = accountName
 	_, port, err := net.SplitHostPort(n.hostAddress)
 	if err != nil {
 		return err
@@ -71,34 +206,50 @@ func (n *Node) Run(accountName string) error {
 		return err
 	}
 
+	listeners := []net.Listener{listener}
+	if n.stratumAddress != "" {
+		stratumListener, err := n.startStratum(accountName)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, stratumListener)
+	}
+
 	rpcListener, err := n.RunRPCServer()
 	if err != nil {
 		return err
 	}
+	listeners = append(listeners, rpcListener)
 
 	logger.Info("Starting node server at ", n.hostAddress)
-	go n.listen(listener, n.messageHandlers())
+	go n.listen(listener)
 
-	// Initiate the connection with the version message to caught up with the network.
-	err = n.peers.ForEach(func(addr string) error {
-		return n.sendVersion(addr)
-	})
-	if err != nil {
-		return err
+	// Initiate the connections with the version message to caught up with the network.
+	seeds := make([]netAddress, 0, len(n.seedNodes))
+	for _, addr := range n.seedNodes {
+		seeds = append(seeds, netAddress{Addr: addr, Timestamp: time.Now().Unix()})
 	}
+	n.addrManager.Add(seeds, n.hostAddress)
+	logger.Debugf("Address book loaded with %d addresses", n.addrManager.Size())
+	go n.maintainOutbound()
+	go n.syncLoop()
+	go n.invLoop()
 
 	if n.miner {
-		go func() {
-			if err := n.startMining(accountName); err != nil {
-				logger.Fatal("Mining: ", err)
-			}
-		}()
+		coinbaseAddr, err := mining.CoinbaseAddress(accountName)
+		if err != nil {
+			return err
+		}
+		n.miningController.SetCoinbaseAddress(coinbaseAddr)
+		if err := n.miningController.Start(n.miningThreads); err != nil {
+			return err
+		}
 	}
 
 	signal.Notify(n.interrupt, os.Interrupt, syscall.SIGTERM)
 	<-n.interrupt
 
-	return n.Close(listener, rpcListener)
+	return n.Close(listeners...)
 }
 
 // Close releases the resources associated to a node.
@@ -109,94 +260,330 @@ func (n *Node) Close(listeners ...net.Listener) error {
 		}
 	}
 
-	close(n.newBlocks)
 	close(n.interrupt)
+	close(n.quit)
+	n.peers.ForEach(func(p *peer) error {
+		p.disconnect()
+		return nil
+	})
 	logger.Info("Server stopped")
 
+	n.miningController.Stop()
+
+	if err := n.txPool.Save(mempool.DefaultPath); err != nil {
+		return err
+	}
+
+	if err := n.feeEstimator.Save(mempool.EstimatesPath); err != nil {
+		return err
+	}
+
+	if err := n.banList.Save(BanListPath); err != nil {
+		return err
+	}
+
+	if err := n.addrManager.Save(PeersPath); err != nil {
+		return err
+	}
+
 	return n.blockchain.Close()
 }
 
-// listen accepts and handles TCP connections. It should be called inside a goroutine.
-func (n *Node) listen(ln net.Listener, handlers map[message]handlerFunc) {
+// listen accepts peer connections until the listener is closed. It should be called
+// inside a goroutine.
+func (n *Node) listen(ln net.Listener) {
 	for {
-		select {
-		case <-n.interrupt:
-			return
-
-		default:
-			conn, err := ln.Accept()
-			if err != nil {
-				logger.Error("Connection: ", err)
-				continue
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
 			}
+			logger.Error("Connection: ", err)
+			continue
+		}
 
-			go func() {
-				if err := handleConn(conn, handlers); err != nil {
-					_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
-					logger.Errorf("Connection on port %s: %v", port, err)
-				}
-				conn.Close()
-			}()
+		if host, err := banAddress(conn.RemoteAddr().String()); err == nil && n.banList.IsBanned(host) {
+			logger.Debugf("Refused connection from banned address %s", host)
+			conn.Close()
+			continue
 		}
+		if n.peers.Count() >= maxPeers {
+			logger.Debugf("Refused connection from %s, the maximum number of peers was reached", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		go n.acceptPeer(conn)
 	}
 }
 
-func (n *Node) startMining(accountName string) error {
-	miner, err := mining.NewCPUMiner(accountName, n.txPool, n.newBlocks)
+// startStratum starts the mining pool server, the rewards are sent to the account provided.
+//
+// The listener is returned to call Close when done.
+func (n *Node) startStratum(accountName string) (net.Listener, error) {
+	coinbaseAddr, err := mining.CoinbaseAddress(accountName)
 	if err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("tcp", n.stratumAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	n.stratum = stratum.NewServer(stratum.Config{
+		CoinbaseAddr: coinbaseAddr,
+		Template:     n.blockTemplate,
+		Submit:       n.submitBlock,
+	})
+	logger.Info("Pool rewards and fees will be send to: ", coinbaseAddr)
+
+	go func() {
+		if err := n.stratum.Serve(ln); err != nil {
+			logger.Error("Stratum: ", err)
+		}
+	}()
+
+	return ln, nil
+}
+
+// blockTemplate returns the template of the block following the chain tip.
+func (n *Node) blockTemplate() (*mining.BlockTemplate, error) {
+	prevBlock, err := n.blockchain.LastBlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return mining.NewBlockTemplate(n.txPool, &prevBlock), nil
+}
+
+// submitBlock validates a block solved outside the node, adds it to the chain and
+// announces it to the peers.
+func (n *Node) submitBlock(b block.Block) error {
+	n.chainMu.Lock()
+	if err := n.checkBlock(b); err != nil {
+		n.chainMu.Unlock()
+		return fmt.Errorf("block rejected: %w", err)
+	}
+
+	if err := n.connectBlock(b, false); err != nil {
+		n.chainMu.Unlock()
 		return err
 	}
+	n.chainMu.Unlock()
+	logger.Infof("Submitted block at height %d (%x)", b.Height, b.Hash)
 
-	for {
+	return n.announceBlock(b)
+}
+
+// generate mines numBlocks blocks on top of the chain tip paying the rewards to coinbaseAddr
+// and returns their hashes.
+func (n *Node) generate(numBlocks int, coinbaseAddr string) ([][]byte, error) {
+	n.generateMu.Lock()
+	defer n.generateMu.Unlock()
+
+	// The miner is never cancelled, blocks are added to the chain as soon as they are mined
+	miner := mining.NewCPUMiner(coinbaseAddr, n.txPool, n.miningThreads)
+	hashes := make([][]byte, 0, numBlocks)
+	for len(hashes) < numBlocks {
 		prevBlock, err := n.blockchain.LastBlock()
 		if err != nil {
-			return err
+			return hashes, err
 		}
 
-		newBlock, err := miner.Mine(&prevBlock)
+		b, err := miner.Mine(context.Background(), &prevBlock)
 		if err != nil {
-			return err
+			return hashes, err
 		}
 
-		// Miner is no-op or the computation was cancelled because the block has been
-		// mined by another node, continue to the next one.
-		if newBlock.Hash == nil {
-			continue
+		if err := n.submitBlock(b); err != nil {
+			return hashes, err
 		}
+		hashes = append(hashes, b.Hash)
+	}
 
-		// Broadcast the newly mined block
-		err = n.peers.ForEach(func(addr string) error {
-			return n.sendBlock(addr, newBlock)
-		})
+	return hashes, nil
+}
+
+// connectBlock adds a block to the chain and updates the UTXO set, the mempool and
+// the fee estimator accordingly. The signatures are not verified if assumedValid is true.
+func (n *Node) connectBlock(b block.Block, assumedValid bool) error {
+	// Transactions must not be accepted into the pool after being checked against the
+	// previous UTXO set
+	n.mempoolMu.Lock()
+	defer n.mempoolMu.Unlock()
+
+	addBlock := n.blockchain.AddBlock
+	if assumedValid {
+		addBlock = n.blockchain.AddAssumedValidBlock
+	}
+	if err := addBlock(b); err != nil {
+		return fmt.Errorf("adding block: %w", err)
+	}
+
+	utxoSet := &utxo.Set{Blockchain: n.blockchain}
+	if err := utxoSet.Update(b); err != nil {
+		return fmt.Errorf("updating utxo set: %v", err)
+	}
+
+	// Remove new block's transactions from the mempool, along with the ones spending
+	// the same outputs
+	txIDs := make([][]byte, 0, len(b.Transactions))
+	for _, tx := range b.Transactions {
+		n.txPool.Remove(tx.ID)
+		if removed := n.txPool.RemoveConflicts(tx); removed > 0 {
+			logger.Debugf("Removed %d transactions conflicting with %x from the mempool", removed, tx.ID)
+		}
+		txIDs = append(txIDs, tx.ID)
+	}
+	n.feeEstimator.ProcessBlock(b.Height, txIDs)
+
+	// Make the miner work on top of the new tip
+	n.miningController.NewTip()
+	return nil
+}
+
+// disconnectBlocks removes the blocks above height from the chain, so the blocks of a
+// competing branch with more work can be connected, and rebuilds the UTXO set. The
+// transactions of the blocks removed are added back to the mempool if they are still valid.
+func (n *Node) disconnectBlocks(height int32) error {
+	n.chainMu.Lock()
+	defer n.chainMu.Unlock()
+	n.mempoolMu.Lock()
+	defer n.mempoolMu.Unlock()
+
+	var (
+		disconnected  []block.Block
+		disconnectErr error
+	)
+	for _, bestHeight := n.blockchain.Tip(); bestHeight > height; bestHeight-- {
+		b, err := n.blockchain.DisconnectTip()
 		if err != nil {
-			return err
+			disconnectErr = fmt.Errorf("disconnecting block: %w", err)
+			break
 		}
+		logger.Infof("Disconnected block at height %d (%x)", b.Height, b.Hash)
+		disconnected = append(disconnected, b)
+	}
 
-		if err := n.blockchain.AddBlock(newBlock); err != nil {
-			return err
+	// The UTXO set must match the chain even if not all the blocks were disconnected
+	utxoSet := &utxo.Set{Blockchain: n.blockchain}
+	if err := utxoSet.Reindex(); err != nil {
+		return fmt.Errorf("rebuilding utxo set: %w", err)
+	}
+	if disconnectErr != nil {
+		return disconnectErr
+	}
+
+	for i := len(disconnected) - 1; i >= 0; i-- {
+		for _, t := range disconnected[i].Transactions[1:] {
+			fee, err := n.checkTx(t)
+			if err != nil {
+				logger.Debugf("Transaction %x from a disconnected block not added to the mempool: %v", t.ID, err)
+				continue
+			}
+			n.txPool.Add(t, fee, height)
 		}
+	}
+
+	n.miningController.NewTip()
+	return nil
+}
+
+// checkBlock validates a solved block that should extend the chain tip, including that
+// its transactions spend existing unspent outputs only once.
+//
+// The consensus rules violations are wrapped in block.ErrInvalidBlock.
+func (n *Node) checkBlock(b block.Block) error {
+	if b.Header == nil {
+		return fmt.Errorf("%w: no header", block.ErrInvalidBlock)
+	}
+
+	tip, err := n.blockchain.LastBlock()
+	if err != nil {
+		return err
+	}
 
-		utxoSet := &utxo.Set{Blockchain: n.blockchain}
-		if err := utxoSet.Update(newBlock); err != nil {
+	if !bytes.Equal(b.PrevBlockHash, tip.Hash) {
+		return fmt.Errorf("block does not extend the chain tip %x", tip.Hash)
+	}
+	if b.Height != tip.Height+1 {
+		return fmt.Errorf("%w: height %d, expected %d", block.ErrInvalidBlock, b.Height, tip.Height+1)
+	}
+	if bits := block.CalculateNextDifficulty(tip); b.Bits != bits {
+		return fmt.Errorf("%w: difficulty bits %08x, expected %08x", block.ErrInvalidBlock, b.Bits, bits)
+	}
+	if err := block.CheckTimestamp(b); err != nil {
+		if errors.Is(err, block.ErrTimeTooNew) {
 			return err
 		}
+		return fmt.Errorf("%w: %v", block.ErrInvalidBlock, err)
 	}
-}
 
-func handleConn(conn io.ReadCloser, handlers map[message]handlerFunc) error {
-	request, err := io.ReadAll(conn)
+	hash, err := b.PowHash()
 	if err != nil {
-		return fmt.Errorf("reading conn: %w", err)
+		return err
+	}
+	if !bytes.Equal(hash, b.Hash) {
+		return fmt.Errorf("%w: hash does not match its header", block.ErrInvalidBlock)
+	}
+	if !b.IsValid() {
+		return fmt.Errorf("%w: hash is higher than the target", block.ErrInvalidBlock)
 	}
-	msg := bytesToMessage(request[:messageLength])
 
-	handle, ok := handlers[msg]
+	if len(b.Transactions) == 0 || !b.Transactions[0].IsCoinbase() {
+		return fmt.Errorf("%w: first transaction is not coinbase", block.ErrInvalidBlock)
+	}
+	ok, err := b.HasValidMerkleRoot()
+	if err != nil {
+		return err
+	}
 	if !ok {
-		return fmt.Errorf("unknown command: %s", msg)
+		return fmt.Errorf("%w: merkle root hash does not match the block transactions", block.ErrInvalidBlock)
+	}
+
+	// The signatures are verified when the block is added to the chain
+	utxoSet := &utxo.Set{Blockchain: n.blockchain}
+	spent := make(map[string]struct{})
+	fees := 0
+	for _, t := range b.Transactions[1:] {
+		if t.IsCoinbase() {
+			return fmt.Errorf("%w: transaction %x is an extra coinbase", block.ErrInvalidBlock, t.ID)
+		}
+
+		for _, in := range t.Inputs {
+			outPoint := fmt.Sprintf("%x:%d", in.PrevOutput.TxID, in.PrevOutput.Index)
+			if _, ok := spent[outPoint]; ok {
+				return fmt.Errorf("%w: transaction %x spends output %s, which another transaction in the block spends",
+					block.ErrInvalidBlock, t.ID, outPoint)
+			}
+			spent[outPoint] = struct{}{}
+
+			_, ok, err := utxoSet.Output(in.PrevOutput)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("%w: transaction %x spends output %s, which is spent or doesn't exist",
+					block.ErrInvalidBlock, t.ID, outPoint)
+			}
+		}
+
+		prevTxs, err := n.blockchain.PrevTxs(t)
+		if err != nil {
+			return err
+		}
+		fee, err := t.Fee(prevTxs)
+		if err != nil {
+			return err
+		}
+		fees += fee
 	}
 
-	if err := handle(request); err != nil {
-		return fmt.Errorf("%s handler: %w", msg, err)
+	// The miner can't claim more than the subsidy plus the fees
+	maxValue := tx.CalculateBlockSubsidy(b.Height) + fees
+	if value := b.Transactions[0].OutputsValue(); value > maxValue {
+		return fmt.Errorf("%w: coinbase pays %d SAT, the maximum is %d SAT", block.ErrInvalidBlock, value, maxValue)
 	}
 
 	return nil
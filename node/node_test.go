@@ -0,0 +1,171 @@
+package node
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GGP1/btcs/block"
+	"github.com/GGP1/btcs/chaincfg"
+	"github.com/GGP1/btcs/mempool"
+	"github.com/GGP1/btcs/tx"
+	"github.com/GGP1/btcs/wallet"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+// newTestNode returns a node running on the regression test network, its files are
+// stored in a temporary directory.
+func newTestNode(t *testing.T, opts ...testNodeOption) *Node {
+	t.Helper()
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	chaincfg.ActiveParams = &chaincfg.RegressionNetParams
+	t.Cleanup(func() {
+		chaincfg.ActiveParams = &chaincfg.MainNetParams
+		os.Chdir(wd)
+	})
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	n, err := New(Config{MiningThreads: 1, MempoolExpiry: mempool.DefaultExpiry})
+	require.NoError(t, err)
+	t.Cleanup(func() { n.blockchain.Close() })
+
+	return n
+}
+
+// testNodeOption prepares the node working directory before the node is created.
+type testNodeOption func(t *testing.T)
+
+// withOutdatedChain writes a blockchain database from before the blocks format was
+// versioned.
+func withOutdatedChain(t *testing.T) {
+	db, err := bolt.Open("blockchain.db", 0o600, nil)
+	require.NoError(t, err)
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("blocks"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("l"), []byte("old genesis"))
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+}
+
+// newTestAccount returns a wallet account and its address.
+func newTestAccount(t *testing.T) (*wallet.Account, string) {
+	t.Helper()
+
+	masterKey, err := wallet.NewMasterKey(bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+	account := wallet.NewAccount(masterKey)
+
+	return account, account.PubKey.Address()
+}
+
+// fundTestAccount mines a block paying the reward to addr and returns the coinbase.
+func fundTestAccount(t *testing.T, n *Node, addr string) tx.Tx {
+	t.Helper()
+
+	hashes, err := n.generate(1, addr)
+	require.NoError(t, err)
+	b, err := n.blockchain.Block(hashes[0])
+	require.NoError(t, err)
+
+	return b.Transactions[0]
+}
+
+// newTestTx returns a transaction signed by account spending the outputs provided and
+// sending value to addr.
+func newTestTx(t *testing.T, n *Node, account *wallet.Account, outPoints []tx.OutPoint, value int, addr string) tx.Tx {
+	t.Helper()
+
+	inputs := make([]tx.Input, 0, len(outPoints))
+	for _, outPoint := range outPoints {
+		inputs = append(inputs, tx.Input{PrevOutput: outPoint, PubKey: account.PublicKey()})
+	}
+
+	spend, err := tx.New(inputs, []tx.Output{tx.NewOutput(value, addr)})
+	require.NoError(t, err)
+	require.NoError(t, n.blockchain.SignTransaction(spend, account.PrivateKey()))
+
+	return *spend
+}
+
+// mineTestBlock returns a solved block on top of the chain tip containing the
+// transactions provided after the coinbase.
+func mineTestBlock(t *testing.T, n *Node, addr string, txs ...tx.Tx) block.Block {
+	t.Helper()
+
+	tip, err := n.blockchain.LastBlock()
+	require.NoError(t, err)
+	coinbase, err := tx.NewCoinbase(addr, "", 0, tip.Height+1)
+	require.NoError(t, err)
+
+	b, err := block.NewBlock(&tip, append([]tx.Tx{*coinbase}, txs...))
+	require.NoError(t, err)
+	for !b.IsValid() {
+		b.Nonce++
+	}
+	b.Hash, err = b.PowHash()
+	require.NoError(t, err)
+
+	return *b
+}
+
+func TestSubmitBlockDoubleSpend(t *testing.T) {
+	n := newTestNode(t)
+	account, addr := newTestAccount(t)
+	coinbase := fundTestAccount(t, n, addr)
+	outPoint := tx.OutPoint{TxID: coinbase.ID, Index: 0}
+	tx1 := newTestTx(t, n, account, []tx.OutPoint{outPoint}, coinbase.OutputsValue(), addr)
+	tx2 := newTestTx(t, n, account, []tx.OutPoint{outPoint}, coinbase.OutputsValue()-1000, addr)
+
+	err := n.submitBlock(mineTestBlock(t, n, addr, tx1, tx2))
+	assert.ErrorContains(t, err, "which another transaction in the block spends")
+
+	err = n.submitBlock(mineTestBlock(t, n, addr, tx1))
+	assert.NoError(t, err)
+
+	// The output was spent in the previous block
+	err = n.submitBlock(mineTestBlock(t, n, addr, tx2))
+	assert.ErrorContains(t, err, "which is spent or doesn't exist")
+}
+
+func TestSubmitBlockInvalidSignature(t *testing.T) {
+	n := newTestNode(t)
+	account, addr := newTestAccount(t)
+	coinbase := fundTestAccount(t, n, addr)
+
+	spend := newTestTx(t, n, account, []tx.OutPoint{{TxID: coinbase.ID, Index: 0}}, coinbase.OutputsValue(), addr)
+	signature := append([]byte{}, spend.Inputs[0].Signature...)
+	signature[len(signature)-1] ^= 0xff
+	spend.Inputs[0].Signature = signature
+
+	err := n.submitBlock(mineTestBlock(t, n, addr, spend))
+	assert.ErrorIs(t, err, block.ErrInvalidTx)
+	assert.ErrorContains(t, err, "invalid signature")
+}
+
+func TestNewResetsOutdatedChain(t *testing.T) {
+	n := newTestNode(t, withOutdatedChain)
+
+	genesis, err := block.NewGenesis()
+	require.NoError(t, err)
+	tip, height := n.blockchain.Tip()
+	assert.Equal(t, genesis.Hash, tip)
+	assert.Equal(t, int32(0), height)
+
+	backups, err := filepath.Glob("blockchain.db.*.bak")
+	require.NoError(t, err)
+	assert.Len(t, backups, 1, "The old database is kept")
+}
@@ -0,0 +1,164 @@
+package node
+
+import (
+	"time"
+
+	"github.com/GGP1/btcs/block"
+)
+
+const (
+	// maxOrphanBlocks is the maximum number of orphan blocks kept, the oldest one is evicted
+	// when it's reached.
+	maxOrphanBlocks = 100
+	// maxOrphanBlocksSize is the maximum size in bytes of the orphan blocks, the largest ones
+	// are evicted when it's exceeded.
+	maxOrphanBlocksSize = 64 * 1024 * 1024
+)
+
+// orphanBlock is a block received before its parent.
+type orphanBlock struct {
+	block    block.Block
+	peer     *peer
+	size     int
+	received time.Time
+}
+
+// orphanPool contains the blocks whose parent is unknown, keyed by parent hash so they
+// are connected once it is.
+//
+// It's not safe for concurrent use, the sync manager lock guards it.
+type orphanPool struct {
+	orphans  map[string]*orphanBlock
+	byParent map[string][]*orphanBlock
+	// size is the sum of the orphans' size in bytes
+	size int
+}
+
+func newOrphanPool() *orphanPool {
+	return &orphanPool{
+		orphans:  make(map[string]*orphanBlock),
+		byParent: make(map[string][]*orphanBlock),
+	}
+}
+
+// Add includes the block in the pool, evicting other orphans if it's full. It returns
+// false if the block is larger than the pool or it was already in it.
+func (o *orphanPool) Add(b block.Block, p *peer, size int) bool {
+	if size > maxOrphanBlocksSize {
+		return false
+	}
+	if _, ok := o.orphans[string(b.Hash)]; ok {
+		return false
+	}
+
+	for len(o.orphans) >= maxOrphanBlocks {
+		o.remove(o.oldest())
+	}
+	for o.size+size > maxOrphanBlocksSize {
+		o.remove(o.largest())
+	}
+
+	orphan := &orphanBlock{block: b, peer: p, size: size, received: time.Now()}
+	o.orphans[string(b.Hash)] = orphan
+	parent := string(b.PrevBlockHash)
+	o.byParent[parent] = append(o.byParent[parent], orphan)
+	o.size += size
+	return true
+}
+
+// Contains returns whether the block with the hash provided is in the pool.
+func (o *orphanPool) Contains(hash []byte) bool {
+	_, ok := o.orphans[string(hash)]
+	return ok
+}
+
+// Count returns the number of orphans in the pool.
+func (o *orphanPool) Count() int {
+	return len(o.orphans)
+}
+
+// RemoveChildren takes the orphans whose parent is the block with the hash provided out
+// of the pool and returns them.
+func (o *orphanPool) RemoveChildren(parentHash []byte) []*orphanBlock {
+	children := append([]*orphanBlock(nil), o.byParent[string(parentHash)]...)
+	for _, child := range children {
+		o.remove(child)
+	}
+	return children
+}
+
+// Root returns the hash of the first ancestor of the orphan that is in the pool, the one
+// whose parent is missing.
+func (o *orphanPool) Root(hash []byte) []byte {
+	for {
+		orphan, ok := o.orphans[string(hash)]
+		if !ok {
+			return hash
+		}
+		if _, ok := o.orphans[string(orphan.block.PrevBlockHash)]; !ok {
+			return hash
+		}
+		hash = orphan.block.PrevBlockHash
+	}
+}
+
+// Range calls f on each orphan, it's safe to remove them inside f.
+func (o *orphanPool) Range(f func(orphan *orphanBlock)) {
+	list := make([]*orphanBlock, 0, len(o.orphans))
+	for _, orphan := range o.orphans {
+		list = append(list, orphan)
+	}
+	for _, orphan := range list {
+		f(orphan)
+	}
+}
+
+// Remove takes the orphan out of the pool.
+func (o *orphanPool) Remove(hash []byte) {
+	if orphan, ok := o.orphans[string(hash)]; ok {
+		o.remove(orphan)
+	}
+}
+
+func (o *orphanPool) remove(orphan *orphanBlock) {
+	hash := string(orphan.block.Hash)
+	if _, ok := o.orphans[hash]; !ok {
+		return
+	}
+	delete(o.orphans, hash)
+	o.size -= orphan.size
+
+	parent := string(orphan.block.PrevBlockHash)
+	siblings := o.byParent[parent]
+	for i, sibling := range siblings {
+		if sibling == orphan {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(o.byParent, parent)
+	} else {
+		o.byParent[parent] = siblings
+	}
+}
+
+func (o *orphanPool) oldest() *orphanBlock {
+	var oldest *orphanBlock
+	for _, orphan := range o.orphans {
+		if oldest == nil || orphan.received.Before(oldest.received) {
+			oldest = orphan
+		}
+	}
+	return oldest
+}
+
+func (o *orphanPool) largest() *orphanBlock {
+	var largest *orphanBlock
+	for _, orphan := range o.orphans {
+		if largest == nil || orphan.size > largest.size {
+			largest = orphan
+		}
+	}
+	return largest
+}
@@ -0,0 +1,68 @@
+package node
+
+import (
+	"testing"
+	"time"
+
+	"github.com/GGP1/btcs/block"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newOrphan(hash, parent byte) block.Block {
+	return block.Block{Header: &block.Header{PrevBlockHash: []byte{parent}}, Hash: []byte{hash}}
+}
+
+func TestOrphanPool(t *testing.T) {
+	o := newOrphanPool()
+	// 1 <- 2 <- 3, 1 <- 4
+	assert.True(t, o.Add(newOrphan(2, 1), nil, 10))
+	assert.True(t, o.Add(newOrphan(3, 2), nil, 10))
+	assert.True(t, o.Add(newOrphan(4, 1), nil, 10))
+	assert.False(t, o.Add(newOrphan(4, 1), nil, 10), "Duplicate")
+	assert.Equal(t, 3, o.Count())
+	assert.Equal(t, 30, o.size)
+
+	assert.Equal(t, []byte{2}, o.Root([]byte{3}))
+	assert.Equal(t, []byte{4}, o.Root([]byte{4}))
+
+	children := o.RemoveChildren([]byte{1})
+	assert.Len(t, children, 2)
+	assert.Equal(t, 1, o.Count())
+	assert.Equal(t, 10, o.size)
+	assert.True(t, o.Contains([]byte{3}))
+	assert.Empty(t, o.RemoveChildren([]byte{1}))
+
+	children = o.RemoveChildren([]byte{2})
+	assert.Len(t, children, 1)
+	assert.Zero(t, o.Count())
+	assert.Zero(t, o.size)
+	assert.Empty(t, o.byParent)
+}
+
+func TestOrphanPoolEviction(t *testing.T) {
+	t.Run("Oldest", func(t *testing.T) {
+		o := newOrphanPool()
+		for i := 0; i < maxOrphanBlocks; i++ {
+			o.Add(newOrphan(byte(i), 255), nil, 1)
+			o.orphans[string([]byte{byte(i)})].received = time.Now().Add(time.Duration(i) * time.Second)
+		}
+
+		o.Add(newOrphan(byte(maxOrphanBlocks), 255), nil, 1)
+		assert.Equal(t, maxOrphanBlocks, o.Count())
+		assert.False(t, o.Contains([]byte{0}))
+		assert.True(t, o.Contains([]byte{1}))
+	})
+
+	t.Run("Largest", func(t *testing.T) {
+		o := newOrphanPool()
+		o.Add(newOrphan(1, 255), nil, maxOrphanBlocksSize/2)
+		o.Add(newOrphan(2, 255), nil, maxOrphanBlocksSize/4)
+		o.Add(newOrphan(3, 255), nil, maxOrphanBlocksSize/2)
+		assert.False(t, o.Contains([]byte{1}))
+		assert.True(t, o.Contains([]byte{2}))
+		assert.True(t, o.Contains([]byte{3}))
+
+		assert.False(t, o.Add(newOrphan(4, 255), nil, maxOrphanBlocksSize+1), "Larger than the pool")
+	})
+}
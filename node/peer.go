@@ -0,0 +1,366 @@
+package node
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/GGP1/btcs/logger"
+)
+
+const (
+	// dialTimeout is the maximum time spent establishing an outbound connection.
+	dialTimeout = 10 * time.Second
+	// writeTimeout is the maximum time spent writing a message to a peer.
+	writeTimeout = time.Minute
+	// maxPeers is the maximum number of connections, inbound and outbound.
+	maxPeers = 125
+	// maxOutboundPeers is the number of connections the node tries to establish.
+	maxOutboundPeers = 8
+	// outboundInterval is how often the number of outbound connections is checked.
+	outboundInterval = 10 * time.Second
+	// handshakeTimeout is the time a peer has to complete the handshake before being
+	// disconnected.
+	handshakeTimeout = 30 * time.Second
+	// sendQueueSize is the number of messages that can be queued, peers that don't keep
+	// up are disconnected.
+	sendQueueSize = 64
+)
+
+// peer is a long-lived connection with another node.
+//
+// Messages are read by the node from the connection and written by the peer's write loop,
+// so they are never interleaved.
+type peer struct {
+	conn net.Conn
+	// addr is the address the connection was dialed to or, for inbound ones,
+	// accepted from
+	addr string
+	// host is the IP address of the connection, the one banned if the peer misbehaves
+	host     string
+	inbound  bool
+	connTime time.Time
+
+	sendQueue chan []byte
+	quit      chan struct{}
+	closeOnce *sync.Once
+
+	mu *sync.Mutex
+	// listenAddr is the address where the peer accepts connections, announced
+	// in its version message
+	listenAddr string
+	// versionReceived and verackReceived track the handshake, it's complete when
+	// both messages were received
+	versionReceived bool
+	verackReceived  bool
+	// protocolVersion is the lowest between the node's and the peer's one
+	protocolVersion int32
+	services        ServiceFlag
+	userAgent       string
+	startHeight     int32
+	// bestHeight is the height of the last block the peer is known to have
+	bestHeight int32
+	// banScore is the sum of the misbehavior scores of the peer
+	banScore int
+	// knownInventory contains the blocks and transactions the peer has, they are
+	// not announced to it
+	knownInventory *knownInventory
+	// pendingTxInv contains the transactions waiting to be announced to the peer
+	pendingTxInv [][]byte
+	// feeFilter is the minimum fee rate (sat/byte) of the transactions announced to
+	// the peer
+	feeFilter float64
+	// compactVersion is the compact blocks protocol version the peer supports, zero if
+	// it doesn't
+	compactVersion uint64
+	// compactAnnounce is set when the peer asked for new blocks to be announced with
+	// compact blocks (high-bandwidth mode)
+	compactAnnounce bool
+	// preferHeaders is set when the peer asked for new blocks to be announced with
+	// headers messages instead of inv ones
+	preferHeaders bool
+}
+
+func newPeer(conn net.Conn, addr string, inbound bool) *peer {
+	host, err := banAddress(conn.RemoteAddr().String())
+	if err != nil {
+		host = conn.RemoteAddr().String()
+	}
+
+	p := &peer{
+		conn:      conn,
+		addr:      addr,
+		host:      host,
+		inbound:   inbound,
+		connTime:  time.Now(),
+		sendQueue: make(chan []byte, sendQueueSize),
+		quit:      make(chan struct{}),
+		closeOnce: &sync.Once{},
+		mu:        &sync.Mutex{},
+
+		knownInventory: newKnownInventory(maxKnownInventory),
+	}
+	if !inbound {
+		p.listenAddr = addr
+	}
+
+	go p.writeLoop()
+	return p
+}
+
+// send queues a message to be written to the peer, it never blocks so a slow peer can't
+// stall the node.
+//
+// Messages sent to a disconnected peer are dropped. If the queue is full, announcements
+// are dropped and the peer is disconnected when sending anything else.
+func (p *peer) send(cmd message, payload any) error {
+	msg, err := newMessage(cmd, payload)
+	if err != nil {
+		return err
+	}
+
+	if !p.connected() {
+		logger.Debugf("Dropped %s message to disconnected peer %s", cmd, p.addr)
+		return nil
+	}
+
+	select {
+	case p.sendQueue <- msg:
+	default:
+		switch cmd {
+		case msgAddr, msgInv, msgTx:
+			logger.Debugf("Dropped %s message to peer %s, its send queue is full", cmd, p.addr)
+		default:
+			logger.Infof("Disconnecting peer %s, its send queue is full", p.addr)
+			p.disconnect()
+		}
+	}
+	return nil
+}
+
+// connected returns whether the connection is still open.
+func (p *peer) connected() bool {
+	select {
+	case <-p.quit:
+		return false
+	default:
+		return true
+	}
+}
+
+// disconnect closes the connection and stops the write loop, it's safe to call it
+// multiple times.
+func (p *peer) disconnect() {
+	p.closeOnce.Do(func() {
+		close(p.quit)
+		p.conn.Close()
+	})
+}
+
+// listenAddress returns the address where the peer accepts connections, it's empty for
+// inbound peers that haven't sent their version yet.
+func (p *peer) listenAddress() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.listenAddr
+}
+
+// setVersion records the information of the peer's version message and negotiates
+// the protocol version.
+func (p *peer) setVersion(v version) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.versionReceived {
+		return errors.New("duplicate version message")
+	}
+	p.versionReceived = true
+
+	if p.inbound {
+		p.listenAddr = v.AddrFrom
+	}
+	p.protocolVersion = protocolVersion
+	if v.ProtocolVersion < protocolVersion {
+		p.protocolVersion = v.ProtocolVersion
+	}
+	p.services = v.Services
+	p.userAgent = v.UserAgent
+	p.startHeight = v.StartHeight
+	if v.StartHeight > p.bestHeight {
+		p.bestHeight = v.StartHeight
+	}
+	return nil
+}
+
+// setVerackReceived records the acknowledgement of the node's version message, which
+// completes the handshake.
+func (p *peer) setVerackReceived() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.versionReceived {
+		return errors.New("verack received before version")
+	}
+	if p.verackReceived {
+		return errors.New("duplicate verack message")
+	}
+	p.verackReceived = true
+	return nil
+}
+
+// addBanScore increases the peer's ban score and returns the updated value.
+func (p *peer) addBanScore(score int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.banScore += score
+	return p.banScore
+}
+
+// height returns the height of the last block the peer is known to have.
+func (p *peer) height() int32 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.bestHeight
+}
+
+// updateHeight records that the peer has the block at height.
+func (p *peer) updateHeight(height int32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if height > p.bestHeight {
+		p.bestHeight = height
+	}
+}
+
+// addKnownInventory records that the peer has the blocks or transactions with the
+// hashes provided.
+func (p *peer) addKnownInventory(hashes ...[]byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, hash := range hashes {
+		p.knownInventory.Add(hash)
+	}
+}
+
+// knowsInventory returns whether the peer is known to have the block or transaction.
+func (p *peer) knowsInventory(hash []byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.knownInventory.Contains(hash)
+}
+
+// queueTxInv adds the transaction to the ones pending to be announced, unless the peer
+// already knows it or its fee rate is below the peer's fee filter.
+func (p *peer) queueTxInv(txID []byte, feeRate float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if feeRate < p.feeFilter || p.knownInventory.Contains(txID) {
+		return
+	}
+	p.knownInventory.Add(txID)
+	p.pendingTxInv = append(p.pendingTxInv, txID)
+}
+
+// takePendingTxInv returns the transactions pending to be announced and clears them.
+func (p *peer) takePendingTxInv() [][]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	txIDs := p.pendingTxInv
+	p.pendingTxInv = nil
+	return txIDs
+}
+
+// setFeeFilter sets the minimum fee rate (sat/byte) of the transactions announced to
+// the peer.
+func (p *peer) setFeeFilter(feeRate float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.feeFilter = feeRate
+}
+
+// setSendCmpct records the compact blocks mode the peer asked for.
+func (p *peer) setSendCmpct(msg sendCmpct) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.compactVersion = msg.Version
+	p.compactAnnounce = msg.Announce
+}
+
+// supportsCompactBlocks returns whether the peer can send and receive compact blocks.
+func (p *peer) supportsCompactBlocks() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.compactVersion == compactBlocksProtocol
+}
+
+// wantsCompactBlocks returns whether the peer wants new blocks to be announced with
+// compact blocks.
+func (p *peer) wantsCompactBlocks() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.compactVersion == compactBlocksProtocol && p.compactAnnounce
+}
+
+// setPreferHeaders records that the peer wants new blocks to be announced with headers.
+func (p *peer) setPreferHeaders() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.preferHeaders = true
+}
+
+// prefersHeaders returns whether the peer wants new blocks to be announced with headers.
+func (p *peer) prefersHeaders() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.preferHeaders
+}
+
+// handshakeComplete returns whether the version and verack messages were exchanged.
+func (p *peer) handshakeComplete() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.versionReceived && p.verackReceived
+}
+
+// info returns the peer information.
+func (p *peer) info() PeerInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return PeerInfo{
+		Addr:            p.addr,
+		ListenAddr:      p.listenAddr,
+		Inbound:         p.inbound,
+		ConnTime:        p.connTime.Unix(),
+		ProtocolVersion: p.protocolVersion,
+		Services:        p.services,
+		UserAgent:       p.userAgent,
+		StartHeight:     p.startHeight,
+		BestHeight:      p.bestHeight,
+		BanScore:        p.banScore,
+		FeeFilter:       p.feeFilter,
+		CompactBlocks:   p.compactVersion == compactBlocksProtocol,
+		HighBandwidth:   p.compactVersion == compactBlocksProtocol && p.compactAnnounce,
+	}
+}
+
+// writeLoop writes the queued messages to the connection until the peer disconnects.
+func (p *peer) writeLoop() {
+	for {
+		select {
+		case <-p.quit:
+			return
+
+		case msg := <-p.sendQueue:
+			if err := p.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+				logger.Debugf("Peer %s: %v", p.addr, err)
+			}
+			if _, err := p.conn.Write(msg); err != nil {
+				logger.Debugf("Writing to peer %s: %v", p.addr, err)
+				p.disconnect()
+				return
+			}
+		}
+	}
+}
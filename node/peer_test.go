@@ -0,0 +1,73 @@
+package node
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerHandshake(t *testing.T) {
+	conn, _ := net.Pipe()
+	p := newPeer(conn, "127.0.0.1:40000", true)
+	defer p.disconnect()
+
+	assert.Error(t, p.setVerackReceived(), "Verack before version")
+	assert.False(t, p.handshakeComplete())
+
+	v := version{
+		ProtocolVersion: protocolVersion + 10,
+		Services:        SFNodeNetwork,
+		AddrFrom:        "127.0.0.1:3000",
+		UserAgent:       "/test:1.0/",
+		StartHeight:     42,
+	}
+	require.NoError(t, p.setVersion(v))
+	assert.Error(t, p.setVersion(v), "Duplicate version")
+	assert.False(t, p.handshakeComplete())
+
+	require.NoError(t, p.setVerackReceived())
+	assert.Error(t, p.setVerackReceived(), "Duplicate verack")
+	assert.True(t, p.handshakeComplete())
+
+	info := p.info()
+	assert.Equal(t, protocolVersion, info.ProtocolVersion, "The lower version is negotiated")
+	assert.Equal(t, v.AddrFrom, info.ListenAddr)
+	assert.Equal(t, v.Services, info.Services)
+	assert.Equal(t, v.UserAgent, info.UserAgent)
+	assert.Equal(t, v.StartHeight, info.StartHeight)
+}
+
+func TestPeerNegotiateVersion(t *testing.T) {
+	conn, _ := net.Pipe()
+	p := newPeer(conn, "127.0.0.1:3000", false)
+	defer p.disconnect()
+
+	require.NoError(t, p.setVersion(version{ProtocolVersion: minProtocolVersion, AddrFrom: "spoofed:1"}))
+
+	info := p.info()
+	assert.Equal(t, minProtocolVersion, info.ProtocolVersion)
+	assert.Equal(t, "127.0.0.1:3000", info.ListenAddr, "Outbound peers keep the dialed address")
+}
+
+func TestPeerSendQueueFull(t *testing.T) {
+	// Nothing is read from the connection, the first message blocks the write loop
+	conn, _ := net.Pipe()
+	p := newPeer(conn, "127.0.0.1:40000", false)
+	defer p.disconnect()
+
+	require.NoError(t, p.send(msgPing, nil))
+	require.Eventually(t, func() bool { return len(p.sendQueue) == 0 }, time.Second, time.Millisecond)
+	for i := 0; i < sendQueueSize; i++ {
+		require.NoError(t, p.send(msgPing, nil))
+	}
+	require.True(t, p.connected())
+
+	require.NoError(t, p.send(msgInv, nil))
+	assert.True(t, p.connected(), "Announcements are dropped")
+
+	require.NoError(t, p.send(msgPing, nil))
+	assert.False(t, p.connected(), "Slow peers are disconnected")
+}
@@ -1,87 +1,124 @@
 package node
 
 import (
+	"sort"
 	"sync"
 )
 
-// peers contains a list of peer nodes.
+// peers contains the connected peer nodes, keyed by address.
 type peers struct {
-	mu       *sync.RWMutex
-	addrs    map[string]struct{}
-	hostAddr string
+	mu    *sync.RWMutex
+	peers map[string]*peer
 }
 
-// newPeers returns a list of peer addresses that is safe for concurrent access.
-func newPeers(hostAddr string, peerAddrs []string) *peers {
-	addrs := make(map[string]struct{}, len(peerAddrs))
-	for _, addr := range peerAddrs {
-		if addr != hostAddr {
-			addrs[addr] = struct{}{}
-		}
-	}
-
+// newPeers returns a set of peers that is safe for concurrent access.
+func newPeers() *peers {
 	return &peers{
-		mu:       &sync.RWMutex{},
-		addrs:    addrs,
-		hostAddr: hostAddr,
+		mu:    &sync.RWMutex{},
+		peers: make(map[string]*peer),
 	}
 }
 
-// Add includes the peers passed to the list.
-// Returns the updated number of peers in the list.
-func (p *peers) Add(addrs ...string) int {
+// Add includes the peer in the set, it returns false if there is already a peer
+// with the same address.
+func (p *peers) Add(peer *peer) bool {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	for _, addr := range addrs {
-		if addr != p.hostAddr {
-			p.addrs[addr] = struct{}{}
-		}
+	if _, ok := p.peers[peer.addr]; ok {
+		return false
 	}
-	return len(p.addrs)
+	p.peers[peer.addr] = peer
+	return true
 }
 
-// Contains returns true if the peer is part of the list.
+// Contains returns true if a peer with the address provided is connected, whether the
+// address is the one the connection was established with or the one the peer listens on.
 func (p *peers) Contains(addr string) bool {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
-	_, ok := p.addrs[addr]
-	return ok
+
+	if _, ok := p.peers[addr]; ok {
+		return true
+	}
+	for _, peer := range p.peers {
+		if peer.listenAddress() == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// Count returns the number of connected peers.
+func (p *peers) Count() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.peers)
+}
+
+// OutboundCount returns the number of connections established by the node.
+func (p *peers) OutboundCount() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	count := 0
+	for _, peer := range p.peers {
+		if !peer.inbound {
+			count++
+		}
+	}
+	return count
+}
+
+// Get returns the peer with the address provided.
+func (p *peers) Get(addr string) (*peer, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	peer, ok := p.peers[addr]
+	return peer, ok
 }
 
-// List returns the list of peers nodes.
+// List returns the addresses of the connected peers, sorted.
 func (p *peers) List() []string {
 	p.mu.RLock()
-	list := make([]string, 0, len(p.addrs))
-	for addr := range p.addrs {
+	list := make([]string, 0, len(p.peers))
+	for addr := range p.peers {
 		list = append(list, addr)
 	}
 	p.mu.RUnlock()
 
+	sort.Strings(list)
 	return list
 }
 
-// ForEach calls f on each node in the peer list.
+// ForEach calls f on each connected peer.
 //
-// It iterates over a copy of the list instead of the underlying map
+// It iterates over a copy of the set instead of the underlying map
 // to prevent data races when the latter is modified in f.
-func (p *peers) ForEach(f func(addr string) error) error {
-	for _, addr := range p.List() {
-		if err := f(addr); err != nil {
+func (p *peers) ForEach(f func(peer *peer) error) error {
+	p.mu.RLock()
+	list := make([]*peer, 0, len(p.peers))
+	for _, peer := range p.peers {
+		list = append(list, peer)
+	}
+	p.mu.RUnlock()
+
+	for _, peer := range list {
+		if err := f(peer); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// Remove takes the peers out of the list. Returns the updated number of peers remaining.
-func (p *peers) Remove(addrs ...string) int {
+// Remove takes the peer out of the set if it's still the one registered with its address.
+// Returns the updated number of peers.
+func (p *peers) Remove(peer *peer) int {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	for _, recvAddr := range addrs {
-		delete(p.addrs, recvAddr)
+	if p.peers[peer.addr] == peer {
+		delete(p.peers, peer.addr)
 	}
-
-	return len(p.addrs)
+	return len(p.peers)
 }
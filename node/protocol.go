@@ -0,0 +1,59 @@
+package node
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// protocolVersion is the latest version of the peer-to-peer protocol the node supports.
+	protocolVersion int32 = 70014
+	// minProtocolVersion is the lowest protocol version of the peers the node talks to,
+	// the ones using a lower version are disconnected.
+	minProtocolVersion int32 = 70002
+	// sendHeadersVersion is the protocol version that introduced the sendheaders message.
+	sendHeadersVersion int32 = 70012
+	// feeFilterVersion is the protocol version that introduced the feefilter message.
+	feeFilterVersion int32 = 70013
+	// compactBlocksVersion is the protocol version that introduced compact blocks.
+	compactBlocksVersion int32 = 70014
+
+	// userAgent identifies the node software to its peers.
+	userAgent = "/btcs:0.1.0/"
+)
+
+// ServiceFlag identifies the services supported by a node.
+type ServiceFlag uint64
+
+const (
+	// SFNodeNetwork indicates the node can serve the full blocks of the chain.
+	SFNodeNetwork ServiceFlag = 1 << iota
+)
+
+// services are the services the node supports.
+const services = SFNodeNetwork
+
+var serviceFlagNames = map[ServiceFlag]string{
+	SFNodeNetwork: "NETWORK",
+}
+
+// String returns the names of the services, separated by a pipe.
+func (f ServiceFlag) String() string {
+	if f == 0 {
+		return "NONE"
+	}
+
+	names := make([]string, 0, 1)
+	for flag := ServiceFlag(1); flag != 0; flag <<= 1 {
+		if f&flag == 0 {
+			continue
+		}
+		if name, ok := serviceFlagNames[flag]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, fmt.Sprintf("UNKNOWN(%#x)", uint64(flag)))
+		}
+	}
+
+	return strings.Join(names, "|")
+}
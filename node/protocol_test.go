@@ -0,0 +1,13 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceFlagString(t *testing.T) {
+	assert.Equal(t, "NONE", ServiceFlag(0).String())
+	assert.Equal(t, "NETWORK", SFNodeNetwork.String())
+	assert.Equal(t, "NETWORK|UNKNOWN(0x4)", (SFNodeNetwork | 1<<2).String())
+}
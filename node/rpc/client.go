@@ -5,6 +5,8 @@ import (
 	"net/rpc"
 
 	"github.com/GGP1/btcs/block"
+	"github.com/GGP1/btcs/mining"
+	"github.com/GGP1/btcs/mining/stratum"
 	"github.com/GGP1/btcs/node"
 	"github.com/GGP1/btcs/tx"
 )
@@ -51,6 +53,35 @@ func (c *Client) DisconnectNode(address string) (int, error) {
 	return peersNum, nil
 }
 
+// EstimateSmartFee returns the fee rate needed for a transaction to confirm within
+// a number of blocks.
+func (c *Client) EstimateSmartFee(params node.EstimateFeeParams) (node.EstimateFeeResponse, error) {
+	var resp node.EstimateFeeResponse
+	if err := c.client.Call("Node.EstimateSmartFee", params, &resp); err != nil {
+		return node.EstimateFeeResponse{}, err
+	}
+
+	return resp, nil
+}
+
+// Generate mines blocks immediately, paying the rewards to the node's account, and
+// returns their hashes.
+func (c *Client) Generate(numBlocks int) ([][]byte, error) {
+	return c.GenerateToAddress(numBlocks, "")
+}
+
+// GenerateToAddress mines blocks immediately, paying the rewards to the address provided,
+// and returns their hashes.
+func (c *Client) GenerateToAddress(numBlocks int, address string) ([][]byte, error) {
+	params := node.GenerateParams{NumBlocks: numBlocks, Address: address}
+	var hashes [][]byte
+	if err := c.client.Call("Node.Generate", params, &hashes); err != nil {
+		return hashes, err
+	}
+
+	return hashes, nil
+}
+
 // GetBestHeight returns the node's blockchain best height.
 func (c *Client) GetBestHeight() (int32, error) {
 	var bestHeight int32
@@ -71,6 +102,36 @@ func (c *Client) GetBlock(hash []byte) (block.Block, error) {
 	return block, nil
 }
 
+// GetBlockTemplate returns the data needed to build and solve the next block.
+func (c *Client) GetBlockTemplate() (mining.BlockTemplate, error) {
+	var template mining.BlockTemplate
+	if err := c.client.Call("Node.GetBlockTemplate", struct{}{}, &template); err != nil {
+		return mining.BlockTemplate{}, err
+	}
+
+	return template, nil
+}
+
+// GetBlockchainInfo returns the state of the chain and the progress of its download.
+func (c *Client) GetBlockchainInfo() (node.BlockchainInfo, error) {
+	var info node.BlockchainInfo
+	if err := c.client.Call("Node.GetBlockchainInfo", struct{}{}, &info); err != nil {
+		return node.BlockchainInfo{}, err
+	}
+
+	return info, nil
+}
+
+// GetDeploymentInfo returns the state of the version bits deployments.
+func (c *Client) GetDeploymentInfo() (node.DeploymentInfo, error) {
+	var info node.DeploymentInfo
+	if err := c.client.Call("Node.GetDeploymentInfo", struct{}{}, &info); err != nil {
+		return node.DeploymentInfo{}, err
+	}
+
+	return info, nil
+}
+
 // GetLastBlock returns the last block (tip) of a chain.
 func (c *Client) GetLastBlock() (block.Block, error) {
 	var block block.Block
@@ -82,13 +143,23 @@ func (c *Client) GetLastBlock() (block.Block, error) {
 }
 
 // GetPeerInfo returns data about each connected node.
-func (c *Client) GetPeerInfo() ([]string, error) {
-	var peerAddresses []string
-	if err := c.client.Call("Node.GetPeerInfo", struct{}{}, &peerAddresses); err != nil {
+func (c *Client) GetPeerInfo() ([]node.PeerInfo, error) {
+	var peersInfo []node.PeerInfo
+	if err := c.client.Call("Node.GetPeerInfo", struct{}{}, &peersInfo); err != nil {
+		return nil, err
+	}
+
+	return peersInfo, nil
+}
+
+// GetPoolWorkers returns the shares submitted by each worker of the node's stratum server.
+func (c *Client) GetPoolWorkers() ([]stratum.WorkerStats, error) {
+	var workers []stratum.WorkerStats
+	if err := c.client.Call("Node.GetPoolWorkers", struct{}{}, &workers); err != nil {
 		return nil, err
 	}
 
-	return peerAddresses, nil
+	return workers, nil
 }
 
 // GetRawMempool returns the node's mempool transaction ids.
@@ -101,6 +172,56 @@ func (c *Client) GetRawMempool() ([]string, error) {
 	return txIDs, nil
 }
 
+// GetRawMempoolVerbose returns the details of each transaction in the node's mempool.
+func (c *Client) GetRawMempoolVerbose() ([]node.MempoolEntry, error) {
+	var entries []node.MempoolEntry
+	if err := c.client.Call("Node.GetRawMempoolVerbose", struct{}{}, &entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// GetMempoolEntry returns the details of a transaction in the mempool.
+func (c *Client) GetMempoolEntry(txID []byte) (node.MempoolEntry, error) {
+	var entry node.MempoolEntry
+	if err := c.client.Call("Node.GetMempoolEntry", txID, &entry); err != nil {
+		return node.MempoolEntry{}, err
+	}
+
+	return entry, nil
+}
+
+// GetMempoolInfo returns the state of the node's mempool.
+func (c *Client) GetMempoolInfo() (node.MempoolInfo, error) {
+	var info node.MempoolInfo
+	if err := c.client.Call("Node.GetMempoolInfo", struct{}{}, &info); err != nil {
+		return node.MempoolInfo{}, err
+	}
+
+	return info, nil
+}
+
+// GetMiningInfo returns the state of the node's miner.
+func (c *Client) GetMiningInfo() (node.MiningInfo, error) {
+	var info node.MiningInfo
+	if err := c.client.Call("Node.GetMiningInfo", struct{}{}, &info); err != nil {
+		return node.MiningInfo{}, err
+	}
+
+	return info, nil
+}
+
+// GetNetworkInfo returns the node's peer-to-peer state.
+func (c *Client) GetNetworkInfo() (node.NetworkInfo, error) {
+	var info node.NetworkInfo
+	if err := c.client.Call("Node.GetNetworkInfo", struct{}{}, &info); err != nil {
+		return node.NetworkInfo{}, err
+	}
+
+	return info, nil
+}
+
 // GetTransaction returns a transaction with the id provided.
 func (c *Client) GetTransaction(id []byte) (block.Block, tx.Tx, error) {
 	var resp node.GetTransactionResponse
@@ -131,6 +252,33 @@ func (c *Client) GetAddressesUTXOs(addresses []string) (map[string][]tx.Output,
 	return utxos, nil
 }
 
+// ClearBanned removes all the bans of the node.
+func (c *Client) ClearBanned() error {
+	var reply struct{}
+	return c.client.Call("Node.ClearBanned", struct{}{}, &reply)
+}
+
+// ListBanned returns the addresses banned by the node.
+func (c *Client) ListBanned() ([]node.BanEntry, error) {
+	var entries []node.BanEntry
+	if err := c.client.Call("Node.ListBanned", struct{}{}, &entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// ImportMempool adds the transactions stored in a mempool dump to the node's pool.
+// It returns the number of transactions accepted.
+func (c *Client) ImportMempool(path string) (int, error) {
+	var added int
+	if err := c.client.Call("Node.ImportMempool", path, &added); err != nil {
+		return 0, err
+	}
+
+	return added, nil
+}
+
 // ListBlocks returns all blocks from the chain.
 func (c *Client) ListBlocks() ([]block.Block, error) {
 	var blocks []block.Block
@@ -141,20 +289,60 @@ func (c *Client) ListBlocks() ([]block.Block, error) {
 	return blocks, nil
 }
 
+// SaveMempool dumps the node's mempool to disk and returns the path of the file.
+func (c *Client) SaveMempool() (string, error) {
+	var path string
+	if err := c.client.Call("Node.SaveMempool", struct{}{}, &path); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
 // SendPing sends a signal request to another node.
 func (c *Client) SendPing() error {
 	var reply struct{}
 	return c.client.Call("Node.SendPing", struct{}{}, &reply)
 }
 
-// SendTx sends sends a transaction to another node and returns the transaction id.
+// SendTx creates a transaction, adds it to the node's mempool and returns its id.
+//
+// If the node rejects the transaction, the error returned is a mempool.RuleError.
 func (c *Client) SendTx(params node.SendTxParams) ([]byte, error) {
-	var reply []byte
+	var reply node.SendTxResponse
 	if err := c.client.Call("Node.SendTx", params, &reply); err != nil {
 		return nil, err
 	}
 
-	return reply, nil
+	if reply.Reject != nil {
+		return reply.TxID, *reply.Reject
+	}
+
+	return reply.TxID, nil
+}
+
+// SetBan adds or removes an address from the node's ban list.
+func (c *Client) SetBan(params node.SetBanParams) error {
+	var reply struct{}
+	return c.client.Call("Node.SetBan", params, &reply)
+}
+
+// SetCoinbaseAddress sets the address where the node's mining rewards are sent.
+func (c *Client) SetCoinbaseAddress(address string) error {
+	var reply struct{}
+	return c.client.Call("Node.SetCoinbaseAddress", address, &reply)
+}
+
+// SetGenerate starts or stops the node's miner.
+func (c *Client) SetGenerate(generate bool, threads int) error {
+	var reply struct{}
+	return c.client.Call("Node.SetGenerate", node.SetGenerateParams{Generate: generate, Threads: threads}, &reply)
+}
+
+// SubmitBlock sends a solved block to the node so it's added to the chain and relayed.
+func (c *Client) SubmitBlock(b block.Block) error {
+	var reply struct{}
+	return c.client.Call("Node.SubmitBlock", b, &reply)
 }
 
 // Stop stops the running node.
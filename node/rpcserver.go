@@ -1,13 +1,23 @@
 package node
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
 	"net"
 	"net/rpc"
 	"os"
+	"sort"
+	"time"
 
 	"github.com/GGP1/btcs/block"
+	"github.com/GGP1/btcs/chaincfg"
 	"github.com/GGP1/btcs/encoding/base58"
 	"github.com/GGP1/btcs/logger"
+	"github.com/GGP1/btcs/mempool"
+	"github.com/GGP1/btcs/mining"
+	"github.com/GGP1/btcs/mining/stratum"
 	"github.com/GGP1/btcs/tx"
 	"github.com/GGP1/btcs/tx/utxo"
 	"github.com/GGP1/btcs/wallet"
@@ -22,12 +32,183 @@ type GetTransactionResponse struct {
 	Block block.Block
 }
 
+// MempoolEntry contains the details of a transaction in the mempool.
+type MempoolEntry struct {
+	TxID string
+	// Unix time at which the transaction entered the pool
+	Time int64
+	// Chain height when the transaction entered the pool
+	Height int32
+	// Size in bytes
+	Size int
+	// Represented in satoshis
+	Fee int
+	// Satoshis per byte
+	FeeRate float64
+	// Number of in-pool ancestors, including the transaction itself. Transactions
+	// spending unconfirmed outputs are not accepted, so it is always 1 for now
+	AncestorCount int
+	// Size in bytes of the in-pool ancestors, including the transaction itself
+	AncestorSize int
+	// Number of in-pool descendants, including the transaction itself. Always 1
+	// for now, like AncestorCount
+	DescendantCount int
+	// Size in bytes of the in-pool descendants, including the transaction itself
+	DescendantSize int
+}
+
+// MempoolInfo contains the state of the mempool.
+type MempoolInfo struct {
+	mempool.Info
+	Expiry time.Duration
+	// Minimum fee rate (sat/byte) for transactions to be accepted
+	MinRelayFeeRate float64
+}
+
+// fallbackFeeRate is the fee rate (sat/byte) used when there is not enough data to estimate one.
+const fallbackFeeRate = mempool.DefaultMinRelayFeeRate
+
+// EstimateFeeParams contains the parameters used for the EstimateSmartFee rpc call.
+type EstimateFeeParams struct {
+	// Number of blocks the transaction should confirm within
+	ConfTarget int
+	// Probability of confirming within ConfTarget blocks, between 0 and 1
+	Confidence float64
+}
+
+// EstimateFeeResponse is the structure of the EstimateSmartFee rpc call response.
+type EstimateFeeResponse struct {
+	// Satoshis per byte
+	FeeRate float64
+	// Number of blocks the estimate is valid for, it may be higher than the target
+	// requested if there wasn't enough data
+	Blocks int
+}
+
+// GenerateParams contains the parameters used for the Generate rpc call.
+type GenerateParams struct {
+	NumBlocks int
+	// Address where the rewards are sent, if it's empty a new address of the node's
+	// account is used
+	Address string
+}
+
+// MiningInfo contains the state of the node's miner and the block being mined.
+type MiningInfo struct {
+	mining.ControllerInfo
+	// Height of the chain tip
+	Height int32
+	// Bits and Target of the next block
+	Bits   uint32
+	Target *big.Int
+	// Number of transactions included in the next block template, excluding the coinbase
+	TemplateTxs int
+	// Number of transactions in the mempool
+	PooledTxs int
+}
+
+// BlockchainInfo contains the state of the chain and the progress of its download.
+type BlockchainInfo struct {
+	SyncInfo
+	// Chain is the name of the network
+	Chain string
+	// Hash and Height of the chain tip
+	BestBlockHash []byte
+	Blocks        int32
+	Difficulty    float64
+	MedianTime    int64
+	// VerificationProgress is the fraction of the headers whose blocks were connected
+	VerificationProgress float64
+	// InitialBlockDownload is true while there are headers whose blocks are missing
+	InitialBlockDownload bool
+}
+
+// DeploymentInfo contains the state of the version bits deployments.
+type DeploymentInfo struct {
+	// Hash and Height of the chain tip, the states are the ones of the following block
+	Hash        []byte
+	Height      int32
+	Deployments []block.DeploymentStatus
+}
+
+// NetworkInfo contains the node's peer-to-peer state.
+type NetworkInfo struct {
+	ProtocolVersion int32
+	UserAgent       string
+	Services        ServiceFlag
+	// Number of inbound and outbound connections
+	Inbound  int
+	Outbound int
+	// MinRelayFeeRate is the minimum fee rate (sat/byte) of the transactions relayed
+	MinRelayFeeRate float64
+	// CompactBlocks contains the reconstruction results of the compact blocks received
+	CompactBlocks CompactBlockStats
+}
+
+// PeerInfo contains the details of a connected peer.
+type PeerInfo struct {
+	// Addr is the address the connection was established with
+	Addr string
+	// ListenAddr is the address where the peer accepts connections
+	ListenAddr string
+	Inbound    bool
+	// Unix time at which the connection was established
+	ConnTime int64
+	// ProtocolVersion is the version negotiated during the handshake, zero if it
+	// isn't complete
+	ProtocolVersion int32
+	Services        ServiceFlag
+	UserAgent       string
+	// StartHeight is the height of the peer's chain when the connection was established
+	StartHeight int32
+	// BestHeight is the height of the last block the peer is known to have
+	BestHeight int32
+	// BanScore is the sum of the peer's misbehavior scores, it's banned when it reaches 100
+	BanScore int
+	// FeeFilter is the minimum fee rate (sat/byte) of the transactions announced to the peer
+	FeeFilter float64
+	// CompactBlocks is true if the peer supports compact blocks and HighBandwidth if it
+	// wants new blocks to be announced with them
+	CompactBlocks bool
+	HighBandwidth bool
+}
+
+// SetBanParams contains the parameters used for the SetBan rpc call.
+type SetBanParams struct {
+	// Address is an IP address, the port is ignored
+	Address string
+	// Remove lifts the ban instead of adding it
+	Remove bool
+	// Duration of the ban, DefaultBanDuration if zero
+	Duration time.Duration
+}
+
+// SetGenerateParams contains the parameters used for the SetGenerate rpc call.
+type SetGenerateParams struct {
+	Generate bool
+	// Number of goroutines mining, if it's lower than one the number of logical CPUs is used
+	Threads int
+}
+
 // SendTxParams contains the parameters used for the SendTx rpc call.
 type SendTxParams struct {
 	AccountName string
 	To          string
 	Amount      int
-	Fee         int
+	// Fee is the absolute fee in satoshis, if it's zero it's calculated from FeeRate
+	Fee int
+	// FeeRate is the fee rate in satoshis per byte, if it's zero it's estimated
+	// using ConfTarget
+	FeeRate float64
+	// ConfTarget is the number of blocks the transaction should confirm within
+	ConfTarget int
+}
+
+// SendTxResponse is the structure of the SendTx rpc call response.
+type SendTxResponse struct {
+	TxID []byte
+	// Reject is the reason the transaction was not accepted, nil if it was
+	Reject *mempool.RuleError
 }
 
 // RunRPCServer starts the node's rpc server.
@@ -53,6 +234,9 @@ func (n *Node) RunRPCServer() (net.Listener, error) {
 			default:
 				conn, err := ln.Accept()
 				if err != nil {
+					if errors.Is(err, net.ErrClosed) {
+						return
+					}
 					logger.Error("RPC: ", err)
 					continue
 				}
@@ -65,18 +249,56 @@ func (n *Node) RunRPCServer() (net.Listener, error) {
 	return ln, nil
 }
 
-// AddNode adds a node to the peer list.
+// AddNode connects to a node and returns the number of peers.
 func (n *Node) AddNode(address string, reply *int) error {
-	*reply = n.peers.Add(address)
-	return n.sendVersion(address)
+	n.addrManager.Add([]netAddress{{Addr: address, Timestamp: time.Now().Unix()}}, n.hostAddress)
+	n.addrManager.Attempt(address)
+	if err := n.connect(address); err != nil {
+		n.addrManager.Failed(address)
+		return err
+	}
+	*reply = n.peers.Count()
+	return nil
 }
 
-// DisconnectNode removes a node from the peer list.
+// DisconnectNode closes the connection with a node and returns the number of peers remaining.
 func (n *Node) DisconnectNode(address string, reply *int) error {
-	*reply = n.peers.Remove(address)
+	p, ok := n.peers.Get(address)
+	if !ok {
+		return fmt.Errorf("peer %q is not connected", address)
+	}
+
+	p.disconnect()
+	*reply = n.peers.Remove(p)
 	return nil
 }
 
+// Generate mines blocks immediately and returns their hashes. It's only available on the
+// regression test network.
+func (n *Node) Generate(params GenerateParams, reply *[][]byte) error {
+	if !chaincfg.ActiveParams.MineBlocksOnDemand {
+		return fmt.Errorf("blocks can't be generated on demand on %s, use the regression test network (startnode --regtest)", chaincfg.ActiveParams.Name)
+	}
+	if params.NumBlocks < 1 {
+		return errors.New("the number of blocks must be higher than zero")
+	}
+
+	coinbaseAddr := params.Address
+	if coinbaseAddr == "" {
+		addr, err := mining.CoinbaseAddress(n.accountName)
+		if err != nil {
+			return err
+		}
+		coinbaseAddr = addr
+	} else if err := wallet.ValidateAddress(coinbaseAddr); err != nil {
+		return err
+	}
+
+	hashes, err := n.generate(params.NumBlocks, coinbaseAddr)
+	*reply = hashes
+	return err
+}
+
 // GetRawMempool returns the node's mempool transaction ids.
 func (n *Node) GetRawMempool(_ struct{}, reply *[]string) error {
 	txIDs := make([]string, 0, n.txPool.Count())
@@ -92,6 +314,82 @@ func (n *Node) GetRawMempool(_ struct{}, reply *[]string) error {
 	return nil
 }
 
+// GetRawMempoolVerbose returns the details of each transaction in the node's mempool,
+// sorted by the time they entered it.
+func (n *Node) GetRawMempoolVerbose(_ struct{}, reply *[]MempoolEntry) error {
+	entries := n.txPool.Entries()
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Time < entries[j].Time
+	})
+
+	mempoolEntries := make([]MempoolEntry, 0, len(entries))
+	for _, entry := range entries {
+		mempoolEntries = append(mempoolEntries, n.mempoolEntry(entry))
+	}
+
+	*reply = mempoolEntries
+	return nil
+}
+
+// GetMempoolEntry returns the details of a transaction in the mempool.
+func (n *Node) GetMempoolEntry(txID []byte, reply *MempoolEntry) error {
+	entry, ok := n.txPool.Entry(txID)
+	if !ok {
+		return errors.New("transaction not in mempool")
+	}
+
+	*reply = n.mempoolEntry(entry)
+	return nil
+}
+
+// GetMempoolInfo returns the state of the mempool.
+func (n *Node) GetMempoolInfo(_ struct{}, reply *MempoolInfo) error {
+	info, err := n.txPool.Info()
+	if err != nil {
+		return err
+	}
+
+	*reply = MempoolInfo{
+		Info:            info,
+		Expiry:          n.mempoolExpiry,
+		MinRelayFeeRate: n.minRelayFeeRate,
+	}
+	return nil
+}
+
+// GetMiningInfo returns the state of the node's miner.
+func (n *Node) GetMiningInfo(_ struct{}, reply *MiningInfo) error {
+	template, err := n.blockTemplate()
+	if err != nil {
+		return err
+	}
+
+	*reply = MiningInfo{
+		ControllerInfo: n.miningController.Info(),
+		Height:         template.Height - 1,
+		Bits:           template.Bits,
+		Target:         template.Target,
+		TemplateTxs:    len(template.Transactions),
+		PooledTxs:      n.txPool.Count(),
+	}
+	return nil
+}
+
+// GetNetworkInfo returns the node's peer-to-peer state.
+func (n *Node) GetNetworkInfo(_ struct{}, reply *NetworkInfo) error {
+	outbound := n.peers.OutboundCount()
+	*reply = NetworkInfo{
+		ProtocolVersion: protocolVersion,
+		UserAgent:       userAgent,
+		Services:        services,
+		Inbound:         n.peers.Count() - outbound,
+		Outbound:        outbound,
+		MinRelayFeeRate: n.minRelayFeeRate,
+		CompactBlocks:   n.compactBlockStats(),
+	}
+	return nil
+}
+
 // GetBestHeight returns the node's blockchain best height.
 func (n *Node) GetBestHeight(_ struct{}, reply *int32) error {
 	bestHeight, err := n.blockchain.BestHeight()
@@ -112,6 +410,47 @@ func (n *Node) GetBlock(hash []byte, reply *block.Block) error {
 	return nil
 }
 
+// GetBlockchainInfo returns the state of the chain and the progress of its download.
+func (n *Node) GetBlockchainInfo(_ struct{}, reply *BlockchainInfo) error {
+	tip, err := n.blockchain.LastBlock()
+	if err != nil {
+		return err
+	}
+
+	syncInfo := n.syncInfo()
+	progress := 1.0
+	if syncInfo.Headers > 0 && tip.Height < syncInfo.Headers {
+		progress = float64(tip.Height) / float64(syncInfo.Headers)
+	}
+
+	*reply = BlockchainInfo{
+		SyncInfo:             syncInfo,
+		Chain:                chaincfg.ActiveParams.Name,
+		BestBlockHash:        tip.Hash,
+		Blocks:               tip.Height,
+		Difficulty:           block.Difficulty(tip.Bits),
+		MedianTime:           block.MedianTimePast(tip.Height),
+		VerificationProgress: progress,
+		InitialBlockDownload: tip.Height < syncInfo.Headers,
+	}
+	return nil
+}
+
+// GetDeploymentInfo returns the state of the deployments for the block following the chain tip.
+func (n *Node) GetDeploymentInfo(_ struct{}, reply *DeploymentInfo) error {
+	tip, err := n.blockchain.LastBlock()
+	if err != nil {
+		return err
+	}
+
+	*reply = DeploymentInfo{
+		Hash:        tip.Hash,
+		Height:      tip.Height,
+		Deployments: block.DeploymentStatuses(tip.Height),
+	}
+	return nil
+}
+
 // GetLastBlock returns the last block (tip) of a chain.
 func (n *Node) GetLastBlock(_ struct{}, reply *block.Block) error {
 	block, err := n.blockchain.LastBlock()
@@ -122,9 +461,39 @@ func (n *Node) GetLastBlock(_ struct{}, reply *block.Block) error {
 	return nil
 }
 
-// GetPeerInfo returns data about each connected node.
-func (n *Node) GetPeerInfo(_ struct{}, reply *[]string) error {
-	*reply = n.peers.List()
+// GetBlockTemplate returns the data needed to build and solve the next block.
+func (n *Node) GetBlockTemplate(_ struct{}, reply *mining.BlockTemplate) error {
+	template, err := n.blockTemplate()
+	if err != nil {
+		return err
+	}
+
+	*reply = *template
+	return nil
+}
+
+// GetPeerInfo returns data about each connected node, sorted by address.
+func (n *Node) GetPeerInfo(_ struct{}, reply *[]PeerInfo) error {
+	peersInfo := make([]PeerInfo, 0, n.peers.Count())
+	n.peers.ForEach(func(p *peer) error {
+		peersInfo = append(peersInfo, p.info())
+		return nil
+	})
+	sort.Slice(peersInfo, func(i, j int) bool {
+		return peersInfo[i].Addr < peersInfo[j].Addr
+	})
+
+	*reply = peersInfo
+	return nil
+}
+
+// GetPoolWorkers returns the shares submitted by each worker of the stratum server.
+func (n *Node) GetPoolWorkers(_ struct{}, reply *[]stratum.WorkerStats) error {
+	if n.stratum == nil {
+		return errors.New("stratum server is not running")
+	}
+
+	*reply = n.stratum.Workers()
 	return nil
 }
 
@@ -198,41 +567,249 @@ func (n *Node) ListBlocks(_ struct{}, reply *[]block.Block) error {
 	return nil
 }
 
+// ClearBanned removes all the bans.
+func (n *Node) ClearBanned(_ struct{}, reply *struct{}) error {
+	n.banList.Clear()
+	return n.banList.Save(BanListPath)
+}
+
+// ListBanned returns the banned addresses.
+func (n *Node) ListBanned(_ struct{}, reply *[]BanEntry) error {
+	*reply = n.banList.List()
+	return nil
+}
+
+// ImportMempool adds the transactions stored in a mempool dump to the pool,
+// returning the number of transactions accepted.
+//
+// The file must be inside the node's data directory, relative paths are resolved from it.
+func (n *Node) ImportMempool(path string, reply *int) error {
+	dataDir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	path, err = dataDirPath(dataDir, path)
+	if err != nil {
+		return err
+	}
+
+	added, err := n.importMempool(path)
+	if err != nil {
+		return err
+	}
+
+	*reply = added
+	return nil
+}
+
+// SaveMempool dumps the mempool to disk and returns the path of the file.
+func (n *Node) SaveMempool(_ struct{}, reply *string) error {
+	if err := n.txPool.Save(mempool.DefaultPath); err != nil {
+		return err
+	}
+
+	*reply = mempool.DefaultPath
+	return nil
+}
+
 // SendPing sends a ping request to all the other peers.
 func (n *Node) SendPing(_ struct{}, reply *struct{}) error {
-	return n.peers.ForEach(func(addr string) error {
-		return n.sendPing(addr)
+	return n.peers.ForEach(func(p *peer) error {
+		return n.sendPing(p)
 	})
 }
 
-// SendTx sends sends a transaction to another node and returns the transaction id.
-func (n *Node) SendTx(params SendTxParams, reply *[]byte) error {
+// SendTx adds a transaction to the mempool and announces it to the other nodes.
+//
+// If no fee is specified, it's estimated so the transaction confirms within ConfTarget blocks.
+//
+// The transaction is validated synchronously, if it's rejected the response contains the reason.
+func (n *Node) SendTx(params SendTxParams, reply *SendTxResponse) error {
 	wallet, err := wallet.Load()
 	if err != nil {
 		return err
 	}
 	defer wallet.Save()
 
+	fee := params.Fee
+	if fee == 0 {
+		feeRate := params.FeeRate
+		if feeRate == 0 {
+			feeRate, err = n.estimateFeeRate(params.ConfTarget)
+			if err != nil {
+				return err
+			}
+		}
+
+		fee, err = n.estimateTxFee(wallet.Account(params.AccountName), params.To, params.Amount, feeRate)
+		if err != nil {
+			return err
+		}
+	}
+
 	utxoSet := &utxo.Set{Blockchain: n.blockchain}
 	tx, err := utxo.NewTx(
 		wallet.Account(params.AccountName),
 		params.To,
 		params.Amount,
-		params.Fee,
+		fee,
 		utxoSet,
 	)
 	if err != nil {
 		return err
 	}
 
-	if err := n.sendTx("", tx); err != nil {
+	entry, err := n.AcceptToMemoryPool(*tx)
+	if err != nil {
+		var ruleErr mempool.RuleError
+		if !errors.As(err, &ruleErr) {
+			return err
+		}
+
+		*reply = SendTxResponse{TxID: tx.ID, Reject: &ruleErr}
+		return nil
+	}
+
+	if err := n.relayTx(entry); err != nil {
+		return err
+	}
+
+	*reply = SendTxResponse{TxID: tx.ID}
+	return nil
+}
+
+// estimateFeeRate returns the fee rate (sat/byte) needed for a transaction to confirm
+// within confTarget blocks, which is never lower than the minimum relay fee rate.
+func (n *Node) estimateFeeRate(confTarget int) (float64, error) {
+	feeRate, _, err := n.feeEstimator.EstimateSmartFeeRate(confTarget, mempool.DefaultConfidence)
+	if err != nil {
+		if err != mempool.ErrInsufficientData {
+			return 0, err
+		}
+		logger.Debugf("Not enough data to estimate the fee, using %.2f SAT/byte", fallbackFeeRate)
+		feeRate = fallbackFeeRate
+	}
+
+	return math.Max(feeRate, n.minRelayFeeRate), nil
+}
+
+// estimateTxFee returns the fee a transaction paying at the fee rate (sat/byte) provided
+// should have. The fee depends on the transaction size, which depends on the inputs
+// selected to pay for the amount and the fee.
+func (n *Node) estimateTxFee(account *wallet.Account, to string, amount int, feeRate float64) (int, error) {
+	utxoSet := &utxo.Set{Blockchain: n.blockchain}
+	return feeForSize(feeRate, func(fee int) (int, error) {
+		return utxo.EstimateTxSize(account, to, amount, fee, utxoSet)
+	})
+}
+
+// feeForSize returns the lowest fee that pays the fee rate (sat/byte) provided for the size
+// of the transaction built to pay it, which txSize returns.
+//
+// Paying a higher fee may require more inputs, so the fee is recalculated until the inputs
+// selected don't change the size anymore.
+func feeForSize(feeRate float64, txSize func(fee int) (int, error)) (int, error) {
+	fee := 0
+	for {
+		size, err := txSize(fee)
+		if err != nil {
+			return 0, err
+		}
+
+		requiredFee := int(math.Ceil(feeRate * float64(size)))
+		if requiredFee <= fee {
+			return fee, nil
+		}
+		fee = requiredFee
+	}
+}
+
+// EstimateSmartFee returns the fee rate needed for a transaction to confirm within
+// a number of blocks.
+func (n *Node) EstimateSmartFee(params EstimateFeeParams, reply *EstimateFeeResponse) error {
+	confidence := params.Confidence
+	if confidence == 0 {
+		confidence = mempool.DefaultConfidence
+	}
+
+	feeRate, blocks, err := n.feeEstimator.EstimateSmartFeeRate(params.ConfTarget, confidence)
+	if err != nil {
+		return err
+	}
+
+	*reply = EstimateFeeResponse{
+		FeeRate: feeRate,
+		Blocks:  blocks,
+	}
+	return nil
+}
+
+// SetBan adds or removes an address from the ban list, the connections with banned
+// addresses are closed.
+func (n *Node) SetBan(params SetBanParams, reply *struct{}) error {
+	address, err := banAddress(params.Address)
+	if err != nil {
+		return err
+	}
+
+	if params.Remove {
+		if !n.banList.Unban(address) {
+			return fmt.Errorf("address %s is not banned", address)
+		}
+		return n.banList.Save(BanListPath)
+	}
+
+	duration := params.Duration
+	if duration <= 0 {
+		duration = DefaultBanDuration
+	}
+	n.banList.Ban(address, duration, "manually added")
+	n.peers.ForEach(func(p *peer) error {
+		if p.host == address {
+			p.disconnect()
+		}
+		return nil
+	})
+
+	return n.banList.Save(BanListPath)
+}
+
+// SetCoinbaseAddress sets the address where the mining rewards are sent.
+func (n *Node) SetCoinbaseAddress(address string, reply *struct{}) error {
+	if err := wallet.ValidateAddress(address); err != nil {
 		return err
 	}
 
-	*reply = tx.ID
+	n.miningController.SetCoinbaseAddress(address)
 	return nil
 }
 
+// SetGenerate starts or stops mining. If no coinbase address was set, a new address
+// of the node's account is used.
+func (n *Node) SetGenerate(params SetGenerateParams, reply *struct{}) error {
+	if !params.Generate {
+		n.miningController.Stop()
+		return nil
+	}
+
+	if n.miningController.CoinbaseAddress() == "" {
+		coinbaseAddr, err := mining.CoinbaseAddress(n.accountName)
+		if err != nil {
+			return err
+		}
+		n.miningController.SetCoinbaseAddress(coinbaseAddr)
+	}
+
+	return n.miningController.Start(params.Threads)
+}
+
+// SubmitBlock validates a block solved outside the node, adds it to the chain and
+// announces it to the peers.
+func (n *Node) SubmitBlock(b block.Block, reply *struct{}) error {
+	return n.submitBlock(b)
+}
+
 // Stop stops the running node.
 func (n *Node) Stop(_ struct{}, reply *struct{}) error {
 	n.interrupt <- os.Interrupt
@@ -0,0 +1,46 @@
+package node
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/GGP1/btcs/chaincfg"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeeForSize(t *testing.T) {
+	// Each input adds 150 bytes and holds 1000 SAT, 1500 SAT are being sent
+	txSize := func(fee int) (int, error) {
+		inputs := (1500 + fee + 999) / 1000
+		return 100 + inputs*150, nil
+	}
+
+	// A fee of 400 SAT fits in the second input but 1000 SAT require a third one
+	fee, err := feeForSize(1, txSize)
+	assert.NoError(t, err)
+	assert.Equal(t, 400, fee)
+
+	fee, err = feeForSize(2.5, txSize)
+	assert.NoError(t, err)
+	assert.Equal(t, 1375, fee)
+	size, _ := txSize(fee)
+	assert.GreaterOrEqual(t, float64(fee), 2.5*float64(size))
+
+	_, err = feeForSize(1, func(int) (int, error) { return 0, errors.New("not enough funds") })
+	assert.Error(t, err)
+}
+
+func TestGenerateRegtestOnly(t *testing.T) {
+	n := newTestNode(t)
+	_, addr := newTestAccount(t)
+
+	var hashes [][]byte
+	err := n.Generate(GenerateParams{NumBlocks: 1, Address: addr}, &hashes)
+	assert.NoError(t, err)
+	assert.Len(t, hashes, 1)
+
+	chaincfg.ActiveParams = &chaincfg.MainNetParams
+	err = n.Generate(GenerateParams{NumBlocks: 1, Address: addr}, &hashes)
+	assert.ErrorContains(t, err, "can't be generated on demand on mainnet")
+}
@@ -0,0 +1,697 @@
+package node
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/GGP1/btcs/block"
+	"github.com/GGP1/btcs/logger"
+)
+
+const (
+	// maxBlocksInFlightPerPeer is the number of blocks requested from a peer at the same time.
+	maxBlocksInFlightPerPeer = 16
+	// blockDownloadWindow is how far past the chain tip blocks are requested, the ones
+	// received are kept in memory until their ancestors are connected.
+	blockDownloadWindow = 1024
+	// blockRequestTimeout is the time a peer has to deliver a block before it's requested
+	// from another one.
+	blockRequestTimeout = 30 * time.Second
+	// headersTimeout is the time the sync peer has to answer a getheaders message before
+	// another peer is picked.
+	headersTimeout = time.Minute
+	// syncInterval is how often the stalled requests are checked.
+	syncInterval = 5 * time.Second
+)
+
+// blockRequest is a block requested to a peer.
+type blockRequest struct {
+	peer *peer
+	time time.Time
+}
+
+// downloadedBlock is a block received before its ancestors were connected.
+type downloadedBlock struct {
+	block block.Block
+	peer  *peer
+}
+
+// syncManager tracks the download of the chain. Headers are downloaded first from the
+// peer with the best chain, then the blocks are requested from all the peers, up to
+// blockDownloadWindow blocks past the tip, and connected in order.
+type syncManager struct {
+	mu      *sync.Mutex
+	headers *block.HeaderChain
+	// syncPeer is the peer the headers are being downloaded from
+	syncPeer         *peer
+	headersRequested time.Time
+	// branch is a competing branch of the header chain being downloaded from the sync
+	// peer, it replaces the header chain once it has more work
+	branch *block.HeaderChain
+	// forked contains the peers whose chain forks from ours below the chain tip or with
+	// less work, headers are not downloaded from them
+	forked map[*peer]struct{}
+	// inFlight contains the blocks requested, keyed by hash
+	inFlight map[string]blockRequest
+	// stalled contains the peers that didn't deliver a block in time, keyed by hash, so
+	// it's requested from another one
+	stalled map[string]*peer
+	// downloaded contains the blocks of the header chain waiting for their ancestors,
+	// keyed by height
+	downloaded map[int32]downloadedBlock
+	// orphans contains the blocks received whose parent is unknown
+	orphans *orphanPool
+	// announcements contains the new chain tips to relay once the lock is released, along
+	// with the peers that delivered them
+	announcements []downloadedBlock
+}
+
+func newSyncManager() *syncManager {
+	return &syncManager{
+		mu:         &sync.Mutex{},
+		headers:    block.NewHeaderChain(),
+		forked:     make(map[*peer]struct{}),
+		inFlight:   make(map[string]blockRequest),
+		stalled:    make(map[string]*peer),
+		downloaded: make(map[int32]downloadedBlock),
+		orphans:    newOrphanPool(),
+	}
+}
+
+// SyncInfo contains the progress of the chain download.
+type SyncInfo struct {
+	// Headers is the height of the last validated header
+	Headers int32
+	// BlocksInFlight is the number of blocks requested and not received yet
+	BlocksInFlight int
+	// Orphans is the number of blocks received whose parent is unknown
+	Orphans int
+	// SyncPeer is the address of the peer the headers are being downloaded from
+	SyncPeer string
+}
+
+// syncInfo returns the progress of the chain download.
+func (n *Node) syncInfo() SyncInfo {
+	s := n.syncManager
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, headersHeight := s.headers.Tip()
+	info := SyncInfo{
+		Headers:        headersHeight,
+		BlocksInFlight: len(s.inFlight),
+		Orphans:        s.orphans.Count(),
+	}
+	if s.syncPeer != nil {
+		info.SyncPeer = s.syncPeer.addr
+	}
+	return info
+}
+
+// headersLocator returns a block locator from the tip of the header chain.
+func (n *Node) headersLocator() [][]byte {
+	n.syncManager.mu.Lock()
+	defer n.syncManager.mu.Unlock()
+	return n.syncManager.headers.Locator()
+}
+
+// unknownBlocks returns the hashes that are not in the chain or the header chain.
+func (n *Node) unknownBlocks(hashes [][]byte) [][]byte {
+	n.syncManager.mu.Lock()
+	defer n.syncManager.mu.Unlock()
+
+	unknown := make([][]byte, 0, len(hashes))
+	for _, hash := range hashes {
+		if !n.syncManager.headers.Contains(hash) {
+			unknown = append(unknown, hash)
+		}
+	}
+	return unknown
+}
+
+// syncLoop periodically re-requests the blocks and headers that weren't delivered in
+// time. It should be called inside a goroutine.
+func (n *Node) syncLoop() {
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.quit:
+			return
+		case <-ticker.C:
+		}
+
+		n.checkStalled(time.Now())
+	}
+}
+
+// checkStalled re-requests the blocks and headers that weren't delivered in time, the
+// blocks from another peer if possible.
+func (n *Node) checkStalled(now time.Time) {
+	s := n.syncManager
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, req := range s.inFlight {
+		if now.Sub(req.time) < blockRequestTimeout {
+			continue
+		}
+		logger.Debugf("Peer %s did not deliver block %x in time", req.peer.addr, hash)
+		delete(s.inFlight, hash)
+		s.stalled[hash] = req.peer
+	}
+	if s.syncPeer != nil && now.Sub(s.headersRequested) > headersTimeout {
+		logger.Debugf("Peer %s did not deliver the headers in time", s.syncPeer.addr)
+		s.syncPeer = nil
+	}
+	n.startHeadersSync()
+	n.requestBlocks()
+}
+
+// syncPeerConnected starts downloading the headers from the peer if its chain is longer
+// than ours and there is no sync peer.
+func (n *Node) syncPeerConnected() {
+	n.syncManager.mu.Lock()
+	defer n.syncManager.mu.Unlock()
+
+	n.startHeadersSync()
+	n.requestBlocks()
+}
+
+// syncPeerDisconnected releases the blocks requested to the peer so they are requested
+// from other ones.
+func (n *Node) syncPeerDisconnected(p *peer) {
+	s := n.syncManager
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, req := range s.inFlight {
+		if req.peer == p {
+			delete(s.inFlight, hash)
+		}
+	}
+	for hash, stalledPeer := range s.stalled {
+		if stalledPeer == p {
+			delete(s.stalled, hash)
+		}
+	}
+	if s.syncPeer == p {
+		s.syncPeer = nil
+	}
+	delete(s.forked, p)
+
+	n.startHeadersSync()
+	n.requestBlocks()
+}
+
+// startHeadersSync picks the peer with the longest chain as the sync peer and requests
+// its headers, if there is no sync peer and its chain is longer than our header chain.
+// Peers known to be on a forked chain are skipped.
+//
+// It must be called with the sync manager lock held.
+func (n *Node) startHeadersSync() {
+	s := n.syncManager
+	if s.syncPeer != nil {
+		return
+	}
+
+	_, headersHeight := s.headers.Tip()
+	var best *peer
+	bestHeight := headersHeight
+	n.peers.ForEach(func(p *peer) error {
+		if !p.handshakeComplete() || p.info().Services&SFNodeNetwork == 0 {
+			return nil
+		}
+		if _, ok := s.forked[p]; ok {
+			return nil
+		}
+		if height := p.height(); height > bestHeight {
+			best, bestHeight = p, height
+		}
+		return nil
+	})
+	if best == nil {
+		return
+	}
+
+	logger.Debugf("Downloading headers from %s, height %d", best.addr, bestHeight)
+	s.syncPeer = best
+	s.branch = nil
+	s.headersRequested = time.Now()
+	if err := n.sendGetHeaders(best, s.headers.Locator(), nil); err != nil {
+		logger.Debugf("Requesting headers from %s: %v", best.addr, err)
+		s.syncPeer = nil
+	}
+}
+
+// requestBlocks requests the blocks of the header chain that weren't downloaded or
+// requested yet, up to blockDownloadWindow blocks past the tip. Each block is requested
+// from the peer with less blocks in flight, preferring the ones that didn't stall it.
+//
+// It must be called with the sync manager lock held.
+func (n *Node) requestBlocks() {
+	s := n.syncManager
+	_, bestHeight := n.blockchain.Tip()
+	_, headersHeight := s.headers.Tip()
+	if headersHeight <= bestHeight {
+		return
+	}
+
+	inFlight := make(map[*peer]int)
+	candidates := make([]*peer, 0)
+	n.peers.ForEach(func(p *peer) error {
+		if p.handshakeComplete() && p.info().Services&SFNodeNetwork != 0 {
+			candidates = append(candidates, p)
+			inFlight[p] = 0
+		}
+		return nil
+	})
+	for _, req := range s.inFlight {
+		if _, ok := inFlight[req.peer]; ok {
+			inFlight[req.peer]++
+		}
+	}
+
+	maxHeight := bestHeight + blockDownloadWindow
+	if headersHeight < maxHeight {
+		maxHeight = headersHeight
+	}
+	for height := bestHeight + 1; height <= maxHeight; height++ {
+		hash := s.headers.Hash(height)
+		if _, ok := s.downloaded[height]; ok {
+			continue
+		}
+		if _, ok := s.inFlight[string(hash)]; ok {
+			continue
+		}
+
+		var target *peer
+		for _, p := range candidates {
+			if inFlight[p] >= maxBlocksInFlightPerPeer || p.height() < height {
+				continue
+			}
+			if target == nil || betterDownloadPeer(p, target, inFlight, s.stalled[string(hash)]) {
+				target = p
+			}
+		}
+		if target == nil {
+			continue
+		}
+
+		// The new tip is requested as a compact block, most of its transactions should be
+		// in the pool already
+		kind := typeBlock
+		if height == headersHeight && height == bestHeight+1 && target.supportsCompactBlocks() {
+			kind = typeCompactBlock
+		}
+		if err := n.sendGetData(target, kind, hash); err != nil {
+			logger.Debugf("Requesting block %x from %s: %v", hash, target.addr, err)
+			continue
+		}
+		s.inFlight[string(hash)] = blockRequest{peer: target, time: time.Now()}
+		inFlight[target]++
+	}
+}
+
+// betterDownloadPeer returns whether p is a better peer to request a block from than
+// current, the one that stalled the block is the last option.
+func betterDownloadPeer(p, current *peer, inFlight map[*peer]int, stalled *peer) bool {
+	if (p == stalled) != (current == stalled) {
+		return current == stalled
+	}
+	return inFlight[p] < inFlight[current]
+}
+
+// processHeaders validates the headers received from the peer and adds them to the header
+// chain, then it requests the next headers or the blocks.
+//
+// Headers forking the header chain are added to a copy of it, which replaces the header
+// chain if it has more work. If the fork is below the chain tip, the blocks above it are
+// disconnected then. Headers are not downloaded anymore from the peers whose chain forks
+// below the latest checkpoint, has less work or is invalid.
+func (n *Node) processHeaders(p *peer, headers []block.Header) error {
+	s := n.syncManager
+	defer n.announceBlocks()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chain := s.headers
+	if p == s.syncPeer && s.branch != nil {
+		chain = s.branch
+	}
+
+	var lastHeight int32 = -1
+	var prevHash []byte
+	for i, header := range headers {
+		b := block.Block{Header: &header}
+		hash, err := b.PowHash()
+		if err != nil {
+			return err
+		}
+		p.addKnownInventory(hash)
+		if i > 0 && !bytes.Equal(header.PrevBlockHash, prevHash) {
+			return misbehavior(scoreMalformedPayload, fmt.Errorf("%w: %x follows %x, not the previous header", block.ErrHeaderDoesNotConnect, hash, header.PrevBlockHash))
+		}
+		prevHash = hash
+		if height, ok := chain.Height(hash); ok {
+			lastHeight = height
+			continue
+		}
+
+		if tipHash, _ := chain.Tip(); !bytes.Equal(header.PrevBlockHash, tipHash) {
+			forkHeight, ok := chain.Height(header.PrevBlockHash)
+			if !ok {
+				// We are missing the headers preceding the first one
+				return n.sendGetHeaders(p, chain.Locator(), nil)
+			}
+
+			fork, err := chain.Fork(forkHeight)
+			if err != nil {
+				logger.Debugf("Headers from %s fork the chain: %v", p.addr, err)
+				n.stopHeadersSync(p)
+				return nil
+			}
+			chain = fork
+		}
+
+		if _, err := chain.Add(header); err != nil {
+			if errors.Is(err, block.ErrInvalidHeader) {
+				n.stopHeadersSync(p)
+				return misbehavior(scoreInvalidBlock, err)
+			}
+			return err
+		}
+		_, lastHeight = chain.Tip()
+	}
+	if lastHeight >= 0 {
+		p.updateHeight(lastHeight)
+	}
+
+	if chain != s.headers {
+		forkHeight := chain.ForkHeight()
+		switch {
+		case chain.Work().Cmp(s.headers.WorkSince(forkHeight)) > 0:
+			_, height := chain.Tip()
+			logger.Infof("Switching to the headers branch of %s, height %d", p.addr, height)
+			if _, bestHeight := n.blockchain.Tip(); forkHeight < bestHeight {
+				if err := n.disconnectBlocks(forkHeight); err != nil {
+					return err
+				}
+			}
+			s.headers = chain
+			s.branch = nil
+			n.discardStaleBlocks()
+		case p == s.syncPeer:
+			// Keep downloading it, it may have more work
+			s.branch = chain
+		default:
+			logger.Debugf("Headers from %s fork the chain with less work, ignoring them", p.addr)
+		}
+	}
+
+	if p == s.syncPeer {
+		switch {
+		case len(headers) == block.MaxHeadersPerMsg:
+			locator := s.headers.Locator()
+			if s.branch != nil {
+				locator = s.branch.Locator()
+			}
+			s.headersRequested = time.Now()
+			if err := n.sendGetHeaders(p, locator, nil); err != nil {
+				return err
+			}
+		case s.branch != nil:
+			logger.Debugf("Headers from %s fork the chain with less work", p.addr)
+			n.stopHeadersSync(p)
+		default:
+			_, headersHeight := s.headers.Tip()
+			logger.Debugf("Headers synchronized with %s, height %d", p.addr, headersHeight)
+			s.syncPeer = nil
+			// Another peer may have a longer chain
+			n.startHeadersSync()
+		}
+	}
+
+	n.adoptOrphans()
+	n.connectBlocks()
+	n.requestBlocks()
+	return nil
+}
+
+// stopHeadersSync stops downloading headers from the peer, whose chain is not the one
+// we follow, and picks another sync peer.
+//
+// It must be called with the sync manager lock held.
+func (n *Node) stopHeadersSync(p *peer) {
+	s := n.syncManager
+	s.forked[p] = struct{}{}
+	if p != s.syncPeer {
+		return
+	}
+
+	s.syncPeer = nil
+	s.branch = nil
+	n.startHeadersSync()
+}
+
+// discardStaleBlocks removes the blocks downloaded or requested that are not part of the
+// header chain anymore.
+//
+// It must be called with the sync manager lock held.
+func (n *Node) discardStaleBlocks() {
+	s := n.syncManager
+	for height, downloaded := range s.downloaded {
+		if !bytes.Equal(s.headers.Hash(height), downloaded.block.Hash) {
+			delete(s.downloaded, height)
+		}
+	}
+	for hash := range s.inFlight {
+		if !s.headers.Contains([]byte(hash)) {
+			delete(s.inFlight, hash)
+		}
+	}
+	for hash := range s.stalled {
+		if !s.headers.Contains([]byte(hash)) {
+			delete(s.stalled, hash)
+		}
+	}
+}
+
+// processBlock stores a block received and connects it, along with the downloaded blocks
+// following it, once its ancestors are connected. Blocks whose parent is unknown are kept
+// in the orphan pool and their ancestors are requested from the peer.
+func (n *Node) processBlock(p *peer, b block.Block, size int) error {
+	s := n.syncManager
+	defer n.announceBlocks()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.inFlight, string(b.Hash))
+	delete(s.stalled, string(b.Hash))
+	if n.blockchain.HasBlock(b.Hash) || s.orphans.Contains(b.Hash) {
+		return nil
+	}
+
+	height, ok := s.headers.Height(b.Hash)
+	if !ok {
+		// Not part of the header chain, a new block announced by the peer
+		if _, err := s.headers.Add(*b.Header); err != nil {
+			switch {
+			case errors.Is(err, block.ErrHeaderDoesNotConnect):
+				if s.headers.Contains(b.PrevBlockHash) {
+					logger.Debugf("Block %x does not extend the chain tip, ignoring it", b.Hash)
+					return nil
+				}
+				return n.addOrphan(p, b, size)
+			case errors.Is(err, block.ErrInvalidHeader):
+				return misbehavior(scoreInvalidBlock, err)
+			default:
+				return err
+			}
+		}
+		_, height = s.headers.Tip()
+	}
+	if b.Height != height {
+		return misbehavior(scoreInvalidBlock, fmt.Errorf("block %x has height %d, expected %d", b.Hash, b.Height, height))
+	}
+	p.updateHeight(height)
+
+	_, bestHeight := n.blockchain.Tip()
+	if height > bestHeight+blockDownloadWindow {
+		// Not requested, it would be kept in memory for too long
+		return nil
+	}
+	s.downloaded[height] = downloadedBlock{block: b, peer: p}
+
+	n.connectBlocks()
+	n.requestBlocks()
+	return nil
+}
+
+// addOrphan stores a block whose parent is unknown and requests its missing ancestors'
+// headers from the peer.
+//
+// It must be called with the sync manager lock held.
+func (n *Node) addOrphan(p *peer, b block.Block, size int) error {
+	s := n.syncManager
+	if !s.orphans.Add(b, p, size) {
+		return nil
+	}
+
+	root := s.orphans.Root(b.Hash)
+	logger.Debugf("Orphan block %x (%d orphans), requesting the ancestors of %x from %s",
+		b.Hash, s.orphans.Count(), root, p.addr)
+	return n.sendGetHeaders(p, s.headers.Locator(), root)
+}
+
+// adoptOrphans moves the orphans whose headers were added to the header chain to the
+// downloaded blocks.
+//
+// It must be called with the sync manager lock held.
+func (n *Node) adoptOrphans() {
+	s := n.syncManager
+	_, bestHeight := n.blockchain.Tip()
+	s.orphans.Range(func(orphan *orphanBlock) {
+		height, ok := s.headers.Height(orphan.block.Hash)
+		if !ok || height > bestHeight+blockDownloadWindow {
+			return
+		}
+
+		s.orphans.Remove(orphan.block.Hash)
+		if height <= bestHeight {
+			return
+		}
+		if orphan.block.Height != height {
+			n.misbehaving(orphan.peer, scoreInvalidBlock, fmt.Sprintf("block %x has height %d, expected %d", orphan.block.Hash, orphan.block.Height, height))
+			return
+		}
+		s.downloaded[height] = downloadedBlock{block: orphan.block, peer: orphan.peer}
+	})
+}
+
+// connectBlocks connects the downloaded blocks following the chain tip in order. Once a
+// block is connected, its orphan children are connected as well. New chain tips are
+// queued to be relayed by announceBlocks.
+//
+// It must be called with the sync manager lock held.
+func (n *Node) connectBlocks() {
+	s := n.syncManager
+	tipHash, bestHeight := n.blockchain.Tip()
+	for {
+		next, ok := s.downloaded[bestHeight+1]
+		if !ok {
+			if !n.adoptChildren(tipHash) {
+				return
+			}
+			continue
+		}
+		delete(s.downloaded, bestHeight+1)
+
+		if !bytes.Equal(next.block.PrevBlockHash, tipHash) {
+			// The chain tip changed, the block belongs to a stale header chain
+			return
+		}
+		if err := n.connectDownloadedBlock(next.block); err != nil {
+			logger.Infof("Block %x from %s rejected: %v", next.block.Hash, next.peer.addr, err)
+			if !isInvalidBlock(err) {
+				// The error was caused by the local state, try again later
+				s.downloaded[next.block.Height] = next
+				return
+			}
+			n.misbehaving(next.peer, scoreInvalidBlock, err.Error())
+			// The headers following an invalid block are invalid as well, the peers on
+			// other branches may have the valid chain
+			s.headers.Invalidate(next.block.Hash)
+			s.forked = make(map[*peer]struct{})
+			n.discardStaleBlocks()
+			return
+		}
+		logger.Infof("Added block at height %d (%x) from %s", next.block.Height, next.block.Hash, next.peer.addr)
+		tipHash, bestHeight = next.block.Hash, next.block.Height
+
+		// Relay the new tip, blocks downloaded while syncing are old news
+		if _, headersHeight := s.headers.Tip(); bestHeight >= headersHeight {
+			s.announcements = append(s.announcements, next)
+		}
+	}
+}
+
+// announceBlocks relays the new chain tips connected to the peers.
+//
+// It must be called without the sync manager lock held, so slow peers don't stall the
+// synchronization.
+func (n *Node) announceBlocks() {
+	s := n.syncManager
+	s.mu.Lock()
+	announcements := s.announcements
+	s.announcements = nil
+	s.mu.Unlock()
+
+	for _, a := range announcements {
+		n.selectHighBandwidthPeer(a.peer)
+		if err := n.announceBlock(a.block); err != nil {
+			logger.Error("Announcing block: ", err)
+		}
+	}
+}
+
+// adoptChildren moves the orphans whose parent is the block with the hash provided to the
+// downloaded blocks, it returns false if there were none.
+//
+// It must be called with the sync manager lock held.
+func (n *Node) adoptChildren(parentHash []byte) bool {
+	s := n.syncManager
+	adopted := false
+	for _, child := range s.orphans.RemoveChildren(parentHash) {
+		b := child.block
+		height, ok := s.headers.Height(b.Hash)
+		if !ok {
+			if _, err := s.headers.Add(*b.Header); err != nil {
+				if errors.Is(err, block.ErrInvalidHeader) {
+					n.misbehaving(child.peer, scoreInvalidBlock, err.Error())
+				}
+				logger.Debugf("Orphan block %x discarded: %v", b.Hash, err)
+				continue
+			}
+			_, height = s.headers.Tip()
+		}
+		if b.Height != height {
+			n.misbehaving(child.peer, scoreInvalidBlock, fmt.Sprintf("block %x has height %d, expected %d", b.Hash, b.Height, height))
+			continue
+		}
+
+		s.downloaded[height] = downloadedBlock{block: b, peer: child.peer}
+		adopted = true
+	}
+
+	return adopted
+}
+
+// isInvalidBlock returns whether a block was rejected for breaking the consensus rules.
+// Other errors, like a timestamp too far ahead of the local clock or a database failure,
+// are caused by the local state and the peer that sent the block must not be punished.
+func isInvalidBlock(err error) bool {
+	return errors.Is(err, block.ErrInvalidBlock) ||
+		errors.Is(err, block.ErrInvalidTx) ||
+		errors.Is(err, block.ErrTxExists) ||
+		errors.Is(err, block.ErrCheckpointMismatch) ||
+		errors.Is(err, block.ErrForkBelowCheckpoint)
+}
+
+// connectDownloadedBlock validates and connects a block whose header was validated.
+// The signatures of the assumed valid block ancestors are not verified.
+//
+// It must be called with the sync manager lock held.
+func (n *Node) connectDownloadedBlock(b block.Block) error {
+	n.chainMu.Lock()
+	defer n.chainMu.Unlock()
+
+	if err := n.checkBlock(b); err != nil {
+		return err
+	}
+	return n.connectBlock(b, n.syncManager.headers.IsAssumedValid(b.Hash, b.Height))
+}
@@ -0,0 +1,326 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/GGP1/btcs/block"
+	"github.com/GGP1/btcs/tx"
+	"github.com/GGP1/btcs/tx/utxo"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPeer is a peer connected through a pipe, the messages the node sends to it are
+// delivered to the messages channel.
+type testPeer struct {
+	*peer
+	messages chan testMessage
+}
+
+type testMessage struct {
+	cmd     message
+	payload []byte
+}
+
+// newTestPeer returns a full node peer that completed the handshake and has the chain up
+// to height.
+func newTestPeer(t *testing.T, n *Node, addr string, height int32) *testPeer {
+	t.Helper()
+
+	conn, remote := net.Pipe()
+	p := newPeer(conn, addr, false)
+	require.NoError(t, p.setVersion(version{ProtocolVersion: protocolVersion, Services: SFNodeNetwork, StartHeight: height}))
+	require.NoError(t, p.setVerackReceived())
+	require.True(t, n.peers.Add(p))
+	t.Cleanup(func() {
+		p.disconnect()
+		remote.Close()
+	})
+
+	tp := &testPeer{peer: p, messages: make(chan testMessage, sendQueueSize)}
+	go func() {
+		for {
+			cmd, payload, err := readMessage(remote)
+			if err != nil {
+				return
+			}
+			tp.messages <- testMessage{cmd: cmd, payload: payload}
+		}
+	}()
+	return tp
+}
+
+// expectGetData waits for a getdata message and returns its payload, the other messages
+// are skipped.
+func (tp *testPeer) expectGetData(t *testing.T) getdata {
+	t.Helper()
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case msg := <-tp.messages:
+			if msg.cmd != msgGetData {
+				continue
+			}
+			data, err := getPayload[getdata](msg.payload)
+			require.NoError(t, err)
+			return data
+		case <-timeout:
+			t.Fatal("getdata message not received")
+			return getdata{}
+		}
+	}
+}
+
+// received returns the commands of the messages sent to the peer so far.
+func (tp *testPeer) received() []message {
+	time.Sleep(50 * time.Millisecond)
+	cmds := make([]message, 0, len(tp.messages))
+	for {
+		select {
+		case msg := <-tp.messages:
+			cmds = append(cmds, msg.cmd)
+		default:
+			return cmds
+		}
+	}
+}
+
+// newTestBlocks returns count solved blocks following prev.
+func newTestBlocks(t *testing.T, prev block.Block, addr string, count int) []block.Block {
+	t.Helper()
+
+	blocks := make([]block.Block, 0, count)
+	for i := 0; i < count; i++ {
+		coinbase, err := tx.NewCoinbase(addr, "", 0, prev.Height+1)
+		require.NoError(t, err)
+		b, err := block.NewBlock(&prev, []tx.Tx{*coinbase})
+		require.NoError(t, err)
+		b.Timestamp = prev.Timestamp + 1
+		for !b.IsValid() {
+			b.Nonce++
+		}
+		b.Hash, err = b.PowHash()
+		require.NoError(t, err)
+
+		blocks = append(blocks, *b)
+		prev = *b
+	}
+	return blocks
+}
+
+func blockHeaders(blocks []block.Block) []block.Header {
+	headers := make([]block.Header, 0, len(blocks))
+	for _, b := range blocks {
+		headers = append(headers, *b.Header)
+	}
+	return headers
+}
+
+func TestBetterDownloadPeer(t *testing.T) {
+	p1, p2 := &peer{addr: "p1"}, &peer{addr: "p2"}
+	inFlight := map[*peer]int{p1: 3, p2: 5}
+
+	assert.True(t, betterDownloadPeer(p1, p2, inFlight, nil), "Less blocks in flight")
+	assert.False(t, betterDownloadPeer(p2, p1, inFlight, nil))
+	assert.True(t, betterDownloadPeer(p2, p1, inFlight, p1), "The current peer stalled the block")
+	assert.False(t, betterDownloadPeer(p1, p2, inFlight, p1), "The peer stalled the block")
+}
+
+func TestProcessHeadersFork(t *testing.T) {
+	n := newTestNode(t)
+	_, addr := newTestAccount(t)
+	genesis, err := n.blockchain.LastBlock()
+	require.NoError(t, err)
+	s := n.syncManager
+
+	mainBlocks := newTestBlocks(t, genesis, addr, 2)
+	forkBlocks := newTestBlocks(t, genesis, addr, 3)
+	mainPeer := newTestPeer(t, n, "127.0.0.1:40001", 2)
+	forkPeer := newTestPeer(t, n, "127.0.0.1:40002", 3)
+
+	s.syncPeer = mainPeer.peer
+	require.NoError(t, n.processHeaders(mainPeer.peer, blockHeaders(mainBlocks)))
+	tipHash, _ := s.headers.Tip()
+	assert.Equal(t, mainBlocks[1].Hash, tipHash)
+	assert.Contains(t, s.inFlight, string(mainBlocks[0].Hash))
+
+	t.Run("More work", func(t *testing.T) {
+		s.syncPeer = forkPeer.peer
+		require.NoError(t, n.processHeaders(forkPeer.peer, blockHeaders(forkBlocks)))
+
+		tipHash, tipHeight := s.headers.Tip()
+		assert.Equal(t, forkBlocks[2].Hash, tipHash)
+		assert.Equal(t, int32(3), tipHeight)
+		assert.Nil(t, s.branch)
+		assert.NotContains(t, s.inFlight, string(mainBlocks[0].Hash), "The stale blocks are not downloaded")
+		assert.Contains(t, s.inFlight, string(forkBlocks[0].Hash))
+	})
+
+	t.Run("Less work", func(t *testing.T) {
+		shortPeer := newTestPeer(t, n, "127.0.0.1:40003", 4)
+		shortBlocks := newTestBlocks(t, genesis, addr, 1)
+
+		s.syncPeer = shortPeer.peer
+		require.NoError(t, n.processHeaders(shortPeer.peer, blockHeaders(shortBlocks)))
+
+		tipHash, _ := s.headers.Tip()
+		assert.Equal(t, forkBlocks[2].Hash, tipHash)
+		assert.Contains(t, s.forked, shortPeer.peer)
+		assert.NotEqual(t, shortPeer.peer, s.syncPeer)
+		assert.NotContains(t, shortPeer.received(), msgGetHeaders)
+	})
+
+	t.Run("Below the chain tip with less work", func(t *testing.T) {
+		for _, b := range forkBlocks {
+			require.NoError(t, n.processBlock(forkPeer.peer, b, 0))
+		}
+		_, bestHeight := n.blockchain.Tip()
+		require.Equal(t, int32(3), bestHeight)
+
+		s.syncPeer = mainPeer.peer
+		require.NoError(t, n.processHeaders(mainPeer.peer, blockHeaders(mainBlocks)))
+
+		_, bestHeight = n.blockchain.Tip()
+		assert.Equal(t, int32(3), bestHeight, "Blocks are not disconnected for a branch with less work")
+		assert.Contains(t, s.forked, mainPeer.peer)
+		assert.Nil(t, s.syncPeer)
+		assert.NotContains(t, mainPeer.received(), msgGetHeaders, "The peer is not asked for the headers again")
+	})
+}
+
+func TestProcessHeadersReorg(t *testing.T) {
+	n := newTestNode(t)
+	account, addr := newTestAccount(t)
+	coinbase := fundTestAccount(t, n, addr)
+	forkBase, err := n.blockchain.LastBlock()
+	require.NoError(t, err)
+	s := n.syncManager
+
+	spend := newTestTx(t, n, account, []tx.OutPoint{{TxID: coinbase.ID, Index: 0}}, coinbase.OutputsValue()-1000, addr)
+	stale := mineTestBlock(t, n, addr, spend)
+	require.NoError(t, n.submitBlock(stale))
+
+	forkBlocks := newTestBlocks(t, forkBase, addr, 2)
+	forkPeer := newTestPeer(t, n, "127.0.0.1:40001", 3)
+	s.syncPeer = forkPeer.peer
+	require.NoError(t, n.processHeaders(forkPeer.peer, blockHeaders(forkBlocks)))
+
+	tipHash, bestHeight := n.blockchain.Tip()
+	assert.Equal(t, forkBase.Hash, tipHash, "The blocks above the fork are disconnected")
+	assert.Equal(t, int32(1), bestHeight)
+	assert.True(t, n.txPool.Contains(spend.ID), "The transactions are added back to the mempool")
+	assert.Contains(t, s.inFlight, string(forkBlocks[0].Hash))
+
+	for _, b := range forkBlocks {
+		require.NoError(t, n.processBlock(forkPeer.peer, b, 0))
+	}
+	tipHash, bestHeight = n.blockchain.Tip()
+	assert.Equal(t, forkBlocks[1].Hash, tipHash)
+	assert.Equal(t, int32(3), bestHeight)
+	assert.False(t, n.blockchain.HasBlock(stale.Hash))
+
+	utxoSet := &utxo.Set{Blockchain: n.blockchain}
+	_, ok, err := utxoSet.Output(tx.OutPoint{TxID: stale.Transactions[0].ID, Index: 0})
+	require.NoError(t, err)
+	assert.False(t, ok, "The disconnected coinbase is not spendable")
+	_, ok, err = utxoSet.Output(tx.OutPoint{TxID: coinbase.ID, Index: 0})
+	require.NoError(t, err)
+	assert.True(t, ok, "The output spent by the disconnected block is unspent again")
+}
+
+func TestCheckStalled(t *testing.T) {
+	n := newTestNode(t)
+	_, addr := newTestAccount(t)
+	genesis, err := n.blockchain.LastBlock()
+	require.NoError(t, err)
+	s := n.syncManager
+
+	blocks := newTestBlocks(t, genesis, addr, 1)
+	p1 := newTestPeer(t, n, "127.0.0.1:40001", 1)
+	p2 := newTestPeer(t, n, "127.0.0.1:40002", 1)
+	peers := map[*peer]*testPeer{p1.peer: p1, p2.peer: p2}
+
+	hash := string(blocks[0].Hash)
+	require.NoError(t, n.processHeaders(p1.peer, blockHeaders(blocks)))
+	req, ok := s.inFlight[hash]
+	require.True(t, ok)
+	assert.Equal(t, blocks[0].Hash, peers[req.peer].expectGetData(t).ID)
+
+	n.checkStalled(time.Now().Add(blockRequestTimeout))
+	retry, ok := s.inFlight[hash]
+	require.True(t, ok)
+	assert.NotEqual(t, req.peer, retry.peer, "The block is requested from another peer")
+	assert.Equal(t, req.peer, s.stalled[hash])
+	assert.Equal(t, blocks[0].Hash, peers[retry.peer].expectGetData(t).ID)
+
+	t.Run("Headers", func(t *testing.T) {
+		s.syncPeer = req.peer
+		s.headersRequested = time.Now()
+		n.checkStalled(time.Now().Add(headersTimeout + time.Second))
+		assert.Nil(t, s.syncPeer)
+	})
+}
+
+func TestConnectBlocksInvalidBlock(t *testing.T) {
+	n := newTestNode(t)
+	_, addr := newTestAccount(t)
+	genesis, err := n.blockchain.LastBlock()
+	require.NoError(t, err)
+	s := n.syncManager
+
+	blocks := newTestBlocks(t, genesis, addr, 3)
+	// The transactions don't match the merkle root anymore
+	invalid := blocks[1]
+	invalid.Transactions = blocks[2].Transactions
+	p1 := newTestPeer(t, n, "127.0.0.1:40001", 3)
+	p2 := newTestPeer(t, n, "127.0.0.1:40002", 3)
+
+	require.NoError(t, n.processHeaders(p1.peer, blockHeaders(blocks)))
+	require.NoError(t, n.processBlock(p1.peer, blocks[2], 0))
+	require.NoError(t, n.processBlock(p2.peer, invalid, 0))
+	require.NoError(t, n.processBlock(p1.peer, blocks[0], 0))
+
+	tipHash, bestHeight := n.blockchain.Tip()
+	assert.Equal(t, blocks[0].Hash, tipHash)
+	assert.Equal(t, int32(1), bestHeight)
+	assert.Positive(t, p2.addBanScore(0), "The peer that sent the invalid block misbehaved")
+
+	headersTip, headersHeight := s.headers.Tip()
+	assert.Equal(t, blocks[0].Hash, headersTip, "The invalid block and its descendants are discarded")
+	assert.Equal(t, int32(1), headersHeight)
+	assert.Empty(t, s.downloaded)
+
+	// The invalid headers are rejected and not requested again
+	s.syncPeer = p1.peer
+	err = n.processHeaders(p1.peer, blockHeaders(blocks))
+	var misbehaviorErr misbehaviorError
+	assert.ErrorAs(t, err, &misbehaviorErr)
+	assert.Contains(t, s.forked, p1.peer)
+	assert.NotEqual(t, p1.peer, s.syncPeer)
+}
+
+func TestIsInvalidBlock(t *testing.T) {
+	cases := []struct {
+		desc     string
+		err      error
+		expected bool
+	}{
+		{desc: "Consensus rule", err: fmt.Errorf("%w: hash is higher than the target", block.ErrInvalidBlock), expected: true},
+		{desc: "Invalid transaction", err: fmt.Errorf("adding block: %w", block.ErrInvalidTx), expected: true},
+		{desc: "Checkpoint", err: fmt.Errorf("adding block: %w", block.ErrCheckpointMismatch), expected: true},
+		{desc: "Timestamp too new", err: fmt.Errorf("%w: 100, the maximum is 50", block.ErrTimeTooNew)},
+		{desc: "Database failure", err: errors.New("database not open")},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.Equal(t, tc.expected, isInvalidBlock(tc.err))
+		})
+	}
+}
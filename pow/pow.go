@@ -0,0 +1,119 @@
+// Package pow contains the hash functions that can be used for the proof of work.
+//
+// All of them produce 32 byte hashes, so the targets and difficulty calculations are the
+// same regardless of the function, what changes is the cost of computing each hash.
+package pow
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// HashSize is the size in bytes of the proof-of-work hashes.
+const HashSize = 32
+
+// Hasher is a proof-of-work hash function.
+type Hasher interface {
+	// Name identifies the function
+	Name() string
+	// Hash returns the proof-of-work hash of the data
+	Hash(data []byte) []byte
+	// InitialBits is the compact target of the blocks mined before the first difficulty
+	// adjustment. Slower functions start with an easier target so the first blocks don't
+	// take too long to mine.
+	InitialBits() uint32
+}
+
+var (
+	// SHA256 hashes the data once with SHA-256, it's the function blocks have used
+	// since the genesis.
+	SHA256 Hasher = sha256Hasher{}
+	// SHA256d hashes the data twice with SHA-256, as Bitcoin does.
+	SHA256d Hasher = sha256dHasher{}
+	// Scrypt uses the parameters chosen by Litecoin (N=1024, r=1, p=1), which require
+	// 128KB of memory per hash.
+	Scrypt Hasher = scryptHasher{}
+	// Argon2 uses Argon2id with 1MB of memory per hash, it's the most expensive to compute
+	// and the least suited for specialized hardware.
+	Argon2 Hasher = argon2Hasher{}
+)
+
+var hashers = map[string]Hasher{
+	SHA256.Name():  SHA256,
+	SHA256d.Name(): SHA256d,
+	Scrypt.Name():  Scrypt,
+	Argon2.Name():  Argon2,
+}
+
+// Get returns the hasher with the name provided.
+func Get(name string) (Hasher, error) {
+	h, ok := hashers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown proof-of-work function %q, available: %v", name, Names())
+	}
+	return h, nil
+}
+
+// Names returns the names of the available hashers sorted alphabetically.
+func Names() []string {
+	names := make([]string, 0, len(hashers))
+	for name := range hashers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type sha256Hasher struct{}
+
+func (sha256Hasher) Name() string { return "sha256" }
+
+func (sha256Hasher) Hash(data []byte) []byte {
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+func (sha256Hasher) InitialBits() uint32 { return 0x1e04ffff }
+
+type sha256dHasher struct{}
+
+func (sha256dHasher) Name() string { return "sha256d" }
+
+func (sha256dHasher) Hash(data []byte) []byte {
+	first := sha256.Sum256(data)
+	hash := sha256.Sum256(first[:])
+	return hash[:]
+}
+
+// InitialBits is twice the SHA-256 target, as each hash costs twice as much.
+func (sha256dHasher) InitialBits() uint32 { return 0x1e09fffe }
+
+type scryptHasher struct{}
+
+func (scryptHasher) Name() string { return "scrypt" }
+
+// Hash uses the data as the salt as well, like Litecoin does with the block header.
+func (scryptHasher) Hash(data []byte) []byte {
+	// The parameters are constant and valid, it never fails
+	hash, _ := scrypt.Key(data, data, 1024, 1, 1, HashSize)
+	return hash
+}
+
+// InitialBits is 2^12 times the SHA-256 target, roughly the difference in their hash rates.
+func (scryptHasher) InitialBits() uint32 { return 0x1f4ffff0 }
+
+type argon2Hasher struct{}
+
+func (argon2Hasher) Name() string { return "argon2" }
+
+// Hash uses the data as the salt as well, there is nothing secret to protect.
+func (argon2Hasher) Hash(data []byte) []byte {
+	return argon2.IDKey(data, data, 1, 1024, 1, HashSize)
+}
+
+// InitialBits is 2^13 times the SHA-256 target, roughly the difference in their hash rates.
+func (argon2Hasher) InitialBits() uint32 { return 0x20009fff }
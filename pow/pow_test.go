@@ -0,0 +1,52 @@
+package pow
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHash(t *testing.T) {
+	cases := []struct {
+		hasher   Hasher
+		expected string
+	}{
+		{
+			hasher:   SHA256,
+			expected: "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		},
+		{
+			hasher:   SHA256d,
+			expected: "4f8b42c22dd3729b519ba6f68d2da7cc5b2d606d05daed5ad5128cc03e6c6358",
+		},
+		{
+			hasher:   Scrypt,
+			expected: "e652c1c3b7a8cd99d2edc49d4509f545c80e4395765e7225c4dde5d80dd76519",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.hasher.Name(), func(t *testing.T) {
+			assert.Equal(t, tc.expected, hex.EncodeToString(tc.hasher.Hash([]byte("abc"))))
+		})
+	}
+}
+
+func TestHashers(t *testing.T) {
+	for _, name := range Names() {
+		t.Run(name, func(t *testing.T) {
+			h, err := Get(name)
+			assert.NoError(t, err)
+			assert.Equal(t, name, h.Name())
+
+			hash := h.Hash([]byte("btcs"))
+			assert.Len(t, hash, HashSize)
+			assert.Equal(t, hash, h.Hash([]byte("btcs")))
+			assert.NotEqual(t, hash, h.Hash([]byte("btcS")))
+		})
+	}
+
+	_, err := Get("x11")
+	assert.Error(t, err)
+}
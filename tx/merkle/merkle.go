@@ -58,3 +58,47 @@ func newNode(left, right *node, data []byte) *node {
 		right: right,
 	}
 }
+
+// Branch returns the hashes needed to calculate the root of a tree whose first leaf is
+// not known yet, data contains the rest of the leaves.
+//
+// Miners use it to calculate the root after changing the coinbase transaction without
+// knowing the other transactions of the block.
+func Branch(data [][]byte) [][]byte {
+	// The first hash of each level is unknown
+	level := make([][]byte, 1, len(data)+1)
+	for _, dt := range data {
+		hash := sha256.Sum256(dt)
+		level = append(level, hash[:])
+	}
+
+	branch := make([][]byte, 0)
+	for len(level) > 1 {
+		branch = append(branch, level[1])
+
+		nextLevel := make([][]byte, 1, len(level)/2+1)
+		for i := 2; i < len(level); i += 2 {
+			j := i + 1
+			if j == len(level) {
+				j--
+			}
+			hash := sha256.Sum256(append(append([]byte{}, level[i]...), level[j]...))
+			nextLevel = append(nextLevel, hash[:])
+		}
+
+		level = nextLevel
+	}
+
+	return branch
+}
+
+// RootFromBranch returns the root hash of the tree whose first leaf is data and
+// the rest of the nodes are summarized in the branch.
+func RootFromBranch(data []byte, branch [][]byte) []byte {
+	hash := sha256.Sum256(data)
+	for _, h := range branch {
+		hash = sha256.Sum256(append(hash[:], h...))
+	}
+
+	return hash[:]
+}
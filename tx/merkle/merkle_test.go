@@ -80,3 +80,23 @@ func TestNewTree(t *testing.T) {
 
 	assert.Equal(t, rootHash, hex.EncodeToString(mTree.Root.Hash), "Merkle tree root hash is correct")
 }
+
+func TestRootFromBranch(t *testing.T) {
+	data := [][]byte{
+		[]byte("node1"),
+		[]byte("node2"),
+		[]byte("node3"),
+		[]byte("node4"),
+		[]byte("node5"),
+		[]byte("node6"),
+		[]byte("node7"),
+	}
+
+	for i := 1; i <= len(data); i++ {
+		leaves := data[:i]
+		mTree := NewTree(leaves)
+		branch := Branch(leaves[1:])
+
+		assert.Equal(t, mTree.Root.Hash, RootFromBranch(leaves[0], branch), "Root hash with %d leaves is correct", i)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -31,23 +32,20 @@ const (
 // Tx represents a transaction.
 //
 // Every new transaction must have at least one input and output, except coinbase.
+//
+// A transaction's fee is equal to the difference between the amount of coins
+// locked in the inputs' referenced outputs and the ones in the new outputs.
 type Tx struct {
 	ID      []byte
 	Inputs  []Input
 	Outputs []Output
-	// In Bitcoin, a transaction's fee is equal to the difference between the amount of coins
-	// locked in the inputs' referenced outputs and the ones in the new outputs.
-	//
-	// To make things simpler we just include it as a field, the input surplus will still exist.
-	Fee int
 }
 
 // New returns a new transaction with the inputs and outputs provided.
-func New(inputs []Input, outputs []Output, fee int) (*Tx, error) {
+func New(inputs []Input, outputs []Output) (*Tx, error) {
 	tx := &Tx{
 		Inputs:  inputs,
 		Outputs: outputs,
-		Fee:     fee,
 	}
 
 	encTx, err := gob.Encode(tx)
@@ -79,11 +77,35 @@ func NewCoinbase(toAddr, data string, fees int, nextBlockHeight int32) (*Tx, err
 			Index: -1,
 		},
 	}
-	subsidy := calculateBlockSubsidy(nextBlockHeight)
+	subsidy := CalculateBlockSubsidy(nextBlockHeight)
 	txOut := NewOutput(subsidy+fees, toAddr)
 	logger.Debugf("Block %d subsidy: %d, fees: %d", nextBlockHeight, subsidy, fees)
 
-	return New([]Input{txin}, []Output{txOut}, 0)
+	return New([]Input{txin}, []Output{txOut})
+}
+
+// Fee returns the difference between the value of the outputs referenced by the inputs
+// and the value of the new ones. It's what the miner including the transaction earns.
+//
+// prevTxs must contain the transactions referenced by the inputs.
+func (tx *Tx) Fee(prevTxs map[string]Tx) (int, error) {
+	if tx.IsCoinbase() {
+		return 0, nil
+	}
+
+	inputsValue := 0
+	for _, in := range tx.Inputs {
+		prevTx, ok := prevTxs[hex.EncodeToString(in.PrevOutput.TxID)]
+		if !ok {
+			return 0, fmt.Errorf("previous transaction %x not found", in.PrevOutput.TxID)
+		}
+		if in.PrevOutput.Index < 0 || in.PrevOutput.Index >= len(prevTx.Outputs) {
+			return 0, fmt.Errorf("output %x:%d does not exist", in.PrevOutput.TxID, in.PrevOutput.Index)
+		}
+		inputsValue += prevTx.Outputs[in.PrevOutput.Index].Value
+	}
+
+	return inputsValue - tx.OutputsValue(), nil
 }
 
 // IsCoinbase checks whether the transaction is coinbase
@@ -93,6 +115,71 @@ func (tx *Tx) IsCoinbase() bool {
 		tx.Inputs[0].PrevOutput.Index == -1
 }
 
+// OutputsValue returns the sum of the transaction outputs value.
+func (tx *Tx) OutputsValue() int {
+	value := 0
+	for _, out := range tx.Outputs {
+		value += out.Value
+	}
+	return value
+}
+
+// SerializeSize returns the number of bytes the transaction would take serialized
+// using Bitcoin's wire format.
+//
+// The signature and public key of the inputs take the place of the signature script,
+// and the public key hash of the outputs the one of the public key script.
+func (tx *Tx) SerializeSize() int {
+	// Version and lock time (4 bytes each) and the number of inputs and outputs
+	size := 8 + varIntSize(len(tx.Inputs)) + varIntSize(len(tx.Outputs))
+
+	for _, in := range tx.Inputs {
+		// Previous output hash and index (4 bytes), signature script and sequence (4 bytes)
+		scriptLen := len(in.Signature) + len(in.PubKey)
+		size += sha256.Size + 4 + varIntSize(scriptLen) + scriptLen + 4
+	}
+
+	for _, out := range tx.Outputs {
+		// Value (8 bytes) and public key script
+		size += 8 + varIntSize(len(out.PubKeyHash)) + len(out.PubKeyHash)
+	}
+
+	return size
+}
+
+// Serialize returns a deterministic binary encoding of the transaction, its hash is signed
+// and it's used to build the blocks merkle tree.
+//
+// Gob encodings can't be used as they include type identifiers assigned in the order
+// each process registers the types, so the same transaction may be encoded differently
+// by two nodes.
+func (tx *Tx) Serialize() []byte {
+	buf := make([]byte, 0, len(tx.ID)+tx.SerializeSize())
+	buf = appendBytes(buf, tx.ID)
+
+	buf = binary.AppendUvarint(buf, uint64(len(tx.Inputs)))
+	for _, in := range tx.Inputs {
+		buf = appendBytes(buf, in.PrevOutput.TxID)
+		buf = binary.AppendVarint(buf, int64(in.PrevOutput.Index))
+		buf = appendBytes(buf, in.Signature)
+		buf = appendBytes(buf, in.PubKey)
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(tx.Outputs)))
+	for _, out := range tx.Outputs {
+		buf = binary.AppendVarint(buf, int64(out.Value))
+		buf = appendBytes(buf, out.PubKeyHash)
+	}
+
+	return buf
+}
+
+// appendBytes appends the length of b followed by its content to buf.
+func appendBytes(buf, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
 // Sign signs the inputs of a transaction.
 func (tx *Tx) Sign(privKey *ecdsa.PrivateKey, prevTxs map[string]Tx) error {
 	if tx.IsCoinbase() {
@@ -114,10 +201,7 @@ func (tx *Tx) Sign(privKey *ecdsa.PrivateKey, prevTxs map[string]Tx) error {
 		// Set the input public key to the public key hash of the referenced output
 		// for calculating the data and then remove it
 		txCopy.Inputs[i].PubKey = prevTx.Outputs[vin.PrevOutput.Index].PubKeyHash
-		data, err := gob.Encode(txCopy)
-		if err != nil {
-			return err
-		}
+		data := txCopy.signatureHash()
 		txCopy.Inputs[i].PubKey = nil
 
 		signature, err := ecdsa.SignASN1(rand.Reader, privKey, data)
@@ -131,11 +215,22 @@ func (tx *Tx) Sign(privKey *ecdsa.PrivateKey, prevTxs map[string]Tx) error {
 	return nil
 }
 
+// signatureHash returns the double SHA-256 hash of the transaction serialization, the
+// data signed by the inputs.
+//
+// ECDSA only takes as many bytes of the data as the curve order has, so signing the
+// serialization itself would leave everything after the transaction ID unsigned.
+func (tx *Tx) signatureHash() []byte {
+	first := sha256.Sum256(tx.Serialize())
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
+
 // String returns a human-readable representation of a transaction.
 func (tx Tx) String() string {
 	lines := make([]string, 0, 1+len(tx.Inputs)+len(tx.Outputs))
 
-	lines = append(lines, fmt.Sprintf("--- Transaction %x ---\nFee: %d SAT", tx.ID, tx.Fee))
+	lines = append(lines, fmt.Sprintf("--- Transaction %x ---\nSize: %d bytes", tx.ID, tx.SerializeSize()))
 
 	inFormat := `  Input %d:
 	TxID: 	 	%x
@@ -197,10 +292,7 @@ func (tx *Tx) Verify(prevTxs map[string]Tx) (bool, error) {
 
 		// Same as in Sign()
 		txCopy.Inputs[i].PubKey = prevTx.Outputs[vin.PrevOutput.Index].PubKeyHash
-		data, err := gob.Encode(txCopy)
-		if err != nil {
-			return false, err
-		}
+		data := txCopy.signatureHash()
 		txCopy.Inputs[i].PubKey = nil
 
 		// Get the public key from the input PubKey field
@@ -218,11 +310,25 @@ func (tx *Tx) Verify(prevTxs map[string]Tx) (bool, error) {
 	return true, nil
 }
 
-// calculateBlockSubsidy returns the subsidy for the miner depending on the height of the
+// varIntSize returns the number of bytes it takes to encode n as a variable length integer.
+func varIntSize(n int) int {
+	switch {
+	case n < 0xfd:
+		return 1
+	case n <= 0xffff:
+		return 3
+	case n <= 0xffffffff:
+		return 5
+	default:
+		return 9
+	}
+}
+
+// CalculateBlockSubsidy returns the subsidy for the miner depending on the height of the
 // block being mined.
 //
 // The subsidy halves every subsidyReductionPeriod blocks.
-func calculateBlockSubsidy(nextBlockHeight int32) int {
+func CalculateBlockSubsidy(nextBlockHeight int32) int {
 	halvings := uint(nextBlockHeight / subsidyReductionPeriod)
 	// Force block reward to zero when right shift is undefined.
 	if halvings >= 64 {
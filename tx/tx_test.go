@@ -1,11 +1,14 @@
 package tx_test
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/rand"
+	"encoding/hex"
 	"math/big"
 	"testing"
 
+	"github.com/GGP1/btcs/tx"
 	"github.com/GGP1/btcs/wallet"
 
 	"github.com/btcsuite/btcd/btcec/v2"
@@ -83,3 +86,66 @@ func newWallet(t *testing.T) *wallet.Wallet {
 
 	return wallet
 }
+
+func TestSerialize(t *testing.T) {
+	transaction := tx.Tx{
+		ID: []byte{1, 2, 3},
+		Inputs: []tx.Input{
+			{Signature: []byte{4}, PubKey: []byte{5, 6}, PrevOutput: tx.OutPoint{TxID: []byte{7}, Index: 1}},
+		},
+		Outputs: []tx.Output{{PubKeyHash: []byte{8}, Value: 1000}},
+	}
+	encoded := transaction.Serialize()
+	assert.Equal(t, encoded, transaction.Serialize())
+
+	// Moving a byte from one field to the next one changes the encoding
+	modified := transaction
+	modified.Inputs = []tx.Input{
+		{Signature: []byte{4, 5}, PubKey: []byte{6}, PrevOutput: tx.OutPoint{TxID: []byte{7}, Index: 1}},
+	}
+	assert.NotEqual(t, encoded, modified.Serialize())
+
+	modified.Inputs = transaction.Inputs
+	modified.Outputs = []tx.Output{{PubKeyHash: []byte{8}, Value: 1001}}
+	assert.NotEqual(t, encoded, modified.Serialize())
+}
+
+func TestSignatureCoversTransaction(t *testing.T) {
+	masterKey, err := wallet.NewMasterKey(bytes.Repeat([]byte{1}, 32))
+	assert.NoError(t, err)
+	account := wallet.NewAccount(masterKey)
+	addr := account.PubKey.Address()
+
+	prevTx := tx.Tx{ID: bytes.Repeat([]byte{2}, 32), Outputs: []tx.Output{tx.NewOutput(1000, addr)}}
+	prevTxs := map[string]tx.Tx{hex.EncodeToString(prevTx.ID): prevTx}
+	inputs := []tx.Input{{PrevOutput: tx.OutPoint{TxID: prevTx.ID, Index: 0}, PubKey: account.PublicKey()}}
+	spend, err := tx.New(inputs, []tx.Output{tx.NewOutput(900, addr)})
+	assert.NoError(t, err)
+	assert.NoError(t, spend.Sign(account.PrivateKey(), prevTxs))
+
+	ok, err := spend.Verify(prevTxs)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	t.Run("Modified output", func(t *testing.T) {
+		modified := *spend
+		modified.Outputs = []tx.Output{tx.NewOutput(1000, addr)}
+		ok, err := modified.Verify(prevTxs)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("Serialization signed directly", func(t *testing.T) {
+		// Signatures made before the serialization was hashed are rejected
+		txCopy := spend.TrimmedCopy()
+		txCopy.Inputs[0].PubKey = prevTx.Outputs[0].PubKeyHash
+		signature, err := ecdsa.SignASN1(rand.Reader, account.PrivateKey(), txCopy.Serialize())
+		assert.NoError(t, err)
+
+		old := *spend
+		old.Inputs = []tx.Input{{PrevOutput: spend.Inputs[0].PrevOutput, PubKey: account.PublicKey(), Signature: signature}}
+		ok, err := old.Verify(prevTxs)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+}
@@ -1,8 +1,10 @@
 package utxo
 
 import (
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"sort"
 
 	"github.com/GGP1/btcs/block"
 	"github.com/GGP1/btcs/encoding/base58"
@@ -13,7 +15,16 @@ import (
 	bolt "go.etcd.io/bbolt"
 )
 
-const utxoBucket = "chainstate"
+const (
+	utxoBucket = "chainstate"
+	// metaBucket contains information about the UTXO set, like the format of its entries.
+	metaBucket = "chainstate_meta"
+	// setVersion is the format of the UTXO set entries. In version 0 the unspent outputs of
+	// a transaction were stored in a slice, since version 1 they are keyed by their index.
+	setVersion = 1
+)
+
+var versionKey = []byte("version")
 
 // Set represents a UTXO set and holds all the unspent transaction outputs of an address.
 type Set struct {
@@ -26,6 +37,22 @@ type UTXO struct {
 	outsIndices []int
 }
 
+// outputs maps the index of a transaction output to the output itself.
+//
+// The index is kept explicitly so spending an output doesn't shift the position
+// of the remaining ones.
+type outputs map[int]tx.Output
+
+// sortedIndices returns the outputs indices in ascending order.
+func (o outputs) sortedIndices() []int {
+	indices := make([]int, 0, len(o))
+	for idx := range o {
+		indices = append(indices, idx)
+	}
+	sort.Ints(indices)
+	return indices
+}
+
 // AccountUTXOs returns an account's unspent outputs to be used in a new transaction.
 //
 // It returns an error if the account doesn't have enough funds.
@@ -45,13 +72,14 @@ func (s *Set) AccountUTXOs(account *wallet.Account, amount, fee int) (int, []UTX
 
 	for k, v := c.First(); k != nil; k, v = c.Next() {
 		txID := hex.EncodeToString(k)
-		outputs, err := gob.Decode[[]tx.Output](v)
+		outs, err := gob.Decode[outputs](v)
 		if err != nil {
 			return 0, nil, err
 		}
 
 		indices := make([]int, 0)
-		for i, out := range outputs {
+		for _, i := range outs.sortedIndices() {
+			out := outs[i]
 			if accumulated >= targetAmount {
 				// We have already collected enough outputs for the transaction
 				if len(indices) > 0 {
@@ -102,12 +130,12 @@ func (s *Set) FindUTXOs(pubKeyHash []byte) ([]tx.Output, error) {
 		b := boltTx.Bucket([]byte(utxoBucket))
 
 		return b.ForEach(func(_, v []byte) error {
-			outputs, err := gob.Decode[[]tx.Output](v)
+			outs, err := gob.Decode[outputs](v)
 			if err != nil {
 				return err
 			}
 
-			for _, output := range outputs {
+			for _, output := range outs {
 				if output.IsLockedWithKey(pubKeyHash) {
 					utxos = append(utxos, output)
 				}
@@ -123,6 +151,67 @@ func (s *Set) FindUTXOs(pubKeyHash []byte) ([]tx.Output, error) {
 	return utxos, nil
 }
 
+// Output returns the unspent output referenced by outPoint.
+//
+// The boolean is false if the output doesn't exist or it was already spent.
+func (s *Set) Output(outPoint tx.OutPoint) (tx.Output, bool, error) {
+	var (
+		output tx.Output
+		found  bool
+	)
+
+	err := s.Blockchain.View(func(boltTx *bolt.Tx) error {
+		b := boltTx.Bucket([]byte(utxoBucket))
+
+		outsBytes := b.Get(outPoint.TxID)
+		if outsBytes == nil {
+			return nil
+		}
+
+		outs, err := gob.Decode[outputs](outsBytes)
+		if err != nil {
+			return err
+		}
+
+		output, found = outs[outPoint.Index]
+		return nil
+	})
+	if err != nil {
+		return tx.Output{}, false, err
+	}
+
+	return output, found, nil
+}
+
+// Upgrade rebuilds the UTXO set if its entries were written in an older format, it
+// returns whether it did.
+func (s *Set) Upgrade() (bool, error) {
+	var version uint32
+	err := s.Blockchain.View(func(boltTx *bolt.Tx) error {
+		b := boltTx.Bucket([]byte(metaBucket))
+		if b == nil {
+			return nil
+		}
+
+		if v := b.Get(versionKey); v != nil {
+			version = binary.BigEndian.Uint32(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if version >= setVersion {
+		return false, nil
+	}
+
+	if err := s.Reindex(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 // Reindex rebuilds the UTXO set.
 func (s *Set) Reindex() error {
 	utxo, err := s.Blockchain.FindUTXOs()
@@ -140,13 +229,13 @@ func (s *Set) Reindex() error {
 			return err
 		}
 
-		for txID, outputs := range utxo {
+		for txID, outs := range utxo {
 			id, err := hex.DecodeString(txID)
 			if err != nil {
 				return err
 			}
 
-			encOutputs, err := gob.Encode(outputs)
+			encOutputs, err := gob.Encode(outputs(outs))
 			if err != nil {
 				return err
 			}
@@ -156,7 +245,14 @@ func (s *Set) Reindex() error {
 			}
 		}
 
-		return nil
+		meta, err := boltTx.CreateBucketIfNotExists([]byte(metaBucket))
+		if err != nil {
+			return err
+		}
+
+		version := make([]byte, 4)
+		binary.BigEndian.PutUint32(version, setVersion)
+		return meta.Put(versionKey, version)
 	})
 }
 
@@ -171,28 +267,23 @@ func (s *Set) Update(block block.Block) error {
 			if !transaction.IsCoinbase() {
 				for _, in := range transaction.Inputs {
 					outsBytes := b.Get(in.PrevOutput.TxID)
-					outs, err := gob.Decode[[]tx.Output](outsBytes)
+					outs, err := gob.Decode[outputs](outsBytes)
 					if err != nil {
 						return err
 					}
 
-					// Find new unspent outputs
-					unspentOuts := make([]tx.Output, 0)
-					for outIdx, out := range outs {
-						if outIdx != in.PrevOutput.Index {
-							unspentOuts = append(unspentOuts, out)
-						}
-					}
+					// Mark the referenced output as spent
+					delete(outs, in.PrevOutput.Index)
 
 					// Delete input with no unspent outputs
-					if len(unspentOuts) == 0 {
+					if len(outs) == 0 {
 						if err := b.Delete(in.PrevOutput.TxID); err != nil {
 							return err
 						}
 						continue
 					}
 
-					encOuts, err := gob.Encode(unspentOuts)
+					encOuts, err := gob.Encode(outs)
 					if err != nil {
 						return err
 					}
@@ -203,7 +294,12 @@ func (s *Set) Update(block block.Block) error {
 				}
 			}
 
-			encOuts, err := gob.Encode(transaction.Outputs)
+			outs := make(outputs, len(transaction.Outputs))
+			for i, out := range transaction.Outputs {
+				outs[i] = out
+			}
+
+			encOuts, err := gob.Encode(outs)
 			if err != nil {
 				return err
 			}
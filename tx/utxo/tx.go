@@ -7,6 +7,9 @@ import (
 	"github.com/GGP1/btcs/wallet"
 )
 
+// maxSignatureSize is the size of the longest ASN.1 encoded ECDSA signature.
+const maxSignatureSize = 72
+
 // NewTx creates a new transaction.
 func NewTx(account *wallet.Account, to string, amount, fee int, set *Set) (*tx.Tx, error) {
 	accumulated, utxos, err := set.AccountUTXOs(account, amount, fee)
@@ -14,21 +17,9 @@ func NewTx(account *wallet.Account, to string, amount, fee int, set *Set) (*tx.T
 		return nil, err
 	}
 
-	inputs := make([]tx.Input, 0)
-	// Reuse object
-	input := tx.Input{PubKey: account.PublicKey()}
-
-	for _, spendableOutput := range utxos {
-		txID, err := hex.DecodeString(spendableOutput.txID)
-		if err != nil {
-			return nil, err
-		}
-
-		input.PrevOutput.TxID = txID
-		for _, outIdx := range spendableOutput.outsIndices {
-			input.PrevOutput.Index = outIdx
-			inputs = append(inputs, input)
-		}
+	inputs, err := accountInputs(account, utxos)
+	if err != nil {
+		return nil, err
 	}
 
 	// The amount will now be locked with the receiver address,
@@ -43,7 +34,7 @@ func NewTx(account *wallet.Account, to string, amount, fee int, set *Set) (*tx.T
 		outputs = append(outputs, tx.NewOutput(accumulated-amount-fee, changeAddr))
 	}
 
-	tx, err := tx.New(inputs, outputs, fee)
+	tx, err := tx.New(inputs, outputs)
 	if err != nil {
 		return nil, err
 	}
@@ -54,3 +45,53 @@ func NewTx(account *wallet.Account, to string, amount, fee int, set *Set) (*tx.T
 
 	return tx, nil
 }
+
+// EstimateTxSize returns the size of the transaction NewTx would create with the same
+// parameters, without deriving a change address nor signing it.
+//
+// Signatures are assumed to take the maximum size, so it may be slightly overestimated.
+func EstimateTxSize(account *wallet.Account, to string, amount, fee int, set *Set) (int, error) {
+	accumulated, utxos, err := set.AccountUTXOs(account, amount, fee)
+	if err != nil {
+		return 0, err
+	}
+
+	inputs, err := accountInputs(account, utxos)
+	if err != nil {
+		return 0, err
+	}
+	for i := range inputs {
+		inputs[i].Signature = make([]byte, maxSignatureSize)
+	}
+
+	outputs := []tx.Output{tx.NewOutput(amount, to)}
+	if accumulated > amount+fee {
+		// The change is locked with a public key hash of the same size
+		outputs = append(outputs, outputs[0])
+	}
+
+	draft := tx.Tx{Inputs: inputs, Outputs: outputs}
+	return draft.SerializeSize(), nil
+}
+
+// accountInputs returns the unsigned inputs spending the account's outputs provided.
+func accountInputs(account *wallet.Account, utxos []UTXO) ([]tx.Input, error) {
+	inputs := make([]tx.Input, 0)
+	// Reuse object
+	input := tx.Input{PubKey: account.PublicKey()}
+
+	for _, spendableOutput := range utxos {
+		txID, err := hex.DecodeString(spendableOutput.txID)
+		if err != nil {
+			return nil, err
+		}
+
+		input.PrevOutput.TxID = txID
+		for _, outIdx := range spendableOutput.outsIndices {
+			input.PrevOutput.Index = outIdx
+			inputs = append(inputs, input)
+		}
+	}
+
+	return inputs, nil
+}